@@ -47,6 +47,7 @@ import (
 	"github.com/containerd/typeurl/v2"
 	"github.com/walteh/runm/cmd/containerd-shim-runm-v2/runm"
 	"github.com/walteh/runm/core/runc/runtime"
+	"github.com/walteh/runm/core/runc/runtime/virt/vmoptions"
 	runmv1 "github.com/walteh/runm/proto/v1"
 )
 
@@ -227,6 +228,19 @@ func (manager) Start(ctx context.Context, id string, opts shim.StartOpts) (_ shi
 		}
 	}
 
+	// the shim we are about to start reads the runm options back from the bundle
+	runtimeOpts, err := shim.ReadRuntimeOptions[any](os.Stdin)
+	if err != nil && !errors.Is(err, errdefs.ErrNotFound) {
+		return params, fmt.Errorf("failed to read runtime options: %w", err)
+	}
+	vmOpts, err := vmoptions.Decode(runtimeOpts)
+	if err != nil {
+		return params, fmt.Errorf("invalid runm runtime options: %w", err)
+	}
+	if err := vmoptions.Write(cmd.Dir, vmOpts); err != nil {
+		return params, fmt.Errorf("failed to write runm runtime options: %w", err)
+	}
+
 	var sockets []*shimSocket
 	defer func() {
 		if retErr != nil {
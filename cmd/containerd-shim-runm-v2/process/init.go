@@ -109,6 +109,12 @@ func (p *Init) Create(ctx context.Context, r *process.CreateConfig) error {
 		pidFile = newPidFile(p.Bundle)
 	)
 
+	if r.Checkpoint != "" {
+		if rr, ok := p.runtime.(runtime.VMRestoredRuntime); ok && rr.RestoredInitPid() != 0 {
+			return p.createVMRestoredState(rr.RestoredInitPid())
+		}
+	}
+
 	if r.Terminal {
 		if socket, err = p.runtime.NewTempConsoleSocket(ctx); err != nil {
 			return fmt.Errorf("failed to create OCI runtime console socket: %w", err)
@@ -0,0 +1,111 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	google_protobuf "github.com/containerd/containerd/v2/pkg/protobuf/types"
+
+	"github.com/walteh/runm/core/runc/process"
+)
+
+// Recover puts an init process rebuilt by a restarted shim into the running state.
+// The process I/O is not reconnected: the pipes to the previous shim are gone.
+func (p *Init) Recover(pid int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pid = pid
+	p.initState = &runningState{p: p}
+}
+
+// RecoverExec rebuilds a running exec process of p after a shim restart.
+func (p *Init) RecoverExec(id, path string, pid int) Process {
+	e := &execProcess{
+		id:        id,
+		path:      path,
+		parent:    p,
+		waitBlock: make(chan struct{}),
+	}
+	e.pid.pid = pid
+	e.execState = &execRunningState{p: e}
+	return e
+}
+
+// createVMRestoredState is used when the runtime restored the whole vm from a
+// checkpoint: the init process already exists, frozen, with the pid it had when the
+// checkpoint was taken. Its I/O is not reconnected.
+func (p *Init) createVMRestoredState(pid int) error {
+	p.pid = pid
+	p.initState = &createdVMRestoredState{p: p}
+	return nil
+}
+
+type createdVMRestoredState struct {
+	p *Init
+}
+
+func (s *createdVMRestoredState) transition(name string) error {
+	switch name {
+	case "running":
+		s.p.initState = &runningState{p: s.p}
+	case "stopped":
+		s.p.initState = &stoppedState{p: s.p}
+	case "deleted":
+		s.p.initState = &deletedState{}
+	default:
+		return fmt.Errorf("invalid state transition %q to %q", stateName(s), name)
+	}
+	return nil
+}
+
+func (s *createdVMRestoredState) Pause(ctx context.Context) error {
+	return errors.New("cannot pause task in created state")
+}
+
+func (s *createdVMRestoredState) Resume(ctx context.Context) error {
+	return errors.New("cannot resume task in created state")
+}
+
+func (s *createdVMRestoredState) Update(ctx context.Context, r *google_protobuf.Any) error {
+	return s.p.update(ctx, r)
+}
+
+func (s *createdVMRestoredState) Checkpoint(ctx context.Context, r *process.CheckpointConfig) error {
+	return errors.New("cannot checkpoint a task in created state")
+}
+
+func (s *createdVMRestoredState) Start(ctx context.Context) error {
+	if err := s.p.runtime.Resume(ctx, s.p.id); err != nil {
+		return s.p.runtimeError(ctx, err, "OCI runtime resume of restored vm failed")
+	}
+	return s.transition("running")
+}
+
+func (s *createdVMRestoredState) Delete(ctx context.Context) error {
+	if err := s.p.delete(ctx); err != nil {
+		return err
+	}
+	return s.transition("deleted")
+}
+
+func (s *createdVMRestoredState) Kill(ctx context.Context, sig uint32, all bool) error {
+	return s.p.kill(ctx, sig, all)
+}
+
+func (s *createdVMRestoredState) SetExited(status int) {
+	s.p.setExited(status)
+
+	if err := s.transition("stopped"); err != nil {
+		panic(err)
+	}
+}
+
+func (s *createdVMRestoredState) Exec(ctx context.Context, path string, r *process.ExecConfig) (Process, error) {
+	return nil, errors.New("cannot exec in a created state")
+}
+
+func (s *createdVMRestoredState) Status(ctx context.Context) (string, error) {
+	return "created", nil
+}
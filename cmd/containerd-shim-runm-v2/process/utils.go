@@ -176,7 +176,7 @@ func stateName(v interface{}) string {
 	switch v.(type) {
 	case *runningState, *execRunningState:
 		return "running"
-	case *createdState, *execCreatedState, *createdCheckpointState:
+	case *createdState, *execCreatedState, *createdCheckpointState, *createdVMRestoredState:
 		return "created"
 	case *pausedState:
 		return "paused"
@@ -66,8 +66,10 @@ func NewContainer(
 		if err != nil {
 			return nil, err
 		}
-		if v != nil {
-			opts = v.(*options.Options)
+		// runm's own options were already handed to the runtime creator by the
+		// shim manager, see vmoptions
+		if o, ok := v.(*options.Options); ok {
+			opts = o
 		}
 	}
 
@@ -148,6 +150,7 @@ func NewContainer(
 		Rootfs:              rootfs,
 		Mounts:              pmounts,
 		OciSpec:             spec,
+		Publisher:           publisher,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create runtime: %w", err)
@@ -526,6 +529,14 @@ func (c *Container) Checkpoint(ctx context.Context, r *task.CheckpointTaskReques
 		return err
 	}
 
+	vmopts, err := VMCheckpointOptions(r)
+	if err != nil {
+		return err
+	}
+	if vmopts != nil {
+		return c.checkpointVM(ctx, p.(*process.Init), r.Path, vmopts)
+	}
+
 	var opts options.CheckpointOptions
 	if r.Options != nil {
 		if err := typeurl.UnmarshalTo(r.Options, &opts); err != nil {
@@ -544,6 +555,44 @@ func (c *Container) Checkpoint(ctx context.Context, r *task.CheckpointTaskReques
 	})
 }
 
+// VMCheckpointOptions returns the runm vm checkpoint options of r, nil if r asks for
+// a regular checkpoint of the container.
+func VMCheckpointOptions(r *task.CheckpointTaskRequest) (*runtime.VMCheckpointOptions, error) {
+	if r.Options == nil || !typeurl.Is(r.Options, &runtime.VMCheckpointOptions{}) {
+		return nil, nil
+	}
+	var opts runtime.VMCheckpointOptions
+	if err := typeurl.UnmarshalTo(r.Options, &opts); err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
+
+// checkpointVM saves the whole vm the container runs in into the checkpoint image.
+// Exec processes would come back without a shim tracking them, so they must be gone.
+func (c *Container) checkpointVM(ctx context.Context, p *process.Init, path string, opts *runtime.VMCheckpointOptions) error {
+	cp, ok := p.Runtime().(runtime.VMCheckpointer)
+	if !ok {
+		return fmt.Errorf("runtime %T cannot checkpoint its vm: %w", p.Runtime(), errdefs.ErrNotImplemented)
+	}
+
+	for _, e := range c.ExecdProcesses() {
+		if e.ExitedAt().IsZero() {
+			return fmt.Errorf("exec %s of container %s is still running: %w", e.ID(), c.ID, errdefs.ErrFailedPrecondition)
+		}
+	}
+
+	status, err := p.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if status != "running" && status != "paused" {
+		return fmt.Errorf("cannot checkpoint the vm of a container in %s state: %w", status, errdefs.ErrFailedPrecondition)
+	}
+
+	return cp.CheckpointVM(ctx, path, p.Pid(), opts.Exit)
+}
+
 // Update the resource information of a running container
 func (c *Container) Update(ctx context.Context, r *task.UpdateTaskRequest) error {
 	p, err := c.Process("")
@@ -0,0 +1,214 @@
+package runm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/api/types/runc/options"
+	"github.com/containerd/containerd/v2/core/events"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/containerd/v2/pkg/oci"
+	"github.com/containerd/containerd/v2/pkg/stdio"
+	"github.com/walteh/run"
+
+	"github.com/walteh/runm/cmd/containerd-shim-runm-v2/process"
+	rtprocess "github.com/walteh/runm/core/runc/process"
+	"github.com/walteh/runm/core/runc/runtime"
+	"github.com/walteh/runm/pkg/atomicfile"
+)
+
+const stateFilename = "runm-state.json"
+
+// ContainerState is what a restarted shim needs to rebuild a Container whose
+// runtime outlived the previous shim process.
+type ContainerState struct {
+	ID              string      `json:"id"`
+	Bundle          string      `json:"bundle"`
+	Namespace       string      `json:"namespace"`
+	RuntimeStateDir string      `json:"runtime_state_dir"`
+	InitPid         int         `json:"init_pid"`
+	Stdio           stdio.Stdio `json:"stdio"`
+	Execs           []ExecState `json:"execs,omitempty"`
+}
+
+type ExecState struct {
+	ID  string `json:"id"`
+	Pid int    `json:"pid"`
+}
+
+// HasContainerState reports whether a previous shim left a state file in the bundle.
+func HasContainerState(bundle string) bool {
+	_, err := os.Stat(filepath.Join(bundle, stateFilename))
+	return err == nil
+}
+
+func ReadContainerState(bundle string) (*ContainerState, error) {
+	data, err := os.ReadFile(filepath.Join(bundle, stateFilename))
+	if err != nil {
+		return nil, err
+	}
+	var st ContainerState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func WriteContainerState(bundle string, st *ContainerState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(bundle, stateFilename), data)
+}
+
+func RemoveContainerState(bundle string) error {
+	if err := os.Remove(filepath.Join(bundle, stateFilename)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// SaveState persists the container and its running processes to the bundle. It is
+// a no-op for runtimes that do not outlive the shim.
+func (c *Container) SaveState(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	init, ok := c.process.(*process.Init)
+	if !ok {
+		return nil
+	}
+
+	rr, ok := init.Runtime().(runtime.ReattachableRuntime)
+	if !ok {
+		return nil
+	}
+
+	ns, _ := namespaces.Namespace(ctx)
+
+	st := &ContainerState{
+		ID:              c.ID,
+		Bundle:          c.Bundle,
+		Namespace:       ns,
+		RuntimeStateDir: rr.StateDir(),
+		InitPid:         init.Pid(),
+		Stdio:           init.Stdio(),
+	}
+
+	for id, p := range c.processes {
+		if p.Pid() <= 0 {
+			continue
+		}
+		st.Execs = append(st.Execs, ExecState{ID: id, Pid: p.Pid()})
+	}
+
+	return WriteContainerState(c.Bundle, st)
+}
+
+// RecoverContainer rebuilds a Container from the state a previous shim left in the
+// bundle, reattaching to its runtime.
+//
+// Process I/O is not reconnected: the stdio sockets the guest allocated were
+// connected to the previous shim and the guest has no way to hand them out again,
+// so the recovered processes only report their exit.
+func RecoverContainer(
+	ctx context.Context,
+	platform stdio.Platform,
+	bundle string,
+	publisher events.Publisher,
+	rtc runtime.RuntimeCreator,
+) (*Container, error) {
+	reattacher, ok := rtc.(runtime.RuntimeReattacher)
+	if !ok {
+		return nil, fmt.Errorf("runtime creator %T cannot reattach to a running container", rtc)
+	}
+
+	st, err := ReadContainerState(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("read container state: %w", err)
+	}
+
+	spec, err := oci.ReadSpec(filepath.Join(bundle, oci.ConfigFilename))
+	if err != nil {
+		return nil, fmt.Errorf("read spec: %w", err)
+	}
+
+	opts, err := ReadOptions(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("read options: %w", err)
+	}
+	if opts == nil {
+		opts = &options.Options{}
+	}
+
+	ctx = namespaces.WithNamespace(ctx, st.Namespace)
+
+	rt, err := reattacher.Reattach(ctx, &runtime.ReattachOptions{
+		ContainerID: st.ID,
+		Namespace:   st.Namespace,
+		Publisher:   publisher,
+		OciSpec:     spec,
+		StateDir:    st.RuntimeStateDir,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reattach runtime: %w", err)
+	}
+
+	if runnable, ok := rt.(run.Runnable); ok {
+		go func() {
+			if err := runnable.Run(ctx); err != nil {
+				slog.ErrorContext(ctx, "failed to run reattached container runtime", "id", st.ID, "error", err)
+			}
+		}()
+	}
+
+	cgroupAdapter, ok := rt.(runtime.CgroupAdapter)
+	if !ok {
+		return nil, fmt.Errorf("runtime is not a cgroup adapter")
+	}
+
+	p, err := newInit(
+		ctx,
+		bundle,
+		filepath.Join(bundle, "work"),
+		st.Namespace,
+		platform,
+		&rtprocess.CreateConfig{
+			ID:       st.ID,
+			Bundle:   bundle,
+			Stdin:    st.Stdio.Stdin,
+			Stdout:   st.Stdio.Stdout,
+			Stderr:   st.Stdio.Stderr,
+			Terminal: st.Stdio.Terminal,
+		},
+		opts,
+		filepath.Join(bundle, "rootfs"),
+		rt,
+		cgroupAdapter,
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.Recover(st.InitPid)
+
+	container := &Container{
+		ID:              st.ID,
+		Bundle:          bundle,
+		process:         p,
+		processes:       make(map[string]process.Process),
+		reservedProcess: make(map[string]struct{}),
+	}
+
+	for _, e := range st.Execs {
+		container.processes[e.ID] = p.RecoverExec(e.ID, bundle, e.Pid)
+	}
+
+	slog.InfoContext(ctx, "recovered container from previous shim", "id", st.ID, "init_pid", st.InitPid, "execs", len(st.Execs))
+
+	return container, nil
+}
@@ -0,0 +1,43 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/containerd/errdefs/pkg/errgrpc"
+	"github.com/containerd/ttrpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+// registerCacheGC serves collections of the vm cache on demand next to the task
+// service, when the runtime creator runs them.
+func (s *service) registerCacheGC(server *ttrpc.Server) {
+	runner, ok := s.creator.(vmm.CacheGCRunner)
+	if !ok {
+		return
+	}
+
+	server.RegisterService(vmm.CacheGCTTRPCService, &ttrpc.ServiceDesc{
+		Methods: map[string]ttrpc.Method{
+			vmm.CacheGCCollectMethod: func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req wrapperspb.BoolValue
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+
+				res, err := runner.CollectVMCache(ctx, req.GetValue())
+				if err != nil {
+					return nil, errgrpc.ToGRPC(err)
+				}
+
+				data, err := json.Marshal(res)
+				if err != nil {
+					return nil, err
+				}
+				return wrapperspb.Bytes(data), nil
+			},
+		},
+	})
+}
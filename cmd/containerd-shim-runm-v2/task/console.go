@@ -0,0 +1,110 @@
+package task
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/containerd/errdefs"
+	"github.com/containerd/errdefs/pkg/errgrpc"
+	"github.com/containerd/ttrpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/walteh/runm/cmd/containerd-shim-runm-v2/process"
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+// consoleLogLink points at the console log in the vm working directory, relative
+// to the bundle, the working directory of the shim. It is there for `tail -F` from
+// the bundle where nothing speaks vmm.ConsoleLogTTRPCService, e.g. next to ctr:
+//
+//	tail -F /run/containerd/io.containerd.runtime.v2.task/<namespace>/<id>/console.log
+//
+// Rotated logs are only served on vmm.ConsoleLogTTRPCService.
+const consoleLogLink = "console.log"
+
+// linkConsoleLog links the console log of the vm the container runs in, if it runs
+// in one, into the bundle until the shim shuts down.
+func (s *service) linkConsoleLog(ctx context.Context, rt any) {
+	clp, ok := rt.(vmm.ConsoleLogProvider)
+	if !ok {
+		return
+	}
+
+	os.Remove(consoleLogLink)
+	if err := os.Symlink(clp.ConsoleLog().Path(), consoleLogLink); err != nil {
+		slog.WarnContext(ctx, "failed to link console log into the bundle", "error", err)
+		return
+	}
+
+	s.shutdown.RegisterCallback(func(ctx context.Context) error {
+		os.Remove(consoleLogLink)
+		return nil
+	})
+}
+
+// registerConsoleLog serves the console logs of the shim's containers next to the
+// task service.
+func (s *service) registerConsoleLog(server *ttrpc.Server) {
+	server.RegisterService(vmm.ConsoleLogTTRPCService, &ttrpc.ServiceDesc{
+		Streams: map[string]ttrpc.Stream{
+			vmm.ConsoleLogReadMethod:   {Handler: s.streamConsoleLog(false), StreamingServer: true},
+			vmm.ConsoleLogFollowMethod: {Handler: s.streamConsoleLog(true), StreamingServer: true},
+		},
+	})
+}
+
+func (s *service) streamConsoleLog(follow bool) ttrpc.StreamHandler {
+	return func(ctx context.Context, ss ttrpc.StreamServer) (interface{}, error) {
+		var req wrapperspb.StringValue
+		if err := ss.RecvMsg(&req); err != nil {
+			return nil, err
+		}
+
+		cl, err := s.consoleLog(req.GetValue())
+		if err != nil {
+			return nil, err
+		}
+
+		w := consoleLogStream{ss}
+		if follow {
+			err = cl.Follow(ctx, w)
+		} else {
+			_, err = cl.WriteTo(w)
+		}
+		if err != nil {
+			return nil, errgrpc.ToGRPC(err)
+		}
+		return nil, nil
+	}
+}
+
+func (s *service) consoleLog(id string) (*vmm.ConsoleLog, error) {
+	container, err := s.getContainer(id)
+	if err != nil {
+		return nil, err
+	}
+
+	proc, err := container.Process("")
+	if err != nil {
+		return nil, err
+	}
+	if init, ok := proc.(*process.Init); ok {
+		if clp, ok := init.Runtime().(vmm.ConsoleLogProvider); ok {
+			return clp.ConsoleLog(), nil
+		}
+	}
+	return nil, errgrpc.ToGRPCf(errdefs.ErrNotImplemented, "container %s does not run in a vm", id)
+}
+
+// consoleLogStream sends what is written to it to the client as it is written.
+type consoleLogStream struct {
+	ss ttrpc.StreamServer
+}
+
+func (w consoleLogStream) Write(p []byte) (int, error) {
+	if err := w.ss.SendMsg(&wrapperspb.BytesValue{Value: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
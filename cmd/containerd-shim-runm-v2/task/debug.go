@@ -14,6 +14,9 @@ import (
 	slogctx "github.com/veqryn/slog-context"
 	"gitlab.com/tozd/go/errors"
 
+	"github.com/walteh/runm/pkg/metrics"
+	"github.com/walteh/runm/pkg/tracing"
+
 	"github.com/containerd/containerd/api/runtime/task/v3"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
@@ -38,6 +41,9 @@ type errTaskService struct {
 func (e *errTaskService) RegisterTTRPC(s *ttrpc.Server) error {
 	s.SetDebugging(true)
 	task.RegisterTTRPCTaskService(s, e)
+	if svc, ok := e.ref.(*service); ok {
+		svc.registerExtensions(s)
+	}
 	return nil
 }
 
@@ -57,7 +63,12 @@ func wrap[I, O any](e *errTaskService, f func(context.Context, I) (O, error)) fu
 	realName := realNameS[len(realNameS)-1]
 
 	return func(ctx context.Context, req I) (resp O, retErr error) {
+		// ended last so that it sees the error of a recovered panic
+		ctx, span := startTaskSpan(ctx, realName)
+		defer func() { tracing.End(span, retErr) }()
+
 		start := time.Now()
+		defer func() { metrics.ObserveRPC(metrics.SideTask, realName, start, retErr) }()
 
 		startLogRecord := slog.NewRecord(start, slog.LevelInfo, strings.ToUpper(realName)+"_START", pc)
 		startLogRecord.AddAttrs(
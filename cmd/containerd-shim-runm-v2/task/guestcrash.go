@@ -0,0 +1,57 @@
+package task
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/log"
+	"gitlab.com/tozd/go/errors"
+
+	gorunc "github.com/containerd/go-runc"
+
+	"github.com/walteh/runm/cmd/containerd-shim-runm-v2/runm"
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+// watchGuestCrash publishes the crash of the guest the container runs in and then
+// exits its processes, whose exits the crashed guest can no longer report. The vm
+// is stopped by then, so none of them is left running.
+func (s *service) watchGuestCrash(ctx context.Context, c *runm.Container, w vmm.GuestCrashWatcher) {
+	crash, err := w.WaitGuestCrash(ctx)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			log.G(ctx).WithError(err).WithField("container", c.ID).Warn("stopped watching for a guest crash")
+		}
+		return
+	}
+	if crash == nil {
+		return
+	}
+
+	log.G(s.context).WithField("container", c.ID).
+		WithField("kind", crash.Kind).
+		WithField("summary", crash.Summary).
+		Error("guest crashed")
+
+	s.send(&topicEvent{topic: vmm.TaskGuestCrashEventTopic, event: crash})
+
+	exitedAt := time.Now()
+
+	// the execs first, the init exit is only published once they are gone
+	procs := c.ExecdProcesses()
+	if init, err := c.Process(""); err == nil {
+		procs = append(procs, init)
+	}
+
+	// processes that already exited are no longer running and are left alone
+	for _, p := range procs {
+		processID := p.ID()
+		s.handleExit(gorunc.Exit{
+			Timestamp: exitedAt,
+			Pid:       p.Pid(),
+			Status:    vmm.GuestCrashExitStatus,
+		}, func(cp containerProcess) bool {
+			return cp.Container == c && cp.Process.ID() == processID
+		})
+	}
+}
@@ -17,6 +17,11 @@
 package plugin
 
 import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+
 	"github.com/containerd/containerd/v2/pkg/shim"
 	"github.com/containerd/containerd/v2/pkg/shutdown"
 	"github.com/containerd/containerd/v2/plugins"
@@ -26,12 +31,73 @@ import (
 
 	"github.com/walteh/runm/cmd/containerd-shim-runm-v2/task"
 	"github.com/walteh/runm/core/runc/runtime"
+	"github.com/walteh/runm/core/runc/runtime/virt/vmoptions"
+	"github.com/walteh/runm/pkg/metrics"
+	"github.com/walteh/runm/pkg/tracing"
 )
 
 func init() {
 	register()
 }
 
+// readOptions reads the runm runtime options of the shim, which runs in the bundle
+// where the manager left them. It also returns the container id, the bundle name.
+func readOptions() (*vmoptions.Options, string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, "", err
+	}
+
+	opts, err := vmoptions.Read(cwd)
+	if err != nil {
+		return nil, "", errors.Errorf("reading runm runtime options: %w", err)
+	}
+
+	return opts, filepath.Base(cwd), nil
+}
+
+// setupTracing exports the spans of the shim as the runm runtime options say.
+func setupTracing(ic *plugin.InitContext, ss shutdown.Service, opts *vmoptions.Options) error {
+	shutdownTracing, err := tracing.Setup(ic.Context, opts.TracingConfig())
+	if err != nil {
+		return errors.Errorf("setting up tracing: %w", err)
+	}
+	ss.RegisterCallback(shutdownTracing)
+
+	return nil
+}
+
+// setupMetrics serves the shim metrics on the metrics address of the runm runtime
+// options, if there is one, until the shim shuts down.
+func setupMetrics(ic *plugin.InitContext, ss shutdown.Service, opts *vmoptions.Options, id string) error {
+	if opts.MetricsAddress == "" {
+		return nil
+	}
+
+	metrics.RegisterHostMetrics()
+
+	address := opts.MetricsListenAddress(id)
+	l, err := metrics.Listen(address)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ic.Context))
+	go func() {
+		if err := metrics.Serve(ctx, l); err != nil {
+			slog.ErrorContext(ctx, "serving metrics", "address", address, "error", err)
+		}
+	}()
+	ss.RegisterCallback(func(context.Context) error {
+		cancel()
+		return nil
+	})
+
+	slog.InfoContext(ctx, "serving metrics", "address", address)
+
+	return nil
+}
+
 func Reregister() {
 	register()
 }
@@ -53,6 +119,16 @@ func register() {
 			if err != nil {
 				return nil, errors.Errorf("getting shutdown: %w", err)
 			}
+			opts, id, err := readOptions()
+			if err != nil {
+				return nil, err
+			}
+			if err := setupTracing(ic, ss.(shutdown.Service), opts); err != nil {
+				return nil, err
+			}
+			if err := setupMetrics(ic, ss.(shutdown.Service), opts, id); err != nil {
+				return nil, errors.Errorf("setting up metrics: %w", err)
+			}
 			rtc, err := ic.GetByID(plugins.InternalPlugin, "runm-runtime-creator")
 			if err != nil {
 				return nil, errors.Errorf("getting runm-runtime-creator: %w", err)
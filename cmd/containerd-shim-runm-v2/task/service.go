@@ -26,6 +26,7 @@ import (
 	"path"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/containerd/containerd/api/types/runc/options"
 	"github.com/containerd/containerd/api/types/task"
@@ -42,6 +43,7 @@ import (
 	"github.com/containerd/ttrpc"
 	"github.com/containerd/typeurl/v2"
 	"gitlab.com/tozd/go/errors"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
 
 	eventstypes "github.com/containerd/containerd/api/events"
@@ -52,8 +54,10 @@ import (
 
 	"github.com/walteh/runm/cmd/containerd-shim-runm-v2/process"
 	"github.com/walteh/runm/cmd/containerd-shim-runm-v2/runm"
+	"github.com/walteh/runm/core/runc/exits"
 	"github.com/walteh/runm/core/runc/oom"
 	"github.com/walteh/runm/core/runc/runtime"
+	"github.com/walteh/runm/core/virt/vmm"
 	runmv1 "github.com/walteh/runm/proto/v1"
 )
 
@@ -72,12 +76,14 @@ func NewTaskService(ctx context.Context, publisher shim.Publisher, sd shutdown.S
 		ep:                   nil,
 		shutdown:             sd,
 		containers:           make(map[string]*runm.Container),
+		guestWatches:         make(map[string]context.CancelFunc),
 		running:              make(map[int][]containerProcess),
 		runningExecs:         make(map[*runm.Container]int),
 		execCountSubscribers: make(map[*runm.Container]chan<- int),
 		containerInitExit:    make(map[*runm.Container]gorunc.Exit),
 		exitSubscribers:      make(map[*map[int][]gorunc.Exit]struct{}),
 		creator:              rtc,
+		publisher:            publisher,
 	}
 	go s.processExits()
 	gorunc.Monitor = reaper.Default
@@ -90,6 +96,12 @@ func NewTaskService(ctx context.Context, publisher shim.Publisher, sd shutdown.S
 		return nil
 	})
 
+	if err := s.recoverContainer(ctx); err != nil {
+		log.G(ctx).WithError(err).Error("failed to recover container from previous shim")
+	}
+
+	s.collectCache(ctx)
+
 	if address, err := shim.ReadAddress("address"); err == nil {
 		sd.RegisterCallback(func(context.Context) error {
 			if err := shim.RemoveSocket(address); err != nil {
@@ -118,6 +130,8 @@ type service struct {
 
 	primaryContainerId string
 	containers         map[string]*runm.Container
+	// container id -> stops watching the guest the container runs in, guarded by mu
+	guestWatches map[string]context.CancelFunc
 
 	lifecycleMu  sync.Mutex
 	running      map[int][]containerProcess // pid -> running process, guarded by lifecycleMu
@@ -336,9 +350,19 @@ func (s *service) Create(ctx context.Context, r *taskAPI.CreateTaskRequest) (_ *
 		return nil, errgrpc.ToGRPCf(errdefs.ErrAlreadyExists, "runm only supports one container per shim")
 	}
 
+	// The following line cannot return an error as the only state in which that
+	// could happen would also cause the container.Pid() call below to
+	// nil-deference panic.
+	proc, _ := container.Process("")
+
 	s.primaryContainerId = r.ID
 	s.containers[r.ID] = container
 
+	if init, ok := proc.(*process.Init); ok {
+		s.watchGuest(container, init)
+		s.linkConsoleLog(ctx, init.Runtime())
+	}
+
 	s.send(&eventstypes.TaskCreate{
 		ContainerID: r.ID,
 		Bundle:      r.Bundle,
@@ -353,22 +377,89 @@ func (s *service) Create(ctx context.Context, r *taskAPI.CreateTaskRequest) (_ *
 		Pid:        uint32(container.Pid()),
 	})
 
-	// The following line cannot return an error as the only state in which that
-	// could happen would also cause the container.Pid() call above to
-	// nil-deference panic.
-	proc, _ := container.Process("")
 	handleStarted(container, proc)
 
+	s.saveContainerState(ctx, container)
+
 	return &taskAPI.CreateTaskResponse{
 		Pid: uint32(container.Pid()),
 	}, nil
 }
 
+// saveContainerState records the container so a restarted shim can reattach to it.
+func (s *service) saveContainerState(ctx context.Context, c *runm.Container) {
+	if err := c.SaveState(ctx); err != nil {
+		log.G(ctx).WithError(err).WithField("id", c.ID).Warn("failed to save container state")
+	}
+}
+
+// recoverContainer reattaches to the container a previous shim process left running
+// in this bundle, if any. Exits that happened while no shim was running are replayed
+// by the guest and published once the exit stream is consumed again.
+func (s *service) recoverContainer(ctx context.Context) error {
+	bundle, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	if !runm.HasContainerState(bundle) {
+		return nil
+	}
+
+	container, err := runm.RecoverContainer(ctx, s.platform, bundle, s.publisher, s.creator)
+	if err != nil {
+		return err
+	}
+
+	serveGrpc, stopGrpc, err := s.serveGrpc(ctx, bundle)
+	if err != nil {
+		return err
+	}
+
+	s.shutdown.RegisterCallback(func(context.Context) error {
+		return stopGrpc()
+	})
+
+	go serveGrpc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.primaryContainerId = container.ID
+	s.containers[container.ID] = container
+
+	s.lifecycleMu.Lock()
+	for _, p := range container.All() {
+		s.running[p.Pid()] = append(s.running[p.Pid()], containerProcess{
+			Container: container,
+			Process:   p,
+		})
+	}
+	s.runningExecs[container] = len(container.ExecdProcesses())
+	s.lifecycleMu.Unlock()
+
+	proc, _ := container.Process("")
+	if init, ok := proc.(*process.Init); ok {
+		s.watchGuest(container, init)
+		s.linkConsoleLog(ctx, init.Runtime())
+	}
+
+	return nil
+}
+
 func (s *service) RegisterTTRPC(server *ttrpc.Server) error {
 	taskAPI.RegisterTTRPCTaskService(server, s)
+	s.registerExtensions(server)
 	return nil
 }
 
+// registerExtensions registers the runm services the shim serves next to the task
+// service.
+func (s *service) registerExtensions(server *ttrpc.Server) {
+	s.registerConsoleLog(server)
+	s.registerCacheGC(server)
+}
+
 // Start a process
 func (s *service) Start(ctx context.Context, r *taskAPI.StartRequest) (*taskAPI.StartResponse, error) {
 	container, err := s.getContainer(r.ID)
@@ -442,6 +533,7 @@ func (s *service) Start(ctx context.Context, r *taskAPI.StartRequest) (*taskAPI.
 			ContainerID: container.ID,
 			Pid:         uint32(p.Pid()),
 		})
+		s.sendBootTiming(ctx, container.ID, p)
 	default:
 		s.send(&eventstypes.TaskExecStarted{
 			ContainerID: container.ID,
@@ -450,11 +542,29 @@ func (s *service) Start(ctx context.Context, r *taskAPI.StartRequest) (*taskAPI.
 		})
 	}
 	handleStarted(container, p)
+	s.saveContainerState(ctx, container)
 	return &taskAPI.StartResponse{
 		Pid: uint32(p.Pid()),
 	}, nil
 }
 
+// sendBootTiming publishes the boot timing of the init process p once it has
+// started, so that it covers the runc start in the guest.
+func (s *service) sendBootTiming(ctx context.Context, id string, p process.Process) {
+	init, ok := p.(*process.Init)
+	if !ok {
+		return
+	}
+	btp, ok := init.Runtime().(vmm.BootTimingProvider)
+	if !ok {
+		return
+	}
+	if bt := btp.BootTiming(); bt != nil {
+		log.G(ctx).WithField("id", id).WithField("total", bt.Total).Info("container boot timing")
+		s.send(&topicEvent{topic: vmm.TaskBootTimingEventTopic, event: bt})
+	}
+}
+
 // Delete the initial process and container
 func (s *service) Delete(ctx context.Context, r *taskAPI.DeleteRequest) (*taskAPI.DeleteResponse, error) {
 	container, err := s.getContainer(r.ID)
@@ -469,6 +579,10 @@ func (s *service) Delete(ctx context.Context, r *taskAPI.DeleteRequest) (*taskAP
 	if r.ExecID == "" {
 		s.mu.Lock()
 		delete(s.containers, r.ID)
+		if stop, ok := s.guestWatches[r.ID]; ok {
+			stop()
+			delete(s.guestWatches, r.ID)
+		}
 		s.mu.Unlock()
 		s.send(&eventstypes.TaskDelete{
 			ContainerID: container.ID,
@@ -479,6 +593,12 @@ func (s *service) Delete(ctx context.Context, r *taskAPI.DeleteRequest) (*taskAP
 		s.lifecycleMu.Lock()
 		delete(s.containerInitExit, container)
 		s.lifecycleMu.Unlock()
+		if err := runm.RemoveContainerState(container.Bundle); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to remove container state")
+		}
+		s.collectCache(context.WithoutCancel(ctx))
+	} else {
+		s.saveContainerState(ctx, container)
 	}
 	return &taskAPI.DeleteResponse{
 		ExitStatus: uint32(p.ExitStatus()),
@@ -487,6 +607,20 @@ func (s *service) Delete(ctx context.Context, r *taskAPI.DeleteRequest) (*taskAP
 	}, nil
 }
 
+// collectCache removes, in the background, what the runtime left on the host for
+// containers that are gone.
+func (s *service) collectCache(ctx context.Context) {
+	cc, ok := s.creator.(runtime.CacheCollector)
+	if !ok {
+		return
+	}
+	go func() {
+		if err := cc.CollectCache(ctx); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to collect runtime cache")
+		}
+	}()
+}
+
 // Exec an additional process inside the container
 func (s *service) Exec(ctx context.Context, r *taskAPI.ExecProcessRequest) (*ptypes.Empty, error) {
 	container, err := s.getContainer(r.ID)
@@ -662,6 +796,19 @@ func (s *service) Checkpoint(ctx context.Context, r *taskAPI.CheckpointTaskReque
 	if err := container.Checkpoint(ctx, r); err != nil {
 		return nil, errgrpc.ToGRPC(err)
 	}
+
+	// the vm is gone after a vm checkpoint with exit, nothing is left in the guest
+	// to report the exit of the init process
+	if vmopts, _ := runm.VMCheckpointOptions(r); vmopts != nil && vmopts.Exit {
+		s.handleExit(gorunc.Exit{
+			Timestamp: time.Now(),
+			Pid:       container.Pid(),
+			Status:    128 + int(unix.SIGKILL),
+		}, func(cp containerProcess) bool {
+			return cp.Container == container && cp.Process.ID() == container.ID
+		})
+	}
+
 	return empty, nil
 }
 
@@ -759,6 +906,11 @@ func (s *service) Stats(ctx context.Context, r *taskAPI.StatsRequest) (*taskAPI.
 	if err != nil {
 		return nil, err
 	}
+	data, err = withVMStats(ctx, container, data)
+	if err != nil {
+		return nil, err
+	}
+
 	return &taskAPI.StatsResponse{
 		Stats: typeurl.MarshalProto(data),
 	}, nil
@@ -768,37 +920,91 @@ func (s *service) processExits() {
 	for e := range s.ec {
 		// While unlikely, it is not impossible for a container process to exit
 		// and have its PID be recycled for a new container process before we
-		// have a chance to process the first exit. As we have no way to tell
-		// for sure which of the processes the exit event corresponds to (until
-		// pidfd support is implemented) there is no way for us to handle the
-		// exit correctly in that case.
+		// have a chance to process the first exit. Exits reaped on the host
+		// carry nothing but the PID, so there is no way to tell which of the
+		// processes the exit event corresponds to. Exits reported by the guest
+		// (see consumeGuestExits) are pinned with a pidfd and carry the
+		// process id, so they do not have this problem.
+		s.handleExit(e, nil)
+	}
+}
 
-		s.lifecycleMu.Lock()
-		// Inform any concurrent s.Start() calls so they can handle the exit
-		// if the PID belongs to them.
-		for subscriber := range s.exitSubscribers {
-			(*subscriber)[e.Pid] = append((*subscriber)[e.Pid], e)
+// watchGuest consumes the exits reported by the guest a container runs in and
+// watches the guest for a crash, until the container is deleted. s.mu must be held.
+func (s *service) watchGuest(c *runm.Container, init *process.Init) {
+	ctx, cancel := context.WithCancel(s.context)
+	s.guestWatches[c.ID] = cancel
+
+	if handler, ok := init.Runtime().(runtime.EventHandler); ok {
+		go s.consumeGuestExits(ctx, c, handler)
+	}
+	if cw, ok := init.Runtime().(vmm.GuestCrashWatcher); ok {
+		go s.watchGuestCrash(ctx, c, cw)
+	}
+}
+
+// consumeGuestExits feeds the process exits reported by the guest agent into the
+// same exit handling as host reaped processes. exits.Stream resubscribes when the
+// guest connection breaks and drops exits that were already delivered.
+func (s *service) consumeGuestExits(ctx context.Context, c *runm.Container, handler runtime.EventHandler) {
+	for ge := range exits.Stream(ctx, handler) {
+		log.G(ctx).WithField("container", ge.ContainerID).
+			WithField("exec", ge.ExecID).
+			WithField("pid", ge.Pid).
+			WithField("status", ge.Status).
+			Debug("guest process exited")
+
+		if ge.ContainerID != c.ID {
+			continue
 		}
-		// Handle the exit for a created/started process. If there's more than
-		// one, assume they've all exited. One of them will be the correct
-		// process.
-		var cps []containerProcess
-		for _, cp := range s.running[e.Pid] {
-			_, init := cp.Process.(*process.Init)
-			if init {
-				s.containerInitExit[cp.Container] = e
-			}
-			cps = append(cps, cp)
+
+		processID := ge.ProcessID()
+		s.handleExit(gorunc.Exit{
+			Timestamp: ge.ExitedAt,
+			Pid:       ge.Pid,
+			Status:    ge.Status,
+		}, func(cp containerProcess) bool {
+			return cp.Container == c && cp.Process.ID() == processID
+		})
+	}
+}
+
+// handleExit dispatches an exit to the processes running with its PID. If match is
+// non-nil, only the processes it accepts are considered exited.
+func (s *service) handleExit(e gorunc.Exit, match func(containerProcess) bool) {
+	s.lifecycleMu.Lock()
+	// Inform any concurrent s.Start() calls so they can handle the exit
+	// if the PID belongs to them.
+	for subscriber := range s.exitSubscribers {
+		(*subscriber)[e.Pid] = append((*subscriber)[e.Pid], e)
+	}
+	// Handle the exit for a created/started process. If there's more than
+	// one and we cannot tell them apart, assume they've all exited. One of
+	// them will be the correct process.
+	var cps, remaining []containerProcess
+	for _, cp := range s.running[e.Pid] {
+		if match != nil && !match(cp) {
+			remaining = append(remaining, cp)
+			continue
+		}
+		_, init := cp.Process.(*process.Init)
+		if init {
+			s.containerInitExit[cp.Container] = e
 		}
+		cps = append(cps, cp)
+	}
+	if len(remaining) > 0 {
+		s.running[e.Pid] = remaining
+	} else {
 		delete(s.running, e.Pid)
-		s.lifecycleMu.Unlock()
+	}
+	s.lifecycleMu.Unlock()
 
-		for _, cp := range cps {
-			if ip, ok := cp.Process.(*process.Init); ok {
-				s.handleInitExit(e, cp.Container, ip)
-			} else {
-				s.handleProcessExit(e, cp.Container, cp.Process)
-			}
+	for _, cp := range cps {
+		if ip, ok := cp.Process.(*process.Init); ok {
+			s.handleInitExit(e, cp.Container, ip)
+		} else {
+			s.handleProcessExit(e, cp.Container, cp.Process)
 		}
 	}
 }
@@ -807,6 +1013,13 @@ func (s *service) send(evt interface{}) {
 	s.events <- evt
 }
 
+// topicEvent carries a runm event, which containerd has no topic for, through
+// the events channel so it stays ordered with the containerd ones.
+type topicEvent struct {
+	topic string
+	event interface{}
+}
+
 // handleInitExit processes container init process exits.
 // This is handled separately from non-init exits, because there
 // are some extra invariants we want to ensure in this case, namely:
@@ -899,7 +1112,12 @@ func (s *service) forward(ctx context.Context, publisher shim.Publisher) {
 	ns, _ := namespaces.Namespace(ctx)
 	ctx = namespaces.WithNamespace(context.Background(), ns)
 	for e := range s.events {
-		err := publisher.Publish(ctx, containerdruntime.GetTopic(e), e)
+		var err error
+		if te, ok := e.(*topicEvent); ok {
+			err = publisher.Publish(ctx, te.topic, te.event)
+		} else {
+			err = publisher.Publish(ctx, containerdruntime.GetTopic(e), e)
+		}
 		if err != nil {
 			log.G(ctx).WithError(err).Error("post event")
 		}
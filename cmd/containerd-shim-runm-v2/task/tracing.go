@@ -0,0 +1,47 @@
+package task
+
+import (
+	"context"
+
+	"github.com/containerd/ttrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/walteh/runm/pkg/tracing"
+)
+
+var _ propagation.TextMapCarrier = ttrpcCarrier{}
+
+// ttrpcCarrier reads the trace context containerd puts in the ttrpc metadata.
+type ttrpcCarrier struct {
+	md ttrpc.MD
+}
+
+func (c ttrpcCarrier) Get(key string) string {
+	if v, ok := c.md.Get(key); ok && len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c ttrpcCarrier) Set(key, value string) {
+	c.md.Set(key, value)
+}
+
+func (c ttrpcCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.md))
+	for k := range c.md {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startTaskSpan starts the server span of a task service call, continuing the trace
+// of the containerd request when it carries one.
+func startTaskSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	if md, ok := ttrpc.GetMetadata(ctx); ok && !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, ttrpcCarrier{md: md})
+	}
+	return otel.Tracer(tracing.TracerName).Start(ctx, "containerd.task.v3.Task/"+method, trace.WithSpanKind(trace.SpanKindServer))
+}
@@ -0,0 +1,40 @@
+package task
+
+import (
+	"context"
+
+	"github.com/containerd/errdefs"
+	"github.com/containerd/errdefs/pkg/errgrpc"
+	"github.com/containerd/typeurl/v2"
+
+	"github.com/walteh/runm/cmd/containerd-shim-runm-v2/process"
+	"github.com/walteh/runm/cmd/containerd-shim-runm-v2/runm"
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+// withVMStats wraps the cgroup metrics of a vm backed container together with the
+// stats of its vm into a vmm.TaskMetrics. The metrics of any other container are
+// returned as they are.
+func withVMStats(ctx context.Context, container *runm.Container, metrics typeurl.Any) (typeurl.Any, error) {
+	proc, err := container.Process("")
+	if err != nil {
+		return nil, err
+	}
+	init, ok := proc.(*process.Init)
+	if !ok {
+		return metrics, nil
+	}
+	vsp, ok := init.Runtime().(vmm.VMStatsProvider)
+	if !ok {
+		return metrics, nil
+	}
+
+	vmStats, err := vsp.VMStats(ctx)
+	if err != nil {
+		return nil, errgrpc.ToGRPCf(errdefs.ErrUnavailable, "getting vm stats: %v", err)
+	}
+	return typeurl.MarshalAny(&vmm.TaskMetrics{
+		Cgroup: typeurl.MarshalProto(metrics),
+		VM:     vmStats,
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -21,11 +22,16 @@ import (
 
 	slogctx "github.com/veqryn/slog-context"
 
+	"github.com/walteh/runm/core/runc/exits"
 	"github.com/walteh/runm/core/runc/runtime"
 	goruncruntime "github.com/walteh/runm/core/runc/runtime/gorunc"
 	"github.com/walteh/runm/core/runc/server"
+	"github.com/walteh/runm/core/virt/procvm/guest"
 	"github.com/walteh/runm/linux/constants"
+	"github.com/walteh/runm/pkg/cmdline"
 	"github.com/walteh/runm/pkg/logging"
+	"github.com/walteh/runm/pkg/metrics"
+	"github.com/walteh/runm/pkg/tracing"
 
 	gorunc "github.com/containerd/go-runc"
 
@@ -39,20 +45,47 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	logger := logging.NewDefaultDevLogger("runm-linux-init", os.Stdout)
+	// the mounter execs us without arguments, but /proc is mounted by now
+	params, paramsErr := readRunmParams()
+	if paramsErr != nil {
+		params = cmdline.DefaultRunmParams()
+	}
+
+	logger := logging.NewDefaultDevLogger("runm-linux-init", os.Stdout, logging.WithHandlerOptions(&slog.HandlerOptions{
+		Level:     params.LogLevel,
+		AddSource: true,
+	}))
 
 	ctx = slogctx.NewCtx(ctx, logger)
 
 	ctx = slogctx.Append(ctx, slog.Int("pid", pid))
 
-	err := recoveryMain(ctx)
+	if paramsErr != nil {
+		slog.ErrorContext(ctx, "invalid runm parameters, using the defaults", "error", paramsErr)
+	}
+
+	slog.InfoContext(ctx, "runm parameters", "mode", params.Mode, "vsock_port", params.VsockPort, "debug", params.Debug, "otlp_endpoint", params.OTLPEndpoint)
+
+	err := recoveryMain(ctx, params)
 	if err != nil {
 		slog.ErrorContext(ctx, "error in main", "error", err)
 		os.Exit(1)
 	}
 }
 
-func recoveryMain(ctx context.Context) (err error) {
+func readRunmParams() (cmdline.RunmParams, error) {
+	// a process vm passes the init parameters as arguments, /proc/cmdline is the host's
+	if guest.Active() {
+		return cmdline.FromInitArgs(os.Args[1:]).RunmParams()
+	}
+	cl, err := cmdline.ReadProc()
+	if err != nil {
+		return cmdline.RunmParams{}, err
+	}
+	return cl.RunmParams()
+}
+
+func recoveryMain(ctx context.Context, params cmdline.RunmParams) (err error) {
 	errChan := make(chan error)
 	go func() {
 		defer func() {
@@ -64,36 +97,43 @@ func recoveryMain(ctx context.Context) (err error) {
 				errChan <- err
 			}
 		}()
-		err := runGrpcVsockServer(ctx)
+		err := runGrpcVsockServer(ctx, params)
 		errChan <- err
 	}()
 
 	return <-errChan
 }
 
-func runGrpcVsockServer(ctx context.Context) error {
+func runGrpcVsockServer(ctx context.Context, params cmdline.RunmParams) error {
 
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+	if params.Debug {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
 
-	go func() {
-		for tick := range ticker.C {
-			if ctx.Err() != nil {
-				return
+		go func() {
+			for tick := range ticker.C {
+				if ctx.Err() != nil {
+					return
+				}
+				slog.InfoContext(ctx, "still running in rootfs, waiting to be killed", "tick", tick)
 			}
-			slog.InfoContext(ctx, "still running in rootfs, waiting to be killed", "tick", tick)
-		}
-	}()
+		}()
+	}
+
+	paths, err := resolveGuestPaths()
+	if err != nil {
+		return errors.Errorf("problem resolving guest paths: %w", err)
+	}
 
-	wrkDir := constants.Ec1AbsPath
+	wrkDir := paths.wrkDir
 
 	realRuntime := goruncruntime.WrapdGoRuncRuntime(&gorunc.Runc{
-		Command:      "/mbin/runc",
-		Log:          filepath.Join(constants.Ec1AbsPath, runtime.LogFileBase),
+		Command:      paths.runc,
+		Log:          filepath.Join(wrkDir, runtime.LogFileBase),
 		LogFormat:    gorunc.JSON,
 		PdeathSignal: unix.SIGKILL,
 		// Root:          filepath.Join(opts.ProcessCreateConfig.Options.Root, opts.Namespace),
-		Root:          constants.NewRootAbsPath,
+		Root:          paths.runcRoot,
 		SystemdCgroup: false,
 	})
 
@@ -106,32 +146,75 @@ func runGrpcVsockServer(ctx context.Context) error {
 
 	var mockRuntimeExtras = &runtimemock.MockRuntimeExtras{}
 
-	grpcVsockServer := grpc.NewServer()
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		ServiceName: "runm-linux-init",
+		Endpoint:    params.OTLPEndpoint,
+		Protocol:    tracing.Protocol(params.OTLPProtocol),
+	})
+	if err != nil {
+		// the guest agent is more important than its spans
+		slog.ErrorContext(ctx, "failed to set up tracing", "error", err)
+	} else {
+		defer func() {
+			if err := shutdownTracing(context.Background()); err != nil {
+				slog.ErrorContext(ctx, "failed to shut down tracing", "error", err)
+			}
+		}()
+	}
+
+	grpcVsockServer := grpc.NewServer(tracing.GRPCServerOption(), metrics.GRPCServerOption())
 
 	realEventHandler := goruncruntime.NewGoRuncEventHandler()
 
+	// runc exits right after starting a detached process, so we need to be the
+	// subreaper to collect the exit status of the container processes
+	if err := exits.BecomeSubreaper(); err != nil {
+		return errors.Errorf("failed to become subreaper: %w", err)
+	}
+
+	processTracker := exits.NewTracker(realEventHandler)
+
+	serverOpts := []server.ServerOpt{server.WithProcessTracker(processTracker)}
+	if guest.Active() {
+		serverOpts = append(serverOpts, server.WithHostClock())
+	}
+
 	serverz := server.NewServer(
 		realRuntime,
 		mockRuntimeExtras,
 		realSocketAllocator,
 		realEventHandler,
 		cgroupAdapter,
+		serverOpts...,
 	)
 
 	serverz.RegisterGrpcServer(grpcVsockServer)
 
-	slog.InfoContext(ctx, "listening on vsock", "port", constants.RunmVsockPort)
+	metrics.RegisterGuestMetrics()
+	metrics.Registry.MustRegister(metrics.NewOpenResourcesCollector(serverz, nil))
+
+	slog.InfoContext(ctx, "listening on vsock", "port", params.VsockPort)
 
-	listener, err := vsock.ListenContextID(3, uint32(constants.RunmVsockPort), nil)
+	listener, err := listenVsock(params.VsockPort)
 	if err != nil {
 		slog.ErrorContext(ctx, "problem listening vsock", "error", err)
 		return errors.Errorf("problem listening vsock: %w", err)
 	}
 
+	metricsListener, err := listenVsock(constants.RunmMetricsVsockPort)
+	if err != nil {
+		return errors.Errorf("problem listening on metrics vsock: %w", err)
+	}
+
 	egroup := errgroup.Group{}
 
 	egroup.Go(func() error {
-		slog.InfoContext(ctx, "serving grpc vsock server", "port", constants.RunmVsockPort)
+		slog.InfoContext(ctx, "serving metrics on vsock", "port", constants.RunmMetricsVsockPort)
+		return metrics.Serve(ctx, metricsListener)
+	})
+
+	egroup.Go(func() error {
+		slog.InfoContext(ctx, "serving grpc vsock server", "port", params.VsockPort)
 		if err := grpcVsockServer.Serve(listener); err != nil {
 			return errors.Errorf("problem serving grpc vsock server: %w", err)
 		}
@@ -141,6 +224,46 @@ func runGrpcVsockServer(ctx context.Context) error {
 	return egroup.Wait()
 }
 
+// guestPaths are where the guest agent keeps its files and finds runc.
+type guestPaths struct {
+	wrkDir   string
+	runc     string
+	runcRoot string
+}
+
+// resolveGuestPaths returns the paths runm-linux-mounter mounted the shares and
+// mbin at. A process vm has no mounter, the shares are plain directories found by
+// their mount tag, runc comes from the PATH and the bundle and rootfs of the
+// container are host paths runc opens directly.
+func resolveGuestPaths() (guestPaths, error) {
+	if !guest.Active() {
+		return guestPaths{
+			wrkDir:   constants.Ec1AbsPath,
+			runc:     filepath.Join(constants.MbinAbsPath, "runc"),
+			runcRoot: constants.NewRootAbsPath,
+		}, nil
+	}
+
+	wrkDir, err := guest.ShareDir(constants.Ec1VirtioTag)
+	if err != nil {
+		return guestPaths{}, err
+	}
+
+	return guestPaths{
+		wrkDir:   wrkDir,
+		runc:     "runc",
+		runcRoot: filepath.Join(guest.Root(), "runc"),
+	}, nil
+}
+
+// listenVsock listens on the vsock port, or on its unix socket in a process vm.
+func listenVsock(port uint32) (net.Listener, error) {
+	if guest.Active() {
+		return guest.Listen(port)
+	}
+	return vsock.ListenContextID(3, port, nil)
+}
+
 func logFile(ctx context.Context, path string) {
 	fmt.Println()
 	fmt.Println("---------------" + path + "-----------------")
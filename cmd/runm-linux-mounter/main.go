@@ -20,6 +20,7 @@ import (
 	slogctx "github.com/veqryn/slog-context"
 
 	"github.com/walteh/runm/linux/constants"
+	"github.com/walteh/runm/pkg/cmdline"
 	"github.com/walteh/runm/pkg/logging"
 )
 
@@ -34,12 +35,25 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	logger := logging.NewDefaultDevLogger("runm-linux-mounter", os.Stdout)
+	// /proc is not mounted yet, but the kernel hands us the init parameters
+	params, paramsErr := cmdline.FromInitArgs(os.Args[1:]).RunmParams()
+	if paramsErr != nil {
+		params = cmdline.DefaultRunmParams()
+	}
+
+	logger := logging.NewDefaultDevLogger("runm-linux-mounter", os.Stdout, logging.WithHandlerOptions(&slog.HandlerOptions{
+		Level:     params.LogLevel,
+		AddSource: true,
+	}))
 
 	ctx = slogctx.NewCtx(ctx, logger)
 
 	ctx = slogctx.Append(ctx, slog.Int("pid", pid))
 
+	if paramsErr != nil {
+		slog.ErrorContext(ctx, "invalid runm parameters, using the defaults", "error", paramsErr)
+	}
+
 	err := recoveryMain(ctx)
 	if err != nil {
 		slog.ErrorContext(ctx, "error in main", "error", err)
@@ -40,9 +40,15 @@ func GvproxyVersion() string {
 
 type gvproxy struct {
 	netdev *virtio.VirtioNet
+	vn     *virtualnetwork.VirtualNetwork
 	waiter func(ctx context.Context) error
 }
 
+// NetworkStats returns the bytes received from and sent to the guest.
+func (p *gvproxy) NetworkStats() (rxBytes, txBytes uint64) {
+	return p.vn.BytesReceived(), p.vn.BytesSent()
+}
+
 func (p *gvproxy) VirtioNetDevice() *virtio.VirtioNet {
 	return p.netdev
 }
@@ -139,6 +145,7 @@ func NewProxy(ctx context.Context, cfg *GvproxyConfig) (Proxy, error) {
 
 	return &gvproxy{
 		netdev: device,
+		vn:     vn,
 		waiter: func(ctx context.Context) error {
 			if err := groupErrs.Wait(); err != nil {
 				if err == context.Canceled {
@@ -54,38 +54,53 @@ func ConvertCreateOptsFromProto(ctx context.Context, opts *runmv1.RuncCreateOpti
 		}
 	}
 
-	io, ok := state.GetOpenIO(opts.GetIoReferenceId())
-	if !ok {
-		return nil, errors.Errorf("io not found")
+	res := &gorunc.CreateOpts{
+		PidFile:      opts.GetPidFile(),
+		NoPivot:      opts.GetNoPivot(),
+		NoNewKeyring: opts.GetNoNewKeyring(),
+		Detach:       opts.GetDetach(),
+		ExtraFiles:   files,
+		Started:      make(chan int),
 	}
 
-	cs, ok := state.GetOpenConsole(opts.GetConsoleReferenceId())
-	if !ok {
-		return nil, errors.Errorf("console not found")
+	// a container gets either a console or its io, no reference means none
+	if ref := opts.GetIoReferenceId(); ref != "" {
+		io, ok := state.GetOpenIO(ref)
+		if !ok {
+			return nil, errors.Errorf("io not found")
+		}
+		res.IO = io
 	}
 
-	return &gorunc.CreateOpts{
-		PidFile:       opts.GetPidFile(),
-		IO:            io,
-		NoPivot:       opts.GetNoPivot(),
-		NoNewKeyring:  opts.GetNoNewKeyring(),
-		ConsoleSocket: cs,
-		Detach:        opts.GetDetach(),
-		ExtraFiles:    files,
-		Started:       make(chan int),
-	}, nil
+	if ref := opts.GetConsoleReferenceId(); ref != "" {
+		cs, ok := state.GetOpenConsole(ref)
+		if !ok {
+			return nil, errors.Errorf("console not found")
+		}
+		res.ConsoleSocket = cs
+	}
+
+	return res, nil
 }
 
 func ConvertCreateOptsToProto(ctx context.Context, opts *gorunc.CreateOpts) (*runmv1.RuncCreateOptions, error) {
 
-	ioz, ok := opts.IO.(runtime.ReferableByReferenceId)
-	if !ok {
-		return nil, errors.Errorf("io is not a referable by reference id")
+	res := &runmv1.RuncCreateOptions{}
+
+	if opts.IO != nil {
+		ioz, ok := opts.IO.(runtime.ReferableByReferenceId)
+		if !ok {
+			return nil, errors.Errorf("io is not a referable by reference id")
+		}
+		res.SetIoReferenceId(ioz.GetReferenceId())
 	}
 
-	csz, ok := opts.ConsoleSocket.(runtime.ReferableByReferenceId)
-	if !ok {
-		return nil, errors.Errorf("console socket is not a referable by reference id")
+	if opts.ConsoleSocket != nil {
+		csz, ok := opts.ConsoleSocket.(runtime.ReferableByReferenceId)
+		if !ok {
+			return nil, errors.Errorf("console socket is not a referable by reference id")
+		}
+		res.SetConsoleReferenceId(csz.GetReferenceId())
 	}
 
 	// for now panic if we see extra files, we shouldnt see any but they are not hanlded
@@ -98,12 +113,9 @@ func ConvertCreateOptsToProto(ctx context.Context, opts *gorunc.CreateOpts) (*ru
 		files[i] = file.Name()
 	}
 
-	res := &runmv1.RuncCreateOptions{}
-	res.SetIoReferenceId(ioz.GetReferenceId())
 	res.SetPidFile(opts.PidFile)
 	res.SetNoPivot(opts.NoPivot)
 	res.SetNoNewKeyring(opts.NoNewKeyring)
-	res.SetConsoleReferenceId(csz.GetReferenceId())
 	res.SetDetach(opts.Detach)
 	res.SetExtraFiles(files)
 
@@ -0,0 +1,137 @@
+package exits
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/walteh/runm/core/runc/runtime"
+	"gitlab.com/tozd/go/errors"
+)
+
+// ProcessExitEventTopic is the runtime.EventHandler topic the guest publishes
+// process exits on.
+const ProcessExitEventTopic = "/runm/process/exit"
+
+// ProcessExit is a single process exit observed by the guest.
+//
+// Epoch identifies the guest agent instance that produced the event and Seq is
+// strictly increasing within an epoch, which lets a consumer that reconnects (and
+// is replayed the recent history) drop exits it has already handled.
+type ProcessExit struct {
+	Epoch       int64     `json:"epoch"`
+	Seq         uint64    `json:"seq"`
+	ContainerID string    `json:"container_id"`
+	ExecID      string    `json:"exec_id,omitempty"`
+	Pid         int       `json:"pid"`
+	Status      int       `json:"status"`
+	ExitedAt    time.Time `json:"exited_at"`
+}
+
+// ProcessID is the containerd process id: the exec id, or the container id for
+// the init process.
+func (e *ProcessExit) ProcessID() string {
+	if e.ExecID != "" {
+		return e.ExecID
+	}
+	return e.ContainerID
+}
+
+func (e *ProcessExit) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int64("epoch", e.Epoch),
+		slog.Uint64("seq", e.Seq),
+		slog.String("container_id", e.ContainerID),
+		slog.String("exec_id", e.ExecID),
+		slog.Int("pid", e.Pid),
+		slog.Int("status", e.Status),
+		slog.Time("exited_at", e.ExitedAt),
+	)
+}
+
+const initPidFile = "init.pid"
+
+// ExecIDFromPidFile recovers the exec id from the pid file the shim asks runc to
+// write: "<bundle>/init.pid" for the init process and "<bundle>/<exec-id>.pid"
+// for execs.
+func ExecIDFromPidFile(path string) string {
+	base := filepath.Base(path)
+	if base == initPidFile || !strings.HasSuffix(base, ".pid") {
+		return ""
+	}
+	return strings.TrimSuffix(base, ".pid")
+}
+
+// RetryInterval is how long Stream waits before resubscribing after the guest
+// event stream ends.
+var RetryInterval = 250 * time.Millisecond
+
+// Stream delivers every process exit published through handler exactly once and in
+// order. When the underlying stream breaks it resubscribes, and the exits replayed
+// by the guest are deduplicated by (epoch, seq). The returned channel is closed when
+// ctx is done.
+func Stream(ctx context.Context, handler runtime.EventHandler) <-chan *ProcessExit {
+	out := make(chan *ProcessExit)
+
+	go func() {
+		defer close(out)
+
+		var (
+			epoch   int64
+			lastSeq uint64
+		)
+
+		for ctx.Err() == nil {
+			events, err := handler.Receive(ctx)
+			if err != nil {
+				slog.WarnContext(ctx, "failed to subscribe to guest exit events, retrying", "error", err)
+			} else {
+				for ev := range events {
+					if ev.Topic != ProcessExitEventTopic {
+						continue
+					}
+
+					exit, err := decode(ev)
+					if err != nil {
+						slog.ErrorContext(ctx, "dropping malformed guest exit event", "error", err)
+						continue
+					}
+
+					if exit.Epoch != epoch {
+						// the guest agent restarted, its sequence starts over
+						epoch, lastSeq = exit.Epoch, 0
+					}
+					if exit.Seq <= lastSeq {
+						continue
+					}
+					lastSeq = exit.Seq
+
+					select {
+					case out <- exit:
+					case <-ctx.Done():
+						return
+					}
+				}
+				slog.InfoContext(ctx, "guest exit event stream ended, resubscribing")
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(RetryInterval):
+			}
+		}
+	}()
+
+	return out
+}
+
+func decode(ev *runtime.PublishEvent) (*ProcessExit, error) {
+	exit := &ProcessExit{}
+	if err := json.Unmarshal(ev.Data, exit); err != nil {
+		return nil, errors.Errorf("unmarshalling process exit: %w", err)
+	}
+	return exit, nil
+}
@@ -0,0 +1,102 @@
+package exits_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/runc/exits"
+	"github.com/walteh/runm/core/runc/runtime"
+	goruncruntime "github.com/walteh/runm/core/runc/runtime/gorunc"
+)
+
+// flakyHandler ends the first `breaks` subscriptions after `breakAfter` events, the
+// way a broken vsock connection ends the grpc stream.
+type flakyHandler struct {
+	runtime.EventHandler
+	breaks     int
+	breakAfter int
+}
+
+func (h *flakyHandler) Receive(ctx context.Context) (<-chan *runtime.PublishEvent, error) {
+	if h.breaks == 0 {
+		return h.EventHandler.Receive(ctx)
+	}
+	h.breaks--
+
+	subCtx, cancel := context.WithCancel(ctx)
+	in, err := h.EventHandler.Receive(subCtx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	out := make(chan *runtime.PublishEvent)
+	go func() {
+		defer cancel()
+		defer close(out)
+		for i := 0; i < h.breakAfter; i++ {
+			ev, ok := <-in
+			if !ok {
+				return
+			}
+			out <- ev
+		}
+	}()
+	return out, nil
+}
+
+func publish(t *testing.T, h runtime.EventHandler, exit *exits.ProcessExit) {
+	t.Helper()
+	data, err := json.Marshal(exit)
+	require.NoError(t, err)
+	require.NoError(t, h.Publish(t.Context(), &runtime.PublishEvent{Topic: exits.ProcessExitEventTopic, Data: data}))
+}
+
+func TestStreamDeliversEachExitOnceAcrossReconnects(t *testing.T) {
+	exits.RetryInterval = time.Millisecond
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	guest := goruncruntime.NewGoRuncEventHandler()
+	require.NoError(t, guest.Publish(ctx, &runtime.PublishEvent{Topic: "/something/else", Data: []byte(`{}`)}))
+
+	for i := 1; i <= 5; i++ {
+		publish(t, guest, &exits.ProcessExit{Epoch: 1, Seq: uint64(i), ContainerID: "ctr", ExecID: "exec", Pid: 100 + i, Status: i})
+	}
+
+	stream := exits.Stream(ctx, &flakyHandler{EventHandler: guest, breaks: 2, breakAfter: 3})
+
+	var got []int
+	for len(got) < 5 {
+		select {
+		case e := <-stream:
+			got = append(got, e.Pid)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out, got %v", got)
+		}
+	}
+	assert.Equal(t, []int{101, 102, 103, 104, 105}, got)
+
+	// a restarted guest agent starts a new epoch with its own sequence
+	publish(t, guest, &exits.ProcessExit{Epoch: 2, Seq: 1, ContainerID: "ctr", Pid: 200})
+
+	select {
+	case e := <-stream:
+		assert.Equal(t, 200, e.Pid)
+		assert.Equal(t, "ctr", e.ProcessID())
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for exit from new epoch")
+	}
+}
+
+func TestExecIDFromPidFile(t *testing.T) {
+	assert.Equal(t, "", exits.ExecIDFromPidFile("/run/bundle/init.pid"))
+	assert.Equal(t, "exec-1", exits.ExecIDFromPidFile("/run/bundle/exec-1.pid"))
+	assert.Equal(t, "", exits.ExecIDFromPidFile("/run/bundle/pidfile"))
+}
@@ -0,0 +1,85 @@
+//go:build linux
+
+package exits
+
+import (
+	"golang.org/x/sys/unix"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// unknownExitStatus is reported when the process was reaped by someone else and its
+// status is lost, matching what containerd reports for processes it cannot wait on.
+const unknownExitStatus = 255
+
+type pidWatcher struct {
+	pid   int
+	pidfd int
+}
+
+// watchPid pins pid with a pidfd. As long as the pidfd is open and we have not
+// reaped the process, the pid cannot be reused, so the exit we report is
+// guaranteed to belong to the process that was tracked.
+func watchPid(pid int) (*pidWatcher, error) {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		return nil, errors.Errorf("pidfd_open: %w", err)
+	}
+	return &pidWatcher{pid: pid, pidfd: fd}, nil
+}
+
+// wait blocks until the process exits and reaps it. The guest agent must be the
+// process's parent or a child subreaper for the status to be available.
+func (w *pidWatcher) wait() (int, error) {
+	defer unix.Close(w.pidfd)
+
+	fds := []unix.PollFd{{Fd: int32(w.pidfd), Events: unix.POLLIN}}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return unknownExitStatus, errors.Errorf("polling pidfd: %w", err)
+		}
+		break
+	}
+
+	// the pidfd can turn readable a moment before the process is a zombie, wait4 then
+	// finds nothing to reap and the status it leaves would read as an exit with 0
+	var ws unix.WaitStatus
+	options := unix.WNOHANG
+	for {
+		pid, err := unix.Wait4(w.pid, &ws, options, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return unknownExitStatus, errors.Errorf("wait4: %w", err)
+		}
+		if pid == 0 {
+			options = 0
+			continue
+		}
+		break
+	}
+
+	switch {
+	case ws.Exited():
+		return ws.ExitStatus(), nil
+	case ws.Signaled():
+		return 128 + int(ws.Signal()), nil
+	default:
+		return unknownExitStatus, errors.Errorf("unexpected wait status %#x", uint32(ws))
+	}
+}
+
+// BecomeSubreaper makes the calling process the reaper for orphaned descendants,
+// so container processes started by a detached runc are reparented to it and their
+// exit status can be collected by the Tracker.
+func BecomeSubreaper() error {
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		return errors.Errorf("setting child subreaper: %w", err)
+	}
+	return nil
+}
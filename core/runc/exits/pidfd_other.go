@@ -0,0 +1,21 @@
+//go:build !linux
+
+package exits
+
+import (
+	"gitlab.com/tozd/go/errors"
+)
+
+type pidWatcher struct{}
+
+func watchPid(pid int) (*pidWatcher, error) {
+	return nil, errors.Errorf("not implemented")
+}
+
+func (w *pidWatcher) wait() (int, error) {
+	return 0, errors.Errorf("not implemented")
+}
+
+func BecomeSubreaper() error {
+	return errors.Errorf("not implemented")
+}
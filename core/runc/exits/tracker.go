@@ -0,0 +1,83 @@
+package exits
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/walteh/runm/core/runc/runtime"
+	"gitlab.com/tozd/go/errors"
+)
+
+// Tracker watches container processes in the guest and publishes a ProcessExit
+// for each one on the event handler.
+type Tracker struct {
+	publisher runtime.EventHandler
+	epoch     int64
+	seq       atomic.Uint64
+
+	// publishMu keeps sequence numbers in publish order
+	publishMu sync.Mutex
+}
+
+func NewTracker(publisher runtime.EventHandler) *Tracker {
+	return &Tracker{
+		publisher: publisher,
+		epoch:     time.Now().UnixNano(),
+	}
+}
+
+// Track starts watching pid and publishes its exit. It returns once the process is
+// being watched; the exit is reported asynchronously.
+func (t *Tracker) Track(ctx context.Context, containerID, execID string, pid int) error {
+	w, err := watchPid(pid)
+	if err != nil {
+		return errors.Errorf("watching pid %d: %w", pid, err)
+	}
+
+	ctx = context.WithoutCancel(ctx)
+
+	go func() {
+		status, err := w.wait()
+		exitedAt := time.Now()
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to get process exit status", "pid", pid, "container_id", containerID, "exec_id", execID, "error", err)
+		}
+
+		if err := t.publish(ctx, containerID, execID, pid, status, exitedAt); err != nil {
+			slog.ErrorContext(ctx, "failed to publish process exit", "pid", pid, "container_id", containerID, "exec_id", execID, "error", err)
+		}
+	}()
+
+	return nil
+}
+
+func (t *Tracker) publish(ctx context.Context, containerID, execID string, pid, status int, exitedAt time.Time) error {
+	t.publishMu.Lock()
+	defer t.publishMu.Unlock()
+
+	exit := &ProcessExit{
+		Epoch:       t.epoch,
+		Seq:         t.seq.Add(1),
+		ContainerID: containerID,
+		ExecID:      execID,
+		Pid:         pid,
+		Status:      status,
+		ExitedAt:    exitedAt,
+	}
+
+	data, err := json.Marshal(exit)
+	if err != nil {
+		return errors.Errorf("marshalling process exit: %w", err)
+	}
+
+	slog.InfoContext(ctx, "process exited", "exit", exit)
+
+	return t.publisher.Publish(ctx, &runtime.PublishEvent{
+		Topic: ProcessExitEventTopic,
+		Data:  data,
+	})
+}
@@ -0,0 +1,30 @@
+package oom
+
+import (
+	"time"
+
+	"github.com/containerd/typeurl/v2"
+)
+
+// TaskOOMDetailEventTopic is published right after the containerd TaskOOM event and
+// carries the memory state of the cgroup once the kill was seen, see OOMEvent.
+const TaskOOMDetailEventTopic = "/runm/tasks/oom-detail"
+
+func init() {
+	typeurl.Register(&OOMEvent{}, "github.com/walteh/runm/core/runc/oom", "OOMEvent")
+}
+
+// OOMEvent describes a single oom kill observed on a container's cgroup.
+//
+// MemoryEvents and MemoryStat are read when the watcher handles the notification,
+// not at the kill: the kernel has already freed the memory of the killed process by
+// then, so MemoryStat shows the cgroup after the kill, and further events may have
+// raised the counters of MemoryEvents. OOMKill is the count the notification carried.
+type OOMEvent struct {
+	ContainerID  string            `json:"container_id"`
+	CgroupPath   string            `json:"cgroup_path"`
+	OOMKill      uint64            `json:"oom_kill"`
+	MemoryEvents map[string]uint64 `json:"memory_events"`
+	MemoryStat   map[string]uint64 `json:"memory_stat"`
+	Timestamp    time.Time         `json:"timestamp"`
+}
@@ -3,22 +3,50 @@ package oom
 import (
 	"context"
 	"log/slog"
+	"time"
 
 	"github.com/containerd/containerd/v2/core/events"
 	"github.com/walteh/run"
 	"github.com/walteh/runm/core/runc/runtime"
+	"github.com/walteh/runm/pkg/metrics"
 	"gitlab.com/tozd/go/errors"
 
 	eventstypes "github.com/containerd/containerd/api/events"
 	coreruntime "github.com/containerd/containerd/v2/core/runtime"
 )
 
+// DefaultQueueSize bounds the number of oom events waiting to be published. When the
+// queue is full the watcher stops reading cgroup events until the publisher catches up,
+// so events are never dropped or reordered.
+const DefaultQueueSize = 16
+
 var _ run.Runnable = (*Watcher)(nil)
 
 type Watcher struct {
 	alive         bool
+	containerID   string
+	cgroupPath    string
+	queueSize     int
 	publisher     events.Publisher
 	cgroupAdapter runtime.CgroupAdapter
+	snapshotter   Snapshotter
+}
+
+type WatcherOpt func(*Watcher)
+
+// WithSnapshotter overrides how the memory state is captured when an oom kill is seen.
+func WithSnapshotter(s Snapshotter) WatcherOpt {
+	return func(w *Watcher) {
+		w.snapshotter = s
+	}
+}
+
+func WithQueueSize(n int) WatcherOpt {
+	return func(w *Watcher) {
+		if n > 0 {
+			w.queueSize = n
+		}
+	}
 }
 
 // Alive implements run.Runnable.
@@ -28,7 +56,10 @@ func (w *Watcher) Alive() bool {
 
 // Fields implements run.Runnable.
 func (w *Watcher) Fields() []slog.Attr {
-	return []slog.Attr{}
+	return []slog.Attr{
+		slog.String("container_id", w.containerID),
+		slog.String("cgroup_path", w.cgroupPath),
+	}
 }
 
 // Name implements run.Runnable.
@@ -36,17 +67,21 @@ func (w *Watcher) Name() string {
 	return "oom-watcher"
 }
 
-type item struct {
-	id  string
-	ev  runtime.CgroupEvent
-	err error
-}
-
-func NewWatcher(publisher events.Publisher, cgroupAdapter runtime.CgroupAdapter) *Watcher {
-	return &Watcher{
+func NewWatcher(containerID, cgroupPath string, publisher events.Publisher, cgroupAdapter runtime.CgroupAdapter, opts ...WatcherOpt) *Watcher {
+	w := &Watcher{
+		containerID:   containerID,
+		cgroupPath:    cgroupPath,
+		queueSize:     DefaultQueueSize,
 		publisher:     publisher,
 		cgroupAdapter: cgroupAdapter,
 	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.snapshotter == nil {
+		w.snapshotter = NewCgroupAdapterSnapshotter(cgroupAdapter)
+	}
+	return w
 }
 
 func (w *Watcher) Close(ctx context.Context) error {
@@ -64,55 +99,104 @@ func (w *Watcher) Run(ctx context.Context) error {
 		return errors.Errorf("failed to open event channel: %w", err)
 	}
 
-	lastOOMMap := make(map[string]uint64) // key: id, value: ev.OOM
-	itemCh := make(chan item)
-
-	defer func() {
-		close(itemCh)
-	}()
+	queue := make(chan *OOMEvent, w.queueSize)
+	publishErr := make(chan error, 1)
 
 	go func() {
-		for {
-			i := item{id: "root"}
-			select {
-			case ev := <-eventCh:
-				i.ev = ev
-				itemCh <- i
-			case err := <-errCh:
-				// channel is closed when cgroup gets deleted
-				if err != nil {
-					i.err = err
-					itemCh <- i
-					// we no longer get any event/err when we got an err
-					slog.Error("error from *cgroupsv2.Manager.EventChan", "error", err)
-				}
+		defer close(publishErr)
+		for ev := range queue {
+			if err := w.publish(ctx, ev); err != nil {
+				publishErr <- err
 				return
 			}
 		}
 	}()
 
+	defer close(queue)
+
+	var lastOOMKill uint64
+
 	for {
 		select {
 		case <-ctx.Done():
-			close(itemCh)
 			return ctx.Err()
-		case i := <-itemCh:
-			if i.err != nil {
-				delete(lastOOMMap, i.id)
-				continue
+		case err := <-publishErr:
+			return err
+		case err, ok := <-errCh:
+			// channel is closed when cgroup gets deleted
+			if !ok || err == nil {
+				return nil
 			}
-			lastOOM := lastOOMMap[i.id]
-			if i.ev.OOMKill > lastOOM {
-				if err := w.publisher.Publish(ctx, coreruntime.TaskOOMEventTopic, &eventstypes.TaskOOM{
-					ContainerID: i.id,
-				}); err != nil {
-					return errors.Errorf("failed to publish OOM event: %w", err)
-				}
+			return errors.Errorf("cgroup event channel: %w", err)
+		case ev, ok := <-eventCh:
+			if !ok {
+				return nil
 			}
-			if i.ev.OOMKill > 0 {
-				lastOOMMap[i.id] = i.ev.OOMKill
+			if ev.OOMKill <= lastOOMKill {
+				continue
+			}
+			lastOOMKill = ev.OOMKill
+
+			oomEvent := w.buildEvent(ctx, ev)
+
+			select {
+			case queue <- oomEvent:
+			case err := <-publishErr:
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 		}
 	}
+}
 
+func (w *Watcher) buildEvent(ctx context.Context, ev runtime.CgroupEvent) *OOMEvent {
+	oomEvent := &OOMEvent{
+		ContainerID: w.containerID,
+		CgroupPath:  w.cgroupPath,
+		OOMKill:     ev.OOMKill,
+		Timestamp:   time.Now(),
+	}
+
+	// the notification only carries the counters, the rest is read now, after the kill
+	snap, err := w.snapshotter.Snapshot(ctx, w.cgroupPath)
+	if err != nil {
+		// the kill already happened, so report it even without the detail
+		slog.WarnContext(ctx, "failed to snapshot cgroup memory state after oom kill", "error", err, "container_id", w.containerID)
+		oomEvent.MemoryEvents = map[string]uint64{
+			"low":      ev.Low,
+			"high":     ev.High,
+			"max":      ev.Max,
+			"oom":      ev.OOM,
+			"oom_kill": ev.OOMKill,
+		}
+		return oomEvent
+	}
+
+	oomEvent.MemoryEvents = snap.MemoryEvents
+	oomEvent.MemoryStat = snap.MemoryStat
+	return oomEvent
+}
+
+func (w *Watcher) publish(ctx context.Context, ev *OOMEvent) error {
+	metrics.OOMKills.WithLabelValues(ev.ContainerID).Inc()
+
+	slog.WarnContext(ctx, "container oom killed",
+		"container_id", ev.ContainerID,
+		"cgroup_path", ev.CgroupPath,
+		"oom_kill", ev.OOMKill,
+		"memory_events", ev.MemoryEvents,
+	)
+
+	if err := w.publisher.Publish(ctx, coreruntime.TaskOOMEventTopic, &eventstypes.TaskOOM{
+		ContainerID: ev.ContainerID,
+	}); err != nil {
+		return errors.Errorf("failed to publish OOM event: %w", err)
+	}
+
+	if err := w.publisher.Publish(ctx, TaskOOMDetailEventTopic, ev); err != nil {
+		return errors.Errorf("failed to publish OOM detail event: %w", err)
+	}
+
+	return nil
 }
@@ -0,0 +1,209 @@
+package oom_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/cgroups/v3/cgroup2/stats"
+	"github.com/containerd/containerd/v2/core/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	coreruntime "github.com/containerd/containerd/v2/core/runtime"
+
+	"github.com/walteh/runm/core/runc/oom"
+	"github.com/walteh/runm/core/runc/runtime"
+)
+
+type published struct {
+	topic string
+	event events.Event
+}
+
+type recordingPublisher struct {
+	mu     sync.Mutex
+	events []published
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, topic string, event events.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, published{topic: topic, event: event})
+	return nil
+}
+
+func (p *recordingPublisher) snapshot() []published {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]published(nil), p.events...)
+}
+
+// fakeCgroup is a cgroup2 directory on disk whose memory.events changes are
+// forwarded as runtime.CgroupEvents, the way the kernel notifies on inotify.
+type fakeCgroup struct {
+	root   string
+	path   string
+	events chan runtime.CgroupEvent
+	errs   chan error
+	kills  uint64
+}
+
+func newFakeCgroup(t *testing.T, path string) *fakeCgroup {
+	t.Helper()
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, path), 0o755))
+	cg := &fakeCgroup{
+		root:   root,
+		path:   path,
+		events: make(chan runtime.CgroupEvent, runtime.CgroupEventBufferSize),
+		errs:   make(chan error, 1),
+	}
+	cg.write(t)
+	return cg
+}
+
+func (cg *fakeCgroup) write(t *testing.T) {
+	t.Helper()
+	dir := filepath.Join(cg.root, cg.path)
+	memEvents := fmt.Sprintf("low 0\nhigh 0\nmax %d\noom %d\noom_kill %d\n", cg.kills*3, cg.kills, cg.kills)
+	memStat := fmt.Sprintf("anon %d\nfile 4096\nkernel_stack 16384\noom_kill_marker %d\n", 67108864-cg.kills, cg.kills)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "memory.events"), []byte(memEvents), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "memory.stat"), []byte(memStat), 0o644))
+}
+
+func (cg *fakeCgroup) triggerOOM(t *testing.T) {
+	t.Helper()
+	cg.kills++
+	cg.write(t)
+
+	vals, err := oom.ReadFlatKeyedFile(filepath.Join(cg.root, cg.path, "memory.events"))
+	require.NoError(t, err)
+	cg.events <- runtime.CgroupEvent{
+		Low:     vals["low"],
+		High:    vals["high"],
+		Max:     vals["max"],
+		OOM:     vals["oom"],
+		OOMKill: vals["oom_kill"],
+	}
+}
+
+func (cg *fakeCgroup) OpenEventChan(ctx context.Context) (<-chan runtime.CgroupEvent, <-chan error, error) {
+	return cg.events, cg.errs, nil
+}
+
+func (cg *fakeCgroup) Stat(ctx context.Context) (*stats.Metrics, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (cg *fakeCgroup) ToggleControllers(ctx context.Context) error {
+	return nil
+}
+
+func TestWatcherPublishesContainerOOMWithDetail(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	cg := newFakeCgroup(t, "/runm/abc123")
+	pub := &recordingPublisher{}
+
+	w := oom.NewWatcher("abc123", cg.path, pub, cg, oom.WithSnapshotter(oom.NewCgroupFSSnapshotter(cg.root)))
+
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+
+	// the detail is read from the cgroup when the event is handled, so each kill
+	// is published before the next one rewrites memory.events and memory.stat
+	for i := range 3 {
+		cg.triggerOOM(t)
+		require.Eventually(t, func() bool { return len(pub.snapshot()) == (i+1)*2 }, 5*time.Second, 10*time.Millisecond)
+	}
+
+	got := pub.snapshot()
+	require.Len(t, got, 6)
+	for i := range 3 {
+		oomEv, detailEv := got[i*2], got[i*2+1]
+
+		assert.Equal(t, coreruntime.TaskOOMEventTopic, oomEv.topic)
+		assert.Equal(t, &eventstypes.TaskOOM{ContainerID: "abc123"}, oomEv.event)
+
+		assert.Equal(t, oom.TaskOOMDetailEventTopic, detailEv.topic)
+		detail, ok := detailEv.event.(*oom.OOMEvent)
+		require.True(t, ok, "unexpected detail type %T", detailEv.event)
+		assert.Equal(t, "abc123", detail.ContainerID)
+		assert.Equal(t, "/runm/abc123", detail.CgroupPath)
+		assert.Equal(t, uint64(i+1), detail.OOMKill, "events must be delivered in order")
+		assert.Equal(t, uint64(i+1), detail.MemoryEvents["oom_kill"])
+		assert.Equal(t, uint64(i+1), detail.MemoryStat["oom_kill_marker"])
+		assert.Equal(t, uint64(4096), detail.MemoryStat["file"])
+	}
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestWatcherIgnoresEventsWithoutNewKills(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	cg := newFakeCgroup(t, "/")
+	pub := &recordingPublisher{}
+
+	w := oom.NewWatcher("abc123", cg.path, pub, cg, oom.WithSnapshotter(oom.NewCgroupFSSnapshotter(cg.root)))
+
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+
+	// memory.high pressure without a kill
+	cg.events <- runtime.CgroupEvent{High: 4}
+	cg.triggerOOM(t)
+	// a repeated notification for the same kill
+	cg.events <- runtime.CgroupEvent{OOM: 1, OOMKill: 1}
+
+	require.Eventually(t, func() bool { return len(pub.snapshot()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// the cgroup going away closes the error channel and stops the watcher
+	close(cg.errs)
+	require.NoError(t, <-done)
+	assert.Len(t, pub.snapshot(), 2)
+}
+
+// pathAdapter serves the stats of every cgroup below its own.
+type pathAdapter struct {
+	fakeCgroup
+	paths []string
+}
+
+func (a *pathAdapter) Stat(ctx context.Context) (*stats.Metrics, error) {
+	return &stats.Metrics{Memory: &stats.MemoryStat{Anon: 1}}, nil
+}
+
+func (a *pathAdapter) StatPath(ctx context.Context, cgroupPath string) (*stats.Metrics, error) {
+	a.paths = append(a.paths, cgroupPath)
+	return &stats.Metrics{
+		Memory:       &stats.MemoryStat{Anon: 2},
+		MemoryEvents: &stats.MemoryEvents{OomKill: 1},
+	}, nil
+}
+
+func TestCgroupAdapterSnapshotterReadsEventCgroup(t *testing.T) {
+	adapter := &pathAdapter{}
+	s := oom.NewCgroupAdapterSnapshotter(adapter)
+
+	snap, err := s.Snapshot(t.Context(), "/default/abc123")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/default/abc123"}, adapter.paths)
+	assert.Equal(t, uint64(2), snap.MemoryStat["anon"])
+	assert.Equal(t, uint64(1), snap.MemoryEvents["oom_kill"])
+
+	// without a path it is the cgroup of the adapter
+	snap, err = s.Snapshot(t.Context(), "")
+	require.NoError(t, err)
+	assert.Len(t, adapter.paths, 1)
+	assert.Equal(t, uint64(1), snap.MemoryStat["anon"])
+}
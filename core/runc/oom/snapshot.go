@@ -0,0 +1,135 @@
+package oom
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/cgroups/v3/cgroup2/stats"
+	"github.com/walteh/runm/core/runc/runtime"
+	"gitlab.com/tozd/go/errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	memoryEventsFile = "memory.events"
+	memoryStatFile   = "memory.stat"
+)
+
+// Snapshot is the memory state of a cgroup at a point in time.
+type Snapshot struct {
+	MemoryEvents map[string]uint64
+	MemoryStat   map[string]uint64
+}
+
+// Snapshotter captures the memory state of the cgroup at cgroupPath.
+type Snapshotter interface {
+	Snapshot(ctx context.Context, cgroupPath string) (*Snapshot, error)
+}
+
+var _ Snapshotter = (*CgroupFSSnapshotter)(nil)
+
+// CgroupFSSnapshotter reads memory.events and memory.stat directly from a cgroup2
+// filesystem mounted at Root.
+type CgroupFSSnapshotter struct {
+	Root string
+}
+
+func NewCgroupFSSnapshotter(root string) *CgroupFSSnapshotter {
+	return &CgroupFSSnapshotter{Root: root}
+}
+
+func (me *CgroupFSSnapshotter) Snapshot(ctx context.Context, cgroupPath string) (*Snapshot, error) {
+	dir := filepath.Join(me.Root, cgroupPath)
+
+	events, err := ReadFlatKeyedFile(filepath.Join(dir, memoryEventsFile))
+	if err != nil {
+		return nil, errors.Errorf("reading %s: %w", memoryEventsFile, err)
+	}
+
+	stat, err := ReadFlatKeyedFile(filepath.Join(dir, memoryStatFile))
+	if err != nil {
+		return nil, errors.Errorf("reading %s: %w", memoryStatFile, err)
+	}
+
+	return &Snapshot{MemoryEvents: events, MemoryStat: stat}, nil
+}
+
+var _ Snapshotter = (*CgroupAdapterSnapshotter)(nil)
+
+// CgroupAdapterSnapshotter builds a snapshot from the stats of a runtime.CgroupAdapter,
+// the only view the host has of the guest cgroups. It reads the cgroup at cgroupPath
+// when the adapter implements runtime.CgroupPathStatter, and the cgroup of the
+// adapter otherwise.
+type CgroupAdapterSnapshotter struct {
+	adapter runtime.CgroupAdapter
+}
+
+func NewCgroupAdapterSnapshotter(adapter runtime.CgroupAdapter) *CgroupAdapterSnapshotter {
+	return &CgroupAdapterSnapshotter{adapter: adapter}
+}
+
+func (me *CgroupAdapterSnapshotter) Snapshot(ctx context.Context, cgroupPath string) (*Snapshot, error) {
+	var metrics *stats.Metrics
+	var err error
+	if ps, ok := me.adapter.(runtime.CgroupPathStatter); ok && cgroupPath != "" {
+		metrics, err = ps.StatPath(ctx, cgroupPath)
+	} else {
+		metrics, err = me.adapter.Stat(ctx)
+	}
+	if err != nil {
+		return nil, errors.Errorf("getting cgroup stats: %w", err)
+	}
+
+	return &Snapshot{
+		MemoryEvents: uint64Fields(metrics.GetMemoryEvents()),
+		MemoryStat:   uint64Fields(metrics.GetMemory()),
+	}, nil
+}
+
+// uint64Fields flattens the populated uint64 fields of a cgroup stats message. The
+// field names of MemoryEvents and MemoryStat match the memory.events and memory.stat keys.
+func uint64Fields(msg proto.Message) map[string]uint64 {
+	out := make(map[string]uint64)
+	if msg == nil || !msg.ProtoReflect().IsValid() {
+		return out
+	}
+	msg.ProtoReflect().Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Kind() == protoreflect.Uint64Kind && !fd.IsList() {
+			out[string(fd.Name())] = v.Uint()
+		}
+		return true
+	})
+	return out
+}
+
+// ReadFlatKeyedFile parses a cgroup2 flat keyed file ("key value" per line).
+func ReadFlatKeyedFile(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("parsing %q in %s: %w", fields[0], path, err)
+		}
+		out[fields[0]] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,35 @@
+package runtime
+
+import (
+	"context"
+
+	"github.com/containerd/typeurl/v2"
+)
+
+func init() {
+	typeurl.Register(&VMCheckpointOptions{}, "github.com/walteh/runm/core/runc/runtime", "VMCheckpointOptions")
+}
+
+// VMCheckpointOptions are runm specific checkpoint options. Passing them as the
+// options of a checkpoint request saves the whole vm the container runs in (memory,
+// device state and working directory) instead of asking the guest to checkpoint the
+// container with criu.
+type VMCheckpointOptions struct {
+	// Exit stops the vm once the checkpoint is written.
+	Exit bool `json:"exit"`
+}
+
+// VMCheckpointer is implemented by runtimes that can save the vm the container runs
+// in into a checkpoint image directory.
+type VMCheckpointer interface {
+	CheckpointVM(ctx context.Context, imagePath string, initPid int, exit bool) error
+}
+
+// VMRestoredRuntime is implemented by runtimes that can be created from a vm
+// checkpoint. A restored runtime comes up with the container already running inside
+// the vm but frozen, so it only has to be resumed when the task is started.
+type VMRestoredRuntime interface {
+	// RestoredInitPid returns the pid of the container init process recorded in the
+	// checkpoint, zero if the runtime was not restored from one.
+	RestoredInitPid() int
+}
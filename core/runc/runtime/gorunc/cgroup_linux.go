@@ -13,7 +13,10 @@ import (
 	"kraftkit.sh/log"
 )
 
-var _ runtime.CgroupAdapter = (*CgroupV2Adapter)(nil)
+var (
+	_ runtime.CgroupAdapter     = (*CgroupV2Adapter)(nil)
+	_ runtime.CgroupPathStatter = (*CgroupV2Adapter)(nil)
+)
 
 type CgroupV2Adapter struct {
 	cgroup *cgroup2.Manager
@@ -34,19 +37,22 @@ func NewCgroupV2Adapter(ctx context.Context) (*CgroupV2Adapter, error) {
 func (me *CgroupV2Adapter) OpenEventChan(ctx context.Context) (<-chan runtime.CgroupEvent, <-chan error, error) {
 	evch, errch := me.cgroup.EventChan()
 
-	evch2 := make(chan runtime.CgroupEvent)
+	evch2 := make(chan runtime.CgroupEvent, runtime.CgroupEventBufferSize)
 
 	go func() {
+		defer close(evch2)
 		for ev := range evch {
-			go func() {
-				evch2 <- runtime.CgroupEvent{
-					Low:     ev.Low,
-					High:    ev.High,
-					Max:     ev.Max,
-					OOM:     ev.OOM,
-					OOMKill: ev.OOMKill,
-				}
-			}()
+			select {
+			case evch2 <- runtime.CgroupEvent{
+				Low:     ev.Low,
+				High:    ev.High,
+				Max:     ev.Max,
+				OOM:     ev.OOM,
+				OOMKill: ev.OOMKill,
+			}:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -74,6 +80,15 @@ func (a *CgroupV2Adapter) Stat(ctx context.Context) (*stats.Metrics, error) {
 	return a.cgroup.Stat()
 }
 
+// StatPath implements runtime.CgroupPathStatter.
+func (a *CgroupV2Adapter) StatPath(ctx context.Context, cgroupPath string) (*stats.Metrics, error) {
+	cg, err := cgroup2.Load(cgroupPath)
+	if err != nil {
+		return nil, errors.Errorf("loading cgroup %s: %w", cgroupPath, err)
+	}
+	return cg.Stat()
+}
+
 type item struct {
 	id  string
 	ev  cgroup2.Event
@@ -10,7 +10,10 @@ import (
 	"gitlab.com/tozd/go/errors"
 )
 
-var _ runtime.CgroupAdapter = (*CgroupV2Adapter)(nil)
+var (
+	_ runtime.CgroupAdapter     = (*CgroupV2Adapter)(nil)
+	_ runtime.CgroupPathStatter = (*CgroupV2Adapter)(nil)
+)
 
 type CgroupV2Adapter struct {
 }
@@ -31,3 +34,7 @@ func (me *CgroupV2Adapter) ToggleControllers(ctx context.Context) error {
 func (a *CgroupV2Adapter) Stat(ctx context.Context) (*stats.Metrics, error) {
 	return nil, errors.Errorf("not implemented")
 }
+
+func (a *CgroupV2Adapter) StatPath(ctx context.Context, cgroupPath string) (*stats.Metrics, error) {
+	return nil, errors.Errorf("not implemented")
+}
@@ -2,33 +2,122 @@ package goruncruntime
 
 import (
 	"context"
+	"sync"
 
 	"github.com/walteh/runm/core/runc/runtime"
 )
 
 var _ runtime.EventHandler = (*GoRuncEventHandler)(nil)
 
+// DefaultEventHistorySize is how many published events are kept and replayed to
+// every new subscriber, so a host that reconnects does not miss what was published
+// while it was away.
+const DefaultEventHistorySize = 1024
+
+// GoRuncEventHandler is an in-memory event bus for the guest. Publish never blocks
+// on slow subscribers; each subscriber has its own unbounded queue that is drained
+// in publish order.
 type GoRuncEventHandler struct {
+	mu          sync.Mutex
+	history     []*runtime.PublishEvent
+	historySize int
+	subscribers map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []*runtime.PublishEvent
+	closed bool
 }
 
 func NewGoRuncEventHandler() runtime.EventHandler {
-	return &GoRuncEventHandler{}
+	return &GoRuncEventHandler{
+		historySize: DefaultEventHistorySize,
+		subscribers: make(map[*subscriber]struct{}),
+	}
 }
 
 // Publish implements runtime.EventHandler.
 func (r *GoRuncEventHandler) Publish(ctx context.Context, event *runtime.PublishEvent) error {
-	// No-op implementation for now
-	// In a real implementation, this would publish the event to some event bus
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.history = append(r.history, event)
+	if len(r.history) > r.historySize {
+		r.history = r.history[len(r.history)-r.historySize:]
+	}
+
+	for sub := range r.subscribers {
+		sub.push(event)
+	}
+
 	return nil
 }
 
-// Receive implements runtime.EventHandler.
+// Receive implements runtime.EventHandler. The returned channel first replays the
+// retained history and then delivers new events until ctx is done.
 func (r *GoRuncEventHandler) Receive(ctx context.Context) (<-chan *runtime.PublishEvent, error) {
+	sub := &subscriber{}
+	sub.cond = sync.NewCond(&sub.mu)
+
+	r.mu.Lock()
+	sub.queue = append(sub.queue, r.history...)
+	r.subscribers[sub] = struct{}{}
+	r.mu.Unlock()
+
 	ch := make(chan *runtime.PublishEvent)
+
 	go func() {
 		<-ctx.Done()
-		close(ch)
+		r.mu.Lock()
+		delete(r.subscribers, sub)
+		r.mu.Unlock()
+		sub.close()
+	}()
+
+	go func() {
+		defer close(ch)
+		for {
+			ev, ok := sub.pop()
+			if !ok {
+				return
+			}
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
 	}()
 
 	return ch, nil
 }
+
+func (s *subscriber) push(ev *runtime.PublishEvent) {
+	s.mu.Lock()
+	s.queue = append(s.queue, ev)
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+func (s *subscriber) pop() (*runtime.PublishEvent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return nil, false
+	}
+	ev := s.queue[0]
+	s.queue = s.queue[1:]
+	return ev, true
+}
+
+func (s *subscriber) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
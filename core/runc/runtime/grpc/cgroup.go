@@ -10,7 +10,10 @@ import (
 	"gitlab.com/tozd/go/errors"
 )
 
-var _ runtime.CgroupAdapter = (*GRPCClientRuntime)(nil)
+var (
+	_ runtime.CgroupAdapter     = (*GRPCClientRuntime)(nil)
+	_ runtime.CgroupPathStatter = (*GRPCClientRuntime)(nil)
+)
 
 // EventChan implements runtime.CgroupAdapter.
 func (me *GRPCClientRuntime) OpenEventChan(ctx context.Context) (<-chan runtime.CgroupEvent, <-chan error, error) {
@@ -20,16 +23,21 @@ func (me *GRPCClientRuntime) OpenEventChan(ctx context.Context) (<-chan runtime.
 		return nil, nil, errors.Errorf("failed to open event channel: %w", err)
 	}
 
-	errch := make(chan error)
-	rch := make(chan runtime.CgroupEvent)
+	errch := make(chan error, 1)
+	rch := make(chan runtime.CgroupEvent, runtime.CgroupEventBufferSize)
 
 	go func() {
 		for {
 			refId, err := stream.Recv()
 			if err != nil {
+				// the stream is done after the first error
 				errch <- err
-			} else {
-				rch <- conversion.ConvertCgroupEventFromProto(refId.GetEvent())
+				return
+			}
+			select {
+			case rch <- conversion.ConvertCgroupEventFromProto(refId.GetEvent()):
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
@@ -39,9 +47,18 @@ func (me *GRPCClientRuntime) OpenEventChan(ctx context.Context) (<-chan runtime.
 
 // Stat implements runtime.CgroupAdapter.
 func (me *GRPCClientRuntime) Stat(ctx context.Context) (*stats.Metrics, error) {
-	var stats *stats.Metrics
+	return me.StatPath(ctx, "")
+}
+
+// StatPath implements runtime.CgroupPathStatter, an empty path is the cgroup the
+// guest adapter was loaded for.
+func (me *GRPCClientRuntime) StatPath(ctx context.Context, cgroupPath string) (*stats.Metrics, error) {
+	stats := &stats.Metrics{}
+
+	req := &runmv1.GetCgroupStatsRequest{}
+	req.SetCgroupPath(cgroupPath)
 
-	res, err := me.guestCgroupAdapterService.GetCgroupStats(ctx, &runmv1.GetCgroupStatsRequest{})
+	res, err := me.guestCgroupAdapterService.GetCgroupStats(ctx, req)
 	if err != nil {
 		return nil, errors.Errorf("failed to get cgroup stats: %w", err)
 	}
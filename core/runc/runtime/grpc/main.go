@@ -7,6 +7,8 @@ import (
 
 	"github.com/walteh/runm/core/runc/runtime"
 	"github.com/walteh/runm/core/runc/state"
+	"github.com/walteh/runm/pkg/metrics"
+	"github.com/walteh/runm/pkg/tracing"
 
 	runmv1 "github.com/walteh/runm/proto/v1"
 )
@@ -42,7 +44,7 @@ type GRPCClientRuntime struct {
 // NewRuncClient creates a new client for the runc service.
 func NewGRPCClientRuntime(target string, opts ...grpc.DialOption) (*GRPCClientRuntime, error) {
 	if len(opts) == 0 {
-		opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials()), tracing.GRPCClientOption(), metrics.GRPCClientOption()}
 	}
 
 	conn, err := grpc.NewClient(target, opts...)
@@ -94,6 +96,11 @@ func (me *GRPCClientRuntime) EventPublisher() runmv1.EventServiceClient {
 	return me.eventService
 }
 
+// OpenResources implements metrics.OpenResources.
+func (me *GRPCClientRuntime) OpenResources() map[string]int {
+	return me.state.OpenResources()
+}
+
 // Close closes the client connection.
 func (c *GRPCClientRuntime) Close() error {
 	if c.conn != nil {
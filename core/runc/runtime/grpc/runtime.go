@@ -8,11 +8,13 @@ import (
 
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"gitlab.com/tozd/go/errors"
+	"go.opentelemetry.io/otel/attribute"
 
 	gorunc "github.com/containerd/go-runc"
 
 	"github.com/walteh/runm/core/runc/conversion"
 	"github.com/walteh/runm/core/runc/runtime"
+	"github.com/walteh/runm/pkg/tracing"
 
 	runmv1 "github.com/walteh/runm/proto/v1"
 )
@@ -249,7 +251,10 @@ func (c *GRPCClientRuntime) NewPipeIO(ctx context.Context, ioUID, ioGID int, opt
 }
 
 // Create creates a new container.
-func (c *GRPCClientRuntime) Create(ctx context.Context, id, bundle string, options *gorunc.CreateOpts) error {
+func (c *GRPCClientRuntime) Create(ctx context.Context, id, bundle string, options *gorunc.CreateOpts) (err error) {
+	ctx, span := tracing.Start(ctx, "guest.Create", attribute.String("container_id", id))
+	defer func() { tracing.End(span, err) }()
+
 	conv, err := conversion.ConvertCreateOptsToProto(ctx, options)
 	if err != nil {
 		return err
@@ -271,7 +276,10 @@ func (c *GRPCClientRuntime) Create(ctx context.Context, id, bundle string, optio
 }
 
 // Start starts an already created container.
-func (c *GRPCClientRuntime) Start(ctx context.Context, id string) error {
+func (c *GRPCClientRuntime) Start(ctx context.Context, id string) (err error) {
+	ctx, span := tracing.Start(ctx, "guest.Start", attribute.String("container_id", id))
+	defer func() { tracing.End(span, err) }()
+
 	req := &runmv1.RuncStartRequest{}
 	req.SetId(id)
 
@@ -286,7 +294,10 @@ func (c *GRPCClientRuntime) Start(ctx context.Context, id string) error {
 }
 
 // Delete deletes a container.
-func (c *GRPCClientRuntime) Delete(ctx context.Context, id string, opts *gorunc.DeleteOpts) error {
+func (c *GRPCClientRuntime) Delete(ctx context.Context, id string, opts *gorunc.DeleteOpts) (err error) {
+	ctx, span := tracing.Start(ctx, "guest.Delete", attribute.String("container_id", id))
+	defer func() { tracing.End(span, err) }()
+
 	req := &runmv1.RuncDeleteRequest{}
 	req.SetId(id)
 	req.SetOptions(conversion.ConvertDeleteOptsToProto(opts))
@@ -302,7 +313,10 @@ func (c *GRPCClientRuntime) Delete(ctx context.Context, id string, opts *gorunc.
 }
 
 // Kill sends the specified signal to the container.
-func (c *GRPCClientRuntime) Kill(ctx context.Context, id string, signal int, opts *gorunc.KillOpts) error {
+func (c *GRPCClientRuntime) Kill(ctx context.Context, id string, signal int, opts *gorunc.KillOpts) (err error) {
+	ctx, span := tracing.Start(ctx, "guest.Kill", attribute.String("container_id", id))
+	defer func() { tracing.End(span, err) }()
+
 	req := &runmv1.RuncKillRequest{}
 	req.SetId(id)
 	req.SetSignal(int32(signal))
@@ -368,7 +382,10 @@ func (c *GRPCClientRuntime) Ps(ctx context.Context, id string) ([]int, error) {
 }
 
 // Exec executes an additional process inside the container.
-func (c *GRPCClientRuntime) Exec(ctx context.Context, id string, spec specs.Process, options *gorunc.ExecOpts) error {
+func (c *GRPCClientRuntime) Exec(ctx context.Context, id string, spec specs.Process, options *gorunc.ExecOpts) (err error) {
+	ctx, span := tracing.Start(ctx, "guest.Exec", attribute.String("container_id", id))
+	defer func() { tracing.End(span, err) }()
+
 	req := &runmv1.RuncExecRequest{}
 	req.SetId(id)
 
@@ -36,11 +36,45 @@ type RuntimeCreator interface {
 	Features(ctx context.Context) (*features.Features, error)
 }
 
+// ReattachOptions describes a runtime created by a previous shim process.
+type ReattachOptions struct {
+	ContainerID string
+	Namespace   string
+	Publisher   events.Publisher
+	OciSpec     *oci.Spec
+	// StateDir is the value ReattachableRuntime.StateDir returned for the runtime.
+	StateDir string
+}
+
+// ReattachableRuntime is implemented by runtimes that outlive the shim process that
+// created them. StateDir holds what a RuntimeReattacher needs to reconnect.
+type ReattachableRuntime interface {
+	StateDir() string
+}
+
+// RuntimeReattacher is implemented by runtime creators that can reconnect to a
+// ReattachableRuntime after a shim restart.
+type RuntimeReattacher interface {
+	Reattach(ctx context.Context, opts *ReattachOptions) (Runtime, error)
+}
+
+// CacheCollector is implemented by runtime creators that leave files on the host
+// beyond the life of a container. The shim collects them when it starts and after
+// every container delete.
+type CacheCollector interface {
+	CollectCache(ctx context.Context) error
+}
+
 //go:mock
 type SocketAllocator interface {
 	AllocateSocket(ctx context.Context) (AllocatedSocket, error)
 }
 
+// CgroupEventBufferSize is the capacity of the channels returned by
+// CgroupAdapter.OpenEventChan. Producers block once it is full rather than
+// spawning a goroutine per event, which keeps delivery ordered and bounded.
+const CgroupEventBufferSize = 32
+
 type CgroupEvent struct {
 	Low     uint64
 	High    uint64
@@ -55,6 +89,12 @@ type CgroupAdapter interface {
 	OpenEventChan(ctx context.Context) (<-chan CgroupEvent, <-chan error, error)
 }
 
+// CgroupPathStatter is implemented by cgroup adapters that read the stats of any
+// cgroup, not only their own, for example the one of the container an event is for.
+type CgroupPathStatter interface {
+	StatPath(ctx context.Context, cgroupPath string) (*stats.Metrics, error)
+}
+
 type GuestManagement interface {
 	TimeSync(ctx context.Context, unixTimeNs uint64, timezone string) error
 	Readiness(ctx context.Context) error
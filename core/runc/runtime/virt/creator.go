@@ -3,10 +3,12 @@ package virt
 import (
 	"context"
 	"log/slog"
+	"time"
 
-	"github.com/containers/common/pkg/strongunits"
+	"github.com/docker/go-units"
 	"github.com/opencontainers/runtime-spec/specs-go/features"
 	"github.com/walteh/runm/core/runc/runtime"
+	"github.com/walteh/runm/core/runc/runtime/virt/vmoptions"
 	"github.com/walteh/runm/core/virt/vmm"
 	"gitlab.com/tozd/go/errors"
 )
@@ -15,13 +17,18 @@ func ptr[T any](v T) *T {
 	return &v
 }
 
-var _ runtime.RuntimeCreator = (*RunmVMRuntimeCreator[vmm.VirtualMachine])(nil)
+var (
+	_ runtime.RuntimeCreator    = (*RunmVMRuntimeCreator[vmm.VirtualMachine])(nil)
+	_ runtime.RuntimeReattacher = (*RunmVMRuntimeCreator[vmm.VirtualMachine])(nil)
+	_ runtime.CacheCollector    = (*RunmVMRuntimeCreator[vmm.VirtualMachine])(nil)
+	_ vmm.CacheGCRunner         = (*RunmVMRuntimeCreator[vmm.VirtualMachine])(nil)
+)
 
 type RunmVMRuntimeCreator[VM vmm.VirtualMachine] struct {
 	// publisher events.Publisher
-	hpv       vmm.Hypervisor[VM]
-	maxMemory strongunits.StorageUnits
-	vcpus     int
+	hpv    vmm.Hypervisor[VM]
+	opts   *vmoptions.Options
+	limits VMSizeLimits
 }
 
 // Features implements runtime.RuntimeCreator.
@@ -58,7 +65,7 @@ func (me *RunmVMRuntimeCreator[VM]) Create(ctx context.Context, opts *runtime.Ru
 		slog.ErrorContext(ctx, "context done before creating VM runtime")
 		return nil, ctx.Err()
 	}
-	vm, err := NewRunmVMRuntime(ctx, me.hpv, opts, me.maxMemory, me.vcpus)
+	vm, err := NewRunmVMRuntime(ctx, me.hpv, opts, me.limits, me.opts)
 	if err != nil {
 		return nil, errors.Errorf("failed to create VM: %w", err)
 	}
@@ -67,10 +74,107 @@ func (me *RunmVMRuntimeCreator[VM]) Create(ctx context.Context, opts *runtime.Ru
 	return vm, nil
 }
 
-func NewRunmVMRuntimeCreator[VM vmm.VirtualMachine](hpv vmm.Hypervisor[VM], maxMemory strongunits.StorageUnits, vcpus int) *RunmVMRuntimeCreator[VM] {
-	return &RunmVMRuntimeCreator[VM]{
-		hpv:       hpv,
-		maxMemory: maxMemory,
-		vcpus:     vcpus,
+// Reattach implements runtime.RuntimeReattacher.
+func (me *RunmVMRuntimeCreator[VM]) Reattach(ctx context.Context, opts *runtime.ReattachOptions) (runtime.Runtime, error) {
+	vm, err := ReattachRunmVMRuntime(ctx, me.hpv, opts, me.opts)
+	if err != nil {
+		return nil, errors.Errorf("failed to reattach VM: %w", err)
+	}
+
+	slog.InfoContext(ctx, "reattached VM", "id", opts.ContainerID)
+	return vm, nil
+}
+
+// CollectCache implements runtime.CacheCollector, running a vmm.VMCacheGC as the
+// cache_gc runtime options say.
+func (me *RunmVMRuntimeCreator[VM]) CollectCache(ctx context.Context) error {
+	if me.opts.CacheGC.Disabled {
+		return nil
+	}
+
+	_, err := me.CollectVMCache(ctx, me.opts.CacheGC.DryRun)
+	return err
+}
+
+// CollectVMCache implements vmm.CacheGCRunner. It collects as the cache_gc runtime
+// options say, with dryRun in place of their dry_run, also when they disable the
+// collections the shim runs by itself.
+func (me *RunmVMRuntimeCreator[VM]) CollectVMCache(ctx context.Context, dryRun bool) (*vmm.CacheGCResult, error) {
+	opts := vmm.CacheGCOptions{
+		MinAge: time.Duration(me.opts.CacheGC.MinAge),
+		DryRun: dryRun,
+	}
+	if me.opts.CacheGC.Budget != "" {
+		budget, err := units.RAMInBytes(me.opts.CacheGC.Budget)
+		if err != nil {
+			return nil, errors.Errorf("parsing cache_gc budget: %w", err)
+		}
+		opts.Budget = budget
+	}
+
+	gc, err := vmm.DefaultVMCacheGC(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := gc.Collect(ctx, opts)
+	if err != nil {
+		return nil, errors.Errorf("collecting vm cache: %w", err)
+	}
+
+	if opts.DryRun {
+		for _, e := range res.Removed {
+			slog.InfoContext(ctx, "vm cache entry would be removed", "kind", e.Kind, "path", e.Path, "size", e.Size, "reason", e.Reason, "last_used", e.LastUsed)
+		}
 	}
+
+	slog.InfoContext(ctx, "collected vm cache", "removed", len(res.Removed), "freed", res.Freed(), "size", res.Size, "dry_run", opts.DryRun)
+
+	// after the working directories, which hold links to the artifacts
+	artifacts, err := vmm.DefaultArtifactStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned, err := artifacts.Prune(ctx, opts.DryRun)
+	if err != nil {
+		return nil, errors.Errorf("pruning artifact store: %w", err)
+	}
+	if len(pruned) > 0 {
+		slog.InfoContext(ctx, "pruned guest image artifacts", "digests", pruned, "dry_run", opts.DryRun)
+	}
+
+	return res, nil
+}
+
+// consoleLogOptions are the vmm.ConsoleLogOptions of the console_log runtime
+// options, which Validate already checked.
+func consoleLogOptions(opts *vmoptions.Options) vmm.ConsoleLogOptions {
+	clo := vmm.ConsoleLogOptions{
+		MaxFiles: opts.ConsoleLog.MaxFiles,
+		MaxAge:   time.Duration(opts.ConsoleLog.MaxAge),
+	}
+	if opts.ConsoleLog.MaxSize != "" {
+		clo.MaxSize, _ = units.RAMInBytes(opts.ConsoleLog.MaxSize)
+	}
+	return clo
+}
+
+// NewRunmVMRuntimeCreator returns a creator that boots every vm as configured by
+// the runm runtime options, see vmoptions.Decode.
+func NewRunmVMRuntimeCreator[VM vmm.VirtualMachine](hpv vmm.Hypervisor[VM], opts *vmoptions.Options) (*RunmVMRuntimeCreator[VM], error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Errorf("invalid runm runtime options: %w", err)
+	}
+
+	limits, err := VMSizeLimitsFromOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RunmVMRuntimeCreator[VM]{
+		hpv:    hpv,
+		opts:   opts,
+		limits: limits,
+	}, nil
 }
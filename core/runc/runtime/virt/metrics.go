@@ -0,0 +1,78 @@
+package virt
+
+import (
+	"context"
+	"log/slog"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/linux/constants"
+	"github.com/walteh/runm/pkg/metrics"
+)
+
+var (
+	vmVCPUsDesc = prometheus.NewDesc("runm_vm_vcpus",
+		"Number of vcpus the vm was booted with.", nil, nil)
+	vmMemoryDesc = prometheus.NewDesc("runm_vm_memory_configured_bytes",
+		"Memory the vm was booted with.", nil, nil)
+	vmBalloonDesc = prometheus.NewDesc("runm_vm_memory_balloon_target_bytes",
+		"Memory the balloon device asks the guest to keep, zero without a balloon device.", nil, nil)
+	vmNetDesc = prometheus.NewDesc("runm_vm_network_bytes_total",
+		"Bytes moved between the host and the guest network, by direction.", []string{"direction"}, nil)
+)
+
+// vmStatsCollector reports the hypervisor side stats of a vm.
+type vmStatsCollector[VM vmm.VirtualMachine] struct {
+	vm *vmm.RunningVM[VM]
+}
+
+func (c *vmStatsCollector[VM]) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{vmVCPUsDesc, vmMemoryDesc, vmBalloonDesc, vmNetDesc} {
+		ch <- d
+	}
+}
+
+func (c *vmStatsCollector[VM]) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+
+	stats, err := c.vm.Stats(ctx)
+	if err != nil {
+		slog.DebugContext(ctx, "collecting vm stats", "id", c.vm.VM().ID(), "error", err)
+		return
+	}
+
+	gauge := func(desc *prometheus.Desc, v uint64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(v))
+	}
+	gauge(vmVCPUsDesc, stats.VCPUs)
+	gauge(vmMemoryDesc, stats.MemoryConfiguredBytes)
+	gauge(vmBalloonDesc, stats.MemoryBalloonTargetBytes)
+	ch <- prometheus.MustNewConstMetric(vmNetDesc, prometheus.CounterValue, float64(stats.NetRxBytes), "rx")
+	ch <- prometheus.MustNewConstMetric(vmNetDesc, prometheus.CounterValue, float64(stats.NetTxBytes), "tx")
+}
+
+// registerVMMetrics exports the stats of vm, the open resources of the guest client
+// and the metrics scraped from the guest agent, all labelled with the vm and the
+// container. The returned func removes them again.
+func registerVMMetrics[VM vmm.VirtualMachine](vm *vmm.RunningVM[VM], resources metrics.OpenResources, containerID string) func() {
+	labels := prometheus.Labels{"vmid": vm.VM().ID(), "container_id": containerID}
+
+	// a registry of its own, as several vms export the same metrics
+	reg := prometheus.NewRegistry()
+	prometheus.WrapRegistererWith(labels, reg).MustRegister(
+		&vmStatsCollector[VM]{vm: vm},
+		metrics.NewOpenResourcesCollector(resources, nil),
+	)
+
+	removeLocal := metrics.AddGatherer(reg)
+	removeGuest := metrics.AddGatherer(metrics.NewRemoteGatherer(func(ctx context.Context) (net.Conn, error) {
+		return vm.VM().VSockConnect(ctx, uint32(constants.RunmMetricsVsockPort))
+	}, labels))
+
+	return func() {
+		removeLocal()
+		removeGuest()
+	}
+}
@@ -0,0 +1,168 @@
+package virt
+
+import (
+	"debug/elf"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/errdefs"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/runc/process"
+	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/linux/constants"
+	"github.com/walteh/runm/pkg/units"
+)
+
+// AnnotationVMPlatform selects the guest platform of the vm a container runs in,
+// clients set it to the platform of the image, for example "linux/amd64".
+const AnnotationVMPlatform = "io.runm.vm.platform"
+
+// elfArchs are the go architectures of the elf machines a guest can run.
+var elfArchs = map[elf.Machine]string{
+	elf.EM_X86_64:  "amd64",
+	elf.EM_AARCH64: "arm64",
+	elf.EM_386:     "386",
+	elf.EM_ARM:     "arm",
+	elf.EM_RISCV:   "riscv64",
+	elf.EM_PPC64:   "ppc64le",
+	elf.EM_S390:    "s390x",
+}
+
+// GuestPlatform picks the platform of the vm a container runs in: the
+// AnnotationVMPlatform annotation, else the platform of the image, read from the
+// binary the container starts in its rootfs, else linux on the architecture of
+// host, unless the spec is for another os. Guests run natively, so the
+// architecture has to match the host.
+func GuestPlatform(spec *specs.Spec, mounts []process.Mount, host units.Platform) (units.Platform, error) {
+	platform := units.Platform(units.OSLinux + "/" + host.Arch())
+
+	var annotations map[string]string
+	if spec != nil {
+		annotations = spec.Annotations
+	}
+
+	if v, ok := annotations[AnnotationVMPlatform]; ok {
+		p, err := units.ParsePlatform(v)
+		if err != nil {
+			return "", errors.Errorf("invalid %s annotation %q: %w", AnnotationVMPlatform, v, errdefs.ErrInvalidArgument)
+		}
+		platform = p
+	} else if p, ok := imagePlatform(spec, mounts); ok {
+		platform = p
+	} else if goos := specOS(spec); goos != "" {
+		platform = units.Platform(goos + "/" + host.Arch())
+	}
+
+	if !vmm.IsSupportedGuestPlatform(platform) {
+		return "", errors.Errorf("unsupported guest platform %s: %w", platform, errdefs.ErrNotImplemented)
+	}
+
+	if platform.Arch() != host.Arch() {
+		return "", errors.Errorf("guest platform %s cannot run on a %s host: %w", platform, host.Arch(), errdefs.ErrNotImplemented)
+	}
+
+	return platform, nil
+}
+
+// specOS is the os the spec was generated for, containerd only fills in the
+// section of that os. It is empty when the spec does not tell.
+func specOS(spec *specs.Spec) string {
+	switch {
+	case spec == nil:
+		return ""
+	case spec.Windows != nil:
+		return "windows"
+	case spec.Solaris != nil:
+		return "solaris"
+	case spec.ZOS != nil:
+		return "zos"
+	case spec.Linux != nil:
+		return units.OSLinux
+	}
+	return ""
+}
+
+// imagePlatform reads the platform of the image from the elf header of the binary
+// the container starts, found in the rootfs or the layers of its overlay. It is
+// not found when the rootfs is not on the host or the binary is a script. A
+// symlink that crosses layers is not followed.
+func imagePlatform(spec *specs.Spec, mounts []process.Mount) (units.Platform, bool) {
+	if spec == nil || spec.Process == nil || len(spec.Process.Args) == 0 {
+		return "", false
+	}
+
+	roots := rootfsDirs(spec, mounts)
+	for _, path := range binaryPaths(spec.Process) {
+		for _, root := range roots {
+			full, err := securejoin.SecureJoin(root, path)
+			if err != nil {
+				continue
+			}
+			f, err := elf.Open(full)
+			if err != nil {
+				continue
+			}
+			machine := f.Machine
+			f.Close()
+
+			if arch, ok := elfArchs[machine]; ok {
+				return units.Platform(units.OSLinux + "/" + arch), true
+			}
+			return units.Platform(units.OSLinux + "/" + strings.ToLower(strings.TrimPrefix(machine.String(), "EM_"))), true
+		}
+	}
+
+	return "", false
+}
+
+// rootfsDirs are the directories on the host the rootfs is made of, the upper
+// layer first.
+func rootfsDirs(spec *specs.Spec, mounts []process.Mount) []string {
+	var dirs []string
+	for _, m := range mounts {
+		switch m.Type {
+		case "bind", "rbind":
+			dirs = append(dirs, m.Source)
+		case "overlay":
+			for _, opt := range m.Options {
+				if dir, ok := strings.CutPrefix(opt, "upperdir="); ok {
+					dirs = append([]string{dir}, dirs...)
+				}
+				if lower, ok := strings.CutPrefix(opt, "lowerdir="); ok {
+					dirs = append(dirs, strings.Split(lower, ":")...)
+				}
+			}
+		}
+	}
+	if spec.Root != nil && filepath.IsAbs(spec.Root.Path) {
+		dirs = append(dirs, spec.Root.Path)
+	}
+	return dirs
+}
+
+// binaryPaths are the paths in the rootfs the first argument of p may be.
+func binaryPaths(p *specs.Process) []string {
+	arg := p.Args[0]
+	if filepath.IsAbs(arg) {
+		return []string{arg}
+	}
+	if strings.Contains(arg, "/") {
+		return []string{filepath.Join("/", p.Cwd, arg)}
+	}
+
+	path := constants.DefaultGuestPath
+	for _, env := range p.Env {
+		if v, ok := strings.CutPrefix(env, "PATH="); ok {
+			path = v
+		}
+	}
+
+	var paths []string
+	for _, dir := range filepath.SplitList(path) {
+		paths = append(paths, filepath.Join("/", dir, arg))
+	}
+	return paths
+}
@@ -0,0 +1,96 @@
+package virt_test
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/runc/process"
+	"github.com/walteh/runm/core/runc/runtime/virt"
+	"github.com/walteh/runm/pkg/units"
+)
+
+// writeELF writes the header of an elf executable for machine, all that is read
+// of it.
+func writeELF(t *testing.T, path string, machine elf.Machine) {
+	t.Helper()
+	hdr := elf.Header64{
+		Type:    uint16(elf.ET_EXEC),
+		Machine: uint16(machine),
+		Version: uint32(elf.EV_CURRENT),
+		Ehsize:  64,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, binary.Write(f, binary.LittleEndian, &hdr))
+}
+
+func TestGuestPlatform(t *testing.T) {
+	annotated := func(platform string) *specs.Spec {
+		return &specs.Spec{Annotations: map[string]string{virt.AnnotationVMPlatform: platform}}
+	}
+	starting := func(args ...string) *specs.Spec {
+		return &specs.Spec{Linux: &specs.Linux{}, Process: &specs.Process{Args: args, Cwd: "/"}}
+	}
+
+	amd64Rootfs := t.TempDir()
+	writeELF(t, filepath.Join(amd64Rootfs, "usr/local/bin/app"), elf.EM_X86_64)
+	require.NoError(t, os.WriteFile(filepath.Join(amd64Rootfs, "usr/local/bin/script"), []byte("#!/bin/sh\n"), 0755))
+
+	// the symlink is absolute, it must resolve in the layer and not on the host
+	lower, upper := t.TempDir(), t.TempDir()
+	writeELF(t, filepath.Join(lower, "bin/busybox"), elf.EM_AARCH64)
+	require.NoError(t, os.Symlink("/bin/busybox", filepath.Join(lower, "bin/sh")))
+	overlay := []process.Mount{{Type: "overlay", Source: "overlay", Options: []string{"workdir=" + t.TempDir(), "upperdir=" + upper, "lowerdir=" + lower}}}
+
+	bind := []process.Mount{{Type: "bind", Source: amd64Rootfs, Options: []string{"rbind"}}}
+
+	tests := []struct {
+		name    string
+		spec    *specs.Spec
+		mounts  []process.Mount
+		host    units.Platform
+		want    units.Platform
+		wantErr error
+	}{
+		{name: "arm64 host", host: units.PlatformDarwinARM64, want: units.PlatformLinuxARM64},
+		{name: "amd64 host", host: units.PlatformDarwinAMD64, want: units.PlatformLinuxAMD64},
+		{name: "image platform", spec: annotated("linux/amd64"), host: units.PlatformDarwinAMD64, want: units.PlatformLinuxAMD64},
+		{name: "image platform variant", spec: annotated("linux/arm64/v8"), host: units.PlatformDarwinARM64, want: units.PlatformLinuxARM64},
+		{name: "foreign architecture", spec: annotated("linux/amd64"), host: units.PlatformDarwinARM64, wantErr: errdefs.ErrNotImplemented},
+		{name: "not linux", spec: annotated("darwin/arm64"), host: units.PlatformDarwinARM64, wantErr: errdefs.ErrNotImplemented},
+		{name: "malformed", spec: annotated("amd64"), host: units.PlatformDarwinAMD64, wantErr: errdefs.ErrInvalidArgument},
+		{name: "binary in rootfs", spec: starting("app"), mounts: bind, host: units.PlatformDarwinAMD64, want: units.PlatformLinuxAMD64},
+		{name: "foreign binary in rootfs", spec: starting("app"), mounts: bind, host: units.PlatformDarwinARM64, wantErr: errdefs.ErrNotImplemented},
+		{name: "symlink in overlay layer", spec: starting("/bin/sh"), mounts: overlay, host: units.PlatformDarwinARM64, want: units.PlatformLinuxARM64},
+		{name: "script falls back to host", spec: starting("script"), mounts: bind, host: units.PlatformDarwinARM64, want: units.PlatformLinuxARM64},
+		{name: "rootfs not on host", spec: starting("app"), host: units.PlatformDarwinARM64, want: units.PlatformLinuxARM64},
+		{name: "windows spec", spec: &specs.Spec{Windows: &specs.Windows{}}, host: units.PlatformDarwinAMD64, wantErr: errdefs.ErrNotImplemented},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := virt.GuestPlatform(tt.spec, tt.mounts, tt.host)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
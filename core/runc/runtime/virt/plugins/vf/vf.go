@@ -1,11 +1,16 @@
 package vfruntimeplugin
 
 import (
+	"os"
+
 	"github.com/containerd/containerd/v2/plugins"
+	"github.com/containerd/log"
 	"github.com/containerd/plugin"
 	"github.com/containerd/plugin/registry"
-	"github.com/containers/common/pkg/strongunits"
+	"gitlab.com/tozd/go/errors"
+
 	"github.com/walteh/runm/core/runc/runtime/virt"
+	"github.com/walteh/runm/core/runc/runtime/virt/vmoptions"
 	"github.com/walteh/runm/core/virt/vf"
 )
 
@@ -19,11 +24,24 @@ func register() {
 		ID:       "runm-runtime-creator",
 		Requires: []plugin.Type{},
 		InitFn: func(ic *plugin.InitContext) (interface{}, error) {
-			return virt.NewRunmVMRuntimeCreator(
-				vf.NewHypervisor(),
-				strongunits.MiB(64), // max memory
-				1,                   // vcpu
-			), nil
+			// the shim runs in the bundle, where the manager left the runtime options
+			cwd, err := os.Getwd()
+			if err != nil {
+				return nil, err
+			}
+
+			opts, err := vmoptions.Read(cwd)
+			if err != nil {
+				return nil, errors.Errorf("reading runm runtime options: %w", err)
+			}
+
+			if opts.LogLevel != "" {
+				if err := log.SetLevel(opts.LogLevel); err != nil {
+					return nil, errors.Errorf("setting log level: %w", err)
+				}
+			}
+
+			return virt.NewRunmVMRuntimeCreator(vf.NewHypervisor(), opts)
 		},
 	})
 
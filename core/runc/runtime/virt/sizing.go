@@ -0,0 +1,225 @@
+package virt
+
+import (
+	"fmt"
+	"log/slog"
+	goruntime "runtime"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/errdefs"
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/runc/runtime/virt/vmoptions"
+	"github.com/walteh/runm/core/virt/host"
+)
+
+const (
+	// AnnotationVMMemory overrides the memory of the vm a container runs in. The value
+	// is a size such as "512m", "2g" or a plain number of bytes.
+	AnnotationVMMemory = "io.runm.vm.memory"
+	// AnnotationVMVCPUs overrides the number of vcpus of the vm a container runs in.
+	AnnotationVMVCPUs = "io.runm.vm.vcpus"
+)
+
+// VMSize is the memory and vcpus a vm is created with.
+type VMSize struct {
+	Memory strongunits.B
+	VCPUs  uint64
+}
+
+// VMSizeLimits are the host wide defaults and maximums a vm is sized within.
+type VMSizeLimits struct {
+	// Default is used for whatever the container neither limits nor annotates.
+	Default VMSize
+	// Max is the largest vm the host allows, zero means no limit.
+	Max VMSize
+	// MemoryOverhead is added to a container memory limit to leave room for the
+	// guest kernel and agent.
+	MemoryOverhead strongunits.B
+}
+
+// DefaultVMSizeLimits allows vms up to the size of the host.
+func DefaultVMSizeLimits() VMSizeLimits {
+	limits := VMSizeLimits{
+		Default: VMSize{
+			Memory: strongunits.MiB(64).ToBytes(),
+			VCPUs:  1,
+		},
+		Max: VMSize{
+			VCPUs: uint64(goruntime.NumCPU()),
+		},
+		MemoryOverhead: strongunits.MiB(32).ToBytes(),
+	}
+
+	if mem, err := host.PhysicalMemory(); err != nil {
+		slog.Warn("unable to read host memory, vm memory is not limited", "error", err)
+	} else {
+		limits.Max.Memory = mem
+	}
+
+	return limits
+}
+
+// VMSizeLimitsFromOptions applies the sizes in the runtime options over
+// DefaultVMSizeLimits.
+func VMSizeLimitsFromOptions(o *vmoptions.Options) (VMSizeLimits, error) {
+	limits := DefaultVMSizeLimits()
+
+	if o.DefaultMemory != "" {
+		mem, err := units.RAMInBytes(o.DefaultMemory)
+		if err != nil || mem <= 0 {
+			return VMSizeLimits{}, errors.Errorf("invalid default_memory %q: %w", o.DefaultMemory, errdefs.ErrInvalidArgument)
+		}
+		limits.Default.Memory = strongunits.B(mem)
+	}
+	if o.DefaultVCPUs > 0 {
+		limits.Default.VCPUs = o.DefaultVCPUs
+	}
+
+	if o.MaxMemory != "" {
+		mem, err := units.RAMInBytes(o.MaxMemory)
+		if err != nil || mem <= 0 {
+			return VMSizeLimits{}, errors.Errorf("invalid max_memory %q: %w", o.MaxMemory, errdefs.ErrInvalidArgument)
+		}
+		if limits.Max.Memory == 0 || strongunits.B(mem) < limits.Max.Memory {
+			limits.Max.Memory = strongunits.B(mem)
+		}
+	}
+	if o.MaxVCPUs > 0 && (limits.Max.VCPUs == 0 || o.MaxVCPUs < limits.Max.VCPUs) {
+		limits.Max.VCPUs = o.MaxVCPUs
+	}
+
+	return limits, nil
+}
+
+// VMSizeError is returned when the size a container asks for is more than the host
+// allows.
+type VMSizeError struct {
+	Resource  string
+	Source    string
+	Requested uint64
+	Max       uint64
+}
+
+func (e *VMSizeError) Error() string {
+	return fmt.Sprintf("vm %s %d requested by %s exceeds the host maximum of %d", e.Resource, e.Requested, e.Source, e.Max)
+}
+
+func (e *VMSizeError) Unwrap() error {
+	return errdefs.ErrInvalidArgument
+}
+
+// ComputeVMSize sizes the vm of a container. For both memory and vcpus the runm
+// annotation wins, then the container resource limits, then the default. Memory
+// derived from a limit includes limits.MemoryOverhead.
+func ComputeVMSize(spec *specs.Spec, limits VMSizeLimits) (VMSize, error) {
+	size := limits.Default
+	memorySource, vcpuSource := "default", "default"
+
+	if spec != nil && spec.Linux != nil && spec.Linux.Resources != nil {
+		res := spec.Linux.Resources
+
+		if res.Memory != nil && res.Memory.Limit != nil && *res.Memory.Limit > 0 {
+			size.Memory = strongunits.B(*res.Memory.Limit) + limits.MemoryOverhead
+			memorySource = "memory limit"
+		}
+
+		if vcpus, err := cpuLimit(res.CPU); err != nil {
+			return VMSize{}, err
+		} else if vcpus > 0 {
+			size.VCPUs = vcpus
+			vcpuSource = "cpu limit"
+		}
+	}
+
+	if spec != nil {
+		if v, ok := spec.Annotations[AnnotationVMMemory]; ok {
+			mem, err := units.RAMInBytes(v)
+			if err != nil || mem <= 0 {
+				return VMSize{}, errors.Errorf("invalid %s annotation %q: %w", AnnotationVMMemory, v, errdefs.ErrInvalidArgument)
+			}
+			size.Memory = strongunits.B(mem)
+			memorySource = AnnotationVMMemory + " annotation"
+		}
+
+		if v, ok := spec.Annotations[AnnotationVMVCPUs]; ok {
+			vcpus, err := strconv.ParseUint(v, 10, 64)
+			if err != nil || vcpus == 0 {
+				return VMSize{}, errors.Errorf("invalid %s annotation %q: %w", AnnotationVMVCPUs, v, errdefs.ErrInvalidArgument)
+			}
+			size.VCPUs = vcpus
+			vcpuSource = AnnotationVMVCPUs + " annotation"
+		}
+	}
+
+	// the hypervisors only take whole mebibytes
+	mib := uint64(strongunits.MiB(1).ToBytes())
+	size.Memory = strongunits.B((uint64(size.Memory) + mib - 1) / mib * mib)
+
+	if limits.Max.Memory > 0 && size.Memory > limits.Max.Memory {
+		return VMSize{}, &VMSizeError{Resource: "memory", Source: memorySource, Requested: uint64(size.Memory), Max: uint64(limits.Max.Memory)}
+	}
+	if limits.Max.VCPUs > 0 && size.VCPUs > limits.Max.VCPUs {
+		return VMSize{}, &VMSizeError{Resource: "vcpus", Source: vcpuSource, Requested: size.VCPUs, Max: limits.Max.VCPUs}
+	}
+
+	return size, nil
+}
+
+// cpuLimit returns the vcpus needed to honour a cpu quota, or else the size of the
+// cpuset, zero when the container has neither.
+func cpuLimit(cpu *specs.LinuxCPU) (uint64, error) {
+	if cpu == nil {
+		return 0, nil
+	}
+
+	if cpu.Quota != nil && *cpu.Quota > 0 {
+		period := uint64(100000)
+		if cpu.Period != nil && *cpu.Period > 0 {
+			period = *cpu.Period
+		}
+		quota := uint64(*cpu.Quota)
+		return (quota + period - 1) / period, nil
+	}
+
+	if cpu.Cpus != "" {
+		n, err := cpusetSize(cpu.Cpus)
+		if err != nil {
+			return 0, errors.Errorf("invalid cpuset %q: %w", cpu.Cpus, errdefs.ErrInvalidArgument)
+		}
+		return n, nil
+	}
+
+	return 0, nil
+}
+
+// cpusetSize counts the cpus in a cpuset list such as "0-3,6".
+func cpusetSize(set string) (uint64, error) {
+	var n uint64
+	for _, part := range strings.Split(set, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.ParseUint(lo, 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.ParseUint(hi, 10, 32); err != nil {
+				return 0, err
+			}
+		}
+		if last < first {
+			return 0, errors.Errorf("range %s is backwards", part)
+		}
+		n += last - first + 1
+	}
+	return n, nil
+}
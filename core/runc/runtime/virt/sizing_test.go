@@ -0,0 +1,153 @@
+package virt_test
+
+import (
+	"testing"
+
+	"github.com/containerd/errdefs"
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/runc/runtime/virt"
+)
+
+func ptr[T any](v T) *T { return &v }
+
+func TestComputeVMSize(t *testing.T) {
+	limits := virt.VMSizeLimits{
+		Default:        virt.VMSize{Memory: strongunits.MiB(64).ToBytes(), VCPUs: 1},
+		Max:            virt.VMSize{Memory: strongunits.GiB(4).ToBytes(), VCPUs: 4},
+		MemoryOverhead: strongunits.MiB(32).ToBytes(),
+	}
+
+	tests := []struct {
+		name    string
+		spec    *specs.Spec
+		want    virt.VMSize
+		wantErr error
+	}{
+		{
+			name: "no spec",
+			want: limits.Default,
+		},
+		{
+			name: "no limits",
+			spec: &specs.Spec{Linux: &specs.Linux{}},
+			want: limits.Default,
+		},
+		{
+			name: "memory limit plus overhead",
+			spec: &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{
+				Memory: &specs.LinuxMemory{Limit: ptr(int64(strongunits.MiB(256).ToBytes()))},
+			}}},
+			want: virt.VMSize{Memory: strongunits.MiB(288).ToBytes(), VCPUs: 1},
+		},
+		{
+			name: "unlimited memory",
+			spec: &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{
+				Memory: &specs.LinuxMemory{Limit: ptr(int64(-1))},
+			}}},
+			want: limits.Default,
+		},
+		{
+			name: "memory rounded up to mebibytes",
+			spec: &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{
+				Memory: &specs.LinuxMemory{Limit: ptr(int64(strongunits.MiB(100).ToBytes()) + 1)},
+			}}},
+			want: virt.VMSize{Memory: strongunits.MiB(133).ToBytes(), VCPUs: 1},
+		},
+		{
+			name: "cpu quota rounded up",
+			spec: &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{
+				CPU: &specs.LinuxCPU{Quota: ptr(int64(150000)), Period: ptr(uint64(100000))},
+			}}},
+			want: virt.VMSize{Memory: limits.Default.Memory, VCPUs: 2},
+		},
+		{
+			name: "cpuset",
+			spec: &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{
+				CPU: &specs.LinuxCPU{Cpus: "0-1,3"},
+			}}},
+			want: virt.VMSize{Memory: limits.Default.Memory, VCPUs: 3},
+		},
+		{
+			name: "quota wins over cpuset",
+			spec: &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{
+				CPU: &specs.LinuxCPU{Quota: ptr(int64(50000)), Cpus: "0-3"},
+			}}},
+			want: virt.VMSize{Memory: limits.Default.Memory, VCPUs: 1},
+		},
+		{
+			name: "annotations win over limits",
+			spec: &specs.Spec{
+				Annotations: map[string]string{
+					virt.AnnotationVMMemory: "1g",
+					virt.AnnotationVMVCPUs:  "2",
+				},
+				Linux: &specs.Linux{Resources: &specs.LinuxResources{
+					Memory: &specs.LinuxMemory{Limit: ptr(int64(strongunits.MiB(256).ToBytes()))},
+					CPU:    &specs.LinuxCPU{Cpus: "0"},
+				}},
+			},
+			want: virt.VMSize{Memory: strongunits.GiB(1).ToBytes(), VCPUs: 2},
+		},
+		{
+			name:    "invalid memory annotation",
+			spec:    &specs.Spec{Annotations: map[string]string{virt.AnnotationVMMemory: "lots"}},
+			wantErr: errdefs.ErrInvalidArgument,
+		},
+		{
+			name:    "zero vcpus annotation",
+			spec:    &specs.Spec{Annotations: map[string]string{virt.AnnotationVMVCPUs: "0"}},
+			wantErr: errdefs.ErrInvalidArgument,
+		},
+		{
+			name: "invalid cpuset",
+			spec: &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{
+				CPU: &specs.LinuxCPU{Cpus: "3-1"},
+			}}},
+			wantErr: errdefs.ErrInvalidArgument,
+		},
+		{
+			name:    "memory above host maximum",
+			spec:    &specs.Spec{Annotations: map[string]string{virt.AnnotationVMMemory: "8g"}},
+			wantErr: errdefs.ErrInvalidArgument,
+		},
+		{
+			name: "vcpus above host maximum",
+			spec: &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{
+				CPU: &specs.LinuxCPU{Cpus: "0-7"},
+			}}},
+			wantErr: errdefs.ErrInvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := virt.ComputeVMSize(tt.spec, limits)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestComputeVMSizeReportsWhatExceededTheHost(t *testing.T) {
+	limits := virt.VMSizeLimits{
+		Default: virt.VMSize{Memory: strongunits.MiB(64).ToBytes(), VCPUs: 1},
+		Max:     virt.VMSize{VCPUs: 2},
+	}
+
+	_, err := virt.ComputeVMSize(&specs.Spec{Annotations: map[string]string{virt.AnnotationVMVCPUs: "3"}}, limits)
+
+	var sizeErr *virt.VMSizeError
+	require.ErrorAs(t, err, &sizeErr)
+	assert.Equal(t, "vcpus", sizeErr.Resource)
+	assert.Equal(t, virt.AnnotationVMVCPUs+" annotation", sizeErr.Source)
+	assert.Equal(t, uint64(3), sizeErr.Requested)
+	assert.Equal(t, uint64(2), sizeErr.Max)
+}
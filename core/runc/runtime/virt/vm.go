@@ -3,14 +3,22 @@ package virt
 import (
 	"context"
 	"log/slog"
+	"time"
 
-	"github.com/containers/common/pkg/strongunits"
+	"github.com/containerd/containerd/v2/core/events"
+	"github.com/containerd/errdefs"
+	gorunc "github.com/containerd/go-runc"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/walteh/run"
 	"github.com/walteh/runm/core/runc/oom"
 	"github.com/walteh/runm/core/runc/runtime"
+	"github.com/walteh/runm/core/runc/runtime/virt/vmoptions"
 	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/pkg/metrics"
 	"github.com/walteh/runm/pkg/units"
+	"gitlab.com/tozd/go/errors"
+
+	grpcruntime "github.com/walteh/runm/core/runc/runtime/grpc"
 )
 
 var (
@@ -20,6 +28,14 @@ var (
 	_ runtime.EventHandler    = (*RunmVMRuntime[vmm.VirtualMachine])(nil)
 	_ runtime.GuestManagement = (*RunmVMRuntime[vmm.VirtualMachine])(nil)
 	_ run.Runnable            = (*RunmVMRuntime[vmm.VirtualMachine])(nil)
+
+	_ runtime.ReattachableRuntime = (*RunmVMRuntime[vmm.VirtualMachine])(nil)
+	_ vmm.VMStatsProvider         = (*RunmVMRuntime[vmm.VirtualMachine])(nil)
+	_ vmm.BootTimingProvider      = (*RunmVMRuntime[vmm.VirtualMachine])(nil)
+	_ vmm.ConsoleLogProvider      = (*RunmVMRuntime[vmm.VirtualMachine])(nil)
+	_ vmm.GuestCrashWatcher       = (*RunmVMRuntime[vmm.VirtualMachine])(nil)
+	_ runtime.VMCheckpointer      = (*RunmVMRuntime[vmm.VirtualMachine])(nil)
+	_ runtime.VMRestoredRuntime   = (*RunmVMRuntime[vmm.VirtualMachine])(nil)
 )
 
 type RunmVMRuntime[VM vmm.VirtualMachine] struct {
@@ -29,9 +45,16 @@ type RunmVMRuntime[VM vmm.VirtualMachine] struct {
 	runtime.EventHandler
 	runtime.GuestManagement
 
-	spec       *specs.Spec
-	vm         *vmm.RunningVM[VM]
-	oomWatcher *oom.Watcher
+	containerID string
+	spec        *specs.Spec
+	vm          *vmm.RunningVM[VM]
+	oomWatcher  *oom.Watcher
+	consoleLog  *vmm.ConsoleLog
+
+	// restoredInitPid is set when the vm was restored from a checkpoint
+	restoredInitPid int
+
+	unregisterMetrics func()
 
 	runGroup *run.Group
 }
@@ -40,30 +63,89 @@ func NewRunmVMRuntime[VM vmm.VirtualMachine](
 	ctx context.Context,
 	hpv vmm.Hypervisor[VM],
 	opts *runtime.RuntimeOptions,
-	maxMemory strongunits.StorageUnits,
-	vcpus int,
+	limits VMSizeLimits,
+	vmopts *vmoptions.Options,
 ) (*RunmVMRuntime[VM], error) {
 
-	runGroup := run.New()
+	size, err := ComputeVMSize(opts.OciSpec, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	platform, err := GuestPlatform(opts.OciSpec, opts.Mounts, units.HostPlatform())
+	if err != nil {
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "sized vm", "id", opts.ProcessCreateConfig.ID, "memory", size.Memory, "vcpus", size.VCPUs, "platform", platform)
+
+	extraDevices, err := vmopts.ExtraDevices()
+	if err != nil {
+		return nil, err
+	}
 
 	cfg := vmm.OCIVMConfig{
 		ID:             opts.ProcessCreateConfig.ID,
 		Spec:           opts.OciSpec,
 		RootfsMounts:   opts.Mounts,
-		StartingMemory: strongunits.MiB(64).ToBytes(),
-		VCPUs:          1,
-		Platform:       units.PlatformLinuxARM64,
+		StartingMemory: size.Memory,
+		VCPUs:          size.VCPUs,
+		Platform:       platform,
+
+		DisableNetwork:      vmopts.NetworkMode == vmoptions.NetworkModeNone,
+		GuestLogLevel:       vmopts.GuestSlogLevel(),
+		GuestDebug:          vmopts.Debug,
+		GuestOTLPEndpoint:   vmopts.Tracing.GuestEndpoint,
+		GuestOTLPProtocol:   vmopts.Tracing.Protocol,
+		BootTimeout:         time.Duration(vmopts.BootTimeout),
+		GuestConnectTimeout: time.Duration(vmopts.GuestConnectTimeout),
+		ExtraDevices:        extraDevices,
+	}
+
+	var checkpoint *vmm.VMCheckpoint
+	checkpointDir := opts.ProcessCreateConfig.Checkpoint
+	if vmm.IsVMCheckpoint(checkpointDir) {
+		cp, err := vmm.ReadVMCheckpoint(checkpointDir)
+		if err != nil {
+			return nil, err
+		}
+		// the guest knows the container by the id it was created with
+		if cp.ContainerID != cfg.ID {
+			return nil, errors.Errorf("vm checkpoint of container %s cannot be restored as container %s", cp.ContainerID, cfg.ID)
+		}
+		// the restored vm must match the saved one
+		cfg.VCPUs = cp.VCPUs
+		cfg.StartingMemory = cp.Memory
+		cfg.Platform = cp.GuestPlatform
+		cfg.RestoreWorkingDir = vmm.VMCheckpointWorkingDir(checkpointDir)
+		checkpoint = cp
 	}
 
+	images := vmopts.GuestImages(cfg.Platform)
+	cfg.BuildDir = images.BuildDir
+	cfg.KernelPath = images.KernelPath
+	cfg.InitramfsPath = images.InitramfsPath
+
 	vm, err := vmm.NewOCIVirtualMachine(ctx, hpv, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	slog.InfoContext(ctx, "created oci vm, starting it", "id", vm.VM().ID())
+	if checkpoint != nil {
+		slog.InfoContext(ctx, "created oci vm, restoring it from checkpoint", "id", vm.VM().ID(), "checkpoint", checkpointDir)
 
-	if err := vm.Start(ctx); err != nil {
-		return nil, err
+		if err := vm.Restore(ctx, checkpointDir); err != nil {
+			if errors.Is(err, vmm.ErrFullSnapshotNotSupported) {
+				return nil, errors.Errorf("%w: %s", errdefs.ErrNotImplemented, err)
+			}
+			return nil, withCrashedContainer(err, cfg.ID)
+		}
+	} else {
+		slog.InfoContext(ctx, "created oci vm, starting it", "id", vm.VM().ID())
+
+		if err := vm.Start(ctx); err != nil {
+			return nil, withCrashedContainer(err, cfg.ID)
+		}
 	}
 
 	slog.InfoContext(ctx, "started vm, connecting to guest service", "id", vm.VM().ID())
@@ -75,28 +157,180 @@ func NewRunmVMRuntime[VM vmm.VirtualMachine](
 
 	srv, err := vm.GuestService(ctx)
 	if err != nil {
-		return nil, err
+		return nil, withCrashedContainer(err, cfg.ID)
 	}
 
 	slog.InfoContext(ctx, "connected to guest service", "id", vm.VM().ID())
 
-	ep := oom.NewWatcher(opts.Publisher, srv)
+	if _, err := vm.Persist(ctx, cfg.Platform); err != nil {
+		// the container still works, it just cannot survive a shim restart
+		slog.WarnContext(ctx, "failed to persist vm state", "id", vm.VM().ID(), "error", err)
+	}
+
+	rt := newRunmVMRuntime(ctx, vm, srv, cfg.ID, cfg.Spec, opts.Publisher, consoleLogOptions(vmopts))
+
+	if checkpoint != nil {
+		// keep the container frozen until the task is started, like a criu restore
+		if err := srv.Pause(ctx, cfg.ID); err != nil {
+			return nil, errors.Errorf("pausing restored container: %w", err)
+		}
+		rt.restoredInitPid = checkpoint.InitPid
+	}
+
+	return rt, nil
+}
+
+// withCrashedContainer names the container in the vmm.GuestCrash err carries, if any.
+func withCrashedContainer(err error, containerID string) error {
+	var crash *vmm.GuestCrash
+	if errors.As(err, &crash) {
+		crash.ContainerID = containerID
+	}
+	return err
+}
+
+// ReattachRunmVMRuntime reconnects to a vm started by a previous shim process.
+func ReattachRunmVMRuntime[VM vmm.VirtualMachine](
+	ctx context.Context,
+	hpv vmm.Hypervisor[VM],
+	opts *runtime.ReattachOptions,
+	vmopts *vmoptions.Options,
+) (*RunmVMRuntime[VM], error) {
+	st, err := vmm.ReadPersistedVM(opts.StateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	vm, err := vmm.ReattachRunningVM(ctx, hpv, st)
+	if err != nil {
+		return nil, err
+	}
+
+	srv, err := vm.GuestService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := srv.Readiness(ctx); err != nil {
+		return nil, errors.Errorf("guest agent of vm %s is not ready: %w", st.ID, err)
+	}
+
+	slog.InfoContext(ctx, "reattached to guest service", "id", st.ID)
+
+	return newRunmVMRuntime(ctx, vm, srv, opts.ContainerID, opts.OciSpec, opts.Publisher, consoleLogOptions(vmopts)), nil
+}
+
+func newRunmVMRuntime[VM vmm.VirtualMachine](
+	ctx context.Context,
+	vm *vmm.RunningVM[VM],
+	srv *grpcruntime.GRPCClientRuntime,
+	containerID string,
+	spec *specs.Spec,
+	publisher events.Publisher,
+	consoleLog vmm.ConsoleLogOptions,
+) *RunmVMRuntime[VM] {
+	runGroup := run.New()
+
+	ep := oom.NewWatcher(containerID, containerCgroupPath(spec), publisher, srv)
 
 	slog.InfoContext(ctx, "created oom watcher", "id", vm.VM().ID())
 
 	runGroup.Always(ep)
 
 	return &RunmVMRuntime[VM]{
-		vm:              vm,
-		oomWatcher:      ep,
-		spec:            cfg.Spec,
-		Runtime:         srv,
-		RuntimeExtras:   srv,
-		CgroupAdapter:   srv,
-		EventHandler:    srv,
-		GuestManagement: srv,
-		runGroup:        runGroup,
-	}, nil
+		containerID:       containerID,
+		vm:                vm,
+		oomWatcher:        ep,
+		consoleLog:        vmm.NewConsoleLog(vm.WorkingDir(), consoleLog),
+		spec:              spec,
+		Runtime:           srv,
+		RuntimeExtras:     srv,
+		CgroupAdapter:     srv,
+		EventHandler:      srv,
+		GuestManagement:   srv,
+		runGroup:          runGroup,
+		unregisterMetrics: registerVMMetrics(vm, srv, containerID),
+	}
+}
+
+// VMStats implements vmm.VMStatsProvider.
+func (r *RunmVMRuntime[VM]) VMStats(ctx context.Context) (*vmm.VMStats, error) {
+	return r.vm.Stats(ctx)
+}
+
+// BootTiming implements vmm.BootTimingProvider.
+func (r *RunmVMRuntime[VM]) BootTiming() *vmm.BootTiming {
+	return r.vm.BootTiming()
+}
+
+// WaitGuestCrash implements vmm.GuestCrashWatcher.
+func (r *RunmVMRuntime[VM]) WaitGuestCrash(ctx context.Context) (*vmm.GuestCrash, error) {
+	crash, err := r.vm.WaitGuestCrash(ctx)
+	if crash != nil {
+		crash.ContainerID = r.containerID
+		metrics.GuestCrashes.WithLabelValues(string(crash.Kind)).Inc()
+	}
+	return crash, err
+}
+
+// ConsoleLog implements vmm.ConsoleLogProvider.
+func (r *RunmVMRuntime[VM]) ConsoleLog() *vmm.ConsoleLog {
+	return r.consoleLog
+}
+
+// Create implements runtime.Runtime, timing the runc create of the container.
+func (r *RunmVMRuntime[VM]) Create(ctx context.Context, id, bundle string, opts *gorunc.CreateOpts) error {
+	start := time.Now()
+	if err := r.Runtime.Create(ctx, id, bundle, opts); err != nil {
+		return err
+	}
+	if id == r.containerID {
+		r.vm.RecordBootPhase(ctx, vmm.BootPhaseRuncCreate, start)
+	}
+	return nil
+}
+
+// Start implements runtime.Runtime, timing the runc start of the container.
+func (r *RunmVMRuntime[VM]) Start(ctx context.Context, id string) error {
+	start := time.Now()
+	if err := r.Runtime.Start(ctx, id); err != nil {
+		return err
+	}
+	if id == r.containerID {
+		r.vm.RecordBootPhase(ctx, vmm.BootPhaseRuncStart, start)
+	}
+	return nil
+}
+
+// CheckpointVM implements runtime.VMCheckpointer.
+func (r *RunmVMRuntime[VM]) CheckpointVM(ctx context.Context, imagePath string, initPid int, exit bool) error {
+	err := r.vm.Checkpoint(ctx, imagePath, &vmm.VMCheckpoint{
+		ContainerID: r.containerID,
+		InitPid:     initPid,
+	}, exit)
+	if errors.Is(err, vmm.ErrFullSnapshotNotSupported) {
+		return errors.Errorf("%w: %s", errdefs.ErrNotImplemented, err)
+	}
+	return err
+}
+
+// RestoredInitPid implements runtime.VMRestoredRuntime.
+func (r *RunmVMRuntime[VM]) RestoredInitPid() int {
+	return r.restoredInitPid
+}
+
+// StateDir implements runtime.ReattachableRuntime.
+func (r *RunmVMRuntime[VM]) StateDir() string {
+	return r.vm.WorkingDir()
+}
+
+// containerCgroupPath is the cgroup the guest places the container in. The guest
+// cgroup adapter watches the root, so that is the fallback.
+func containerCgroupPath(spec *specs.Spec) string {
+	if spec != nil && spec.Linux != nil && spec.Linux.CgroupsPath != "" {
+		return spec.Linux.CgroupsPath
+	}
+	return "/"
 }
 
 // Alive implements run.Runnable.
@@ -106,7 +340,9 @@ func (r *RunmVMRuntime[VM]) Alive() bool {
 
 // Close implements run.Runnable.
 func (r *RunmVMRuntime[VM]) Close(ctx context.Context) error {
-	return r.vm.VM().HardStop(ctx)
+	r.unregisterMetrics()
+	defer r.vm.ReleaseWorkingDir()
+	return r.vm.HardStop(ctx)
 }
 
 // Fields implements run.Runnable.
@@ -126,5 +362,11 @@ func (r *RunmVMRuntime[VM]) Name() string {
 func (r *RunmVMRuntime[VM]) Run(ctx context.Context) error {
 	slog.InfoContext(ctx, "running vm", "id", r.vm.VM().ID())
 
+	if vmm.CanRotateConsoleLog(r.vm.VM()) {
+		go r.consoleLog.RunRotation(ctx)
+	} else {
+		slog.InfoContext(ctx, "not rotating console log, the hypervisor does not append to it", "id", r.vm.VM().ID())
+	}
+
 	return r.runGroup.RunContext(ctx)
 }
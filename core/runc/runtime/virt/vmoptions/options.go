@@ -0,0 +1,437 @@
+// Package vmoptions holds the runm runtime options containerd hands the shim.
+//
+// With CRI the options live in the containerd config, either inline through a
+// runm config file or as its body:
+//
+//	[plugins."io.containerd.cri.v1.runtime".containerd.runtimes.runm]
+//	  runtime_type = "io.containerd.runm.v2"
+//	  [plugins."io.containerd.cri.v1.runtime".containerd.runtimes.runm.options]
+//	    ConfigPath = "/etc/runm/runm.toml"
+//
+// and with ctr through `ctr run --runtime-config-path /etc/runm/runm.toml`. The
+// config file itself is decoded into Options:
+//
+//	kernel_path = "/opt/runm/kernel"
+//	initramfs_path = "/opt/runm/initramfs.cpio.gz"
+//	default_memory = "512m"
+//	default_vcpus = 2
+//	network_mode = "none"
+//	log_level = "debug"
+//	boot_timeout = "1m"
+//	metrics_address = "unix:///run/runm/metrics/{id}.sock"
+//	devices = ["virtio-rng"]
+//
+//	[platforms."linux/amd64"]
+//	  build_dir = "/opt/runm/amd64"
+//
+//	[tracing]
+//	  endpoint = "http://localhost:4317"
+//	  guest_endpoint = "http://192.168.127.254:4317"
+//
+//	[cache_gc]
+//	  budget = "20g"
+//	  dry_run = true
+//
+//	[console_log]
+//	  max_size = "1m"
+//	  max_files = 3
+//	  max_age = "24h"
+package vmoptions
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/api/types/runc/options"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/typeurl/v2"
+	"github.com/pelletier/go-toml/v2"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/pkg/tracing"
+	"github.com/walteh/runm/pkg/units"
+
+	runtimeoptions "github.com/containerd/containerd/api/types/runtimeoptions/v1"
+	dockerunits "github.com/docker/go-units"
+)
+
+func init() {
+	typeurl.Register(&Options{}, "github.com/walteh/runm/core/runc/runtime/virt/vmoptions", "Options")
+}
+
+// Filename is where the shim manager leaves the decoded options in the bundle for
+// the shim serving the container.
+const Filename = "runm-options.json"
+
+// BuildDirEnv is the development fallback for BuildDir when no options are given.
+const BuildDirEnv = "LINUX_RUNTIME_BUILD_DIR"
+
+const (
+	DefaultBootTimeout         = 30 * time.Second
+	DefaultGuestConnectTimeout = 3 * time.Second
+)
+
+type NetworkMode string
+
+const (
+	// NetworkModeGvnet gives the vm a virtio-net device backed by gvisor-tap-vsock.
+	NetworkModeGvnet NetworkMode = "gvnet"
+	// NetworkModeNone boots the vm without a network device.
+	NetworkModeNone NetworkMode = "none"
+)
+
+// Duration is a time.Duration written as a string such as "30s".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// GuestImages are the kernel, initramfs and mbin image a guest boots from.
+type GuestImages struct {
+	BuildDir      string `toml:"build_dir" json:"build_dir,omitempty"`
+	KernelPath    string `toml:"kernel_path" json:"kernel_path,omitempty"`
+	InitramfsPath string `toml:"initramfs_path" json:"initramfs_path,omitempty"`
+}
+
+// TracingOptions configures OpenTelemetry tracing of the shim and the guest agent.
+type TracingOptions struct {
+	// Endpoint is the url of the OTLP collector the shim exports to.
+	Endpoint string `toml:"endpoint" json:"endpoint,omitempty"`
+	// Protocol is how the collectors are spoken to, "grpc" by default or
+	// "http/protobuf".
+	Protocol string `toml:"protocol" json:"protocol,omitempty"`
+	// FilePath gets the shim spans as json lines, for use without a collector.
+	FilePath string `toml:"file_path" json:"file_path,omitempty"`
+	// GuestEndpoint is the url of the collector the guest agent exports to, it has
+	// to be reachable from the guest network. The guest exports nothing without it.
+	GuestEndpoint string `toml:"guest_endpoint" json:"guest_endpoint,omitempty"`
+}
+
+// CacheGCOptions configures the collection of the vm working directories and
+// snapshots, which the shim runs when it starts and after every container delete.
+type CacheGCOptions struct {
+	// Budget caps their disk usage, e.g. "20g". Without it only the working
+	// directories of vms that no longer exist are removed.
+	Budget string `toml:"budget" json:"budget,omitempty"`
+	// MinAge keeps working directories younger than MinAge, 10m by default.
+	MinAge Duration `toml:"min_age" json:"min_age,omitempty"`
+	// DryRun logs what would be removed without removing it.
+	DryRun   bool `toml:"dry_run" json:"dry_run,omitempty"`
+	Disabled bool `toml:"disabled" json:"disabled,omitempty"`
+}
+
+// ConsoleLogOptions configures the rotation of the guest console log, console.log in
+// the working directory of the vm.
+type ConsoleLogOptions struct {
+	// MaxSize rotates the log once it grows past it, e.g. "1m", 10m by default.
+	MaxSize string `toml:"max_size" json:"max_size,omitempty"`
+	// MaxFiles is the number of rotated logs kept, 5 by default.
+	MaxFiles int `toml:"max_files" json:"max_files,omitempty"`
+	// MaxAge removes rotated logs older than MaxAge, they are kept by default.
+	MaxAge Duration `toml:"max_age" json:"max_age,omitempty"`
+}
+
+// Options configures every vm a runm shim creates. Zero fields take the defaults.
+type Options struct {
+	// BuildDir holds the kernel, initramfs and mbin image built for the guest.
+	BuildDir string `toml:"build_dir" json:"build_dir,omitempty"`
+	// KernelPath and InitramfsPath override the kernel and initramfs in BuildDir.
+	KernelPath    string `toml:"kernel_path" json:"kernel_path,omitempty"`
+	InitramfsPath string `toml:"initramfs_path" json:"initramfs_path,omitempty"`
+	// Platforms, keyed by guest platform such as "linux/amd64", replace the guest
+	// images above for guests of that platform.
+	Platforms map[string]GuestImages `toml:"platforms" json:"platforms,omitempty"`
+
+	// DefaultMemory and DefaultVCPUs size vms whose container sets no limits, see
+	// virt.ComputeVMSize. MaxMemory and MaxVCPUs cap every vm below the host size.
+	DefaultMemory string `toml:"default_memory" json:"default_memory,omitempty"`
+	DefaultVCPUs  uint64 `toml:"default_vcpus" json:"default_vcpus,omitempty"`
+	MaxMemory     string `toml:"max_memory" json:"max_memory,omitempty"`
+	MaxVCPUs      uint64 `toml:"max_vcpus" json:"max_vcpus,omitempty"`
+
+	NetworkMode NetworkMode `toml:"network_mode" json:"network_mode,omitempty"`
+	// LogLevel is the level the shim and the guest log at, one of trace, debug,
+	// info, warn or error. The guest logs at debug when it is not set.
+	LogLevel string `toml:"log_level" json:"log_level,omitempty"`
+	// Debug keeps extra diagnostics running in the guest.
+	Debug bool `toml:"debug" json:"debug,omitempty"`
+
+	// BootTimeout bounds how long the vm may take to reach the running state.
+	BootTimeout Duration `toml:"boot_timeout" json:"boot_timeout,omitempty"`
+	// GuestConnectTimeout bounds how long the guest agent may take to accept a
+	// connection once the vm runs.
+	GuestConnectTimeout Duration `toml:"guest_connect_timeout" json:"guest_connect_timeout,omitempty"`
+
+	// MetricsAddress is where the shim serves prometheus metrics, "unix://<path>" or
+	// a tcp "host:port". "{id}" is replaced with the container id, so that every shim
+	// gets its own socket. No metrics are served without it.
+	MetricsAddress string `toml:"metrics_address" json:"metrics_address,omitempty"`
+
+	// Devices are added to every vm, written as device strings such as
+	// "virtio-rng", see virtio.ParseDevice.
+	Devices []string `toml:"devices" json:"devices,omitempty"`
+
+	Tracing    TracingOptions    `toml:"tracing" json:"tracing"`
+	CacheGC    CacheGCOptions    `toml:"cache_gc" json:"cache_gc"`
+	ConsoleLog ConsoleLogOptions `toml:"console_log" json:"console_log"`
+}
+
+// Default returns the options used when containerd passes none.
+func Default() *Options {
+	o := &Options{}
+	o.fill()
+	return o
+}
+
+func (o *Options) fill() {
+	if o.BuildDir == "" {
+		o.BuildDir = os.Getenv(BuildDirEnv)
+	}
+	if o.NetworkMode == "" {
+		o.NetworkMode = NetworkModeGvnet
+	}
+	for platform, images := range o.Platforms {
+		// "linux/arm64/v8" is looked up as "linux/arm64"
+		if resolved := units.ResolvePlatformVariant(platform).String(); resolved != platform {
+			delete(o.Platforms, platform)
+			o.Platforms[resolved] = images
+		}
+	}
+	if o.BootTimeout == 0 {
+		o.BootTimeout = Duration(DefaultBootTimeout)
+	}
+	if o.GuestConnectTimeout == 0 {
+		o.GuestConnectTimeout = Duration(DefaultGuestConnectTimeout)
+	}
+}
+
+// GuestImages returns the images guests of platform boot from.
+func (o *Options) GuestImages(platform units.Platform) GuestImages {
+	if images, ok := o.Platforms[platform.String()]; ok {
+		return images
+	}
+	return GuestImages{
+		BuildDir:      o.BuildDir,
+		KernelPath:    o.KernelPath,
+		InitramfsPath: o.InitramfsPath,
+	}
+}
+
+// SlogLevel returns LogLevel as a slog level, info when it is not set.
+func (o *Options) SlogLevel() slog.Level {
+	switch strings.ToLower(o.LogLevel) {
+	case "trace":
+		return slog.LevelDebug - 4
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// TracingConfig is the tracing setup of the shim.
+func (o *Options) TracingConfig() tracing.Config {
+	return tracing.Config{
+		ServiceName: "containerd-shim-runm-v2",
+		Endpoint:    o.Tracing.Endpoint,
+		Protocol:    tracing.Protocol(o.Tracing.Protocol),
+		FilePath:    o.Tracing.FilePath,
+	}
+}
+
+// MetricsListenAddress is MetricsAddress for the shim of container id.
+func (o *Options) MetricsListenAddress(id string) string {
+	return strings.ReplaceAll(o.MetricsAddress, "{id}", id)
+}
+
+// ExtraDevices returns Devices parsed into the devices added to every vm.
+func (o *Options) ExtraDevices() ([]virtio.VirtioDevice, error) {
+	devs, err := virtio.ParseDevices(o.Devices)
+	if err != nil {
+		return nil, errors.Errorf("invalid devices: %w: %w", err, errdefs.ErrInvalidArgument)
+	}
+	return devs, nil
+}
+
+// GuestSlogLevel is the level runm-linux-init logs at, LogLevel when it is set and
+// debug otherwise.
+func (o *Options) GuestSlogLevel() slog.Level {
+	if o.LogLevel == "" {
+		return slog.LevelDebug
+	}
+	return o.SlogLevel()
+}
+
+// Validate reports the first option that cannot be used. A missing BuildDir is only
+// reported when a vm is created, so that a shim can still be cleaned up without one.
+func (o *Options) Validate() error {
+	for name, v := range map[string]string{"default_memory": o.DefaultMemory, "max_memory": o.MaxMemory, "cache_gc budget": o.CacheGC.Budget, "console_log max_size": o.ConsoleLog.MaxSize} {
+		if v == "" {
+			continue
+		}
+		if n, err := dockerunits.RAMInBytes(v); err != nil || n <= 0 {
+			return errors.Errorf("invalid %s %q: %w", name, v, errdefs.ErrInvalidArgument)
+		}
+	}
+
+	for platform := range o.Platforms {
+		if p, err := units.ParsePlatform(platform); err != nil || p.OS() != units.OSLinux {
+			return errors.Errorf("invalid guest platform %q: %w", platform, errdefs.ErrInvalidArgument)
+		}
+	}
+
+	switch o.NetworkMode {
+	case NetworkModeGvnet, NetworkModeNone:
+	default:
+		return errors.Errorf("invalid network_mode %q, expected %q or %q: %w", o.NetworkMode, NetworkModeGvnet, NetworkModeNone, errdefs.ErrInvalidArgument)
+	}
+
+	switch strings.ToLower(o.LogLevel) {
+	case "", "trace", "debug", "info", "warn", "warning", "error":
+	default:
+		return errors.Errorf("invalid log_level %q: %w", o.LogLevel, errdefs.ErrInvalidArgument)
+	}
+
+	if o.BootTimeout < 0 || o.GuestConnectTimeout < 0 {
+		return errors.Errorf("timeouts must not be negative: %w", errdefs.ErrInvalidArgument)
+	}
+
+	if o.CacheGC.MinAge < 0 {
+		return errors.Errorf("cache_gc min_age must not be negative: %w", errdefs.ErrInvalidArgument)
+	}
+
+	if o.ConsoleLog.MaxFiles < 0 || o.ConsoleLog.MaxAge < 0 {
+		return errors.Errorf("console_log max_files and max_age must not be negative: %w", errdefs.ErrInvalidArgument)
+	}
+
+	switch tracing.Protocol(o.Tracing.Protocol) {
+	case "", tracing.ProtocolGRPC, tracing.ProtocolHTTP:
+	default:
+		return errors.Errorf("invalid tracing protocol %q, expected %q or %q: %w", o.Tracing.Protocol, tracing.ProtocolGRPC, tracing.ProtocolHTTP, errdefs.ErrInvalidArgument)
+	}
+
+	for name, v := range map[string]string{"endpoint": o.Tracing.Endpoint, "guest_endpoint": o.Tracing.GuestEndpoint} {
+		if v == "" {
+			continue
+		}
+		if u, err := url.Parse(v); err != nil || u.Host == "" {
+			return errors.Errorf("invalid tracing %s %q: %w", name, v, errdefs.ErrInvalidArgument)
+		}
+	}
+
+	if o.Tracing.GuestEndpoint != "" && o.NetworkMode == NetworkModeNone {
+		return errors.Errorf("tracing guest_endpoint needs a guest network: %w", errdefs.ErrInvalidArgument)
+	}
+
+	if o.MetricsAddress != "" {
+		if path, ok := strings.CutPrefix(o.MetricsAddress, "unix://"); ok {
+			if !filepath.IsAbs(path) {
+				return errors.Errorf("invalid metrics_address %q, the socket path must be absolute: %w", o.MetricsAddress, errdefs.ErrInvalidArgument)
+			}
+		} else if _, _, err := net.SplitHostPort(strings.TrimPrefix(o.MetricsAddress, "tcp://")); err != nil {
+			return errors.Errorf("invalid metrics_address %q: %w", o.MetricsAddress, errdefs.ErrInvalidArgument)
+		}
+	}
+
+	if _, err := o.ExtraDevices(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Decode turns the runtime options containerd sends the shim into validated
+// Options. nil and runc options, which CRI sends when no options are configured,
+// give the defaults.
+func Decode(v any) (*Options, error) {
+	var o *Options
+
+	switch v := v.(type) {
+	case nil, *options.Options:
+		o = &Options{}
+	case *Options:
+		c := *v
+		c.Platforms = maps.Clone(v.Platforms)
+		c.Devices = slices.Clone(v.Devices)
+		o = &c
+	case *runtimeoptions.Options:
+		body := v.GetConfigBody()
+		if len(body) == 0 && v.GetConfigPath() != "" {
+			var err error
+			if body, err = os.ReadFile(v.GetConfigPath()); err != nil {
+				return nil, errors.Errorf("reading runm config: %w", err)
+			}
+		}
+		o = &Options{}
+		if len(body) > 0 {
+			dec := toml.NewDecoder(bytes.NewReader(body))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(o); err != nil {
+				return nil, errors.Errorf("decoding runm config %s: %w", v.GetConfigPath(), err)
+			}
+		}
+	default:
+		return nil, errors.Errorf("unsupported runtime options %T: %w", v, errdefs.ErrInvalidArgument)
+	}
+
+	o.fill()
+
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// Read reads the options the shim manager wrote to the bundle at path. When the
+// file does not exist, Read returns the defaults.
+func Read(path string) (*Options, error) {
+	data, err := os.ReadFile(filepath.Join(path, Filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Default(), nil
+		}
+		return nil, err
+	}
+
+	o := &Options{}
+	if err := json.Unmarshal(data, o); err != nil {
+		return nil, errors.Errorf("decoding %s: %w", Filename, err)
+	}
+	o.fill()
+
+	return o, nil
+}
+
+// Write writes the options to the bundle at path.
+func Write(path string, o *Options) error {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(path, Filename), data, 0600)
+}
@@ -0,0 +1,198 @@
+package vmoptions_test
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/api/types/runc/options"
+	"github.com/containerd/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	runtimeoptions "github.com/containerd/containerd/api/types/runtimeoptions/v1"
+
+	"github.com/walteh/runm/core/runc/runtime/virt/vmoptions"
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/pkg/units"
+)
+
+const config = `
+build_dir = "/opt/runm"
+kernel_path = "/opt/runm/custom-kernel"
+default_memory = "512m"
+default_vcpus = 2
+network_mode = "none"
+log_level = "debug"
+boot_timeout = "1m"
+`
+
+func TestDecode(t *testing.T) {
+	want := &vmoptions.Options{
+		BuildDir:            "/opt/runm",
+		KernelPath:          "/opt/runm/custom-kernel",
+		DefaultMemory:       "512m",
+		DefaultVCPUs:        2,
+		NetworkMode:         vmoptions.NetworkModeNone,
+		LogLevel:            "debug",
+		BootTimeout:         vmoptions.Duration(time.Minute),
+		GuestConnectTimeout: vmoptions.Duration(vmoptions.DefaultGuestConnectTimeout),
+	}
+
+	t.Run("config body", func(t *testing.T) {
+		got, err := vmoptions.Decode(&runtimeoptions.Options{ConfigBody: []byte(config)})
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("config path", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "runm.toml")
+		require.NoError(t, os.WriteFile(path, []byte(config), 0600))
+
+		got, err := vmoptions.Decode(&runtimeoptions.Options{ConfigPath: path})
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("typed options", func(t *testing.T) {
+		got, err := vmoptions.Decode(&vmoptions.Options{BuildDir: "/opt/runm", MaxVCPUs: 4})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(4), got.MaxVCPUs)
+		assert.Equal(t, vmoptions.NetworkModeGvnet, got.NetworkMode)
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		t.Setenv(vmoptions.BuildDirEnv, "/from/env")
+
+		for _, v := range []any{nil, &options.Options{}, &runtimeoptions.Options{}} {
+			got, err := vmoptions.Decode(v)
+			require.NoError(t, err)
+			assert.Equal(t, vmoptions.Default(), got)
+			assert.Equal(t, "/from/env", got.BuildDir)
+		}
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		_, err := vmoptions.Decode(&runtimeoptions.Options{ConfigBody: []byte(`kernel = "/boot/vmlinuz"`)})
+		require.Error(t, err)
+	})
+
+	t.Run("invalid network mode", func(t *testing.T) {
+		_, err := vmoptions.Decode(&runtimeoptions.Options{ConfigBody: []byte(`network_mode = "bridge"`)})
+		require.ErrorIs(t, err, errdefs.ErrInvalidArgument)
+	})
+
+	t.Run("invalid memory", func(t *testing.T) {
+		_, err := vmoptions.Decode(&vmoptions.Options{DefaultMemory: "lots"})
+		require.ErrorIs(t, err, errdefs.ErrInvalidArgument)
+	})
+
+	t.Run("tracing", func(t *testing.T) {
+		got, err := vmoptions.Decode(&runtimeoptions.Options{ConfigBody: []byte(`
+[tracing]
+endpoint = "http://localhost:4318"
+protocol = "http/protobuf"
+guest_endpoint = "http://192.168.127.254:4318"
+`)})
+		require.NoError(t, err)
+		assert.Equal(t, "http://192.168.127.254:4318", got.Tracing.GuestEndpoint)
+		assert.Equal(t, "http://localhost:4318", got.TracingConfig().Endpoint)
+
+		for _, body := range []string{
+			"[tracing]\nprotocol = \"zipkin\"",
+			"[tracing]\nendpoint = \"localhost\"",
+			"network_mode = \"none\"\n[tracing]\nguest_endpoint = \"http://192.168.127.254:4317\"",
+		} {
+			_, err := vmoptions.Decode(&runtimeoptions.Options{ConfigBody: []byte(body)})
+			require.ErrorIs(t, err, errdefs.ErrInvalidArgument, body)
+		}
+	})
+
+	t.Run("metrics address", func(t *testing.T) {
+		got, err := vmoptions.Decode(&runtimeoptions.Options{ConfigBody: []byte(`metrics_address = "unix:///run/runm/metrics/{id}.sock"`)})
+		require.NoError(t, err)
+		assert.Equal(t, "unix:///run/runm/metrics/abc.sock", got.MetricsListenAddress("abc"))
+
+		for _, addr := range []string{"unix://metrics.sock", "localhost"} {
+			_, err := vmoptions.Decode(&vmoptions.Options{MetricsAddress: addr})
+			require.ErrorIs(t, err, errdefs.ErrInvalidArgument, addr)
+		}
+
+		_, err = vmoptions.Decode(&vmoptions.Options{MetricsAddress: "127.0.0.1:9101"})
+		require.NoError(t, err)
+	})
+
+	t.Run("cache gc", func(t *testing.T) {
+		got, err := vmoptions.Decode(&runtimeoptions.Options{ConfigBody: []byte("[cache_gc]\nbudget = \"20g\"\nmin_age = \"1h\"\ndry_run = true")})
+		require.NoError(t, err)
+		assert.Equal(t, vmoptions.CacheGCOptions{Budget: "20g", MinAge: vmoptions.Duration(time.Hour), DryRun: true}, got.CacheGC)
+
+		_, err = vmoptions.Decode(&vmoptions.Options{CacheGC: vmoptions.CacheGCOptions{Budget: "plenty"}})
+		require.ErrorIs(t, err, errdefs.ErrInvalidArgument)
+	})
+
+	t.Run("console log", func(t *testing.T) {
+		got, err := vmoptions.Decode(&runtimeoptions.Options{ConfigBody: []byte("[console_log]\nmax_size = \"1m\"\nmax_files = 3\nmax_age = \"24h\"")})
+		require.NoError(t, err)
+		assert.Equal(t, vmoptions.ConsoleLogOptions{MaxSize: "1m", MaxFiles: 3, MaxAge: vmoptions.Duration(24 * time.Hour)}, got.ConsoleLog)
+
+		_, err = vmoptions.Decode(&vmoptions.Options{ConsoleLog: vmoptions.ConsoleLogOptions{MaxSize: "big"}})
+		require.ErrorIs(t, err, errdefs.ErrInvalidArgument)
+
+		_, err = vmoptions.Decode(&vmoptions.Options{ConsoleLog: vmoptions.ConsoleLogOptions{MaxFiles: -1}})
+		require.ErrorIs(t, err, errdefs.ErrInvalidArgument)
+	})
+
+	t.Run("devices", func(t *testing.T) {
+		got, err := vmoptions.Decode(&runtimeoptions.Options{ConfigBody: []byte(`devices = ["virtio-rng", "virtio-input,keyboard"]`)})
+		require.NoError(t, err)
+		devs, err := got.ExtraDevices()
+		require.NoError(t, err)
+		assert.Equal(t, []virtio.VirtioDevice{&virtio.VirtioRng{}, &virtio.VirtioInput{InputType: virtio.VirtioInputKeyboardDevice}}, devs)
+
+		_, err = vmoptions.Decode(&vmoptions.Options{Devices: []string{"virtio-input,mouse"}})
+		require.ErrorIs(t, err, errdefs.ErrInvalidArgument)
+		require.ErrorIs(t, err, virtio.ErrInvalidDeviceString)
+	})
+}
+
+func TestGuestImages(t *testing.T) {
+	o, err := vmoptions.Decode(&runtimeoptions.Options{ConfigBody: []byte(`
+build_dir = "/opt/runm/arm64"
+kernel_path = "/opt/runm/arm64/custom-kernel"
+
+[platforms."linux/amd64"]
+build_dir = "/opt/runm/amd64"
+`)})
+	require.NoError(t, err)
+
+	assert.Equal(t, vmoptions.GuestImages{BuildDir: "/opt/runm/arm64", KernelPath: "/opt/runm/arm64/custom-kernel"}, o.GuestImages(units.PlatformLinuxARM64))
+	assert.Equal(t, vmoptions.GuestImages{BuildDir: "/opt/runm/amd64"}, o.GuestImages(units.PlatformLinuxAMD64))
+
+	_, err = vmoptions.Decode(&vmoptions.Options{Platforms: map[string]vmoptions.GuestImages{"amd64": {}}})
+	require.ErrorIs(t, err, errdefs.ErrInvalidArgument)
+}
+
+func TestReadWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	got, err := vmoptions.Read(dir)
+	require.NoError(t, err)
+	assert.Equal(t, vmoptions.Default(), got)
+
+	want, err := vmoptions.Decode(&runtimeoptions.Options{ConfigBody: []byte(config)})
+	require.NoError(t, err)
+	require.NoError(t, vmoptions.Write(dir, want))
+
+	got, err = vmoptions.Read(dir)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func TestGuestSlogLevel(t *testing.T) {
+	assert.Equal(t, slog.LevelDebug, (&vmoptions.Options{}).GuestSlogLevel())
+	assert.Equal(t, slog.LevelInfo, (&vmoptions.Options{LogLevel: "info"}).GuestSlogLevel())
+	assert.Equal(t, slog.LevelWarn, (&vmoptions.Options{LogLevel: "warn"}).GuestSlogLevel())
+}
@@ -3,7 +3,11 @@ package server
 import (
 	"context"
 
+	"github.com/containerd/cgroups/v3/cgroup2/stats"
+	"github.com/containerd/errdefs"
+	"github.com/walteh/runm/core/runc/runtime"
 	runmv1 "github.com/walteh/runm/proto/v1"
+	"gitlab.com/tozd/go/errors"
 	"google.golang.org/grpc"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
@@ -12,8 +16,18 @@ import (
 var _ runmv1.CgroupAdapterServiceServer = (*Server)(nil)
 
 // GetCgroupStats implements runmv1.CgroupAdapterServiceServer.
-func (s *Server) GetCgroupStats(ctx context.Context, _ *runmv1.GetCgroupStatsRequest) (*runmv1.GetCgroupStatsResponse, error) {
-	statz, err := s.cgroupAdapter.Stat(ctx)
+func (s *Server) GetCgroupStats(ctx context.Context, req *runmv1.GetCgroupStatsRequest) (*runmv1.GetCgroupStatsResponse, error) {
+	var statz *stats.Metrics
+	var err error
+	if path := req.GetCgroupPath(); path != "" {
+		ps, ok := s.cgroupAdapter.(runtime.CgroupPathStatter)
+		if !ok {
+			return nil, errors.Errorf("cgroup adapter %T cannot read cgroup %s: %w", s.cgroupAdapter, path, errdefs.ErrNotImplemented)
+		}
+		statz, err = ps.StatPath(ctx, path)
+	} else {
+		statz, err = s.cgroupAdapter.Stat(ctx)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -38,28 +52,28 @@ func (s *Server) StreamCgroupEvents(_ *runmv1.StreamCgroupEventsRequest, srv grp
 		return err
 	}
 
-	oerrch := make(chan error)
-
 	for {
 		select {
-		case event := <-eventCh:
-			go func() {
-				rev := &runmv1.CgroupEvent{}
-				rev.SetHigh(event.High)
-				rev.SetMax(event.Max)
-				rev.SetOom(event.OOM)
-				rev.SetOomKill(event.OOMKill)
-				rev.SetLow(event.Low)
-				resp := &runmv1.StreamCgroupEventsResponse{}
-				resp.SetEvent(rev)
-				if err := srv.Send(resp); err != nil {
-					oerrch <- err
-				}
-			}()
+		case <-srv.Context().Done():
+			return srv.Context().Err()
+		case event, ok := <-eventCh:
+			if !ok {
+				return nil
+			}
+			rev := &runmv1.CgroupEvent{}
+			rev.SetHigh(event.High)
+			rev.SetMax(event.Max)
+			rev.SetOom(event.OOM)
+			rev.SetOomKill(event.OOMKill)
+			rev.SetLow(event.Low)
+			resp := &runmv1.StreamCgroupEventsResponse{}
+			resp.SetEvent(rev)
+			// send inline so events reach the host in the order the cgroup produced them
+			if err := srv.Send(resp); err != nil {
+				return err
+			}
 		case err := <-errCh:
 			return err
-		case err := <-oerrch:
-			return err
 		}
 	}
 }
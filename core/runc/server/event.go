@@ -2,7 +2,6 @@ package server
 
 import (
 	"context"
-	"encoding/json"
 	"log/slog"
 
 	"github.com/walteh/runm/core/runc/runtime"
@@ -27,42 +26,23 @@ func (s *Server) PublishEvent(ctx context.Context, req *runmv1.PublishEventReque
 	return &runmv1.PublishEventResponse{}, nil
 }
 
-// PublishEvents implements runmv1.EventServiceServer.
+// ReceiveEvents implements runmv1.EventServiceServer.
 func (s *Server) ReceiveEvents(_ *emptypb.Empty, srv grpc.ServerStreamingServer[runmv1.PublishEventsResponse]) error {
 	rec, err := s.eventHandler.Receive(srv.Context())
 	if err != nil {
 		return err
 	}
 
-	errch := make(chan error)
-
-	defer func() {
-		close(errch)
-	}()
-
+	// events are sent one at a time so the host sees them in publish order
 	for event := range rec {
-		go func() {
-			resp := &runmv1.PublishEventsResponse{}
-			resp.SetTopic(event.Topic)
-			by, err := json.Marshal(event.Data)
-			if err != nil {
-				errch <- errors.Errorf("failed to marshal json event data: %w", err)
-				return
-			}
-			resp.SetRawJson(by)
-			if err := srv.Send(resp); err != nil {
-				errch <- err
-			}
-		}()
-	}
-
-	for {
-		select {
-		case <-srv.Context().Done():
-			return srv.Context().Err()
-		case err := <-errch:
-			slog.Error("failed to send event", "error", err)
+		resp := &runmv1.PublishEventsResponse{}
+		resp.SetTopic(event.Topic)
+		resp.SetRawJson(event.Data)
+		if err := srv.Send(resp); err != nil {
+			slog.Error("failed to send event", "error", err, "topic", event.Topic)
 			return err
 		}
 	}
+
+	return srv.Context().Err()
 }
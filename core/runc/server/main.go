@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
@@ -18,13 +19,37 @@ type Server struct {
 	socketAllocator runtime.SocketAllocator
 	eventHandler    runtime.EventHandler
 	cgroupAdapter   runtime.CgroupAdapter
+	processTracker  ProcessTracker
+	hostClock       bool
 
 	state *state.State
 }
 
+// ProcessTracker is told about every process the server starts so that its exit
+// can be reported to the host.
+type ProcessTracker interface {
+	Track(ctx context.Context, containerID, execID string, pid int) error
+}
+
 type ServerOpt func(*ServerOpts)
 
 type ServerOpts struct {
+	ProcessTracker ProcessTracker
+	HostClock      bool
+}
+
+func WithProcessTracker(tracker ProcessTracker) ServerOpt {
+	return func(o *ServerOpts) {
+		o.ProcessTracker = tracker
+	}
+}
+
+// WithHostClock is for guests that share the clock of the host, like process
+// vms, GuestTimeSync then leaves the clock alone.
+func WithHostClock() ServerOpt {
+	return func(o *ServerOpts) {
+		o.HostClock = true
+	}
 }
 
 func NewServer(
@@ -46,12 +71,19 @@ func NewServer(
 		socketAllocator: socketAllocator,
 		eventHandler:    eventHandler,
 		cgroupAdapter:   cgroupAdapter,
+		processTracker:  optz.ProcessTracker,
+		hostClock:       optz.HostClock,
 		state:           state.NewState(),
 	}
 
 	return s
 }
 
+// OpenResources implements metrics.OpenResources.
+func (s *Server) OpenResources() map[string]int {
+	return s.state.OpenResources()
+}
+
 func (s *Server) RegisterGrpcServer(grpcServer *grpc.Server) {
 	runmv1.RegisterRuncServiceServer(grpcServer, s)
 	runmv1.RegisterRuncExtrasServiceServer(grpcServer, s)
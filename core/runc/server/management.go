@@ -10,6 +10,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/walteh/runm/linux/constants"
 	runmv1 "github.com/walteh/runm/proto/v1"
 	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
@@ -38,7 +39,7 @@ func (s *Server) GuestRunCommand(ctx context.Context, req *runmv1.GuestRunComman
 		Chroot: req.GetChroot(),
 	}
 	envdat := []string{
-		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"PATH=" + constants.DefaultGuestPath,
 	}
 	for key, value := range req.GetEnvVars() {
 		envdat = append(envdat, fmt.Sprintf("%s=%s", key, value))
@@ -73,11 +74,13 @@ func (s *Server) GuestTimeSync(ctx context.Context, req *runmv1.GuestTimeSyncReq
 	nowNano := uint64(time.Now().UnixNano())
 	updateNano := uint64(req.GetUnixTimeNs())
 
-	tv := unix.NsecToTimeval(int64(updateNano))
+	if !s.hostClock {
+		tv := unix.NsecToTimeval(int64(updateNano))
 
-	if err := unix.Settimeofday(&tv); err != nil {
-		slog.ErrorContext(ctx, "Settimeofday failed", "error", err)
-		return nil, status.Errorf(codes.Internal, "unix.Settimeofday failed: %v", err)
+		if err := unix.Settimeofday(&tv); err != nil {
+			slog.ErrorContext(ctx, "Settimeofday failed", "error", err)
+			return nil, status.Errorf(codes.Internal, "unix.Settimeofday failed: %v", err)
+		}
 	}
 
 	offset := int64(nowNano) - int64(updateNano)
@@ -10,9 +10,12 @@ import (
 
 	"github.com/kr/pty"
 	"gitlab.com/tozd/go/errors"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/walteh/runm/core/runc/conversion"
+	"github.com/walteh/runm/core/runc/exits"
 	"github.com/walteh/runm/core/runc/runtime"
+	"github.com/walteh/runm/pkg/tracing"
 
 	runmv1 "github.com/walteh/runm/proto/v1"
 )
@@ -90,10 +93,16 @@ func (s *Server) Create(ctx context.Context, req *runmv1.RuncCreateRequest) (*ru
 		return nil, errors.Errorf("failed to convert create opts: %w", err)
 	}
 
-	err = s.runtime.Create(ctx, req.GetId(), req.GetBundle(), opts)
+	runcCtx, span := tracing.Start(ctx, "runc.create", attribute.String("container_id", req.GetId()))
+	err = s.runtime.Create(runcCtx, req.GetId(), req.GetBundle(), opts)
+	tracing.End(span, err)
 	if err != nil {
 		resp.SetGoError(err.Error())
+		return resp, nil
 	}
+
+	s.trackProcess(ctx, req.GetId(), opts.PidFile)
+
 	return resp, nil
 }
 
@@ -101,7 +110,9 @@ func (s *Server) Create(ctx context.Context, req *runmv1.RuncCreateRequest) (*ru
 func (s *Server) Start(ctx context.Context, req *runmv1.RuncStartRequest) (*runmv1.RuncStartResponse, error) {
 	resp := &runmv1.RuncStartResponse{}
 
+	ctx, span := tracing.Start(ctx, "runc.start", attribute.String("container_id", req.GetId()))
 	err := s.runtime.Start(ctx, req.GetId())
+	tracing.End(span, err)
 	if err != nil {
 		resp.SetGoError(err.Error())
 	}
@@ -116,7 +127,9 @@ func (s *Server) Delete(ctx context.Context, req *runmv1.RuncDeleteRequest) (*ru
 
 	opts := conversion.ConvertDeleteOptsFromProto(req.GetOptions())
 
+	ctx, span := tracing.Start(ctx, "runc.delete", attribute.String("container_id", req.GetId()))
 	err := s.runtime.Delete(ctx, req.GetId(), opts)
+	tracing.End(span, err)
 	if err != nil {
 		resp.SetGoError(err.Error())
 	}
@@ -129,7 +142,9 @@ func (s *Server) Kill(ctx context.Context, req *runmv1.RuncKillRequest) (*runmv1
 
 	opts := conversion.ConvertKillOptsFromProto(req.GetOptions())
 
+	ctx, span := tracing.Start(ctx, "runc.kill", attribute.String("container_id", req.GetId()), attribute.Int("signal", int(req.GetSignal())))
 	err := s.runtime.Kill(ctx, req.GetId(), int(req.GetSignal()), opts)
+	tracing.End(span, err)
 	if err != nil {
 		resp.SetGoError(err.Error())
 	}
@@ -195,14 +210,37 @@ func (s *Server) Exec(ctx context.Context, req *runmv1.RuncExecRequest) (*runmv1
 		return nil, err
 	}
 
-	err = s.runtime.Exec(ctx, req.GetId(), *processSpec, opts)
+	runcCtx, span := tracing.Start(ctx, "runc.exec", attribute.String("container_id", req.GetId()))
+	err = s.runtime.Exec(runcCtx, req.GetId(), *processSpec, opts)
+	tracing.End(span, err)
 	if err != nil {
 		resp.SetGoError(err.Error())
+		return resp, nil
 	}
 
+	s.trackProcess(ctx, req.GetId(), opts.PidFile)
+
 	return resp, nil
 }
 
+// trackProcess hands the process runc just started to the process tracker. The exec
+// id is recovered from the pid file name the shim chose.
+func (s *Server) trackProcess(ctx context.Context, containerID, pidFile string) {
+	if s.processTracker == nil || pidFile == "" {
+		return
+	}
+
+	pid, err := s.runtime.ReadPidFile(ctx, pidFile)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to read pid file, exit will not be reported", "pid_file", pidFile, "error", err)
+		return
+	}
+
+	if err := s.processTracker.Track(ctx, containerID, exits.ExecIDFromPidFile(pidFile), pid); err != nil {
+		slog.ErrorContext(ctx, "failed to track process, exit will not be reported", "pid", pid, "error", err)
+	}
+}
+
 // Checkpoint implements runmv1.RuncServiceServer.
 func (s *Server) Checkpoint(context.Context, *runmv1.RuncCheckpointRequest) (*runmv1.RuncCheckpointResponse, error) {
 	return nil, runtime.ReflectNotImplementedError()
@@ -54,3 +54,21 @@ func (s *State) DeleteOpenSocket(referenceId string) {
 func (s *State) DeleteOpenConsole(referenceId string) {
 	s.openConsoles.Delete(referenceId)
 }
+
+// OpenResources counts what is held open, keyed by kind.
+func (s *State) OpenResources() map[string]int {
+	return map[string]int{
+		"io":      count(s.openIOs),
+		"socket":  count(s.openSockets),
+		"console": count(s.openConsoles),
+	}
+}
+
+func count[V any](m *syncmap.Map[string, V]) int {
+	n := 0
+	m.Range(func(string, V) bool {
+		n++
+		return true
+	})
+	return n
+}
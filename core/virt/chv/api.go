@@ -0,0 +1,233 @@
+package chv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// VMConfig is the part of the cloud hypervisor vm config runm uses, see
+// https://github.com/cloud-hypervisor/cloud-hypervisor/blob/main/vmm/src/api/openapi/cloud-hypervisor.yaml
+type VMConfig struct {
+	Cpus    CpusConfig     `json:"cpus"`
+	Memory  MemoryConfig   `json:"memory"`
+	Payload PayloadConfig  `json:"payload"`
+	Disks   []DiskConfig   `json:"disks,omitempty"`
+	Net     []NetConfig    `json:"net,omitempty"`
+	Fs      []FsConfig     `json:"fs,omitempty"`
+	Vsock   *VsockConfig   `json:"vsock,omitempty"`
+	Balloon *BalloonConfig `json:"balloon,omitempty"`
+	Rng     *RngConfig     `json:"rng,omitempty"`
+	Serial  ConsoleConfig  `json:"serial"`
+	Console ConsoleConfig  `json:"console"`
+}
+
+type CpusConfig struct {
+	BootVcpus uint64 `json:"boot_vcpus"`
+	MaxVcpus  uint64 `json:"max_vcpus"`
+}
+
+type MemoryConfig struct {
+	Size uint64 `json:"size"`
+	// Shared memory is required by vhost-user devices like virtiofs.
+	Shared bool `json:"shared,omitempty"`
+}
+
+type PayloadConfig struct {
+	Kernel    string `json:"kernel,omitempty"`
+	Initramfs string `json:"initramfs,omitempty"`
+	Cmdline   string `json:"cmdline,omitempty"`
+}
+
+type DiskConfig struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+	Serial   string `json:"serial,omitempty"`
+}
+
+type NetConfig struct {
+	Mac string `json:"mac,omitempty"`
+}
+
+type FsConfig struct {
+	Tag       string `json:"tag"`
+	Socket    string `json:"socket"`
+	NumQueues int    `json:"num_queues"`
+	QueueSize int    `json:"queue_size"`
+}
+
+type VsockConfig struct {
+	Cid    uint32 `json:"cid"`
+	Socket string `json:"socket"`
+}
+
+type BalloonConfig struct {
+	// Size is the memory taken from the guest, not the memory left to it.
+	Size         uint64 `json:"size"`
+	DeflateOnOom bool   `json:"deflate_on_oom,omitempty"`
+}
+
+type RngConfig struct {
+	Src string `json:"src"`
+}
+
+type ConsoleMode string
+
+const (
+	ConsoleModeOff  ConsoleMode = "Off"
+	ConsoleModeNull ConsoleMode = "Null"
+	ConsoleModeFile ConsoleMode = "File"
+	// ConsoleModeTty writes to the stdout of cloud hypervisor.
+	ConsoleModeTty ConsoleMode = "Tty"
+)
+
+type ConsoleConfig struct {
+	Mode ConsoleMode `json:"mode"`
+	File string      `json:"file,omitempty"`
+}
+
+// VMState is the state cloud hypervisor reports for a vm.
+type VMState string
+
+const (
+	VMStateCreated    VMState = "Created"
+	VMStateRunning    VMState = "Running"
+	VMStateShutdown   VMState = "Shutdown"
+	VMStatePaused     VMState = "Paused"
+	VMStateBreakPoint VMState = "BreakPoint"
+)
+
+type VMInfo struct {
+	Config           VMConfig `json:"config"`
+	State            VMState  `json:"state"`
+	MemoryActualSize uint64   `json:"memory_actual_size,omitempty"`
+}
+
+type resizeRequest struct {
+	DesiredBalloon *uint64 `json:"desired_balloon,omitempty"`
+}
+
+type snapshotRequest struct {
+	DestinationURL string `json:"destination_url"`
+}
+
+type restoreRequest struct {
+	SourceURL string `json:"source_url"`
+}
+
+// apiClient talks to the rest api cloud hypervisor serves on its --api-socket.
+type apiClient struct {
+	socket string
+	http   *http.Client
+}
+
+func newAPIClient(socket string) *apiClient {
+	return &apiClient{
+		socket: socket,
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// do calls endpoint with in as the json body and decodes the response into out,
+// either may be nil.
+func (c *apiClient) do(ctx context.Context, method, endpoint string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return errors.Errorf("marshalling %s request: %w", endpoint, err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://localhost/api/v1/"+endpoint, body)
+	if err != nil {
+		return errors.Errorf("creating %s request: %w", endpoint, err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.Errorf("calling cloud hypervisor %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return errors.Errorf("cloud hypervisor %s: %s: %s", endpoint, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return errors.Errorf("decoding %s response: %w", endpoint, err)
+	}
+	return nil
+}
+
+func (c *apiClient) ping(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, "vmm.ping", nil, nil)
+}
+
+func (c *apiClient) shutdownVMM(ctx context.Context) error {
+	return c.do(ctx, http.MethodPut, "vmm.shutdown", nil, nil)
+}
+
+func (c *apiClient) create(ctx context.Context, cfg *VMConfig) error {
+	return c.do(ctx, http.MethodPut, "vm.create", cfg, nil)
+}
+
+func (c *apiClient) info(ctx context.Context) (*VMInfo, error) {
+	info := &VMInfo{}
+	if err := c.do(ctx, http.MethodGet, "vm.info", nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (c *apiClient) boot(ctx context.Context) error {
+	return c.do(ctx, http.MethodPut, "vm.boot", nil, nil)
+}
+
+func (c *apiClient) shutdown(ctx context.Context) error {
+	return c.do(ctx, http.MethodPut, "vm.shutdown", nil, nil)
+}
+
+func (c *apiClient) powerButton(ctx context.Context) error {
+	return c.do(ctx, http.MethodPut, "vm.power-button", nil, nil)
+}
+
+func (c *apiClient) pause(ctx context.Context) error {
+	return c.do(ctx, http.MethodPut, "vm.pause", nil, nil)
+}
+
+func (c *apiClient) resume(ctx context.Context) error {
+	return c.do(ctx, http.MethodPut, "vm.resume", nil, nil)
+}
+
+func (c *apiClient) resizeBalloon(ctx context.Context, size uint64) error {
+	return c.do(ctx, http.MethodPut, "vm.resize", &resizeRequest{DesiredBalloon: &size}, nil)
+}
+
+func (c *apiClient) snapshot(ctx context.Context, dir string) error {
+	return c.do(ctx, http.MethodPut, "vm.snapshot", &snapshotRequest{DestinationURL: "file://" + dir}, nil)
+}
+
+func (c *apiClient) restore(ctx context.Context, dir string) error {
+	return c.do(ctx, http.MethodPut, "vm.restore", &restoreRequest{SourceURL: "file://" + dir}, nil)
+}
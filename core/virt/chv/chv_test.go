@@ -0,0 +1,351 @@
+package chv_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/virt/chv"
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/core/virt/vmm/vmmtest"
+)
+
+func TestMain(m *testing.M) {
+	vmmtest.Main(m, func(args []string) error {
+		if len(args) != 2 || args[0] != "--api-socket" {
+			return fmt.Errorf("unexpected arguments %q", args)
+		}
+		return runFakeVMM(strings.TrimPrefix(args[1], "path="))
+	})
+}
+
+// fakeVMM serves the parts of the cloud hypervisor api the backend uses.
+type fakeVMM struct {
+	mu     sync.Mutex
+	config *chv.VMConfig
+	state  chv.VMState
+}
+
+func runFakeVMM(socket string) error {
+	f := &fakeVMM{}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/vmm.ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version":"fake"}`))
+	})
+	mux.HandleFunc("PUT /api/v1/vmm.shutdown", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			os.Exit(0)
+		}()
+	})
+	mux.HandleFunc("PUT /api/v1/vm.create", func(w http.ResponseWriter, r *http.Request) {
+		cfg := &chv.VMConfig{}
+		if err := json.NewDecoder(r.Body).Decode(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.config != nil {
+			http.Error(w, "VM is already created", http.StatusInternalServerError)
+			return
+		}
+		if err := f.setConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f.state = chv.VMStateCreated
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /api/v1/vm.info", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.config == nil {
+			http.Error(w, "VM is not created", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(&chv.VMInfo{Config: *f.config, State: f.state})
+	})
+	f.transition(mux, "vm.boot", chv.VMStateCreated, chv.VMStateRunning)
+	f.transition(mux, "vm.pause", chv.VMStateRunning, chv.VMStatePaused)
+	f.transition(mux, "vm.resume", chv.VMStatePaused, chv.VMStateRunning)
+	f.transition(mux, "vm.power-button", chv.VMStateRunning, chv.VMStateShutdown)
+	f.transition(mux, "vm.shutdown", chv.VMStateRunning, chv.VMStateShutdown)
+	mux.HandleFunc("PUT /api/v1/vm.resize", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			DesiredBalloon *uint64 `json:"desired_balloon"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.DesiredBalloon == nil {
+			http.Error(w, "bad resize request", http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.config.Balloon.Size = *req.DesiredBalloon
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PUT /api/v1/vm.snapshot", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			DestinationURL string `json:"destination_url"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.state != chv.VMStatePaused {
+			http.Error(w, "VM is not paused", http.StatusInternalServerError)
+			return
+		}
+		data, _ := json.Marshal(f.config)
+		if err := os.WriteFile(filepath.Join(strings.TrimPrefix(req.DestinationURL, "file://"), "config.json"), data, 0600); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PUT /api/v1/vm.restore", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			SourceURL string `json:"source_url"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		data, err := os.ReadFile(filepath.Join(strings.TrimPrefix(req.SourceURL, "file://"), "config.json"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cfg := &chv.VMConfig{}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if err := f.setConfig(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f.state = chv.VMStatePaused
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.Serve(l, mux)
+}
+
+func (f *fakeVMM) transition(mux *http.ServeMux, endpoint string, from, to chv.VMState) {
+	mux.HandleFunc("PUT /api/v1/"+endpoint, func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.state != from {
+			http.Error(w, fmt.Sprintf("VM is %s, not %s", f.state, from), http.StatusInternalServerError)
+			return
+		}
+		f.state = to
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// setConfig takes cfg and serves its hybrid vsock socket, every guest port echoes.
+func (f *fakeVMM) setConfig(cfg *chv.VMConfig) error {
+	f.config = cfg
+	if cfg.Vsock == nil {
+		return nil
+	}
+	return vmmtest.ServeHybridVsock(cfg.Vsock.Socket)
+}
+
+func newHypervisor(t *testing.T) vmm.Hypervisor[*chv.VirtualMachine] {
+	bin := vmmtest.Binary(t)
+	return chv.NewHypervisor(chv.Config{
+		Binary:    bin,
+		Virtiofsd: bin,
+		Root:      vmmtest.Root(t, "chv"),
+	})
+}
+
+func TestVirtualMachine(t *testing.T) {
+	disk := filepath.Join(t.TempDir(), "mbin.squashfs")
+	require.NoError(t, os.WriteFile(disk, nil, 0644))
+	blk, err := virtio.VirtioBlkNew(disk)
+	require.NoError(t, err)
+	blk.ReadOnly = true
+	blk.SetDeviceIdentifier("mbin")
+
+	share, err := virtio.VirtioFsNew(t.TempDir(), "share")
+	require.NoError(t, err)
+
+	consoleLog := filepath.Join(t.TempDir(), "console.log")
+
+	vmmtest.RunVirtualMachine(t, newHypervisor(t), &vmm.NewVMOptions{
+		Vcpus:  2,
+		Memory: strongunits.MiB(512).ToBytes(),
+		Devices: []virtio.VirtioDevice{
+			share,
+			blk,
+			&virtio.VirtioVsock{},
+			&virtio.VirtioBalloon{},
+			&virtio.VirtioRng{},
+			&virtio.VirtioSerialLogFile{Path: consoleLog, Append: true},
+		},
+	}, func(t *testing.T, vm *chv.VirtualMachine) {
+		ctx := t.Context()
+
+		info, err := vm.Info(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, chv.VMStateRunning, info.State)
+		assert.Equal(t, chv.CpusConfig{BootVcpus: 2, MaxVcpus: 2}, info.Config.Cpus)
+		assert.Equal(t, chv.MemoryConfig{Size: uint64(strongunits.MiB(512).ToBytes()), Shared: true}, info.Config.Memory)
+		assert.Equal(t, "/images/kernel", info.Config.Payload.Kernel)
+		assert.Contains(t, info.Config.Payload.Cmdline, "console=hvc0")
+		assert.Equal(t, []chv.DiskConfig{{Path: disk, Readonly: true, Serial: "mbin"}}, info.Config.Disks)
+		require.Len(t, info.Config.Fs, 1)
+		assert.Equal(t, "share", info.Config.Fs[0].Tag)
+		assert.Equal(t, chv.ConsoleConfig{Mode: chv.ConsoleModeTty}, info.Config.Console)
+		assert.FileExists(t, consoleLog)
+		assert.True(t, vmm.CanRotateConsoleLog(vm), "the console log is appended to")
+		assert.NotNil(t, info.Config.Rng)
+		require.NotNil(t, info.Config.Vsock)
+		assert.Equal(t, info.Config.Vsock.Socket, vm.HybridVsockSocketPath())
+
+		vmmtest.Echo(t, vm)
+
+		// virtiofs is served by vhost-user, which cloud hypervisor cannot snapshot
+		require.ErrorIs(t, vm.SaveFullSnapshot(ctx, t.TempDir()), vmm.ErrFullSnapshotNotSupported)
+	})
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	vmmtest.RunSnapshotRestore(t, newHypervisor(t), func() *vmm.NewVMOptions {
+		return &vmm.NewVMOptions{
+			Vcpus:   1,
+			Memory:  strongunits.MiB(256).ToBytes(),
+			Devices: []virtio.VirtioDevice{&virtio.VirtioVsock{}},
+		}
+	})
+}
+
+func TestSnapshotRestoreRelocatesDevices(t *testing.T) {
+	ctx := t.Context()
+	hpv := newHypervisor(t)
+
+	withDisk := func(dir string) *vmm.NewVMOptions {
+		disk := filepath.Join(dir, "mbin.squashfs")
+		require.NoError(t, os.WriteFile(disk, nil, 0644))
+		blk, err := virtio.VirtioBlkNew(disk)
+		require.NoError(t, err)
+		return &vmm.NewVMOptions{
+			Vcpus:   1,
+			Memory:  strongunits.MiB(256).ToBytes(),
+			Devices: []virtio.VirtioDevice{blk, &virtio.VirtioVsock{}},
+		}
+	}
+
+	vm, err := hpv.NewVirtualMachine(ctx, "vm-saved", withDisk(t.TempDir()), vmmtest.Bootloader(t))
+	require.NoError(t, err)
+	defer vm.HardStop(context.Background())
+	require.NoError(t, vm.Start(ctx))
+	require.NoError(t, vm.Pause(ctx))
+
+	snapshot := t.TempDir()
+	require.NoError(t, vm.SaveFullSnapshot(ctx, snapshot))
+	require.NoError(t, vm.HardStop(ctx))
+
+	dir := t.TempDir()
+	restored, err := hpv.NewVirtualMachine(ctx, "vm-restored", withDisk(dir), vmmtest.Bootloader(t))
+	require.NoError(t, err)
+	defer restored.HardStop(context.Background())
+	require.NoError(t, restored.RestoreFromFullSnapshot(ctx, snapshot))
+
+	info, err := restored.Info(ctx)
+	require.NoError(t, err)
+	require.Len(t, info.Config.Disks, 1)
+	assert.Equal(t, filepath.Join(dir, "mbin.squashfs"), info.Config.Disks[0].Path)
+	require.NotNil(t, info.Config.Vsock)
+	assert.NotEqual(t, vm.HybridVsockSocketPath(), info.Config.Vsock.Socket)
+	assert.Equal(t, restored.HybridVsockSocketPath(), info.Config.Vsock.Socket)
+	vmmtest.Echo(t, restored)
+
+	// the snapshot itself is left as it was saved, so it can be restored again
+	saved, err := os.ReadFile(filepath.Join(snapshot, "config.json"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(saved), dir)
+}
+
+func TestReattach(t *testing.T) {
+	ctx := t.Context()
+	bin := vmmtest.Binary(t)
+	cfg := chv.Config{Binary: bin, Virtiofsd: bin, Root: vmmtest.Root(t, "chv")}
+
+	share, err := virtio.VirtioFsNew(t.TempDir(), "share")
+	require.NoError(t, err)
+
+	vm, err := chv.NewHypervisor(cfg).NewVirtualMachine(ctx, "vm-chv-reattach", &vmm.NewVMOptions{
+		Vcpus:   1,
+		Memory:  strongunits.MiB(256).ToBytes(),
+		Devices: []virtio.VirtioDevice{share, &virtio.VirtioVsock{}},
+	}, vmmtest.Bootloader(t))
+	require.NoError(t, err)
+	defer vm.HardStop(context.Background())
+	require.NoError(t, vm.Start(ctx))
+	assert.Len(t, vm.HelperPids(), 1, "the virtiofsd of the share")
+
+	// stands in for a virtiofsd of the previous shim, which outlives it
+	helper := exec.Command("sleep", "60")
+	helper.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	require.NoError(t, helper.Start())
+	defer helper.Process.Kill()
+	helperExited := make(chan struct{})
+	go func() {
+		_ = helper.Wait()
+		close(helperExited)
+	}()
+
+	hpv, ok := chv.NewHypervisor(cfg).(vmm.ReattachableHypervisor[*chv.VirtualMachine])
+	require.True(t, ok)
+	reattached, err := hpv.ReattachVirtualMachine(ctx, &vmm.PersistedVM{
+		ID:         "vm-chv-reattach",
+		HelperPids: []int{helper.Process.Pid},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, vmm.VirtualMachineStateTypeRunning, reattached.CurrentState())
+	assert.Equal(t, []int{helper.Process.Pid}, reattached.HelperPids())
+	vmmtest.Echo(t, reattached)
+
+	require.NoError(t, reattached.HardStop(ctx))
+	select {
+	case <-helperExited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the helper processes of the reattached vm were left running")
+	}
+}
+
+func TestUnsupportedConfig(t *testing.T) {
+	sock, err := os.CreateTemp(t.TempDir(), "net")
+	require.NoError(t, err)
+	defer sock.Close()
+
+	vmmtest.RunUnsupportedConfig(t, newHypervisor(t), nil,
+		vmmtest.BadConfig{Name: "datagram socket network", Devices: []virtio.VirtioDevice{&virtio.VirtioNet{Socket: sock}}},
+	)
+}
@@ -0,0 +1,91 @@
+package chv
+
+import (
+	"path/filepath"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/virtiofsd"
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+// guestCID is the context id of every guest, hybrid vsock does not need them to
+// be unique on the host.
+const guestCID = 3
+
+// buildVMConfig translates the devices of a vm into its cloud hypervisor config,
+// the sockets of the vm are placed in dir. It also returns the console log device,
+// if there is one, for startVMM.
+func buildVMConfig(dir string, opts *vmm.NewVMOptions, bl virtio.Bootloader) (*VMConfig, []virtiofsd.Share, *virtio.VirtioSerialLogFile, error) {
+	if opts.Vcpus == 0 {
+		return nil, nil, nil, errors.Errorf("VCPU count cannot be 0")
+	}
+	if opts.Memory.ToBytes() == 0 {
+		return nil, nil, nil, errors.Errorf("Memory cannot be 0")
+	}
+
+	linux, ok := bl.(*virtio.LinuxBootloader)
+	if !ok {
+		return nil, nil, nil, errors.Errorf("unsupported bootloader %T, cloud hypervisor boots linux kernels directly", bl)
+	}
+
+	cfg := &VMConfig{
+		Cpus:   CpusConfig{BootVcpus: opts.Vcpus, MaxVcpus: opts.Vcpus},
+		Memory: MemoryConfig{Size: uint64(opts.Memory.ToBytes())},
+		Payload: PayloadConfig{
+			Kernel:    linux.VmlinuzPath,
+			Initramfs: linux.InitrdPath,
+			Cmdline:   linux.KernelCmdLine,
+		},
+		// the guest console is hvc0, the legacy serial port is unused
+		Serial:  ConsoleConfig{Mode: ConsoleModeNull},
+		Console: ConsoleConfig{Mode: ConsoleModeOff},
+	}
+
+	var shares []virtiofsd.Share
+	var console *virtio.VirtioSerialLogFile
+
+	for _, dev := range opts.Devices {
+		switch dev := dev.(type) {
+		case *virtio.VirtioFs:
+			s := virtiofsd.Share{
+				Tag:    dev.MountTag,
+				Dir:    dev.SharedDir,
+				Socket: filepath.Join(dir, "virtiofs-"+dev.MountTag+".sock"),
+			}
+			shares = append(shares, s)
+			cfg.Fs = append(cfg.Fs, FsConfig{Tag: s.Tag, Socket: s.Socket, NumQueues: 1, QueueSize: 1024})
+			cfg.Memory.Shared = true
+		case *virtio.VirtioBlk:
+			if dev.ImagePath == "" {
+				return nil, nil, nil, errors.Errorf("disk %q has no image path", dev.DevName)
+			}
+			cfg.Disks = append(cfg.Disks, DiskConfig{Path: dev.ImagePath, Readonly: dev.ReadOnly, Serial: dev.DeviceIdentifier})
+		case *virtio.VirtioNet:
+			// cloud hypervisor creates a tap device, it cannot use a datagram socket
+			if dev.Socket != nil || !dev.Nat {
+				return nil, nil, nil, errors.Errorf("cloud hypervisor only supports nat networking, disable the vm network to use it")
+			}
+			cfg.Net = append(cfg.Net, NetConfig{Mac: dev.MacAddress.String()})
+		case *virtio.VirtioVsock:
+			if cfg.Vsock != nil {
+				return nil, nil, nil, errors.Errorf("only one vsock device is supported")
+			}
+			cfg.Vsock = &VsockConfig{Cid: guestCID, Socket: filepath.Join(dir, "vsock.sock")}
+		case *virtio.VirtioBalloon:
+			cfg.Balloon = &BalloonConfig{DeflateOnOom: true}
+		case *virtio.VirtioRng:
+			cfg.Rng = &RngConfig{Src: "/dev/urandom"}
+		case *virtio.VirtioSerialLogFile:
+			// cloud hypervisor opens a console file itself, without O_APPEND, so it
+			// writes to its stdout instead, a log the vm opens the way the device asks
+			cfg.Console = ConsoleConfig{Mode: ConsoleModeTty}
+			console = dev
+		default:
+			return nil, nil, nil, errors.Errorf("unsupported device %T for cloud hypervisor", dev)
+		}
+	}
+
+	return cfg, shares, console, nil
+}
@@ -0,0 +1,170 @@
+// Package chv runs vms with Cloud Hypervisor on linux hosts. Every vm gets its own
+// cloud-hypervisor process driven through its rest api, and a virtiofsd per
+// directory share.
+package chv
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/virtiofsd"
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+const defaultAPITimeout = 5 * time.Second
+
+type Config struct {
+	// Binary is the cloud-hypervisor executable, looked up in PATH by default.
+	Binary string
+	// Virtiofsd serves the directory shares, looked up in PATH by default.
+	Virtiofsd string
+	// Root holds a directory per vm with its api, vsock and virtiofs sockets, it
+	// defaults to a directory in os.TempDir. Unix socket paths are short, so keep
+	// it short too.
+	Root string
+	// APITimeout bounds the wait for a new cloud-hypervisor process to serve its
+	// api, and for virtiofsd to create its socket.
+	APITimeout time.Duration
+}
+
+func NewHypervisor(cfg Config) vmm.Hypervisor[*VirtualMachine] {
+	if cfg.Binary == "" {
+		cfg.Binary = "cloud-hypervisor"
+	}
+	if cfg.Virtiofsd == "" {
+		cfg.Virtiofsd = "virtiofsd"
+	}
+	if cfg.Root == "" {
+		cfg.Root = filepath.Join(os.TempDir(), "runm-chv")
+	}
+	if cfg.APITimeout == 0 {
+		cfg.APITimeout = defaultAPITimeout
+	}
+	return &Hypervisor{
+		cfg:    cfg,
+		vms:    make(map[string]*VirtualMachine),
+		notify: make(chan *VirtualMachine),
+	}
+}
+
+var (
+	_ vmm.Hypervisor[*VirtualMachine]             = &Hypervisor{}
+	_ vmm.ReattachableHypervisor[*VirtualMachine] = &Hypervisor{}
+)
+
+type Hypervisor struct {
+	cfg    Config
+	vms    map[string]*VirtualMachine
+	mu     sync.Mutex
+	notify chan *VirtualMachine
+}
+
+func (hpv *Hypervisor) vmDir(id string) string {
+	return filepath.Join(hpv.cfg.Root, id)
+}
+
+func (hpv *Hypervisor) NewVirtualMachine(ctx context.Context, id string, opts *vmm.NewVMOptions, bl virtio.Bootloader) (*VirtualMachine, error) {
+	if opts == nil {
+		return nil, errors.Errorf("VM options are nil")
+	}
+
+	if err := virtio.ValidateDevices(opts.Devices, bl, opts.GuestPlatform); err != nil {
+		return nil, err
+	}
+
+	dir := hpv.vmDir(id)
+
+	cfg, shares, console, err := buildVMConfig(dir, opts, bl)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Errorf("creating vm directory: %w", err)
+	}
+
+	if cfg.Vsock != nil {
+		if err := os.Remove(cfg.Vsock.Socket); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Errorf("removing stale vsock socket: %w", err)
+		}
+	}
+
+	vm := newVirtualMachine(id, dir, opts, cfg)
+
+	// nothing started below may outlive a failed creation
+	ok := false
+	defer func() {
+		if !ok {
+			vm.killProcesses()
+		}
+	}()
+
+	for _, s := range shares {
+		cmd, err := virtiofsd.Start(ctx, hpv.cfg.Virtiofsd, s, filepath.Join(dir, "virtiofsd-"+s.Tag+".log"), hpv.cfg.APITimeout)
+		if err != nil {
+			return nil, err
+		}
+		vm.virtiofsd = append(vm.virtiofsd, cmd)
+	}
+
+	if err := vm.startVMM(ctx, hpv.cfg.Binary, console, hpv.cfg.APITimeout); err != nil {
+		return nil, err
+	}
+
+	ok = true
+
+	slog.InfoContext(ctx, "created cloud hypervisor vm", "id", id, "dir", dir, "vcpus", opts.Vcpus, "memory", opts.Memory, "shares", len(shares))
+
+	hpv.mu.Lock()
+	hpv.vms[id] = vm
+	hpv.mu.Unlock()
+
+	go func() {
+		hpv.notify <- vm
+	}()
+
+	return vm, nil
+}
+
+// ReattachVirtualMachine implements vmm.ReattachableHypervisor, the vm keeps
+// running in the cloud-hypervisor process started by the previous shim.
+func (hpv *Hypervisor) ReattachVirtualMachine(ctx context.Context, st *vmm.PersistedVM) (*VirtualMachine, error) {
+	dir := hpv.vmDir(st.ID)
+	client := newAPIClient(filepath.Join(dir, "api.sock"))
+
+	info, err := client.info(ctx)
+	if err != nil {
+		return nil, errors.Errorf("reading vm info: %w", err)
+	}
+
+	vm := newVirtualMachine(st.ID, dir, &vmm.NewVMOptions{
+		Vcpus:         info.Config.Cpus.BootVcpus,
+		Memory:        strongunits.B(info.Config.Memory.Size),
+		GuestPlatform: st.GuestPlatform,
+	}, &info.Config)
+	vm.client = client
+	vm.created = true
+	// the daemons die with this vm, not with the shim that started them
+	vm.virtiofsdPids = st.HelperPids
+	vm.states = vmm.NewStateMachine(vmStateToHypervisorState(info.State))
+
+	go vm.watch(context.WithoutCancel(ctx))
+
+	hpv.mu.Lock()
+	hpv.vms[st.ID] = vm
+	hpv.mu.Unlock()
+
+	return vm, nil
+}
+
+func (hpv *Hypervisor) OnCreate() <-chan *VirtualMachine {
+	return hpv.notify
+}
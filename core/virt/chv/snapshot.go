@@ -0,0 +1,106 @@
+package chv
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// snapshotConfigFile is the vm config cloud hypervisor saves into a snapshot and
+// creates the restored vm from.
+const snapshotConfigFile = "config.json"
+
+// relocateSnapshot returns a snapshot directory to restore vm from. Cloud hypervisor
+// reopens the files the saved config names, which are the disks and sockets in the
+// working directory of the vm the snapshot was taken from, so the config is rewritten
+// to the files of vm and the rest of the snapshot is linked next to it.
+func (vm *VirtualMachine) relocateSnapshot(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", errors.Errorf("resolving snapshot directory: %w", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, snapshotConfigFile))
+	if err != nil {
+		return "", errors.Errorf("reading snapshot config: %w", err)
+	}
+
+	// decoded loosely, so the fields runm does not know survive the rewrite
+	cfg := map[string]any{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&cfg); err != nil {
+		return "", errors.Errorf("decoding snapshot config: %w", err)
+	}
+
+	if err := relocateConfig(cfg, vm.config); err != nil {
+		return "", errors.Errorf("snapshot of vm with other devices: %w", err)
+	}
+
+	data, err = json.Marshal(cfg)
+	if err != nil {
+		return "", errors.Errorf("encoding snapshot config: %w", err)
+	}
+
+	out := filepath.Join(vm.dir, "restore")
+	if err := os.RemoveAll(out); err != nil {
+		return "", errors.Errorf("removing previous restore directory: %w", err)
+	}
+	if err := os.MkdirAll(out, 0700); err != nil {
+		return "", errors.Errorf("creating restore directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", errors.Errorf("reading snapshot directory: %w", err)
+	}
+	for _, e := range entries {
+		if e.Name() == snapshotConfigFile {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(dir, e.Name()), filepath.Join(out, e.Name())); err != nil {
+			return "", errors.Errorf("linking snapshot file: %w", err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(out, snapshotConfigFile), data, 0600); err != nil {
+		return "", errors.Errorf("writing snapshot config: %w", err)
+	}
+
+	return out, nil
+}
+
+// relocateConfig points the files named by the saved config cfg at the ones of own.
+// The devices are matched by position, vmm.SnapshotInfo has already checked the vm
+// was created with the devices it was saved with.
+func relocateConfig(cfg map[string]any, own *VMConfig) error {
+	disks, _ := cfg["disks"].([]any)
+	if len(disks) != len(own.Disks) {
+		return errors.Errorf("saved with %d disks, not %d", len(disks), len(own.Disks))
+	}
+	for i, d := range disks {
+		disk, ok := d.(map[string]any)
+		if !ok {
+			return errors.Errorf("disk %d is not an object", i)
+		}
+		disk["path"] = own.Disks[i].Path
+	}
+
+	vsock, _ := cfg["vsock"].(map[string]any)
+	if (vsock == nil) != (own.Vsock == nil) {
+		return errors.New("vsock device does not match")
+	}
+	if vsock != nil {
+		vsock["socket"] = own.Vsock.Socket
+	}
+
+	if payload, ok := cfg["payload"].(map[string]any); ok {
+		payload["kernel"] = own.Payload.Kernel
+		payload["initramfs"] = own.Payload.Initramfs
+	}
+
+	return nil
+}
@@ -0,0 +1,549 @@
+package chv
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/virtiofsd"
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+// pollInterval is how often the vm state is read, cloud hypervisor does not push
+// state changes over its api.
+const pollInterval = 100 * time.Millisecond
+
+var (
+	_ vmm.VirtualMachine      = &VirtualMachine{}
+	_ vmm.HybridVsockVM       = &VirtualMachine{}
+	_ vmm.FullSnapshotCapable = &VirtualMachine{}
+	_ vmm.StateHistoryVM      = &VirtualMachine{}
+	_ vmm.ConsoleLogAppender  = &VirtualMachine{}
+	_ vmm.HelperProcessVM     = &VirtualMachine{}
+)
+
+func vmStateToHypervisorState(state VMState) vmm.VirtualMachineStateType {
+	switch state {
+	case VMStateCreated, VMStateShutdown:
+		return vmm.VirtualMachineStateTypeStopped
+	case VMStateRunning:
+		return vmm.VirtualMachineStateTypeRunning
+	case VMStatePaused, VMStateBreakPoint:
+		return vmm.VirtualMachineStateTypePaused
+	default:
+		return vmm.VirtualMachineStateTypeUnknown
+	}
+}
+
+type VirtualMachine struct {
+	id     string
+	dir    string
+	opts   *vmm.NewVMOptions
+	config *VMConfig
+	client *apiClient
+
+	// process is nil when the vm was reattached
+	process   *exec.Cmd
+	virtiofsd []*exec.Cmd
+	// virtiofsdPids are the daemons of a reattached vm, started by another process
+	virtiofsdPids []int
+	// exited is closed once cloud hypervisor is gone
+	exited   chan struct{}
+	exitOnce sync.Once
+
+	// opMu keeps a polled state from overwriting the state set by a change made
+	// through the api while the poll was in flight
+	opMu sync.Mutex
+
+	states *vmm.StateMachine
+
+	mu       sync.Mutex
+	created  bool
+	stopping bool
+}
+
+func newVirtualMachine(id, dir string, opts *vmm.NewVMOptions, cfg *VMConfig) *VirtualMachine {
+	return &VirtualMachine{
+		id:     id,
+		dir:    dir,
+		opts:   opts,
+		config: cfg,
+		exited: make(chan struct{}),
+		states: vmm.NewStateMachine(vmm.VirtualMachineStateTypeStopped),
+	}
+}
+
+// startVMM starts cloud-hypervisor and waits for its api. The console of the vm goes
+// to its stdout.
+func (vm *VirtualMachine) startVMM(ctx context.Context, binary string, console *virtio.VirtioSerialLogFile, timeout time.Duration) error {
+	socket := filepath.Join(vm.dir, "api.sock")
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return errors.Errorf("removing stale api socket: %w", err)
+	}
+
+	logFile, err := os.Create(filepath.Join(vm.dir, "cloud-hypervisor.log"))
+	if err != nil {
+		return errors.Errorf("creating cloud hypervisor log: %w", err)
+	}
+	defer logFile.Close()
+
+	// the vm outlives the context it was created with
+	cmd := exec.Command(binary, "--api-socket", "path="+socket)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// own session, so the vm outlives a shim restart and can be reattached
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if console != nil {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if console.Append {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		consoleFile, err := os.OpenFile(console.Path, flags, 0644)
+		if err != nil {
+			return errors.Errorf("opening console log: %w", err)
+		}
+		defer consoleFile.Close()
+		cmd.Stdout = consoleFile
+	}
+
+	if err := cmd.Start(); err != nil {
+		return errors.Errorf("starting cloud hypervisor: %w", err)
+	}
+
+	vm.process = cmd
+	vm.client = newAPIClient(socket)
+
+	go func() {
+		err := cmd.Wait()
+		slog.InfoContext(ctx, "cloud hypervisor exited", "id", vm.id, "error", err)
+		vm.gone(err)
+	}()
+
+	if err := vmm.WaitFor(ctx, timeout, vm.client.ping); err != nil {
+		return errors.Errorf("waiting for cloud hypervisor api: %w", err)
+	}
+
+	go vm.watch(context.WithoutCancel(ctx))
+
+	return nil
+}
+
+// watch follows the vm state until cloud hypervisor is gone.
+func (vm *VirtualMachine) watch(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-vm.exited:
+			return
+		case <-ticker.C:
+		}
+
+		if vm.poll(ctx) {
+			return
+		}
+	}
+}
+
+// poll reads the vm state once and reports whether cloud hypervisor is gone.
+func (vm *VirtualMachine) poll(ctx context.Context) bool {
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	vm.mu.Lock()
+	created := vm.created
+	vm.mu.Unlock()
+	if !created {
+		return false
+	}
+
+	info, err := vm.client.info(ctx)
+	if err != nil {
+		// a reattached vm has no process to wait on
+		if vm.process == nil && vm.client.ping(ctx) != nil {
+			vm.gone(err)
+			return true
+		}
+		return false
+	}
+
+	if state := vmStateToHypervisorState(info.State); state != vm.CurrentState() {
+		vm.setState(state, map[string]string{"raw_state": string(info.State)})
+	}
+	return false
+}
+
+// gone cleans up after cloud hypervisor exited.
+func (vm *VirtualMachine) gone(err error) {
+	vm.exitOnce.Do(func() {
+		virtiofsd.Stop(vm.virtiofsd)
+		virtiofsd.Kill(vm.virtiofsdPids)
+
+		vm.mu.Lock()
+		stopping := vm.stopping
+		vm.mu.Unlock()
+
+		// the socket outlives cloud hypervisor and would block a restore from binding it
+		if socket := vm.HybridVsockSocketPath(); socket != "" {
+			_ = os.Remove(socket)
+		}
+
+		if err != nil && !stopping && vm.CurrentState() != vmm.VirtualMachineStateTypeStopped {
+			vm.setState(vmm.VirtualMachineStateTypeError, map[string]string{"error": err.Error()})
+		} else {
+			vm.setState(vmm.VirtualMachineStateTypeStopped, nil)
+		}
+
+		close(vm.exited)
+	})
+}
+
+// killProcesses is used when the vm could not be created.
+func (vm *VirtualMachine) killProcesses() {
+	if vm.process != nil {
+		_ = vm.process.Process.Kill()
+		<-vm.exited
+		return
+	}
+	virtiofsd.Stop(vm.virtiofsd)
+}
+
+// Info returns the vm as cloud hypervisor reports it.
+func (vm *VirtualMachine) Info(ctx context.Context) (*VMInfo, error) {
+	return vm.client.info(ctx)
+}
+
+func (vm *VirtualMachine) Start(ctx context.Context) error {
+	if !vm.CanStart(ctx) {
+		return &vmm.OperationError{Operation: vmm.OperationStart, State: vm.CurrentState()}
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	vm.mu.Lock()
+	created := vm.created
+	vm.mu.Unlock()
+
+	if !created {
+		if err := vm.client.create(ctx, vm.config); err != nil {
+			return errors.Errorf("creating vm: %w", err)
+		}
+		vm.mu.Lock()
+		vm.created = true
+		vm.mu.Unlock()
+	}
+
+	vm.setState(vmm.VirtualMachineStateTypeStarting, nil)
+
+	if err := vm.client.boot(ctx); err != nil {
+		vm.setState(vmm.VirtualMachineStateTypeError, map[string]string{"error": err.Error()})
+		return errors.Errorf("booting vm: %w", err)
+	}
+
+	vm.setState(vmm.VirtualMachineStateTypeRunning, nil)
+
+	return nil
+}
+
+// HardStop shuts down cloud hypervisor along with the vm.
+func (vm *VirtualMachine) HardStop(ctx context.Context) error {
+	vm.mu.Lock()
+	vm.stopping = true
+	vm.mu.Unlock()
+
+	if err := vm.client.shutdownVMM(ctx); err != nil {
+		if vm.process == nil {
+			return errors.Errorf("shutting down cloud hypervisor: %w", err)
+		}
+		slog.WarnContext(ctx, "cloud hypervisor did not shut down, killing it", "id", vm.id, "error", err)
+		_ = vm.process.Process.Kill()
+	}
+
+	select {
+	case <-vm.exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RequestStop presses the acpi power button of the vm.
+func (vm *VirtualMachine) RequestStop(ctx context.Context) (bool, error) {
+	if err := vm.states.Check(vmm.OperationRequestStop); err != nil {
+		return false, err
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	if err := vm.client.powerButton(ctx); err != nil {
+		return false, errors.Errorf("requesting vm stop: %w", err)
+	}
+	vm.setState(vmm.VirtualMachineStateTypeStopping, nil)
+	return true, nil
+}
+
+func (vm *VirtualMachine) Pause(ctx context.Context) error {
+	if err := vm.states.Check(vmm.OperationPause); err != nil {
+		return err
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	if err := vm.client.pause(ctx); err != nil {
+		return errors.Errorf("pausing vm: %w", err)
+	}
+	vm.setState(vmm.VirtualMachineStateTypePaused, nil)
+	return nil
+}
+
+func (vm *VirtualMachine) Resume(ctx context.Context) error {
+	if err := vm.states.Check(vmm.OperationResume); err != nil {
+		return err
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	if err := vm.client.resume(ctx); err != nil {
+		return errors.Errorf("resuming vm: %w", err)
+	}
+	vm.setState(vmm.VirtualMachineStateTypeRunning, nil)
+	return nil
+}
+
+func (vm *VirtualMachine) CanStart(_ context.Context) bool {
+	select {
+	case <-vm.exited:
+		return false
+	default:
+	}
+	return vm.states.Can(vmm.OperationStart)
+}
+
+func (vm *VirtualMachine) CanHardStop(_ context.Context) bool {
+	select {
+	case <-vm.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+func (vm *VirtualMachine) CanRequestStop(_ context.Context) bool {
+	return vm.states.Can(vmm.OperationRequestStop)
+}
+
+func (vm *VirtualMachine) CanPause(_ context.Context) bool {
+	return vm.states.Can(vmm.OperationPause)
+}
+
+func (vm *VirtualMachine) CanResume(_ context.Context) bool {
+	return vm.states.Can(vmm.OperationResume)
+}
+
+func (vm *VirtualMachine) CurrentState() vmm.VirtualMachineStateType {
+	return vm.states.Current()
+}
+
+// setState moves the vm to state, a change the state machine rejects is logged
+// and dropped.
+func (vm *VirtualMachine) setState(state vmm.VirtualMachineStateType, metadata map[string]string) {
+	if err := vm.states.Transition(state, metadata); err != nil {
+		slog.Warn("ignoring vm state change", "id", vm.id, "error", err)
+	}
+}
+
+// StateChangeNotify implements vmm.VirtualMachine.
+func (vm *VirtualMachine) StateChangeNotify(ctx context.Context) <-chan vmm.VirtualMachineStateChange {
+	return vm.states.Subscribe(ctx)
+}
+
+// StateHistory implements vmm.StateHistoryVM.
+func (vm *VirtualMachine) StateHistory() []vmm.StateTransition {
+	return vm.states.History()
+}
+
+// HelperPids implements vmm.HelperProcessVM, the virtiofsd daemons of the vm.
+func (vm *VirtualMachine) HelperPids() []int {
+	pids := append([]int{}, vm.virtiofsdPids...)
+	for _, cmd := range vm.virtiofsd {
+		pids = append(pids, cmd.Process.Pid)
+	}
+	return pids
+}
+
+// HybridVsockSocketPath implements vmm.HybridVsockVM.
+func (vm *VirtualMachine) HybridVsockSocketPath() string {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.config.Vsock == nil {
+		return ""
+	}
+	return vm.config.Vsock.Socket
+}
+
+// VSockConnect implements vmm.VirtualMachine.
+func (vm *VirtualMachine) VSockConnect(ctx context.Context, port uint32) (net.Conn, error) {
+	socket := vm.HybridVsockSocketPath()
+	if socket == "" {
+		return nil, errors.Errorf("vm %s has no vsock device", vm.id)
+	}
+	return vmm.DialHybridVsock(ctx, socket, port)
+}
+
+// VSockListen implements vmm.VirtualMachine. Cloud hypervisor forwards guest
+// connections to port to the socket "<vsock socket>_<port>".
+func (vm *VirtualMachine) VSockListen(ctx context.Context, port uint32) (net.Listener, error) {
+	socket := vm.HybridVsockSocketPath()
+	if socket == "" {
+		return nil, errors.Errorf("vm %s has no vsock device", vm.id)
+	}
+	path := socket + "_" + strconv.FormatUint(uint64(port), 10)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Errorf("removing stale socket: %w", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Errorf("listening on vsock port %d: %w", port, err)
+	}
+	return l, nil
+}
+
+// SupportsFullSnapshot implements vmm.FullSnapshotCapable. Cloud hypervisor cannot
+// snapshot vhost-user devices, so vms with directory shares cannot be saved.
+func (vm *VirtualMachine) SupportsFullSnapshot(ctx context.Context) error {
+	if len(vm.config.Fs) > 0 {
+		return errors.Errorf("vm %s has virtiofs shares: %w", vm.id, vmm.ErrFullSnapshotNotSupported)
+	}
+	return nil
+}
+
+// SaveFullSnapshot writes the snapshot into the directory path, the vm must be paused.
+func (vm *VirtualMachine) SaveFullSnapshot(ctx context.Context, path string) error {
+	if err := vm.SupportsFullSnapshot(ctx); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return errors.Errorf("creating snapshot directory: %w", err)
+	}
+
+	if err := vm.client.snapshot(ctx, path); err != nil {
+		return errors.Errorf("saving snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// RestoreFromFullSnapshot restores a snapshot into a vm that was never started, it
+// is paused afterwards.
+func (vm *VirtualMachine) RestoreFromFullSnapshot(ctx context.Context, path string) error {
+	if err := vm.SupportsFullSnapshot(ctx); err != nil {
+		return err
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	vm.mu.Lock()
+	created := vm.created
+	vm.mu.Unlock()
+	if created {
+		return errors.New("cannot restore from snapshot into a vm that was already started")
+	}
+
+	dir, err := vm.relocateSnapshot(path)
+	if err != nil {
+		return errors.Errorf("relocating snapshot: %w", err)
+	}
+
+	if err := vm.client.restore(ctx, dir); err != nil {
+		return errors.Errorf("restoring from snapshot: %w", err)
+	}
+
+	info, err := vm.client.info(ctx)
+	if err != nil {
+		return errors.Errorf("reading restored vm info: %w", err)
+	}
+
+	vm.mu.Lock()
+	vm.created = true
+	vm.config.Vsock = info.Config.Vsock
+	vm.mu.Unlock()
+
+	vm.setState(vmm.VirtualMachineStateTypePaused, nil)
+
+	return nil
+}
+
+// SetMemoryBalloonTargetSize inflates the balloon until the guest is left with
+// targetBytes.
+func (vm *VirtualMachine) SetMemoryBalloonTargetSize(ctx context.Context, targetBytes strongunits.B) error {
+	if vm.config.Balloon == nil {
+		return errors.New("no memory balloon devices found")
+	}
+
+	total := vm.config.Memory.Size
+	if uint64(targetBytes) > total {
+		return errors.Errorf("target memory size %d exceeds vm memory %d", uint64(targetBytes), total)
+	}
+
+	if err := vm.client.resizeBalloon(ctx, total-uint64(targetBytes)); err != nil {
+		return errors.Errorf("resizing memory balloon: %w", err)
+	}
+
+	return nil
+}
+
+func (vm *VirtualMachine) GetMemoryBalloonTargetSize(ctx context.Context) (strongunits.B, error) {
+	info, err := vm.client.info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if info.Config.Balloon == nil {
+		return 0, errors.New("no memory balloon devices found")
+	}
+	return strongunits.B(info.Config.Memory.Size - info.Config.Balloon.Size), nil
+}
+
+func (vm *VirtualMachine) ID() string {
+	return vm.id
+}
+
+// AppendsConsoleLog implements vmm.ConsoleLogAppender. The console is written to
+// the stdout of cloud hypervisor, see startVMM.
+func (vm *VirtualMachine) AppendsConsoleLog() bool {
+	return true
+}
+
+func (vm *VirtualMachine) Devices() []virtio.VirtioDevice {
+	return vm.opts.Devices
+}
+
+func (vm *VirtualMachine) Opts() *vmm.NewVMOptions {
+	return vm.opts
+}
+
+func (vm *VirtualMachine) ServeBackgroundTasks(ctx context.Context) error {
+	return nil
+}
+
+func (vm *VirtualMachine) StartGraphicApplication(width float64, height float64) error {
+	return errors.New("cloud hypervisor vms have no display")
+}
@@ -0,0 +1,278 @@
+package firecracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// VMConfig is the part of the firecracker vm config runm uses, as returned by
+// GET /vm/config, see
+// https://github.com/firecracker-microvm/firecracker/blob/main/src/firecracker/swagger/firecracker.yaml
+type VMConfig struct {
+	BootSource    BootSource     `json:"boot-source"`
+	MachineConfig MachineConfig  `json:"machine-config"`
+	Drives        []Drive        `json:"drives,omitempty"`
+	Vsock         *Vsock         `json:"vsock,omitempty"`
+	Balloon       *Balloon       `json:"balloon,omitempty"`
+	Entropy       *EntropyDevice `json:"entropy,omitempty"`
+}
+
+type BootSource struct {
+	KernelImagePath string `json:"kernel_image_path"`
+	InitrdPath      string `json:"initrd_path,omitempty"`
+	BootArgs        string `json:"boot_args,omitempty"`
+}
+
+type MachineConfig struct {
+	VcpuCount  uint64 `json:"vcpu_count"`
+	MemSizeMib uint64 `json:"mem_size_mib"`
+}
+
+type Drive struct {
+	DriveID      string `json:"drive_id"`
+	PathOnHost   string `json:"path_on_host"`
+	IsRootDevice bool   `json:"is_root_device"`
+	IsReadOnly   bool   `json:"is_read_only"`
+}
+
+type Vsock struct {
+	GuestCID uint32 `json:"guest_cid"`
+	UDSPath  string `json:"uds_path"`
+}
+
+type Balloon struct {
+	// AmountMib is the memory taken from the guest, not the memory left to it.
+	AmountMib    uint64 `json:"amount_mib"`
+	DeflateOnOom bool   `json:"deflate_on_oom"`
+}
+
+type EntropyDevice struct{}
+
+// InstanceState is the state firecracker reports for its vm.
+type InstanceState string
+
+const (
+	InstanceStateNotStarted InstanceState = "Not started"
+	InstanceStateRunning    InstanceState = "Running"
+	InstanceStatePaused     InstanceState = "Paused"
+)
+
+type InstanceInfo struct {
+	ID         string        `json:"id"`
+	State      InstanceState `json:"state"`
+	VMMVersion string        `json:"vmm_version"`
+	AppName    string        `json:"app_name"`
+}
+
+type action struct {
+	ActionType string `json:"action_type"`
+}
+
+type vmStateRequest struct {
+	State string `json:"state"`
+}
+
+type balloonUpdate struct {
+	AmountMib uint64 `json:"amount_mib"`
+}
+
+type snapshotCreateRequest struct {
+	SnapshotType string `json:"snapshot_type"`
+	SnapshotPath string `json:"snapshot_path"`
+	MemFilePath  string `json:"mem_file_path"`
+}
+
+type memBackend struct {
+	BackendType string `json:"backend_type"`
+	BackendPath string `json:"backend_path"`
+}
+
+type snapshotLoadRequest struct {
+	SnapshotPath  string         `json:"snapshot_path"`
+	MemBackend    memBackend     `json:"mem_backend"`
+	ResumeVM      bool           `json:"resume_vm"`
+	VsockOverride *vsockOverride `json:"vsock_override,omitempty"`
+}
+
+// vsockOverride moves the vsock device of a snapshot to another socket.
+type vsockOverride struct {
+	UDSPath string `json:"uds_path"`
+}
+
+type driveUpdate struct {
+	DriveID    string `json:"drive_id"`
+	PathOnHost string `json:"path_on_host"`
+}
+
+type apiError struct {
+	FaultMessage string `json:"fault_message"`
+}
+
+// apiClient talks to the rest api firecracker serves on its --api-sock.
+type apiClient struct {
+	socket string
+	http   *http.Client
+}
+
+func newAPIClient(socket string) *apiClient {
+	return &apiClient{
+		socket: socket,
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// do calls endpoint with in as the json body and decodes the response into out,
+// either may be nil.
+func (c *apiClient) do(ctx context.Context, method, endpoint string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return errors.Errorf("marshalling %s request: %w", endpoint, err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://localhost"+endpoint, body)
+	if err != nil {
+		return errors.Errorf("creating %s request: %w", endpoint, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.Errorf("calling firecracker %s %s: %w", method, endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		fault := &apiError{}
+		if json.Unmarshal(msg, fault) == nil && fault.FaultMessage != "" {
+			return errors.Errorf("firecracker %s %s: %s: %s", method, endpoint, resp.Status, fault.FaultMessage)
+		}
+		return errors.Errorf("firecracker %s %s: %s: %s", method, endpoint, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return errors.Errorf("decoding %s response: %w", endpoint, err)
+	}
+	return nil
+}
+
+func (c *apiClient) instanceInfo(ctx context.Context) (*InstanceInfo, error) {
+	info := &InstanceInfo{}
+	if err := c.do(ctx, http.MethodGet, "/", nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (c *apiClient) ping(ctx context.Context) error {
+	_, err := c.instanceInfo(ctx)
+	return err
+}
+
+func (c *apiClient) vmConfig(ctx context.Context) (*VMConfig, error) {
+	cfg := &VMConfig{}
+	if err := c.do(ctx, http.MethodGet, "/vm/config", nil, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configure sends cfg device by device, firecracker has no call taking it whole.
+func (c *apiClient) configure(ctx context.Context, cfg *VMConfig) error {
+	if err := c.do(ctx, http.MethodPut, "/boot-source", &cfg.BootSource, nil); err != nil {
+		return err
+	}
+	if err := c.do(ctx, http.MethodPut, "/machine-config", &cfg.MachineConfig, nil); err != nil {
+		return err
+	}
+	for _, drive := range cfg.Drives {
+		if err := c.do(ctx, http.MethodPut, "/drives/"+drive.DriveID, &drive, nil); err != nil {
+			return err
+		}
+	}
+	if cfg.Vsock != nil {
+		if err := c.do(ctx, http.MethodPut, "/vsock", cfg.Vsock, nil); err != nil {
+			return err
+		}
+	}
+	if cfg.Balloon != nil {
+		if err := c.do(ctx, http.MethodPut, "/balloon", cfg.Balloon, nil); err != nil {
+			return err
+		}
+	}
+	if cfg.Entropy != nil {
+		if err := c.do(ctx, http.MethodPut, "/entropy", cfg.Entropy, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *apiClient) action(ctx context.Context, actionType string) error {
+	return c.do(ctx, http.MethodPut, "/actions", &action{ActionType: actionType}, nil)
+}
+
+func (c *apiClient) setState(ctx context.Context, state string) error {
+	return c.do(ctx, http.MethodPatch, "/vm", &vmStateRequest{State: state}, nil)
+}
+
+func (c *apiClient) balloon(ctx context.Context) (*Balloon, error) {
+	b := &Balloon{}
+	if err := c.do(ctx, http.MethodGet, "/balloon", nil, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (c *apiClient) updateBalloon(ctx context.Context, amountMib uint64) error {
+	return c.do(ctx, http.MethodPatch, "/balloon", &balloonUpdate{AmountMib: amountMib}, nil)
+}
+
+func (c *apiClient) createSnapshot(ctx context.Context, statePath, memPath string) error {
+	return c.do(ctx, http.MethodPut, "/snapshot/create", &snapshotCreateRequest{
+		SnapshotType: "Full",
+		SnapshotPath: statePath,
+		MemFilePath:  memPath,
+	}, nil)
+}
+
+// loadSnapshot loads a snapshot, its vsock device is served on vsockPath unless
+// that is empty.
+func (c *apiClient) loadSnapshot(ctx context.Context, statePath, memPath, vsockPath string) error {
+	req := &snapshotLoadRequest{
+		SnapshotPath: statePath,
+		MemBackend:   memBackend{BackendType: "File", BackendPath: memPath},
+	}
+	if vsockPath != "" {
+		req.VsockOverride = &vsockOverride{UDSPath: vsockPath}
+	}
+	return c.do(ctx, http.MethodPut, "/snapshot/load", req, nil)
+}
+
+// updateDrive points a drive of a booted or restored vm at another file.
+func (c *apiClient) updateDrive(ctx context.Context, id, path string) error {
+	return c.do(ctx, http.MethodPatch, "/drives/"+id, &driveUpdate{DriveID: id, PathOnHost: path}, nil)
+}
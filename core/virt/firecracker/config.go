@@ -0,0 +1,84 @@
+package firecracker
+
+import (
+	"path/filepath"
+	"strconv"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+// guestCID is the context id of every guest, hybrid vsock does not need them to
+// be unique on the host.
+const guestCID = 3
+
+// ErrUnsupportedDevice is returned for devices firecracker has no equivalent for.
+var ErrUnsupportedDevice = errors.New("device is not supported by firecracker")
+
+// buildVMConfig translates the devices of a vm into its firecracker config, the
+// sockets of the vm are placed in dir. Firecracker has no virtio console, the
+// guest console is the serial port written to the stdout of firecracker, so the
+// log device, if any, is returned to redirect it.
+func buildVMConfig(dir string, opts *vmm.NewVMOptions, bl virtio.Bootloader) (*VMConfig, *virtio.VirtioSerialLogFile, error) {
+	if opts.Vcpus == 0 {
+		return nil, nil, errors.Errorf("VCPU count cannot be 0")
+	}
+	memory := uint64(opts.Memory.ToBytes()) >> 20
+	if memory == 0 {
+		return nil, nil, errors.Errorf("Memory cannot be 0")
+	}
+
+	linux, ok := bl.(*virtio.LinuxBootloader)
+	if !ok {
+		return nil, nil, errors.Errorf("unsupported bootloader %T, firecracker boots linux kernels directly", bl)
+	}
+
+	cfg := &VMConfig{
+		BootSource: BootSource{
+			KernelImagePath: linux.VmlinuzPath,
+			InitrdPath:      linux.InitrdPath,
+			BootArgs:        linux.KernelCmdLine,
+		},
+		MachineConfig: MachineConfig{VcpuCount: opts.Vcpus, MemSizeMib: memory},
+	}
+
+	var console *virtio.VirtioSerialLogFile
+
+	for i, dev := range opts.Devices {
+		switch dev := dev.(type) {
+		case *virtio.VirtioBlk:
+			if dev.ImagePath == "" {
+				return nil, nil, errors.Errorf("disk %q has no image path", dev.DevName)
+			}
+			cfg.Drives = append(cfg.Drives, Drive{
+				DriveID:    "disk" + strconv.Itoa(i),
+				PathOnHost: dev.ImagePath,
+				IsReadOnly: dev.ReadOnly,
+			})
+		case *virtio.VirtioVsock:
+			if cfg.Vsock != nil {
+				return nil, nil, errors.Errorf("only one vsock device is supported")
+			}
+			cfg.Vsock = &Vsock{GuestCID: guestCID, UDSPath: filepath.Join(dir, "vsock.sock")}
+		case *virtio.VirtioBalloon:
+			cfg.Balloon = &Balloon{DeflateOnOom: true}
+		case *virtio.VirtioRng:
+			cfg.Entropy = &EntropyDevice{}
+		case *virtio.VirtioSerialLogFile:
+			console = dev
+			// the last console on the command line becomes /dev/console
+			cfg.BootSource.BootArgs += " console=ttyS0"
+		case *virtio.VirtioFs:
+			return nil, nil, errors.Errorf("virtiofs share %q, use a block device instead: %w", dev.MountTag, ErrUnsupportedDevice)
+		case *virtio.VirtioNet:
+			// firecracker only attaches tap devices, which runm does not create
+			return nil, nil, errors.Errorf("network device, disable the vm network to use firecracker: %w", ErrUnsupportedDevice)
+		default:
+			return nil, nil, errors.Errorf("%T: %w", dev, ErrUnsupportedDevice)
+		}
+	}
+
+	return cfg, console, nil
+}
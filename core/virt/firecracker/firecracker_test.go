@@ -0,0 +1,443 @@
+package firecracker_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/virt/firecracker"
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/core/virt/vmm/vmmtest"
+	"github.com/walteh/runm/pkg/units"
+)
+
+func TestMain(m *testing.M) {
+	vmmtest.Main(m, func(args []string) error {
+		var socket string
+		for i, arg := range args {
+			if arg == "--api-sock" && i+1 < len(args) {
+				socket = args[i+1]
+			}
+		}
+		return runFakeFirecracker(socket)
+	})
+}
+
+// fakeFirecracker serves the parts of the firecracker api the backend uses.
+type fakeFirecracker struct {
+	mu     sync.Mutex
+	config firecracker.VMConfig
+	state  firecracker.InstanceState
+	// locked is set once the vm booted or a snapshot was loaded
+	locked bool
+}
+
+func fault(w http.ResponseWriter, msg string) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"fault_message": msg})
+}
+
+func runFakeFirecracker(socket string) error {
+	f := &fakeFirecracker{state: firecracker.InstanceStateNotStarted}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		json.NewEncoder(w).Encode(&firecracker.InstanceInfo{ID: "anonymous-instance", State: f.state, VMMVersion: "fake", AppName: "Firecracker"})
+	})
+	mux.HandleFunc("GET /vm/config", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		json.NewEncoder(w).Encode(&f.config)
+	})
+	f.preBoot(mux, "/boot-source", func(r *http.Request) error {
+		return json.NewDecoder(r.Body).Decode(&f.config.BootSource)
+	})
+	f.preBoot(mux, "/machine-config", func(r *http.Request) error {
+		return json.NewDecoder(r.Body).Decode(&f.config.MachineConfig)
+	})
+	f.preBoot(mux, "/drives/{id}", func(r *http.Request) error {
+		var d firecracker.Drive
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			return err
+		}
+		if d.DriveID != r.PathValue("id") {
+			return fmt.Errorf("drive id %q does not match the path", d.DriveID)
+		}
+		f.config.Drives = append(f.config.Drives, d)
+		return nil
+	})
+	mux.HandleFunc("PATCH /drives/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			DriveID    string `json:"drive_id"`
+			PathOnHost string `json:"path_on_host"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if !f.locked {
+			fault(w, "the update operation is not allowed before boot")
+			return
+		}
+		for i := range f.config.Drives {
+			if f.config.Drives[i].DriveID == r.PathValue("id") {
+				f.config.Drives[i].PathOnHost = req.PathOnHost
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		fault(w, "no drive "+r.PathValue("id"))
+	})
+	f.preBoot(mux, "/vsock", func(r *http.Request) error {
+		f.config.Vsock = &firecracker.Vsock{}
+		return json.NewDecoder(r.Body).Decode(f.config.Vsock)
+	})
+	f.preBoot(mux, "/balloon", func(r *http.Request) error {
+		f.config.Balloon = &firecracker.Balloon{}
+		return json.NewDecoder(r.Body).Decode(f.config.Balloon)
+	})
+	f.preBoot(mux, "/entropy", func(r *http.Request) error {
+		f.config.Entropy = &firecracker.EntropyDevice{}
+		return nil
+	})
+	mux.HandleFunc("PUT /actions", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ActionType string `json:"action_type"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		switch req.ActionType {
+		case "InstanceStart":
+			if f.locked || f.config.BootSource.KernelImagePath == "" {
+				fault(w, "cannot start the microvm")
+				return
+			}
+			if err := f.serveVsock(); err != nil {
+				fault(w, err.Error())
+				return
+			}
+			f.locked = true
+			f.state = firecracker.InstanceStateRunning
+			fmt.Println("fake firecracker booted")
+		case "SendCtrlAltDel":
+			if f.state != firecracker.InstanceStateRunning {
+				fault(w, "the microvm is not running")
+				return
+			}
+			// the guest reboots, which ends firecracker
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				os.Exit(0)
+			}()
+		default:
+			fault(w, "unknown action "+req.ActionType)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PATCH /vm", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			State string `json:"state"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		switch {
+		case req.State == "Paused" && f.state == firecracker.InstanceStateRunning:
+			f.state = firecracker.InstanceStatePaused
+		case req.State == "Resumed" && f.state == firecracker.InstanceStatePaused:
+			f.state = firecracker.InstanceStateRunning
+		default:
+			fault(w, fmt.Sprintf("cannot move a %s microvm to %s", f.state, req.State))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /balloon", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.config.Balloon == nil {
+			fault(w, "no balloon device")
+			return
+		}
+		json.NewEncoder(w).Encode(f.config.Balloon)
+	})
+	mux.HandleFunc("PATCH /balloon", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			AmountMib uint64 `json:"amount_mib"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.config.Balloon == nil || !f.locked {
+			fault(w, "the balloon is not active")
+			return
+		}
+		f.config.Balloon.AmountMib = req.AmountMib
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PUT /snapshot/create", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			SnapshotType string `json:"snapshot_type"`
+			SnapshotPath string `json:"snapshot_path"`
+			MemFilePath  string `json:"mem_file_path"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.state != firecracker.InstanceStatePaused {
+			fault(w, "the microvm is not paused")
+			return
+		}
+		data, _ := json.Marshal(&f.config)
+		if err := os.WriteFile(req.SnapshotPath, data, 0600); err != nil {
+			fault(w, err.Error())
+			return
+		}
+		if err := os.WriteFile(req.MemFilePath, []byte("memory"), 0600); err != nil {
+			fault(w, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PUT /snapshot/load", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			SnapshotPath string `json:"snapshot_path"`
+			MemBackend   struct {
+				BackendType string `json:"backend_type"`
+				BackendPath string `json:"backend_path"`
+			} `json:"mem_backend"`
+			VsockOverride *struct {
+				UDSPath string `json:"uds_path"`
+			} `json:"vsock_override"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.locked || f.config.BootSource.KernelImagePath != "" {
+			fault(w, "loading a snapshot is only allowed before configuring the microvm")
+			return
+		}
+		if _, err := os.Stat(req.MemBackend.BackendPath); err != nil {
+			fault(w, err.Error())
+			return
+		}
+		data, err := os.ReadFile(req.SnapshotPath)
+		if err != nil {
+			fault(w, err.Error())
+			return
+		}
+		if err := json.Unmarshal(data, &f.config); err != nil {
+			fault(w, err.Error())
+			return
+		}
+		if req.VsockOverride != nil {
+			if f.config.Vsock == nil {
+				fault(w, "the snapshot has no vsock device to override")
+				return
+			}
+			f.config.Vsock.UDSPath = req.VsockOverride.UDSPath
+		}
+		if err := f.serveVsock(); err != nil {
+			fault(w, err.Error())
+			return
+		}
+		f.locked = true
+		f.state = firecracker.InstanceStatePaused
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.Serve(l, mux)
+}
+
+// preBoot serves a configuration endpoint firecracker only accepts before boot.
+func (f *fakeFirecracker) preBoot(mux *http.ServeMux, endpoint string, set func(r *http.Request) error) {
+	mux.HandleFunc("PUT "+endpoint, func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.locked {
+			fault(w, "the update operation is not allowed after boot")
+			return
+		}
+		if err := set(r); err != nil {
+			fault(w, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// serveVsock serves the hybrid vsock socket of the config, every guest port echoes.
+func (f *fakeFirecracker) serveVsock() error {
+	if f.config.Vsock == nil {
+		return nil
+	}
+	return vmmtest.ServeHybridVsock(f.config.Vsock.UDSPath)
+}
+
+func newHypervisor(t *testing.T, root string) vmm.Hypervisor[*firecracker.VirtualMachine] {
+	return firecracker.NewHypervisor(firecracker.Config{
+		Binary: vmmtest.Binary(t),
+		Root:   root,
+	})
+}
+
+func TestVirtualMachine(t *testing.T) {
+	disk := filepath.Join(t.TempDir(), "mbin.squashfs")
+	require.NoError(t, os.WriteFile(disk, nil, 0644))
+	blk, err := virtio.VirtioBlkNew(disk)
+	require.NoError(t, err)
+	blk.ReadOnly = true
+
+	consoleLog := filepath.Join(t.TempDir(), "console.log")
+
+	vmmtest.RunVirtualMachine(t, newHypervisor(t, vmmtest.Root(t, "fc")), &vmm.NewVMOptions{
+		Vcpus:         2,
+		Memory:        strongunits.MiB(512).ToBytes(),
+		GuestPlatform: units.PlatformLinuxAMD64,
+		Devices: []virtio.VirtioDevice{
+			blk,
+			&virtio.VirtioVsock{},
+			&virtio.VirtioBalloon{},
+			&virtio.VirtioRng{},
+			&virtio.VirtioSerialLogFile{Path: consoleLog},
+		},
+	}, func(t *testing.T, vm *firecracker.VirtualMachine) {
+		cfg, err := vm.Config(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, firecracker.MachineConfig{VcpuCount: 2, MemSizeMib: 512}, cfg.MachineConfig)
+		assert.Equal(t, "/images/kernel", cfg.BootSource.KernelImagePath)
+		assert.Equal(t, "/images/initramfs.cpio.gz", cfg.BootSource.InitrdPath)
+		assert.True(t, strings.HasSuffix(cfg.BootSource.BootArgs, " console=ttyS0"), cfg.BootSource.BootArgs)
+		assert.Equal(t, []firecracker.Drive{{DriveID: "disk0", PathOnHost: disk, IsReadOnly: true}}, cfg.Drives)
+		assert.NotNil(t, cfg.Entropy)
+		require.NotNil(t, cfg.Vsock)
+		assert.Equal(t, cfg.Vsock.UDSPath, vm.HybridVsockSocketPath())
+
+		vmmtest.Echo(t, vm)
+
+		// the serial console is the stdout of firecracker
+		console, err := os.ReadFile(consoleLog)
+		require.NoError(t, err)
+		assert.Contains(t, string(console), "fake firecracker booted")
+	})
+}
+
+func snapshotOptions() *vmm.NewVMOptions {
+	return &vmm.NewVMOptions{
+		Vcpus:   1,
+		Memory:  strongunits.MiB(256).ToBytes(),
+		Devices: []virtio.VirtioDevice{&virtio.VirtioVsock{}},
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	vmmtest.RunSnapshotRestore(t, newHypervisor(t, vmmtest.Root(t, "fc")), snapshotOptions)
+}
+
+func TestSnapshotRestoreRelocatesDrives(t *testing.T) {
+	ctx := t.Context()
+	hpv := newHypervisor(t, vmmtest.Root(t, "fc"))
+
+	withDisk := func(dir string) *vmm.NewVMOptions {
+		disk := filepath.Join(dir, "mbin.squashfs")
+		require.NoError(t, os.WriteFile(disk, nil, 0644))
+		blk, err := virtio.VirtioBlkNew(disk)
+		require.NoError(t, err)
+		opts := snapshotOptions()
+		opts.Devices = append(opts.Devices, blk)
+		return opts
+	}
+
+	vm, err := hpv.NewVirtualMachine(ctx, "vm-fc-saved", withDisk(t.TempDir()), vmmtest.Bootloader(t))
+	require.NoError(t, err)
+	defer vm.HardStop(context.Background())
+	require.NoError(t, vm.Start(ctx))
+	require.NoError(t, vm.Pause(ctx))
+
+	snapshot := filepath.Join(t.TempDir(), "vm.snapshot")
+	require.NoError(t, vm.SaveFullSnapshot(ctx, snapshot))
+	require.NoError(t, vm.HardStop(ctx))
+
+	dir := t.TempDir()
+	restored, err := hpv.NewVirtualMachine(ctx, "vm-fc-restored", withDisk(dir), vmmtest.Bootloader(t))
+	require.NoError(t, err)
+	defer restored.HardStop(context.Background())
+	require.NoError(t, restored.RestoreFromFullSnapshot(ctx, snapshot))
+
+	cfg, err := restored.Config(ctx)
+	require.NoError(t, err)
+	require.Len(t, cfg.Drives, 1)
+	assert.Equal(t, filepath.Join(dir, "mbin.squashfs"), cfg.Drives[0].PathOnHost)
+}
+
+func TestSnapshotRunning(t *testing.T) {
+	ctx := t.Context()
+
+	vm, err := newHypervisor(t, vmmtest.Root(t, "fc")).NewVirtualMachine(ctx, "vm-fc-running", snapshotOptions(), vmmtest.Bootloader(t))
+	require.NoError(t, err)
+	defer vm.HardStop(context.Background())
+	require.NoError(t, vm.Start(ctx))
+
+	// firecracker only snapshots paused vms
+	require.Error(t, vm.SaveFullSnapshot(ctx, filepath.Join(t.TempDir(), "vm.snapshot")))
+}
+
+func TestReattach(t *testing.T) {
+	ctx := t.Context()
+	root := vmmtest.Root(t, "fc")
+
+	vm, err := newHypervisor(t, root).NewVirtualMachine(ctx, "vm-fc-reattach", &vmm.NewVMOptions{
+		Vcpus:   1,
+		Memory:  strongunits.MiB(256).ToBytes(),
+		Devices: []virtio.VirtioDevice{&virtio.VirtioVsock{}},
+	}, vmmtest.Bootloader(t))
+	require.NoError(t, err)
+	defer vm.HardStop(context.Background())
+	require.NoError(t, vm.Start(ctx))
+
+	// a new shim finds the vm from its id alone
+	hpv, ok := newHypervisor(t, root).(vmm.ReattachableHypervisor[*firecracker.VirtualMachine])
+	require.True(t, ok)
+	reattached, err := hpv.ReattachVirtualMachine(ctx, &vmm.PersistedVM{ID: "vm-fc-reattach"})
+	require.NoError(t, err)
+
+	assert.Equal(t, vmm.VirtualMachineStateTypeRunning, reattached.CurrentState())
+	assert.Equal(t, uint64(1), reattached.Opts().Vcpus)
+	assert.Equal(t, vm.HybridVsockSocketPath(), reattached.HybridVsockSocketPath())
+	vmmtest.Echo(t, reattached)
+
+	require.NoError(t, reattached.HardStop(ctx))
+	assert.Equal(t, vmm.VirtualMachineStateTypeStopped, reattached.CurrentState())
+	assert.Eventually(t, func() bool { return !vm.CanHardStop(ctx) }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestUnsupportedConfig(t *testing.T) {
+	share, err := virtio.VirtioFsNew(t.TempDir(), "share")
+	require.NoError(t, err)
+
+	vmmtest.RunUnsupportedConfig(t, newHypervisor(t, vmmtest.Root(t, "fc")), firecracker.ErrUnsupportedDevice,
+		vmmtest.BadConfig{Name: "virtiofs", Devices: []virtio.VirtioDevice{share}, Is: firecracker.ErrUnsupportedDevice},
+		vmmtest.BadConfig{Name: "network", Devices: []virtio.VirtioDevice{&virtio.VirtioNet{Nat: true}}, Is: firecracker.ErrUnsupportedDevice},
+	)
+}
@@ -0,0 +1,147 @@
+// Package firecracker runs vms as Firecracker microvms on linux hosts. Every vm
+// gets its own firecracker process driven through its rest api. Firecracker has
+// no directory shares, so the container rootfs has to come in as a block device.
+package firecracker
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+const defaultAPITimeout = 5 * time.Second
+
+type Config struct {
+	// Binary is the firecracker executable, looked up in PATH by default.
+	Binary string
+	// Root holds a directory per vm with its api and vsock sockets, it defaults to
+	// a directory in os.TempDir. Unix socket paths are short, so keep it short too.
+	Root string
+	// APITimeout bounds the wait for a new firecracker process to serve its api.
+	APITimeout time.Duration
+}
+
+func NewHypervisor(cfg Config) vmm.Hypervisor[*VirtualMachine] {
+	if cfg.Binary == "" {
+		cfg.Binary = "firecracker"
+	}
+	if cfg.Root == "" {
+		cfg.Root = filepath.Join(os.TempDir(), "runm-firecracker")
+	}
+	if cfg.APITimeout == 0 {
+		cfg.APITimeout = defaultAPITimeout
+	}
+	return &Hypervisor{
+		cfg:    cfg,
+		vms:    make(map[string]*VirtualMachine),
+		notify: make(chan *VirtualMachine),
+	}
+}
+
+var (
+	_ vmm.Hypervisor[*VirtualMachine]             = &Hypervisor{}
+	_ vmm.ReattachableHypervisor[*VirtualMachine] = &Hypervisor{}
+)
+
+type Hypervisor struct {
+	cfg    Config
+	vms    map[string]*VirtualMachine
+	mu     sync.Mutex
+	notify chan *VirtualMachine
+}
+
+func (hpv *Hypervisor) vmDir(id string) string {
+	return filepath.Join(hpv.cfg.Root, id)
+}
+
+func (hpv *Hypervisor) NewVirtualMachine(ctx context.Context, id string, opts *vmm.NewVMOptions, bl virtio.Bootloader) (*VirtualMachine, error) {
+	if opts == nil {
+		return nil, errors.Errorf("VM options are nil")
+	}
+
+	if err := virtio.ValidateDevices(opts.Devices, bl, opts.GuestPlatform); err != nil {
+		return nil, err
+	}
+
+	dir := hpv.vmDir(id)
+
+	cfg, console, err := buildVMConfig(dir, opts, bl)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Errorf("creating vm directory: %w", err)
+	}
+
+	if cfg.Vsock != nil {
+		if err := os.Remove(cfg.Vsock.UDSPath); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Errorf("removing stale vsock socket: %w", err)
+		}
+	}
+
+	vm := newVirtualMachine(id, dir, opts, cfg)
+
+	if err := vm.startVMM(ctx, hpv.cfg.Binary, console, hpv.cfg.APITimeout); err != nil {
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "created firecracker vm", "id", id, "dir", dir, "vcpus", opts.Vcpus, "memory", opts.Memory)
+
+	hpv.mu.Lock()
+	hpv.vms[id] = vm
+	hpv.mu.Unlock()
+
+	go func() {
+		hpv.notify <- vm
+	}()
+
+	return vm, nil
+}
+
+// ReattachVirtualMachine implements vmm.ReattachableHypervisor, the vm keeps
+// running in the firecracker process started by the previous shim.
+func (hpv *Hypervisor) ReattachVirtualMachine(ctx context.Context, st *vmm.PersistedVM) (*VirtualMachine, error) {
+	dir := hpv.vmDir(st.ID)
+	client := newAPIClient(filepath.Join(dir, "api.sock"))
+
+	info, err := client.instanceInfo(ctx)
+	if err != nil {
+		return nil, errors.Errorf("reading instance info: %w", err)
+	}
+
+	cfg, err := client.vmConfig(ctx)
+	if err != nil {
+		return nil, errors.Errorf("reading vm config: %w", err)
+	}
+
+	vm := newVirtualMachine(st.ID, dir, &vmm.NewVMOptions{
+		Vcpus:         cfg.MachineConfig.VcpuCount,
+		Memory:        strongunits.MiB(cfg.MachineConfig.MemSizeMib).ToBytes(),
+		GuestPlatform: st.GuestPlatform,
+	}, cfg)
+	vm.client = client
+	vm.configured = true
+	vm.states = vmm.NewStateMachine(instanceStateToHypervisorState(info.State))
+
+	go vm.watch(context.WithoutCancel(ctx))
+
+	hpv.mu.Lock()
+	hpv.vms[st.ID] = vm
+	hpv.mu.Unlock()
+
+	return vm, nil
+}
+
+func (hpv *Hypervisor) OnCreate() <-chan *VirtualMachine {
+	return hpv.notify
+}
@@ -0,0 +1,571 @@
+package firecracker
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/pkg/units"
+)
+
+// pollInterval is how often the vm state is read, firecracker does not push
+// state changes over its api.
+const pollInterval = 100 * time.Millisecond
+
+var (
+	_ vmm.VirtualMachine      = &VirtualMachine{}
+	_ vmm.HybridVsockVM       = &VirtualMachine{}
+	_ vmm.FullSnapshotCapable = &VirtualMachine{}
+	_ vmm.StateHistoryVM      = &VirtualMachine{}
+	_ vmm.ConsoleLogAppender  = &VirtualMachine{}
+)
+
+func instanceStateToHypervisorState(state InstanceState) vmm.VirtualMachineStateType {
+	switch state {
+	case InstanceStateNotStarted:
+		return vmm.VirtualMachineStateTypeStopped
+	case InstanceStateRunning:
+		return vmm.VirtualMachineStateTypeRunning
+	case InstanceStatePaused:
+		return vmm.VirtualMachineStateTypePaused
+	default:
+		return vmm.VirtualMachineStateTypeUnknown
+	}
+}
+
+type VirtualMachine struct {
+	id     string
+	dir    string
+	opts   *vmm.NewVMOptions
+	config *VMConfig
+	client *apiClient
+
+	// process is nil when the vm was reattached
+	process *exec.Cmd
+	// exited is closed once firecracker is gone
+	exited   chan struct{}
+	exitOnce sync.Once
+
+	// opMu keeps a polled state from overwriting the state set by a change made
+	// through the api while the poll was in flight
+	opMu sync.Mutex
+
+	states *vmm.StateMachine
+
+	mu sync.Mutex
+	// configured is set once the devices are sent or a snapshot is loaded, after
+	// which firecracker accepts neither
+	configured bool
+	stopping   bool
+}
+
+func newVirtualMachine(id, dir string, opts *vmm.NewVMOptions, cfg *VMConfig) *VirtualMachine {
+	return &VirtualMachine{
+		id:     id,
+		dir:    dir,
+		opts:   opts,
+		config: cfg,
+		exited: make(chan struct{}),
+		states: vmm.NewStateMachine(vmm.VirtualMachineStateTypeStopped),
+	}
+}
+
+func (vm *VirtualMachine) pidFile() string {
+	return filepath.Join(vm.dir, "firecracker.pid")
+}
+
+// startVMM starts firecracker and waits for its api. The guest serial console is
+// the stdout of firecracker, it goes to console when set and is dropped otherwise.
+func (vm *VirtualMachine) startVMM(ctx context.Context, binary string, console *virtio.VirtioSerialLogFile, timeout time.Duration) error {
+	socket := filepath.Join(vm.dir, "api.sock")
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return errors.Errorf("removing stale api socket: %w", err)
+	}
+
+	// firecracker only logs into a file that already exists
+	logPath := filepath.Join(vm.dir, "firecracker.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return errors.Errorf("creating firecracker log: %w", err)
+	}
+	defer logFile.Close()
+
+	// the vm outlives the context it was created with
+	cmd := exec.Command(binary, "--api-sock", socket, "--log-path", logPath, "--level", "Info")
+	cmd.Stderr = logFile
+	// own session, so the vm survives the shim and can be reattached
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if console != nil {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if console.Append {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		consoleFile, err := os.OpenFile(console.Path, flags, 0644)
+		if err != nil {
+			return errors.Errorf("opening console log: %w", err)
+		}
+		defer consoleFile.Close()
+		cmd.Stdout = consoleFile
+	}
+
+	if err := cmd.Start(); err != nil {
+		return errors.Errorf("starting firecracker: %w", err)
+	}
+
+	vm.process = cmd
+	vm.client = newAPIClient(socket)
+
+	go func() {
+		err := cmd.Wait()
+		slog.InfoContext(ctx, "firecracker exited", "id", vm.id, "error", err)
+		vm.gone(err)
+	}()
+
+	// a reattaching shim finds the process through it
+	if err := os.WriteFile(vm.pidFile(), []byte(strconv.Itoa(cmd.Process.Pid)), 0600); err != nil {
+		vm.killProcess()
+		return errors.Errorf("writing firecracker pid file: %w", err)
+	}
+
+	if err := vmm.WaitFor(ctx, timeout, vm.client.ping); err != nil {
+		vm.killProcess()
+		return errors.Errorf("waiting for firecracker api: %w", err)
+	}
+
+	go vm.watch(context.WithoutCancel(ctx))
+
+	return nil
+}
+
+// watch follows the vm state until firecracker is gone.
+func (vm *VirtualMachine) watch(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-vm.exited:
+			return
+		case <-ticker.C:
+		}
+
+		if vm.poll(ctx) {
+			return
+		}
+	}
+}
+
+// poll reads the vm state once and reports whether firecracker is gone.
+func (vm *VirtualMachine) poll(ctx context.Context) bool {
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	info, err := vm.client.instanceInfo(ctx)
+	if err != nil {
+		// a reattached vm has no process to wait on
+		if vm.process == nil {
+			vm.gone(err)
+			return true
+		}
+		return false
+	}
+
+	vm.mu.Lock()
+	configured := vm.configured
+	vm.mu.Unlock()
+	if !configured {
+		return false
+	}
+
+	if state := instanceStateToHypervisorState(info.State); state != vm.CurrentState() {
+		vm.setState(state, map[string]string{"raw_state": string(info.State)})
+	}
+	return false
+}
+
+// gone cleans up after firecracker exited.
+func (vm *VirtualMachine) gone(err error) {
+	vm.exitOnce.Do(func() {
+		// the socket outlives firecracker and would block a restore from binding it
+		if socket := vm.HybridVsockSocketPath(); socket != "" {
+			_ = os.Remove(socket)
+		}
+		_ = os.Remove(vm.pidFile())
+
+		vm.mu.Lock()
+		stopping := vm.stopping
+		vm.mu.Unlock()
+
+		if err != nil && !stopping && vm.CurrentState() != vmm.VirtualMachineStateTypeStopped {
+			vm.setState(vmm.VirtualMachineStateTypeError, map[string]string{"error": err.Error()})
+		} else {
+			vm.setState(vmm.VirtualMachineStateTypeStopped, nil)
+		}
+
+		close(vm.exited)
+	})
+}
+
+// killProcess kills firecracker, which has no api call to shut itself down.
+func (vm *VirtualMachine) killProcess() {
+	if vm.process != nil {
+		_ = vm.process.Process.Kill()
+		<-vm.exited
+		return
+	}
+
+	data, err := os.ReadFile(vm.pidFile())
+	if err != nil {
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return
+	}
+	_ = syscall.Kill(pid, syscall.SIGKILL)
+}
+
+// Config returns the vm as firecracker reports it.
+func (vm *VirtualMachine) Config(ctx context.Context) (*VMConfig, error) {
+	return vm.client.vmConfig(ctx)
+}
+
+func (vm *VirtualMachine) Start(ctx context.Context) error {
+	if !vm.CanStart(ctx) {
+		return &vmm.OperationError{Operation: vmm.OperationStart, State: vm.CurrentState()}
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	vm.mu.Lock()
+	configured := vm.configured
+	vm.mu.Unlock()
+
+	if configured {
+		return errors.New("firecracker cannot start a vm twice")
+	}
+
+	if err := vm.client.configure(ctx, vm.config); err != nil {
+		return errors.Errorf("configuring vm: %w", err)
+	}
+	vm.mu.Lock()
+	vm.configured = true
+	vm.mu.Unlock()
+
+	vm.setState(vmm.VirtualMachineStateTypeStarting, nil)
+
+	if err := vm.client.action(ctx, "InstanceStart"); err != nil {
+		vm.setState(vmm.VirtualMachineStateTypeError, map[string]string{"error": err.Error()})
+		return errors.Errorf("booting vm: %w", err)
+	}
+
+	vm.setState(vmm.VirtualMachineStateTypeRunning, nil)
+
+	return nil
+}
+
+// HardStop kills firecracker along with the vm.
+func (vm *VirtualMachine) HardStop(ctx context.Context) error {
+	vm.mu.Lock()
+	vm.stopping = true
+	vm.mu.Unlock()
+
+	vm.killProcess()
+
+	select {
+	case <-vm.exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RequestStop sends ctrl+alt+del to the guest, which reboots and so ends
+// firecracker. Firecracker only emulates the keyboard for x86 guests.
+func (vm *VirtualMachine) RequestStop(ctx context.Context) (bool, error) {
+	if vm.opts.GuestPlatform.Arch() == units.ArchARM64 {
+		return false, errors.Errorf("firecracker cannot request an arm64 guest to stop")
+	}
+
+	if err := vm.states.Check(vmm.OperationRequestStop); err != nil {
+		return false, err
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	if err := vm.client.action(ctx, "SendCtrlAltDel"); err != nil {
+		return false, errors.Errorf("requesting vm stop: %w", err)
+	}
+	vm.setState(vmm.VirtualMachineStateTypeStopping, nil)
+	return true, nil
+}
+
+func (vm *VirtualMachine) Pause(ctx context.Context) error {
+	if err := vm.states.Check(vmm.OperationPause); err != nil {
+		return err
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	if err := vm.client.setState(ctx, "Paused"); err != nil {
+		return errors.Errorf("pausing vm: %w", err)
+	}
+	vm.setState(vmm.VirtualMachineStateTypePaused, nil)
+	return nil
+}
+
+func (vm *VirtualMachine) Resume(ctx context.Context) error {
+	if err := vm.states.Check(vmm.OperationResume); err != nil {
+		return err
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	if err := vm.client.setState(ctx, "Resumed"); err != nil {
+		return errors.Errorf("resuming vm: %w", err)
+	}
+	vm.setState(vmm.VirtualMachineStateTypeRunning, nil)
+	return nil
+}
+
+func (vm *VirtualMachine) CanStart(_ context.Context) bool {
+	select {
+	case <-vm.exited:
+		return false
+	default:
+	}
+	vm.mu.Lock()
+	configured := vm.configured
+	vm.mu.Unlock()
+	return !configured && vm.states.Can(vmm.OperationStart)
+}
+
+func (vm *VirtualMachine) CanHardStop(_ context.Context) bool {
+	select {
+	case <-vm.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+func (vm *VirtualMachine) CanRequestStop(_ context.Context) bool {
+	return vm.states.Can(vmm.OperationRequestStop) && vm.opts.GuestPlatform.Arch() != units.ArchARM64
+}
+
+func (vm *VirtualMachine) CanPause(_ context.Context) bool {
+	return vm.states.Can(vmm.OperationPause)
+}
+
+func (vm *VirtualMachine) CanResume(_ context.Context) bool {
+	return vm.states.Can(vmm.OperationResume)
+}
+
+func (vm *VirtualMachine) CurrentState() vmm.VirtualMachineStateType {
+	return vm.states.Current()
+}
+
+// setState moves the vm to state, a change the state machine rejects is logged
+// and dropped.
+func (vm *VirtualMachine) setState(state vmm.VirtualMachineStateType, metadata map[string]string) {
+	if err := vm.states.Transition(state, metadata); err != nil {
+		slog.Warn("ignoring vm state change", "id", vm.id, "error", err)
+	}
+}
+
+// StateChangeNotify implements vmm.VirtualMachine.
+func (vm *VirtualMachine) StateChangeNotify(ctx context.Context) <-chan vmm.VirtualMachineStateChange {
+	return vm.states.Subscribe(ctx)
+}
+
+// StateHistory implements vmm.StateHistoryVM.
+func (vm *VirtualMachine) StateHistory() []vmm.StateTransition {
+	return vm.states.History()
+}
+
+// HybridVsockSocketPath implements vmm.HybridVsockVM.
+func (vm *VirtualMachine) HybridVsockSocketPath() string {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.config.Vsock == nil {
+		return ""
+	}
+	return vm.config.Vsock.UDSPath
+}
+
+// VSockConnect implements vmm.VirtualMachine.
+func (vm *VirtualMachine) VSockConnect(ctx context.Context, port uint32) (net.Conn, error) {
+	socket := vm.HybridVsockSocketPath()
+	if socket == "" {
+		return nil, errors.Errorf("vm %s has no vsock device", vm.id)
+	}
+	return vmm.DialHybridVsock(ctx, socket, port)
+}
+
+// VSockListen implements vmm.VirtualMachine. Firecracker forwards guest
+// connections to port to the socket "<uds path>_<port>".
+func (vm *VirtualMachine) VSockListen(ctx context.Context, port uint32) (net.Listener, error) {
+	socket := vm.HybridVsockSocketPath()
+	if socket == "" {
+		return nil, errors.Errorf("vm %s has no vsock device", vm.id)
+	}
+	path := socket + "_" + strconv.FormatUint(uint64(port), 10)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Errorf("removing stale socket: %w", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Errorf("listening on vsock port %d: %w", port, err)
+	}
+	return l, nil
+}
+
+// SupportsFullSnapshot implements vmm.FullSnapshotCapable, every device firecracker
+// accepts can be snapshotted.
+func (vm *VirtualMachine) SupportsFullSnapshot(ctx context.Context) error {
+	return nil
+}
+
+func snapshotFiles(dir string) (state, memory string) {
+	return filepath.Join(dir, "vmstate"), filepath.Join(dir, "memory")
+}
+
+// SaveFullSnapshot writes the vm state and memory into the directory path, the
+// vm must be paused.
+func (vm *VirtualMachine) SaveFullSnapshot(ctx context.Context, path string) error {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return errors.Errorf("creating snapshot directory: %w", err)
+	}
+
+	state, memory := snapshotFiles(path)
+	if err := vm.client.createSnapshot(ctx, state, memory); err != nil {
+		return errors.Errorf("saving snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// RestoreFromFullSnapshot loads a snapshot into a vm that was never started, it
+// is paused afterwards with the devices it was saved with.
+func (vm *VirtualMachine) RestoreFromFullSnapshot(ctx context.Context, path string) error {
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	vm.mu.Lock()
+	configured := vm.configured
+	vm.mu.Unlock()
+	if configured {
+		return errors.New("cannot restore from snapshot into a vm that was already started")
+	}
+
+	// the vsock socket is created by the load, so it is placed in the working
+	// directory of this vm right away
+	var vsockPath string
+	if vm.config.Vsock != nil {
+		vsockPath = vm.config.Vsock.UDSPath
+	}
+
+	state, memory := snapshotFiles(path)
+	if err := vm.client.loadSnapshot(ctx, state, memory, vsockPath); err != nil {
+		return errors.Errorf("restoring from snapshot: %w", err)
+	}
+
+	// firecracker reopens the drives at the paths they were saved with, in the
+	// working directory of the vm the snapshot was taken from, which has to be
+	// readable while loading. the guest is moved on to the drives of this vm before
+	// it resumes
+	for _, d := range vm.config.Drives {
+		if err := vm.client.updateDrive(ctx, d.DriveID, d.PathOnHost); err != nil {
+			return errors.Errorf("relocating drive %s: %w", d.DriveID, err)
+		}
+	}
+
+	cfg, err := vm.client.vmConfig(ctx)
+	if err != nil {
+		return errors.Errorf("reading restored vm config: %w", err)
+	}
+
+	vm.mu.Lock()
+	vm.configured = true
+	vm.config.Vsock = cfg.Vsock
+	vm.mu.Unlock()
+
+	vm.setState(vmm.VirtualMachineStateTypePaused, nil)
+
+	return nil
+}
+
+// SetMemoryBalloonTargetSize inflates the balloon until the guest is left with
+// targetBytes.
+func (vm *VirtualMachine) SetMemoryBalloonTargetSize(ctx context.Context, targetBytes strongunits.B) error {
+	if vm.config.Balloon == nil {
+		return errors.New("no memory balloon devices found")
+	}
+
+	total := vm.config.MachineConfig.MemSizeMib
+	target := uint64(targetBytes) >> 20
+	if target > total {
+		return errors.Errorf("target memory size %d exceeds vm memory %d", uint64(targetBytes), total<<20)
+	}
+
+	if err := vm.client.updateBalloon(ctx, total-target); err != nil {
+		return errors.Errorf("resizing memory balloon: %w", err)
+	}
+
+	return nil
+}
+
+func (vm *VirtualMachine) GetMemoryBalloonTargetSize(ctx context.Context) (strongunits.B, error) {
+	if vm.config.Balloon == nil {
+		return 0, errors.New("no memory balloon devices found")
+	}
+	b, err := vm.client.balloon(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return strongunits.MiB(vm.config.MachineConfig.MemSizeMib - b.AmountMib).ToBytes(), nil
+}
+
+func (vm *VirtualMachine) ID() string {
+	return vm.id
+}
+
+// AppendsConsoleLog implements vmm.ConsoleLogAppender. The serial console is
+// written to the stdout of firecracker, see startVMM.
+func (vm *VirtualMachine) AppendsConsoleLog() bool {
+	return true
+}
+
+func (vm *VirtualMachine) Devices() []virtio.VirtioDevice {
+	return vm.opts.Devices
+}
+
+func (vm *VirtualMachine) Opts() *vmm.NewVMOptions {
+	return vm.opts
+}
+
+func (vm *VirtualMachine) ServeBackgroundTasks(ctx context.Context) error {
+	return nil
+}
+
+func (vm *VirtualMachine) StartGraphicApplication(width float64, height float64) error {
+	return errors.New("firecracker vms have no display")
+}
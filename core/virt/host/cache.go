@@ -52,12 +52,39 @@ func CacheDirPrefix() (string, error) {
 	return filepath.Join(userCacheDir, "ec1", "cache"), nil
 }
 
+// VMCacheDir holds the working directory of every vm, see EmphiricalVMCacheDir.
+func VMCacheDir(ctx context.Context) (string, error) {
+	cacheDir, err := CacheDirPrefix()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "vm"), nil
+}
+
 func EmphiricalVMCacheDir(ctx context.Context, id string) (string, error) {
+	vmDir, err := VMCacheDir(ctx)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(vmDir, id), nil
+}
+
+// ArtifactCacheDir is the default root of the shared guest image store.
+func ArtifactCacheDir(ctx context.Context) (string, error) {
+	cacheDir, err := CacheDirPrefix()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "artifacts"), nil
+}
+
+// SnapshotCacheDir is the default root of the vm snapshot store.
+func SnapshotCacheDir(ctx context.Context) (string, error) {
 	cacheDir, err := CacheDirPrefix()
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(cacheDir, "vm", id), nil
+	return filepath.Join(cacheDir, "snapshots"), nil
 }
 
 func TempDir(ctx context.Context) string {
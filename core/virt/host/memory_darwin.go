@@ -0,0 +1,17 @@
+//go:build darwin
+
+package host
+
+import (
+	"github.com/containers/common/pkg/strongunits"
+	"golang.org/x/sys/unix"
+)
+
+// PhysicalMemory returns the memory installed in the host.
+func PhysicalMemory() (strongunits.B, error) {
+	size, err := unix.SysctlUint64("hw.memsize")
+	if err != nil {
+		return 0, err
+	}
+	return strongunits.B(size), nil
+}
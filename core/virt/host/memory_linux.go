@@ -0,0 +1,17 @@
+//go:build linux
+
+package host
+
+import (
+	"github.com/containers/common/pkg/strongunits"
+	"golang.org/x/sys/unix"
+)
+
+// PhysicalMemory returns the memory installed in the host.
+func PhysicalMemory() (strongunits.B, error) {
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return 0, err
+	}
+	return strongunits.B(uint64(info.Totalram) * uint64(info.Unit)), nil
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !linux
+
+package host
+
+import (
+	"github.com/containers/common/pkg/strongunits"
+	"gitlab.com/tozd/go/errors"
+)
+
+// PhysicalMemory returns the memory installed in the host.
+func PhysicalMemory() (strongunits.B, error) {
+	return 0, errors.New("physical memory size is not available on this platform")
+}
@@ -0,0 +1,102 @@
+// Package guest is the guest side of a procvm virtual machine. The guest agent
+// runs as a local process, vsock ports are unix sockets in the vm root and
+// virtiofs shares are plain directories listed in the vm root.
+package guest
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// The environment the host starts the guest agent with.
+const (
+	EnvRoot = "RUNM_PROCVM_ROOT"
+	EnvID   = "RUNM_PROCVM_ID"
+)
+
+// Active reports whether the current process was started as a procvm guest.
+func Active() bool {
+	return os.Getenv(EnvRoot) != ""
+}
+
+// Root is the vm root of the current guest.
+func Root() string {
+	return os.Getenv(EnvRoot)
+}
+
+// VsockDir holds the sockets of the vsock ports of a vm.
+func VsockDir(root string) string {
+	return filepath.Join(root, "vsock")
+}
+
+// ListenSocketPath is where the guest listens on port, the host connects to it.
+func ListenSocketPath(root string, port uint32) string {
+	return filepath.Join(VsockDir(root), "guest-"+strconv.FormatUint(uint64(port), 10)+".sock")
+}
+
+// DialSocketPath is where the host listens on port, the guest connects to it.
+func DialSocketPath(root string, port uint32) string {
+	return filepath.Join(VsockDir(root), "host-"+strconv.FormatUint(uint64(port), 10)+".sock")
+}
+
+// SharesPath lists the shared directories of the vm by mount tag.
+func SharesPath(root string) string {
+	return filepath.Join(root, "shares.json")
+}
+
+// Listen listens on the vsock port of the current guest.
+func Listen(port uint32) (net.Listener, error) {
+	path := ListenSocketPath(Root(), port)
+	// a previous agent may have left its socket behind
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Errorf("removing stale socket: %w", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Errorf("listening on vsock port %d: %w", port, err)
+	}
+	return l, nil
+}
+
+// Dial connects to a vsock port the host listens on.
+func Dial(ctx context.Context, port uint32) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", DialSocketPath(Root(), port))
+	if err != nil {
+		return nil, errors.Errorf("dialing host vsock port %d: %w", port, err)
+	}
+	return conn, nil
+}
+
+// Shares returns the shared directories of the current guest by mount tag.
+func Shares() (map[string]string, error) {
+	data, err := os.ReadFile(SharesPath(Root()))
+	if err != nil {
+		return nil, errors.Errorf("reading shares: %w", err)
+	}
+	shares := map[string]string{}
+	if err := json.Unmarshal(data, &shares); err != nil {
+		return nil, errors.Errorf("decoding shares: %w", err)
+	}
+	return shares, nil
+}
+
+// ShareDir returns the directory shared with mount tag, where a real guest
+// would mount the virtiofs share.
+func ShareDir(tag string) (string, error) {
+	shares, err := Shares()
+	if err != nil {
+		return "", err
+	}
+	dir, ok := shares[tag]
+	if !ok {
+		return "", errors.Errorf("no share with mount tag %q", tag)
+	}
+	return dir, nil
+}
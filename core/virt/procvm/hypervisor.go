@@ -0,0 +1,182 @@
+// Package procvm is a test hypervisor that boots a vm by starting the guest agent
+// as a local process, optionally in new linux namespaces. Vsock ports are unix
+// sockets and virtiofs shares are handed to the agent as directories, see the
+// guest package for the agent side.
+//
+// It lets NewOCIVirtualMachine and the vm runtime be tested without
+// virtualization. Nothing in the guest is isolated from the host.
+package procvm
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/pkg/cmdline"
+)
+
+type Config struct {
+	// Root holds a directory per vm with its vsock sockets and shares, it
+	// defaults to a directory in os.TempDir. Unix socket paths are short, so
+	// keep it short too.
+	Root string
+	// Agent is the command started in place of the guest kernel, the init
+	// parameters of the bootloader are appended to it.
+	Agent []string
+	// Env is added to the environment of the agent.
+	Env []string
+	// Namespaces starts the agent in new mount, uts, ipc and pid namespaces, and
+	// in a new user namespace when not running as root.
+	Namespaces bool
+}
+
+func NewHypervisor(cfg Config) vmm.Hypervisor[*VirtualMachine] {
+	if cfg.Root == "" {
+		cfg.Root = filepath.Join(os.TempDir(), "runm-procvm")
+	}
+	return &Hypervisor{
+		cfg:    cfg,
+		vms:    make(map[string]*VirtualMachine),
+		notify: make(chan *VirtualMachine),
+	}
+}
+
+var (
+	_ vmm.Hypervisor[*VirtualMachine]             = &Hypervisor{}
+	_ vmm.ReattachableHypervisor[*VirtualMachine] = &Hypervisor{}
+)
+
+type Hypervisor struct {
+	cfg    Config
+	vms    map[string]*VirtualMachine
+	mu     sync.Mutex
+	notify chan *VirtualMachine
+}
+
+func (hpv *Hypervisor) NewVirtualMachine(ctx context.Context, id string, opts *vmm.NewVMOptions, bl virtio.Bootloader) (*VirtualMachine, error) {
+	if opts == nil {
+		return nil, errors.Errorf("VM options are nil")
+	}
+	if len(hpv.cfg.Agent) == 0 {
+		return nil, errors.Errorf("no guest agent configured")
+	}
+
+	if err := virtio.ValidateDevices(opts.Devices, bl, opts.GuestPlatform); err != nil {
+		return nil, err
+	}
+
+	linux, ok := bl.(*virtio.LinuxBootloader)
+	if !ok {
+		return nil, errors.Errorf("unsupported bootloader %T, only linux guests can run as a process", bl)
+	}
+
+	// the kernel hands init its parameters with the quotes removed
+	cl, err := cmdline.Parse(linux.KernelCmdLine)
+	if err != nil {
+		return nil, errors.Errorf("parsing kernel command line: %w", err)
+	}
+	args := append([]string{}, hpv.cfg.Agent...)
+	for _, p := range cl.Init {
+		if p.HasValue {
+			args = append(args, p.Key+"="+p.Value)
+		} else {
+			args = append(args, p.Key)
+		}
+	}
+
+	vm := &VirtualMachine{
+		id:         id,
+		root:       filepath.Join(hpv.cfg.Root, id),
+		opts:       opts,
+		args:       args,
+		env:        hpv.cfg.Env,
+		namespaces: hpv.cfg.Namespaces,
+		shares:     map[string]string{},
+		states:     vmm.NewStateMachine(vmm.VirtualMachineStateTypeStopped),
+	}
+
+	for _, dev := range opts.Devices {
+		switch dev := dev.(type) {
+		case *virtio.VirtioFs:
+			vm.shares[dev.MountTag] = dev.SharedDir
+		case *virtio.VirtioSerialLogFile:
+			vm.logFile = dev
+		default:
+			slog.DebugContext(ctx, "ignoring device the process vm cannot emulate", "id", id, "device", dev)
+		}
+	}
+
+	slog.InfoContext(ctx, "created process vm", "id", id, "root", vm.root, "args", args, "shares", len(vm.shares))
+
+	hpv.mu.Lock()
+	hpv.vms[id] = vm
+	hpv.mu.Unlock()
+
+	go func() {
+		hpv.notify <- vm
+	}()
+
+	return vm, nil
+}
+
+// ReattachVirtualMachine implements vmm.ReattachableHypervisor, the vm keeps
+// running as the agent process started by the previous shim.
+func (hpv *Hypervisor) ReattachVirtualMachine(ctx context.Context, st *vmm.PersistedVM) (*VirtualMachine, error) {
+	root := filepath.Join(hpv.cfg.Root, st.ID)
+
+	as, err := readAgentState(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Kill(as.Pid, 0); err != nil {
+		return nil, errors.Errorf("guest agent %d of vm %s is gone: %w", as.Pid, st.ID, err)
+	}
+
+	opts := &vmm.NewVMOptions{
+		Vcpus:         as.VCPUs,
+		Memory:        as.Memory,
+		GuestPlatform: st.GuestPlatform,
+	}
+	for tag, dir := range as.Shares {
+		opts.Devices = append(opts.Devices, &virtio.VirtioFs{DirectorySharingConfig: virtio.DirectorySharingConfig{MountTag: tag}, SharedDir: dir})
+	}
+	if as.ConsoleLog != nil {
+		opts.Devices = append(opts.Devices, as.ConsoleLog)
+	}
+
+	exited := make(chan struct{})
+	vm := &VirtualMachine{
+		id:         st.ID,
+		root:       root,
+		opts:       opts,
+		args:       as.Args,
+		env:        hpv.cfg.Env,
+		namespaces: hpv.cfg.Namespaces,
+		shares:     as.Shares,
+		logFile:    as.ConsoleLog,
+		states:     vmm.NewStateMachine(vmm.VirtualMachineStateTypeRunning),
+		pid:        as.Pid,
+		exited:     exited,
+	}
+
+	go vm.watch(context.WithoutCancel(ctx), as.Pid, exited)
+
+	slog.InfoContext(ctx, "reattached process vm", "id", st.ID, "root", root, "pid", as.Pid)
+
+	hpv.mu.Lock()
+	hpv.vms[st.ID] = vm
+	hpv.mu.Unlock()
+
+	return vm, nil
+}
+
+func (hpv *Hypervisor) OnCreate() <-chan *VirtualMachine {
+	return hpv.notify
+}
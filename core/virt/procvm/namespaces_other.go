@@ -0,0 +1,16 @@
+//go:build !linux
+
+package procvm
+
+import (
+	"syscall"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+func sysProcAttr(namespaces bool) (*syscall.SysProcAttr, error) {
+	if namespaces {
+		return nil, errors.Errorf("namespaces are only supported on linux")
+	}
+	return &syscall.SysProcAttr{Setpgid: true}, nil
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package procvm
+
+import (
+	"gitlab.com/tozd/go/errors"
+	"golang.org/x/sys/unix"
+)
+
+// waitProcess blocks until pid exits. The pidfd reports the exit even when pid is
+// not a child of this process and nothing reaps it.
+func waitProcess(pid int) error {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		if errors.Is(err, unix.ESRCH) {
+			return nil
+		}
+		return errors.Errorf("opening pidfd: %w", err)
+	}
+	defer unix.Close(fd)
+
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return errors.Errorf("polling pidfd: %w", err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package procvm
+
+import (
+	"syscall"
+	"time"
+)
+
+// waitProcess blocks until pid exits, polling as pid is not a child of this process.
+func waitProcess(pid int) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,435 @@
+package procvm_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	goruntime "runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/containers"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/containerd/v2/pkg/oci"
+	gorunc "github.com/containerd/go-runc"
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/walteh/runm/core/runc/process"
+	"github.com/walteh/runm/core/runc/runtime"
+	"github.com/walteh/runm/core/runc/runtime/virt"
+	"github.com/walteh/runm/core/runc/runtime/virt/vmoptions"
+	"github.com/walteh/runm/core/runc/server"
+	"github.com/walteh/runm/core/virt/procvm"
+	"github.com/walteh/runm/core/virt/procvm/guest"
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/linux/constants"
+	"github.com/walteh/runm/pkg/cmdline"
+	"github.com/walteh/runm/pkg/units"
+
+	mockruntime "github.com/walteh/runm/gen/mocks/core/runc/runtime"
+)
+
+// agentEnv makes the test binary run as the guest agent.
+const agentEnv = "RUNM_PROCVM_TEST_AGENT"
+
+// shimEnv makes the test binary run as a shim that creates a container and exits,
+// leaving its vm behind. It holds the shimConfig as json.
+const shimEnv = "RUNM_PROCVM_TEST_SHIM"
+
+type shimConfig struct {
+	Root        string `json:"root"`
+	BuildDir    string `json:"build_dir"`
+	Rootfs      string `json:"rootfs"`
+	ContainerID string `json:"container_id"`
+	// StateDirFile is where the shim writes the state directory of the runtime.
+	StateDirFile string `json:"state_dir_file"`
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(agentEnv) != "" {
+		if err := runAgent(); err != nil {
+			fmt.Fprintln(os.Stderr, "agent:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if cfg := os.Getenv(shimEnv); cfg != "" {
+		if err := runShim(cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "shim:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runAgent serves the guest api like runm-linux-init, backed by mocks.
+func runAgent() error {
+	params, err := cmdline.FromInitArgs(os.Args[1:]).RunmParams()
+	if err != nil {
+		return err
+	}
+
+	if dir, err := guest.ShareDir("test"); err == nil {
+		if err := os.WriteFile(filepath.Join(dir, "agent"), []byte(os.Getenv(guest.EnvID)), 0644); err != nil {
+			return err
+		}
+	}
+
+	srv := server.NewServer(
+		&mockruntime.MockRuntime{
+			PsFunc: func(ctx context.Context, id string) ([]int, error) {
+				return []int{42}, nil
+			},
+		},
+		&mockruntime.MockRuntimeExtras{},
+		&mockruntime.MockSocketAllocator{},
+		nil,
+		nil,
+		server.WithHostClock(),
+	)
+
+	grpcServer := grpc.NewServer()
+	srv.RegisterGrpcServer(grpcServer)
+
+	l, err := guest.Listen(params.VsockPort)
+	if err != nil {
+		return err
+	}
+	return grpcServer.Serve(l)
+}
+
+// runShim creates a container like the shim does and writes down the state
+// directory of its runtime, then exits without stopping the vm.
+func runShim(data string) error {
+	var cfg shimConfig
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		return err
+	}
+
+	opts, err := vmoptions.Decode(&vmoptions.Options{
+		BuildDir:    cfg.BuildDir,
+		NetworkMode: vmoptions.NetworkModeNone,
+	})
+	if err != nil {
+		return err
+	}
+
+	creator, err := virt.NewRunmVMRuntimeCreator(procvm.NewHypervisor(hypervisorConfig(cfg.Root)), opts)
+	if err != nil {
+		return err
+	}
+
+	rt, err := creator.Create(context.Background(), &runtime.RuntimeOptions{
+		ProcessCreateConfig: &process.CreateConfig{ID: cfg.ContainerID},
+		Mounts:              []process.Mount{{Type: "bind", Source: cfg.Rootfs, Options: []string{"rbind"}}},
+		OciSpec:             &oci.Spec{Root: &specs.Root{Path: cfg.Rootfs}, Process: &specs.Process{Args: []string{"true"}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	rrt, ok := rt.(runtime.ReattachableRuntime)
+	if !ok {
+		return fmt.Errorf("runtime %T is not reattachable", rt)
+	}
+	return os.WriteFile(cfg.StateDirFile, []byte(rrt.StateDir()), 0644)
+}
+
+func hypervisorConfig(root string) procvm.Config {
+	return procvm.Config{
+		Root:  root,
+		Agent: []string{os.Args[0]},
+		Env:   []string{agentEnv + "=1"},
+	}
+}
+
+func newRoot(t *testing.T) string {
+	// unix socket paths are too long for t.TempDir on some systems
+	root, err := os.MkdirTemp("", "procvm")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(root) })
+	return root
+}
+
+func newHypervisor(t *testing.T) vmm.Hypervisor[*procvm.VirtualMachine] {
+	return procvm.NewHypervisor(hypervisorConfig(newRoot(t)))
+}
+
+func guestPlatform() units.Platform {
+	return units.Platform("linux/" + goruntime.GOARCH)
+}
+
+func TestVirtualMachineLifecycle(t *testing.T) {
+	ctx := t.Context()
+	hpv := newHypervisor(t)
+
+	share := t.TempDir()
+	shareDev, err := virtio.VirtioFsNew(share, "test")
+	require.NoError(t, err)
+
+	bl, err := vmm.NewLinuxBootloader(guestPlatform(), "kernel", "initramfs", cmdline.DefaultRunmParams())
+	require.NoError(t, err)
+
+	vm, err := hpv.NewVirtualMachine(ctx, "vm-lifecycle", &vmm.NewVMOptions{
+		Vcpus:   1,
+		Memory:  strongunits.MiB(256).ToBytes(),
+		Devices: []virtio.VirtioDevice{shareDev, &virtio.VirtioSerialLogFile{Path: filepath.Join(t.TempDir(), "console.log")}},
+	}, bl)
+	require.NoError(t, err)
+	assert.Equal(t, vm, <-hpv.OnCreate())
+
+	require.NoError(t, vm.Start(ctx))
+	defer vm.HardStop(context.Background())
+	assert.Equal(t, vmm.VirtualMachineStateTypeRunning, vm.CurrentState())
+
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		conn, err := vm.VSockConnect(ctx, constants.RunmVsockPort)
+		if assert.NoError(c, err) {
+			conn.Close()
+		}
+	}, 10*time.Second, 50*time.Millisecond)
+
+	marker, err := os.ReadFile(filepath.Join(share, "agent"))
+	require.NoError(t, err)
+	assert.Equal(t, "vm-lifecycle", string(marker))
+
+	require.NoError(t, vm.Pause(ctx))
+	assert.Equal(t, vmm.VirtualMachineStateTypePaused, vm.CurrentState())
+	require.NoError(t, vm.Resume(ctx))
+	assert.Equal(t, vmm.VirtualMachineStateTypeRunning, vm.CurrentState())
+
+	require.ErrorIs(t, vm.SaveFullSnapshot(ctx, t.TempDir()), vmm.ErrFullSnapshotNotSupported)
+
+	require.NoError(t, vm.HardStop(ctx))
+	assert.Equal(t, vmm.VirtualMachineStateTypeStopped, vm.CurrentState())
+	assert.True(t, vm.CanStart(ctx))
+}
+
+// newContainer returns the build directory and an oci spec with a rootfs, the
+// guest images are never booted so they can be empty.
+func newContainer(t *testing.T) (string, *oci.Spec, []process.Mount) {
+	// the vm working directory is in the user cache directory
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	buildDir := t.TempDir()
+	for _, name := range []string{"kernel", "initramfs.cpio.gz", constants.MbinFileName} {
+		require.NoError(t, os.WriteFile(filepath.Join(buildDir, name), nil, 0644))
+	}
+
+	rootfs := t.TempDir()
+	spec := &oci.Spec{
+		Root:    &specs.Root{Path: rootfs},
+		Process: &specs.Process{Args: []string{"true"}},
+	}
+
+	return buildDir, spec, []process.Mount{{Type: "bind", Source: rootfs, Options: []string{"rbind"}}}
+}
+
+func TestOCIVirtualMachine(t *testing.T) {
+	ctx := t.Context()
+	hpv := newHypervisor(t)
+	buildDir, spec, mounts := newContainer(t)
+
+	rvm, err := vmm.NewOCIVirtualMachine(ctx, hpv, vmm.OCIVMConfig{
+		ID:             "procvm-oci-container",
+		RootfsMounts:   mounts,
+		Spec:           spec,
+		StartingMemory: strongunits.MiB(256).ToBytes(),
+		VCPUs:          1,
+		Platform:       guestPlatform(),
+		BuildDir:       buildDir,
+		DisableNetwork: true,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, rvm.Start(ctx))
+	defer rvm.VM().HardStop(context.Background())
+
+	stdout, _, code, err := rvm.RunCommandSimple(ctx, "echo hello")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), code)
+	assert.Equal(t, "hello\n", string(stdout))
+
+	shares, err := os.ReadFile(guest.SharesPath(rvm.VM().Root()))
+	require.NoError(t, err)
+	assert.Contains(t, string(shares), constants.RootfsVirtioTag)
+	assert.Contains(t, string(shares), constants.Ec1VirtioTag)
+}
+
+func TestRunmVMRuntime(t *testing.T) {
+	ctx := t.Context()
+	hpv := newHypervisor(t)
+	buildDir, spec, mounts := newContainer(t)
+
+	opts, err := vmoptions.Decode(&vmoptions.Options{
+		BuildDir:    buildDir,
+		NetworkMode: vmoptions.NetworkModeNone,
+	})
+	require.NoError(t, err)
+
+	creator, err := virt.NewRunmVMRuntimeCreator(hpv, opts)
+	require.NoError(t, err)
+
+	rt, err := creator.Create(ctx, &runtime.RuntimeOptions{
+		ProcessCreateConfig: &process.CreateConfig{ID: "procvm-runtime-container"},
+		Mounts:              mounts,
+		OciSpec:             spec,
+	})
+	require.NoError(t, err)
+
+	vmrt, ok := rt.(*virt.RunmVMRuntime[*procvm.VirtualMachine])
+	require.True(t, ok)
+	defer vmrt.Close(context.Background())
+	assert.True(t, vmrt.Alive())
+
+	pids, err := rt.Ps(ctx, "procvm-runtime-container")
+	require.NoError(t, err)
+	assert.Equal(t, []int{42}, pids)
+}
+
+func TestReattachRunmVMRuntime(t *testing.T) {
+	ctx := t.Context()
+	root := newRoot(t)
+	buildDir, spec, _ := newContainer(t)
+
+	stateDirFile := filepath.Join(t.TempDir(), "state-dir")
+	cfg, err := json.Marshal(&shimConfig{
+		Root:         root,
+		BuildDir:     buildDir,
+		Rootfs:       spec.Root.Path,
+		ContainerID:  "procvm-reattach-container",
+		StateDirFile: stateDirFile,
+	})
+	require.NoError(t, err)
+
+	// the previous shim, its vm outlives it
+	shim := exec.CommandContext(ctx, os.Args[0])
+	shim.Env = append(os.Environ(), shimEnv+"="+string(cfg))
+	shim.Stdout = os.Stdout
+	shim.Stderr = os.Stderr
+	require.NoError(t, shim.Run())
+
+	stateDir, err := os.ReadFile(stateDirFile)
+	require.NoError(t, err)
+
+	opts, err := vmoptions.Decode(&vmoptions.Options{
+		BuildDir:    buildDir,
+		NetworkMode: vmoptions.NetworkModeNone,
+	})
+	require.NoError(t, err)
+
+	creator, err := virt.NewRunmVMRuntimeCreator(procvm.NewHypervisor(hypervisorConfig(root)), opts)
+	require.NoError(t, err)
+
+	rt, err := creator.Reattach(ctx, &runtime.ReattachOptions{
+		ContainerID: "procvm-reattach-container",
+		OciSpec:     spec,
+		StateDir:    string(stateDir),
+	})
+	require.NoError(t, err)
+
+	vmrt, ok := rt.(*virt.RunmVMRuntime[*procvm.VirtualMachine])
+	require.True(t, ok)
+	assert.True(t, vmrt.Alive())
+
+	pids, err := rt.Ps(ctx, "procvm-reattach-container")
+	require.NoError(t, err)
+	assert.Equal(t, []int{42}, pids)
+
+	// the agent is no child of this process, stopping it must still be noticed
+	require.NoError(t, vmrt.Close(ctx))
+	assert.False(t, vmrt.Alive())
+}
+
+// buildLinuxInit builds runm-linux-init, the real guest agent. It is linked
+// statically, so it also runs as the process of a container with an empty rootfs.
+func buildLinuxInit(t *testing.T) string {
+	t.Helper()
+
+	bin := filepath.Join(t.TempDir(), "runm-linux-init")
+	cmd := exec.CommandContext(t.Context(), "go", "build", "-o", bin, "github.com/walteh/runm/cmd/runm-linux-init")
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, "building runm-linux-init: %s", out)
+	return bin
+}
+
+func TestLinuxInitCreatesContainer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	if goruntime.GOOS != "linux" {
+		t.Skip("runc only runs on linux")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("runc needs root")
+	}
+	if _, err := exec.LookPath("runc"); err != nil {
+		t.Skip("runc not available")
+	}
+
+	ctx := t.Context()
+	initBin := buildLinuxInit(t)
+	buildDir, _, mounts := newContainer(t)
+	rootfs := mounts[0].Source
+
+	data, err := os.ReadFile(initBin)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "init"), data, 0755))
+
+	const id = "procvm-init-container"
+	spec, err := oci.GenerateSpec(namespaces.WithNamespace(ctx, "default"), nil, &containers.Container{ID: id},
+		oci.WithRootFSPath(rootfs),
+		oci.WithProcessArgs("/init"),
+	)
+	require.NoError(t, err)
+
+	bundle := t.TempDir()
+	specData, err := json.Marshal(spec)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(bundle, "config.json"), specData, 0644))
+
+	opts, err := vmoptions.Decode(&vmoptions.Options{
+		BuildDir:    buildDir,
+		NetworkMode: vmoptions.NetworkModeNone,
+	})
+	require.NoError(t, err)
+
+	// the real agent, it finds its working directory by the mount tag of the share
+	hpv := procvm.NewHypervisor(procvm.Config{Root: newRoot(t), Agent: []string{initBin}})
+	creator, err := virt.NewRunmVMRuntimeCreator(hpv, opts)
+	require.NoError(t, err)
+
+	rt, err := creator.Create(ctx, &runtime.RuntimeOptions{
+		ProcessCreateConfig: &process.CreateConfig{ID: id},
+		Mounts:              mounts,
+		OciSpec:             spec,
+	})
+	require.NoError(t, err)
+
+	vmrt, ok := rt.(*virt.RunmVMRuntime[*procvm.VirtualMachine])
+	require.True(t, ok)
+	defer vmrt.Close(context.Background())
+
+	pidFile := filepath.Join(bundle, "init.pid")
+	require.NoError(t, rt.Create(ctx, id, bundle, &gorunc.CreateOpts{PidFile: pidFile}))
+	defer rt.Delete(context.Background(), id, &gorunc.DeleteOpts{Force: true})
+
+	pid, err := rt.ReadPidFile(ctx, pidFile)
+	require.NoError(t, err)
+	assert.Positive(t, pid)
+
+	// the process vm shares the pid namespace of the host, runc init waits for start
+	assert.NoError(t, syscall.Kill(pid, 0))
+}
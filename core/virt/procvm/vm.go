@@ -0,0 +1,431 @@
+package procvm
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/containers/common/pkg/strongunits"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/procvm/guest"
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/pkg/atomicfile"
+)
+
+var (
+	_ vmm.VirtualMachine     = &VirtualMachine{}
+	_ vmm.StateHistoryVM     = &VirtualMachine{}
+	_ vmm.ConsoleLogAppender = &VirtualMachine{}
+)
+
+type VirtualMachine struct {
+	id         string
+	root       string
+	opts       *vmm.NewVMOptions
+	args       []string
+	env        []string
+	namespaces bool
+	shares     map[string]string
+	logFile    *virtio.VirtioSerialLogFile
+
+	states *vmm.StateMachine
+
+	mu sync.Mutex
+	// pid is the guest agent, it leads its own process group. It is 0 when the
+	// agent is not running.
+	pid      int
+	exited   chan struct{}
+	stopping bool
+	balloon  strongunits.B
+}
+
+// Root is the directory the vsock sockets and shares of the vm are kept in.
+func (vm *VirtualMachine) Root() string {
+	return vm.root
+}
+
+func (vm *VirtualMachine) Start(ctx context.Context) error {
+	if err := vm.states.Check(vmm.OperationStart); err != nil {
+		return err
+	}
+
+	vm.setState(vmm.VirtualMachineStateTypeStarting, nil)
+
+	cmd, err := vm.prepare()
+	if err != nil {
+		vm.setState(vmm.VirtualMachineStateTypeError, map[string]string{"error": err.Error()})
+		return err
+	}
+
+	slog.DebugContext(ctx, "starting process vm", "id", vm.id, "args", vm.args)
+
+	if err := cmd.Start(); err != nil {
+		vm.closeLog(cmd)
+		vm.setState(vmm.VirtualMachineStateTypeError, map[string]string{"error": err.Error()})
+		return errors.Errorf("starting guest agent: %w", err)
+	}
+
+	exited := make(chan struct{})
+	vm.mu.Lock()
+	vm.pid = cmd.Process.Pid
+	vm.exited = exited
+	vm.stopping = false
+	vm.mu.Unlock()
+
+	if err := vm.writeAgentState(cmd.Process.Pid); err != nil {
+		slog.WarnContext(ctx, "the vm cannot be reattached from another process", "id", vm.id, "error", err)
+	}
+
+	// running before waiting, so an agent that exits right away ends up stopped
+	vm.setState(vmm.VirtualMachineStateTypeRunning, map[string]string{"pid": strconv.Itoa(cmd.Process.Pid)})
+
+	go vm.wait(ctx, cmd, exited)
+
+	return nil
+}
+
+// prepare lays out the vm root and returns the agent command, its output goes to
+// the console log like a real guest console.
+func (vm *VirtualMachine) prepare() (*exec.Cmd, error) {
+	if err := os.MkdirAll(guest.VsockDir(vm.root), 0700); err != nil {
+		return nil, errors.Errorf("creating vm root: %w", err)
+	}
+
+	shares, err := json.Marshal(vm.shares)
+	if err != nil {
+		return nil, errors.Errorf("marshalling shares: %w", err)
+	}
+	if err := os.WriteFile(guest.SharesPath(vm.root), shares, 0600); err != nil {
+		return nil, errors.Errorf("writing shares: %w", err)
+	}
+
+	attr, err := sysProcAttr(vm.namespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	// the vm outlives the boot context, so it is not tied to any context
+	cmd := exec.Command(vm.args[0], vm.args[1:]...)
+	cmd.Dir = vm.root
+	cmd.Env = append(os.Environ(), vm.env...)
+	cmd.Env = append(cmd.Env, guest.EnvRoot+"="+vm.root, guest.EnvID+"="+vm.id)
+	cmd.SysProcAttr = attr
+
+	if vm.logFile != nil {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if vm.logFile.Append {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		f, err := os.OpenFile(vm.logFile.Path, flags, 0644)
+		if err != nil {
+			return nil, errors.Errorf("opening console log: %w", err)
+		}
+		cmd.Stdout = f
+		cmd.Stderr = f
+	}
+
+	return cmd, nil
+}
+
+func (vm *VirtualMachine) wait(ctx context.Context, cmd *exec.Cmd, exited chan struct{}) {
+	err := cmd.Wait()
+	vm.closeLog(cmd)
+
+	vm.mu.Lock()
+	stopping := vm.stopping
+	vm.pid = 0
+	vm.mu.Unlock()
+
+	// HardStop returns once the state has changed
+	defer close(exited)
+
+	metadata := map[string]string{"exit_code": strconv.Itoa(cmd.ProcessState.ExitCode())}
+	if err != nil && !stopping {
+		slog.ErrorContext(ctx, "guest agent exited unexpectedly", "id", vm.id, "error", err)
+		metadata["error"] = err.Error()
+		vm.setState(vmm.VirtualMachineStateTypeError, metadata)
+		return
+	}
+
+	slog.InfoContext(ctx, "guest agent exited", "id", vm.id, "exit_code", cmd.ProcessState.ExitCode())
+	vm.setState(vmm.VirtualMachineStateTypeStopped, metadata)
+}
+
+// agentState is what a process other than the one that started the vm needs to
+// reattach to it, see Hypervisor.ReattachVirtualMachine.
+type agentState struct {
+	Pid        int                         `json:"pid"`
+	Args       []string                    `json:"args"`
+	VCPUs      uint64                      `json:"vcpus"`
+	Memory     strongunits.B               `json:"memory"`
+	Shares     map[string]string           `json:"shares"`
+	ConsoleLog *virtio.VirtioSerialLogFile `json:"console_log,omitempty"`
+}
+
+func agentStatePath(root string) string {
+	return filepath.Join(root, "agent.json")
+}
+
+func (vm *VirtualMachine) writeAgentState(pid int) error {
+	data, err := json.Marshal(&agentState{
+		Pid:        pid,
+		Args:       vm.args,
+		VCPUs:      vm.opts.Vcpus,
+		Memory:     vm.opts.Memory,
+		Shares:     vm.shares,
+		ConsoleLog: vm.logFile,
+	})
+	if err != nil {
+		return errors.Errorf("marshalling agent state: %w", err)
+	}
+	if err := atomicfile.WriteFile(agentStatePath(vm.root), data); err != nil {
+		return errors.Errorf("writing agent state: %w", err)
+	}
+	return nil
+}
+
+func readAgentState(root string) (*agentState, error) {
+	data, err := os.ReadFile(agentStatePath(root))
+	if err != nil {
+		return nil, errors.Errorf("reading agent state: %w", err)
+	}
+	st := &agentState{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, errors.Errorf("unmarshalling agent state: %w", err)
+	}
+	return st, nil
+}
+
+// watch waits for an agent started by another process, which cannot wait for it
+// the way wait does. Its exit code is lost with that process.
+func (vm *VirtualMachine) watch(ctx context.Context, pid int, exited chan struct{}) {
+	err := waitProcess(pid)
+
+	vm.mu.Lock()
+	stopping := vm.stopping
+	vm.pid = 0
+	vm.mu.Unlock()
+
+	defer close(exited)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "lost track of guest agent", "id", vm.id, "pid", pid, "error", err)
+		vm.setState(vmm.VirtualMachineStateTypeError, map[string]string{"error": err.Error()})
+		return
+	}
+	if !stopping {
+		slog.ErrorContext(ctx, "guest agent exited unexpectedly", "id", vm.id, "pid", pid)
+		vm.setState(vmm.VirtualMachineStateTypeError, map[string]string{"error": "guest agent exited"})
+		return
+	}
+
+	slog.InfoContext(ctx, "guest agent exited", "id", vm.id, "pid", pid)
+	vm.setState(vmm.VirtualMachineStateTypeStopped, nil)
+}
+
+func (vm *VirtualMachine) closeLog(cmd *exec.Cmd) {
+	if f, ok := cmd.Stdout.(*os.File); ok {
+		_ = f.Close()
+	}
+}
+
+// signal sends sig to every process of the guest.
+func (vm *VirtualMachine) signal(sig syscall.Signal) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.pid == 0 {
+		return errors.Errorf("vm %s is not running", vm.id)
+	}
+	if sig == syscall.SIGKILL || sig == syscall.SIGTERM {
+		vm.stopping = true
+	}
+	// the agent leads its own process group
+	if err := syscall.Kill(-vm.pid, sig); err != nil {
+		return errors.Errorf("signalling guest agent: %w", err)
+	}
+	return nil
+}
+
+func (vm *VirtualMachine) HardStop(ctx context.Context) error {
+	vm.mu.Lock()
+	exited := vm.exited
+	vm.mu.Unlock()
+
+	if err := vm.signal(syscall.SIGKILL); err != nil {
+		return err
+	}
+
+	select {
+	case <-exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (vm *VirtualMachine) RequestStop(ctx context.Context) (bool, error) {
+	if err := vm.states.Check(vmm.OperationRequestStop); err != nil {
+		return false, err
+	}
+	if err := vm.signal(syscall.SIGTERM); err != nil {
+		return false, err
+	}
+	vm.setState(vmm.VirtualMachineStateTypeStopping, nil)
+	return true, nil
+}
+
+func (vm *VirtualMachine) Pause(ctx context.Context) error {
+	if err := vm.states.Check(vmm.OperationPause); err != nil {
+		return err
+	}
+	if err := vm.signal(syscall.SIGSTOP); err != nil {
+		return err
+	}
+	vm.setState(vmm.VirtualMachineStateTypePaused, nil)
+	return nil
+}
+
+func (vm *VirtualMachine) Resume(ctx context.Context) error {
+	if err := vm.states.Check(vmm.OperationResume); err != nil {
+		return err
+	}
+	if err := vm.signal(syscall.SIGCONT); err != nil {
+		return err
+	}
+	vm.setState(vmm.VirtualMachineStateTypeRunning, nil)
+	return nil
+}
+
+func (vm *VirtualMachine) CanStart(_ context.Context) bool {
+	return vm.states.Can(vmm.OperationStart)
+}
+
+func (vm *VirtualMachine) CanHardStop(_ context.Context) bool {
+	vm.mu.Lock()
+	running := vm.pid != 0
+	vm.mu.Unlock()
+	return running && vm.states.Can(vmm.OperationHardStop)
+}
+
+func (vm *VirtualMachine) CanRequestStop(_ context.Context) bool {
+	return vm.states.Can(vmm.OperationRequestStop)
+}
+
+func (vm *VirtualMachine) CanPause(_ context.Context) bool {
+	return vm.states.Can(vmm.OperationPause)
+}
+
+func (vm *VirtualMachine) CanResume(_ context.Context) bool {
+	return vm.states.Can(vmm.OperationResume)
+}
+
+func (vm *VirtualMachine) CurrentState() vmm.VirtualMachineStateType {
+	return vm.states.Current()
+}
+
+// setState moves the vm to state, a change the state machine rejects is logged
+// and dropped.
+func (vm *VirtualMachine) setState(state vmm.VirtualMachineStateType, metadata map[string]string) {
+	if err := vm.states.Transition(state, metadata); err != nil {
+		slog.Warn("ignoring vm state change", "id", vm.id, "error", err)
+	}
+}
+
+// StateChangeNotify implements vmm.VirtualMachine.
+func (vm *VirtualMachine) StateChangeNotify(ctx context.Context) <-chan vmm.VirtualMachineStateChange {
+	return vm.states.Subscribe(ctx)
+}
+
+// StateHistory implements vmm.StateHistoryVM.
+func (vm *VirtualMachine) StateHistory() []vmm.StateTransition {
+	return vm.states.History()
+}
+
+// VSockConnect implements vmm.VirtualMachine.
+func (vm *VirtualMachine) VSockConnect(ctx context.Context, port uint32) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", guest.ListenSocketPath(vm.root, port))
+	if err != nil {
+		return nil, errors.Errorf("connecting to guest vsock port %d: %w", port, err)
+	}
+	return conn, nil
+}
+
+// VSockListen implements vmm.VirtualMachine.
+func (vm *VirtualMachine) VSockListen(ctx context.Context, port uint32) (net.Listener, error) {
+	path := guest.DialSocketPath(vm.root, port)
+	if err := os.MkdirAll(guest.VsockDir(vm.root), 0700); err != nil {
+		return nil, errors.Errorf("creating vsock directory: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Errorf("removing stale socket: %w", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Errorf("listening on vsock port %d: %w", port, err)
+	}
+	return l, nil
+}
+
+func (vm *VirtualMachine) ID() string {
+	return vm.id
+}
+
+// AppendsConsoleLog implements vmm.ConsoleLogAppender, the guest writes its
+// console to stdout.
+func (vm *VirtualMachine) AppendsConsoleLog() bool {
+	return true
+}
+
+func (vm *VirtualMachine) Devices() []virtio.VirtioDevice {
+	return vm.opts.Devices
+}
+
+func (vm *VirtualMachine) Opts() *vmm.NewVMOptions {
+	return vm.opts
+}
+
+func (vm *VirtualMachine) ServeBackgroundTasks(ctx context.Context) error {
+	return nil
+}
+
+func (vm *VirtualMachine) StartGraphicApplication(width float64, height float64) error {
+	return errors.Errorf("process vms have no display")
+}
+
+func (vm *VirtualMachine) SaveFullSnapshot(ctx context.Context, path string) error {
+	return vmm.ErrFullSnapshotNotSupported
+}
+
+func (vm *VirtualMachine) RestoreFromFullSnapshot(ctx context.Context, path string) error {
+	return vmm.ErrFullSnapshotNotSupported
+}
+
+// SetMemoryBalloonTargetSize only records the target, the guest shares host memory.
+func (vm *VirtualMachine) SetMemoryBalloonTargetSize(ctx context.Context, targetBytes strongunits.B) error {
+	if targetBytes > vm.opts.Memory {
+		return errors.Errorf("target memory size %d exceeds vm memory %d", uint64(targetBytes), uint64(vm.opts.Memory))
+	}
+	vm.mu.Lock()
+	vm.balloon = targetBytes
+	vm.mu.Unlock()
+	return nil
+}
+
+func (vm *VirtualMachine) GetMemoryBalloonTargetSize(ctx context.Context) (strongunits.B, error) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.balloon == 0 {
+		return vm.opts.Memory, nil
+	}
+	return vm.balloon, nil
+}
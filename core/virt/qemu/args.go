@@ -0,0 +1,193 @@
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/virtiofsd"
+	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/pkg/units"
+)
+
+// vsockDevice is the vhost-vsock device of a guest, followed by its cid.
+const vsockDevice = "vhost-vsock-pci,guest-cid="
+
+// commandLine is a qemu invocation along with what it needs from the host.
+type commandLine struct {
+	args []string
+	// extraFiles are passed to qemu from fd 3 on
+	extraFiles []*os.File
+	shares     []virtiofsd.Share
+	qmpSocket  string
+	// cid is the vsock context id of the guest, 0 without a vsock device
+	cid     uint32
+	balloon bool
+}
+
+// buildCommandLine translates the devices of a vm into qemu arguments, the
+// sockets of the vm are placed in dir. The vm is left paused (-S) until it is
+// continued over qmp.
+func buildCommandLine(id, dir string, platform units.Platform, accel Accel, opts *vmm.NewVMOptions, bl virtio.Bootloader) (*commandLine, error) {
+	if opts.Vcpus == 0 {
+		return nil, errors.Errorf("VCPU count cannot be 0")
+	}
+	memory := uint64(opts.Memory.ToBytes()) >> 20
+	if memory == 0 {
+		return nil, errors.Errorf("Memory cannot be 0")
+	}
+
+	linux, ok := bl.(*virtio.LinuxBootloader)
+	if !ok {
+		return nil, errors.Errorf("unsupported bootloader %T, qemu boots linux kernels directly", bl)
+	}
+
+	if platform.OS() != "linux" {
+		return nil, errors.Errorf("unsupported guest platform %s for qemu", platform)
+	}
+
+	var machine string
+	switch platform.Arch() {
+	case "amd64":
+		machine = "q35"
+	case "arm64":
+		machine = "virt"
+	default:
+		return nil, errors.Errorf("unsupported guest platform %s for qemu", platform)
+	}
+
+	cpu := "max"
+	if accel == AccelKVM {
+		cpu = "host"
+	}
+
+	cl := &commandLine{qmpSocket: filepath.Join(dir, "qmp.sock")}
+
+	var devices []string
+	var shared bool
+
+	for i, dev := range opts.Devices {
+		switch dev := dev.(type) {
+		case *virtio.VirtioFs:
+			s := virtiofsd.Share{
+				Tag:    dev.MountTag,
+				Dir:    dev.SharedDir,
+				Socket: filepath.Join(dir, "virtiofs-"+dev.MountTag+".sock"),
+			}
+			cl.shares = append(cl.shares, s)
+			shared = true
+			devices = append(devices,
+				"-chardev", fmt.Sprintf("socket,id=fs%d,path=%s", i, escape(s.Socket)),
+				"-device", fmt.Sprintf("vhost-user-fs-pci,chardev=fs%d,tag=%s", i, escape(s.Tag)),
+			)
+		case *virtio.VirtioBlk:
+			if dev.ImagePath == "" {
+				return nil, errors.Errorf("disk %q has no image path", dev.DevName)
+			}
+			drive := fmt.Sprintf("file=%s,if=none,id=disk%d,format=raw", escape(dev.ImagePath), i)
+			if dev.ReadOnly {
+				drive += ",readonly=on"
+			}
+			blk := fmt.Sprintf("virtio-blk-pci,drive=disk%d", i)
+			if dev.DeviceIdentifier != "" {
+				blk += ",serial=" + escape(dev.DeviceIdentifier)
+			}
+			devices = append(devices, "-drive", drive, "-device", blk)
+		case *virtio.VirtioNet:
+			var netdev string
+			switch {
+			case dev.Socket != nil:
+				// qemu numbers the inherited files from 3
+				netdev = fmt.Sprintf("dgram,id=net%d,local.type=fd,local.str=%d", i, 3+len(cl.extraFiles))
+				cl.extraFiles = append(cl.extraFiles, dev.Socket)
+			case dev.Nat:
+				netdev = fmt.Sprintf("user,id=net%d", i)
+			default:
+				return nil, errors.Errorf("network device needs nat or a datagram socket")
+			}
+			nic := fmt.Sprintf("virtio-net-pci,netdev=net%d", i)
+			if dev.MacAddress != nil {
+				nic += ",mac=" + dev.MacAddress.String()
+			}
+			devices = append(devices, "-netdev", netdev, "-device", nic)
+		case *virtio.VirtioVsock:
+			if cl.cid != 0 {
+				return nil, errors.Errorf("only one vsock device is supported")
+			}
+			cl.cid = guestCID(id)
+			devices = append(devices, "-device", vsockDevice+strconv.FormatUint(uint64(cl.cid), 10))
+		case *virtio.VirtioBalloon:
+			cl.balloon = true
+			devices = append(devices, "-device", "virtio-balloon-pci,id=balloon0,deflate-on-oom=on")
+		case *virtio.VirtioRng:
+			devices = append(devices, "-device", "virtio-rng-pci")
+		case *virtio.VirtioSerialLogFile:
+			console := "file,id=console,path=" + escape(dev.Path)
+			if dev.Append {
+				console += ",append=on"
+			}
+			// the guest console is hvc0
+			devices = append(devices,
+				"-chardev", console,
+				"-device", "virtio-serial-pci",
+				"-device", "virtconsole,chardev=console",
+			)
+		default:
+			return nil, errors.Errorf("unsupported device %T for qemu", dev)
+		}
+	}
+
+	cl.args = []string{
+		"-name", escape(id),
+		"-nodefaults",
+		"-nographic",
+		"-S",
+		"-accel", string(accel),
+		"-cpu", cpu,
+		"-smp", strconv.FormatUint(opts.Vcpus, 10),
+		"-m", strconv.FormatUint(memory, 10) + "M",
+	}
+
+	// vhost-user devices map the guest memory, so it has to be shared
+	if shared {
+		cl.args = append(cl.args,
+			"-object", fmt.Sprintf("memory-backend-memfd,id=mem,size=%dM,share=on", memory),
+			"-machine", machine+",memory-backend=mem",
+		)
+	} else {
+		cl.args = append(cl.args, "-machine", machine)
+	}
+
+	cl.args = append(cl.args, "-kernel", linux.VmlinuzPath)
+	if linux.InitrdPath != "" {
+		cl.args = append(cl.args, "-initrd", linux.InitrdPath)
+	}
+	if linux.KernelCmdLine != "" {
+		cl.args = append(cl.args, "-append", linux.KernelCmdLine)
+	}
+
+	cl.args = append(cl.args, "-qmp", fmt.Sprintf("unix:%s,server=on,wait=off", escape(cl.qmpSocket)))
+	cl.args = append(cl.args, devices...)
+
+	return cl, nil
+}
+
+// setCID moves the vsock device of the guest to cid.
+func (cl *commandLine) setCID(cid uint32) {
+	for i, arg := range cl.args {
+		if strings.HasPrefix(arg, vsockDevice) {
+			cl.args[i] = vsockDevice + strconv.FormatUint(uint64(cid), 10)
+		}
+	}
+	cl.cid = cid
+}
+
+// escape doubles the commas in a value of a qemu option list.
+func escape(s string) string {
+	return strings.ReplaceAll(s, ",", ",,")
+}
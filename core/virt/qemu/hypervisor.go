@@ -0,0 +1,233 @@
+// Package qemu runs vms with QEMU. Every vm gets its own qemu process, controlled
+// through its QMP socket, and a virtiofsd per directory share. Without KVM the
+// guest is emulated with TCG, which is slow but runs on any CI machine.
+package qemu
+
+import (
+	"context"
+	"hash/crc32"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/virtiofsd"
+	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/pkg/units"
+)
+
+const defaultQMPTimeout = 5 * time.Second
+
+type Accel string
+
+const (
+	// AccelAuto uses kvm when the host can run the guest natively, and tcg otherwise.
+	AccelAuto Accel = ""
+	AccelKVM  Accel = "kvm"
+	AccelTCG  Accel = "tcg"
+)
+
+type Config struct {
+	// Binary is the qemu system emulator, qemu-system-<guest arch> in PATH by default.
+	Binary string
+	// Virtiofsd serves the directory shares, looked up in PATH by default.
+	Virtiofsd string
+	// Root holds a directory per vm with its qmp and virtiofs sockets, it defaults
+	// to a directory in os.TempDir. Unix socket paths are short, so keep it short too.
+	Root string
+	// Accel is the qemu accelerator, picked per vm by default.
+	Accel Accel
+	// QMPTimeout bounds the wait for a new qemu process to serve qmp, and for
+	// virtiofsd to create its socket.
+	QMPTimeout time.Duration
+}
+
+func NewHypervisor(cfg Config) vmm.Hypervisor[*VirtualMachine] {
+	if cfg.Virtiofsd == "" {
+		cfg.Virtiofsd = "virtiofsd"
+	}
+	if cfg.Root == "" {
+		cfg.Root = filepath.Join(os.TempDir(), "runm-qemu")
+	}
+	if cfg.QMPTimeout == 0 {
+		cfg.QMPTimeout = defaultQMPTimeout
+	}
+	return &Hypervisor{
+		cfg:    cfg,
+		vms:    make(map[string]*VirtualMachine),
+		notify: make(chan *VirtualMachine),
+	}
+}
+
+var (
+	_ vmm.Hypervisor[*VirtualMachine]             = &Hypervisor{}
+	_ vmm.ReattachableHypervisor[*VirtualMachine] = &Hypervisor{}
+)
+
+type Hypervisor struct {
+	cfg    Config
+	vms    map[string]*VirtualMachine
+	mu     sync.Mutex
+	notify chan *VirtualMachine
+}
+
+func (hpv *Hypervisor) NewVirtualMachine(ctx context.Context, id string, opts *vmm.NewVMOptions, bl virtio.Bootloader) (*VirtualMachine, error) {
+	if opts == nil {
+		return nil, errors.Errorf("VM options are nil")
+	}
+
+	if err := virtio.ValidateDevices(opts.Devices, bl, opts.GuestPlatform); err != nil {
+		return nil, err
+	}
+
+	platform := opts.GuestPlatform
+	if platform == "" {
+		platform = units.HostPlatform()
+	}
+
+	binary := hpv.cfg.Binary
+	if binary == "" {
+		arch, err := qemuArch(platform)
+		if err != nil {
+			return nil, err
+		}
+		binary = "qemu-system-" + arch
+	}
+
+	accel := hpv.cfg.Accel
+	if accel == AccelAuto {
+		accel = detectAccel(platform)
+	}
+
+	dir := filepath.Join(hpv.cfg.Root, id)
+
+	cmd, err := buildCommandLine(id, dir, platform, accel, opts, bl)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Errorf("creating vm directory: %w", err)
+	}
+
+	vm := newVirtualMachine(id, dir, binary, hpv.cfg.QMPTimeout, opts, cmd)
+
+	for _, s := range cmd.shares {
+		proc, err := virtiofsd.Start(ctx, hpv.cfg.Virtiofsd, s, filepath.Join(dir, "virtiofsd-"+s.Tag+".log"), hpv.cfg.QMPTimeout)
+		if err != nil {
+			virtiofsd.Stop(vm.virtiofsd)
+			return nil, err
+		}
+		vm.virtiofsd = append(vm.virtiofsd, proc)
+	}
+
+	slog.InfoContext(ctx, "created qemu vm", "id", id, "dir", dir, "accel", accel, "vcpus", opts.Vcpus, "memory", opts.Memory, "shares", len(cmd.shares))
+
+	hpv.mu.Lock()
+	hpv.vms[id] = vm
+	hpv.mu.Unlock()
+
+	go func() {
+		hpv.notify <- vm
+	}()
+
+	return vm, nil
+}
+
+// ReattachVirtualMachine implements vmm.ReattachableHypervisor, the vm keeps
+// running in the qemu process launched by the previous shim.
+func (hpv *Hypervisor) ReattachVirtualMachine(ctx context.Context, st *vmm.PersistedVM) (*VirtualMachine, error) {
+	dir := filepath.Join(hpv.cfg.Root, st.ID)
+
+	ls, err := readLaunchState(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cl := &commandLine{
+		args:      ls.Args,
+		shares:    ls.Shares,
+		qmpSocket: filepath.Join(dir, "qmp.sock"),
+		cid:       ls.CID,
+		balloon:   ls.Balloon,
+	}
+	vm := newVirtualMachine(st.ID, dir, ls.Binary, hpv.cfg.QMPTimeout, &vmm.NewVMOptions{
+		Vcpus:         ls.Vcpus,
+		Memory:        ls.Memory,
+		GuestPlatform: st.GuestPlatform,
+	}, cl)
+	// the daemons die with this vm, not with the shim that started them
+	vm.virtiofsdPids = st.HelperPids
+	vm.states = vmm.NewStateMachine(vmm.VirtualMachineStateTypeUnknown)
+
+	if err := vm.reattach(ctx); err != nil {
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "reattached qemu vm", "id", st.ID, "dir", dir, "cid", ls.CID, "state", vm.CurrentState())
+
+	hpv.mu.Lock()
+	hpv.vms[st.ID] = vm
+	hpv.mu.Unlock()
+
+	return vm, nil
+}
+
+func (hpv *Hypervisor) OnCreate() <-chan *VirtualMachine {
+	return hpv.notify
+}
+
+func qemuArch(platform units.Platform) (string, error) {
+	switch platform.Arch() {
+	case "amd64":
+		return "x86_64", nil
+	case "arm64":
+		return "aarch64", nil
+	default:
+		return "", errors.Errorf("unsupported guest platform %s for qemu", platform)
+	}
+}
+
+// detectAccel picks kvm when the guest runs natively on this host and the
+// current user may open /dev/kvm.
+func detectAccel(platform units.Platform) Accel {
+	if runtime.GOOS != "linux" || platform.Arch() != runtime.GOARCH {
+		return AccelTCG
+	}
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return AccelTCG
+	}
+	f.Close()
+	return AccelKVM
+}
+
+// guestCIDAttempts is how many cids a vm is launched with before giving up, as
+// another vm on the host may have taken the cid.
+const guestCIDAttempts = 5
+
+// guestCID derives the first vsock context id tried for a vm from its id.
+// vhost-vsock ids are global to the host, 0 to 2 are reserved.
+func guestCID(id string) uint32 {
+	return 3 + crc32.ChecksumIEEE([]byte(id))%(1<<30)
+}
+
+// randomGuestCID is tried once the cid derived from the id is taken.
+func randomGuestCID() uint32 {
+	return 3 + rand.Uint32N(1<<30)
+}
+
+// guestCIDInUse reports whether qemu failed because the cid of the guest is
+// taken, from its log.
+func guestCIDInUse(log []byte) bool {
+	l := strings.ToLower(string(log))
+	return strings.Contains(l, "guest cid") && strings.Contains(l, strings.ToLower(syscall.EADDRINUSE.Error()))
+}
@@ -0,0 +1,357 @@
+package qemu_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/virt/qemu"
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/core/virt/vmm/vmmtest"
+	"github.com/walteh/runm/pkg/units"
+)
+
+// takenCIDEnv is a guest cid the fake qemu finds taken by another vm.
+const takenCIDEnv = "RUNM_QEMU_TEST_TAKEN_CID"
+
+func TestMain(m *testing.M) {
+	vmmtest.Main(m, runFakeQEMU)
+}
+
+// fakeQEMU scripts the qmp replies and events of a qemu process.
+type fakeQEMU struct {
+	// mu is held per command, a reattaching shim connects next to the first one
+	mu        sync.Mutex
+	status    string
+	migration string
+	balloon   uint64
+}
+
+func runFakeQEMU(args []string) error {
+	f := &fakeQEMU{status: "prelaunch"}
+
+	var socket string
+	for i := 0; i < len(args)-1; i++ {
+		switch args[i] {
+		case "-qmp":
+			socket = strings.TrimPrefix(strings.Split(args[i+1], ",")[0], "unix:")
+		case "-incoming":
+			f.status = "inmigrate"
+		case "-device":
+			if cid, ok := strings.CutPrefix(args[i+1], "vhost-vsock-pci,guest-cid="); ok && cid == os.Getenv(takenCIDEnv) {
+				return fmt.Errorf("-device %s: vhost-vsock: unable to set guest cid: Address already in use", args[i+1])
+			}
+		case "-m":
+			mib, err := strconv.ParseUint(strings.TrimSuffix(args[i+1], "M"), 10, 64)
+			if err != nil {
+				return err
+			}
+			f.balloon = mib << 20
+		}
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go f.serve(conn)
+	}
+}
+
+func (f *fakeQEMU) serve(conn net.Conn) {
+	defer conn.Close()
+
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+
+	enc.Encode(map[string]any{"QMP": map[string]any{"version": map[string]any{}, "capabilities": []string{}}})
+
+	for {
+		var cmd struct {
+			Execute   string          `json:"execute"`
+			Arguments json.RawMessage `json:"arguments"`
+			ID        string          `json:"id"`
+		}
+		if err := dec.Decode(&cmd); err != nil {
+			return
+		}
+
+		reply := func(ret any) {
+			enc.Encode(map[string]any{"return": ret, "id": cmd.ID})
+		}
+		fail := func(desc string) {
+			enc.Encode(map[string]any{"error": map[string]string{"class": "GenericError", "desc": desc}, "id": cmd.ID})
+		}
+		event := func(name string, data any) {
+			enc.Encode(map[string]any{"event": name, "data": data, "timestamp": map[string]int{}})
+		}
+		var uri struct {
+			URI   string `json:"uri"`
+			Value uint64 `json:"value"`
+		}
+		json.Unmarshal(cmd.Arguments, &uri)
+
+		f.mu.Lock()
+		switch cmd.Execute {
+		case "qmp_capabilities":
+			reply(struct{}{})
+		case "cont":
+			if f.status == "inmigrate" {
+				fail("migration is not completed")
+				continue
+			}
+			f.status = "running"
+			event("RESUME", struct{}{})
+			reply(struct{}{})
+		case "stop":
+			f.status = "paused"
+			event("STOP", struct{}{})
+			reply(struct{}{})
+		case "system_powerdown":
+			reply(struct{}{})
+			event("SHUTDOWN", map[string]any{"guest": true, "reason": "guest-shutdown"})
+			os.Exit(0)
+		case "quit":
+			reply(struct{}{})
+			os.Exit(0)
+		case "balloon":
+			f.balloon = uri.Value
+			reply(struct{}{})
+		case "query-balloon":
+			reply(map[string]uint64{"actual": f.balloon})
+		case "migrate":
+			if err := os.WriteFile(strings.TrimPrefix(uri.URI, "file:"), []byte("fake qemu snapshot"), 0600); err != nil {
+				fail(err.Error())
+				continue
+			}
+			f.migration = "completed"
+			reply(struct{}{})
+		case "migrate-incoming":
+			if f.status != "inmigrate" {
+				fail("qemu was not started with -incoming defer")
+				continue
+			}
+			if _, err := os.ReadFile(strings.TrimPrefix(uri.URI, "file:")); err != nil {
+				fail(err.Error())
+				continue
+			}
+			f.migration = "completed"
+			f.status = "paused"
+			reply(struct{}{})
+		case "query-migrate":
+			reply(map[string]string{"status": f.migration})
+		case "query-status":
+			reply(map[string]any{"running": f.status == "running", "status": f.status})
+		default:
+			enc.Encode(map[string]any{"error": map[string]string{"class": "CommandNotFound", "desc": "unknown command " + cmd.Execute}, "id": cmd.ID})
+		}
+		f.mu.Unlock()
+	}
+}
+
+func newHypervisor(t *testing.T) vmm.Hypervisor[*qemu.VirtualMachine] {
+	bin := vmmtest.Binary(t)
+	return qemu.NewHypervisor(qemu.Config{
+		Binary:    bin,
+		Virtiofsd: bin,
+		Root:      vmmtest.Root(t, "qemu"),
+		Accel:     qemu.AccelTCG,
+	})
+}
+
+// assertArg checks that flag is directly followed by value in args.
+func assertArg(t *testing.T, args []string, flag, value string) {
+	t.Helper()
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == flag && args[i+1] == value {
+			return
+		}
+	}
+	assert.Failf(t, "missing argument", "%s %s not in %q", flag, value, args)
+}
+
+func TestCommandLine(t *testing.T) {
+	ctx := t.Context()
+	hpv := newHypervisor(t)
+
+	disk := filepath.Join(t.TempDir(), "mbin.squashfs")
+	require.NoError(t, os.WriteFile(disk, nil, 0644))
+	blk, err := virtio.VirtioBlkNew(disk)
+	require.NoError(t, err)
+	blk.ReadOnly = true
+	blk.SetDeviceIdentifier("mbin")
+
+	share, err := virtio.VirtioFsNew(t.TempDir(), "share")
+	require.NoError(t, err)
+
+	sock, err := os.CreateTemp(t.TempDir(), "net")
+	require.NoError(t, err)
+	defer sock.Close()
+
+	mac, err := net.ParseMAC("5a:94:ef:e4:0c:ee")
+	require.NoError(t, err)
+
+	consoleLog := filepath.Join(t.TempDir(), "console.log")
+
+	vm, err := hpv.NewVirtualMachine(ctx, "vm-qemu-args", &vmm.NewVMOptions{
+		Vcpus:         2,
+		Memory:        strongunits.MiB(512).ToBytes(),
+		GuestPlatform: units.PlatformLinuxAMD64,
+		Devices: []virtio.VirtioDevice{
+			share,
+			blk,
+			&virtio.VirtioNet{Socket: sock, MacAddress: mac},
+			&virtio.VirtioVsock{},
+			&virtio.VirtioBalloon{},
+			&virtio.VirtioRng{},
+			&virtio.VirtioSerialLogFile{Path: consoleLog},
+		},
+	}, vmmtest.Bootloader(t))
+	require.NoError(t, err)
+	defer vm.HardStop(context.Background())
+	assert.Equal(t, vm, <-hpv.OnCreate())
+
+	args := vm.Args()
+	assert.Contains(t, args, "-S")
+	assertArg(t, args, "-accel", "tcg")
+	assertArg(t, args, "-cpu", "max")
+	assertArg(t, args, "-smp", "2")
+	assertArg(t, args, "-m", "512M")
+	assertArg(t, args, "-object", "memory-backend-memfd,id=mem,size=512M,share=on")
+	assertArg(t, args, "-machine", "q35,memory-backend=mem")
+	assertArg(t, args, "-kernel", "/images/kernel")
+	assertArg(t, args, "-initrd", "/images/initramfs.cpio.gz")
+	assertArg(t, args, "-device", "vhost-user-fs-pci,chardev=fs0,tag=share")
+	assertArg(t, args, "-drive", "file="+disk+",if=none,id=disk1,format=raw,readonly=on")
+	assertArg(t, args, "-device", "virtio-blk-pci,drive=disk1,serial=mbin")
+	assertArg(t, args, "-netdev", "dgram,id=net2,local.type=fd,local.str=3")
+	assertArg(t, args, "-device", "virtio-net-pci,netdev=net2,mac=5a:94:ef:e4:0c:ee")
+	assertArg(t, args, "-device", "virtio-balloon-pci,id=balloon0,deflate-on-oom=on")
+	assertArg(t, args, "-device", "virtio-rng-pci")
+	assertArg(t, args, "-chardev", "file,id=console,path="+consoleLog)
+	assertArg(t, args, "-device", "virtconsole,chardev=console")
+
+	i := slices.Index(args, "-append")
+	require.GreaterOrEqual(t, i, 0)
+	assert.Contains(t, args[i+1], "console=hvc0")
+
+	// virtiofs is served by vhost-user, which qemu cannot migrate
+	require.ErrorIs(t, vm.SupportsFullSnapshot(ctx), vmm.ErrFullSnapshotNotSupported)
+
+	// a vm that never ran stops without qemu
+	require.NoError(t, vm.HardStop(ctx))
+	assert.False(t, vm.CanStart(ctx))
+}
+
+func TestVirtualMachine(t *testing.T) {
+	vmmtest.RunVirtualMachine(t, newHypervisor(t), &vmm.NewVMOptions{
+		Vcpus:   1,
+		Memory:  strongunits.MiB(512).ToBytes(),
+		Devices: []virtio.VirtioDevice{&virtio.VirtioBalloon{}},
+	}, nil)
+}
+
+// guestCID returns the cid of the vsock device in args.
+func guestCID(t *testing.T, args []string) string {
+	t.Helper()
+	for _, arg := range args {
+		if cid, ok := strings.CutPrefix(arg, "vhost-vsock-pci,guest-cid="); ok {
+			return cid
+		}
+	}
+	require.Failf(t, "missing vsock device", "no vhost-vsock-pci in %q", args)
+	return ""
+}
+
+func TestGuestCIDInUse(t *testing.T) {
+	ctx := t.Context()
+	hpv := newHypervisor(t)
+
+	vm, err := hpv.NewVirtualMachine(ctx, "vm-qemu-cid", &vmm.NewVMOptions{
+		Vcpus:   1,
+		Memory:  strongunits.MiB(256).ToBytes(),
+		Devices: []virtio.VirtioDevice{&virtio.VirtioVsock{}},
+	}, vmmtest.Bootloader(t))
+	require.NoError(t, err)
+	defer vm.HardStop(context.Background())
+
+	taken := guestCID(t, vm.Args())
+	t.Setenv(takenCIDEnv, taken)
+
+	require.NoError(t, vm.Start(ctx))
+	assert.Equal(t, vmm.VirtualMachineStateTypeRunning, vm.CurrentState())
+	assert.NotEqual(t, taken, guestCID(t, vm.Args()))
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	vmmtest.RunSnapshotRestore(t, newHypervisor(t), func() *vmm.NewVMOptions {
+		return &vmm.NewVMOptions{
+			Vcpus:  1,
+			Memory: strongunits.MiB(256).ToBytes(),
+		}
+	})
+}
+
+func TestReattach(t *testing.T) {
+	ctx := t.Context()
+	bin := vmmtest.Binary(t)
+	cfg := qemu.Config{Binary: bin, Virtiofsd: bin, Root: vmmtest.Root(t, "qemu"), Accel: qemu.AccelTCG}
+
+	vm, err := qemu.NewHypervisor(cfg).NewVirtualMachine(ctx, "vm-qemu-reattach", &vmm.NewVMOptions{
+		Vcpus:   2,
+		Memory:  strongunits.MiB(256).ToBytes(),
+		Devices: []virtio.VirtioDevice{&virtio.VirtioVsock{}, &virtio.VirtioBalloon{}},
+	}, vmmtest.Bootloader(t))
+	require.NoError(t, err)
+	defer vm.HardStop(context.Background())
+	require.NoError(t, vm.Start(ctx))
+
+	// a new shim finds the vm from its id alone
+	hpv, ok := qemu.NewHypervisor(cfg).(vmm.ReattachableHypervisor[*qemu.VirtualMachine])
+	require.True(t, ok)
+	reattached, err := hpv.ReattachVirtualMachine(ctx, &vmm.PersistedVM{ID: "vm-qemu-reattach"})
+	require.NoError(t, err)
+
+	assert.Equal(t, vmm.VirtualMachineStateTypeRunning, reattached.CurrentState())
+	assert.Equal(t, uint64(2), reattached.Opts().Vcpus)
+	assert.Equal(t, vm.Args(), reattached.Args())
+
+	require.NoError(t, reattached.Pause(ctx))
+	assert.Equal(t, vmm.VirtualMachineStateTypePaused, reattached.CurrentState())
+	require.NoError(t, reattached.Resume(ctx))
+
+	size, err := reattached.GetMemoryBalloonTargetSize(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, strongunits.MiB(256).ToBytes(), size)
+
+	require.NoError(t, reattached.HardStop(ctx))
+	assert.Equal(t, vmm.VirtualMachineStateTypeStopped, reattached.CurrentState())
+	assert.Eventually(t, func() bool { return !vm.CanHardStop(ctx) }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestUnsupportedConfig(t *testing.T) {
+	vmmtest.RunUnsupportedConfig(t, newHypervisor(t), nil,
+		vmmtest.BadConfig{Name: "network without backend", Devices: []virtio.VirtioDevice{&virtio.VirtioNet{}}},
+		vmmtest.BadConfig{Name: "darwin guest", Platform: units.PlatformDarwinARM64},
+	)
+}
@@ -0,0 +1,152 @@
+package qemu
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// qmpError is the error qemu replied to a command with.
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *qmpError) Error() string {
+	return e.Class + ": " + e.Desc
+}
+
+type qmpCommand struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+	ID        string `json:"id"`
+}
+
+// qmpMessage is anything qemu sends, a greeting, a reply or an event.
+type qmpMessage struct {
+	QMP    json.RawMessage `json:"QMP,omitempty"`
+	Return json.RawMessage `json:"return,omitempty"`
+	Error  *qmpError       `json:"error,omitempty"`
+	ID     string          `json:"id,omitempty"`
+	Event  string          `json:"event,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// qmpClient runs one command at a time on a qmp socket, events are handed to
+// onEvent from the reading goroutine as they arrive.
+type qmpClient struct {
+	conn    net.Conn
+	enc     *json.Encoder
+	onEvent func(event string, data json.RawMessage)
+
+	// mu allows a single command in flight
+	mu      sync.Mutex
+	nextID  int
+	replies chan *qmpMessage
+
+	// closed is closed with err set once the socket is unusable
+	closed chan struct{}
+	err    error
+}
+
+// dialQMP connects to socket and negotiates the qmp capabilities.
+func dialQMP(ctx context.Context, socket string, onEvent func(event string, data json.RawMessage)) (*qmpClient, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, errors.Errorf("dialing qmp socket: %w", err)
+	}
+
+	dec := json.NewDecoder(conn)
+
+	greeting := &qmpMessage{}
+	if err := dec.Decode(greeting); err != nil {
+		conn.Close()
+		return nil, errors.Errorf("reading qmp greeting: %w", err)
+	}
+	if greeting.QMP == nil {
+		conn.Close()
+		return nil, errors.Errorf("unexpected qmp greeting")
+	}
+
+	c := &qmpClient{
+		conn:    conn,
+		enc:     json.NewEncoder(conn),
+		onEvent: onEvent,
+		replies: make(chan *qmpMessage, 1),
+		closed:  make(chan struct{}),
+	}
+
+	go c.read(dec)
+
+	if err := c.execute(ctx, "qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *qmpClient) read(dec *json.Decoder) {
+	for {
+		msg := &qmpMessage{}
+		if err := dec.Decode(msg); err != nil {
+			c.err = errors.Errorf("reading qmp socket: %w", err)
+			close(c.closed)
+			return
+		}
+		if msg.Event != "" {
+			if c.onEvent != nil {
+				c.onEvent(msg.Event, msg.Data)
+			}
+			continue
+		}
+		c.replies <- msg
+	}
+}
+
+// execute runs cmd with args and decodes its return value into out, either may
+// be nil.
+func (c *qmpClient) execute(ctx context.Context, cmd string, args any, out any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextID++
+	id := strconv.Itoa(c.nextID)
+
+	if err := c.enc.Encode(&qmpCommand{Execute: cmd, Arguments: args, ID: id}); err != nil {
+		return errors.Errorf("sending qmp %s: %w", cmd, err)
+	}
+
+	for {
+		select {
+		case msg := <-c.replies:
+			// a reply to a command given up on by its caller
+			if msg.ID != id {
+				continue
+			}
+			if msg.Error != nil {
+				return errors.Errorf("qmp %s: %w", cmd, msg.Error)
+			}
+			if out == nil {
+				return nil
+			}
+			if err := json.Unmarshal(msg.Return, out); err != nil {
+				return errors.Errorf("decoding qmp %s reply: %w", cmd, err)
+			}
+			return nil
+		case <-c.closed:
+			return errors.Errorf("qmp %s: %w", cmd, c.err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *qmpClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,108 @@
+package qemu
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/common/pkg/strongunits"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/virtiofsd"
+	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/pkg/atomicfile"
+)
+
+// launchState is what a shim needs to reattach to a qemu launched by another one,
+// it is written to the vm directory once qemu serves qmp.
+type launchState struct {
+	Binary  string            `json:"binary"`
+	Args    []string          `json:"args"`
+	CID     uint32            `json:"cid"`
+	Balloon bool              `json:"balloon"`
+	Shares  []virtiofsd.Share `json:"shares,omitempty"`
+	Vcpus   uint64            `json:"vcpus"`
+	Memory  strongunits.B     `json:"memory"`
+}
+
+func launchStatePath(dir string) string {
+	return filepath.Join(dir, "qemu.json")
+}
+
+func (vm *VirtualMachine) writeLaunchState() error {
+	vm.mu.Lock()
+	ls := &launchState{
+		Binary:  vm.binary,
+		Args:    vm.cmdline.args,
+		CID:     vm.cmdline.cid,
+		Balloon: vm.cmdline.balloon,
+		Shares:  vm.cmdline.shares,
+		Vcpus:   vm.opts.Vcpus,
+		Memory:  vm.opts.Memory,
+	}
+	data, err := json.Marshal(ls)
+	vm.mu.Unlock()
+	if err != nil {
+		return errors.Errorf("marshalling launch state: %w", err)
+	}
+
+	if err := atomicfile.WriteFile(launchStatePath(vm.dir), data); err != nil {
+		return errors.Errorf("writing launch state: %w", err)
+	}
+	return nil
+}
+
+func readLaunchState(dir string) (*launchState, error) {
+	data, err := os.ReadFile(launchStatePath(dir))
+	if err != nil {
+		return nil, errors.Errorf("reading launch state: %w", err)
+	}
+	ls := &launchState{}
+	if err := json.Unmarshal(data, ls); err != nil {
+		return nil, errors.Errorf("unmarshalling launch state: %w", err)
+	}
+	return ls, nil
+}
+
+type statusInfo struct {
+	Running bool   `json:"running"`
+	Status  string `json:"status"`
+}
+
+// reattach connects to the qmp socket of a qemu launched by another process, the
+// state of vm is unknown until then. qemu is no child of this one, the vm is gone
+// once qemu closes the socket.
+func (vm *VirtualMachine) reattach(ctx context.Context) error {
+	qmp, err := dialQMP(ctx, vm.cmdline.qmpSocket, vm.handleEvent)
+	if err != nil {
+		return errors.Errorf("connecting to qemu of vm %s: %w", vm.id, err)
+	}
+
+	info := &statusInfo{}
+	if err := qmp.execute(ctx, "query-status", nil, info); err != nil {
+		qmp.Close()
+		return errors.Errorf("reading vm status: %w", err)
+	}
+
+	// an event may have moved the vm on already
+	state := vmm.VirtualMachineStateTypePaused
+	if info.Running {
+		state = vmm.VirtualMachineStateTypeRunning
+	}
+	if vm.CurrentState() == vmm.VirtualMachineStateTypeUnknown {
+		vm.setState(state, map[string]string{"status": info.Status})
+	}
+
+	vm.mu.Lock()
+	vm.qmp = qmp
+	vm.launched = true
+	vm.mu.Unlock()
+
+	go func() {
+		<-qmp.closed
+		vm.gone(qmp.err)
+	}()
+
+	return nil
+}
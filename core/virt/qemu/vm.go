@@ -0,0 +1,626 @@
+package qemu
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/mdlayher/vsock"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/virtiofsd"
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+// migratePollInterval is how often the progress of a snapshot is read.
+const migratePollInterval = 20 * time.Millisecond
+
+var (
+	_ vmm.VirtualMachine      = &VirtualMachine{}
+	_ vmm.FullSnapshotCapable = &VirtualMachine{}
+	_ vmm.StateHistoryVM      = &VirtualMachine{}
+	_ vmm.ConsoleLogAppender  = &VirtualMachine{}
+	_ vmm.HelperProcessVM     = &VirtualMachine{}
+)
+
+type VirtualMachine struct {
+	id         string
+	dir        string
+	binary     string
+	qmpTimeout time.Duration
+	opts       *vmm.NewVMOptions
+	cmdline    *commandLine
+
+	// process and qmp are set once qemu is launched, by Start or by a restore
+	process   *exec.Cmd
+	qmp       *qmpClient
+	virtiofsd []*exec.Cmd
+	// virtiofsdPids are the daemons of a reattached vm, started by another process
+	virtiofsdPids []int
+	// exited is closed once qemu is gone, or the vm was stopped before it ran
+	exited   chan struct{}
+	exitOnce sync.Once
+
+	// opMu serializes the changes made over qmp
+	opMu sync.Mutex
+
+	states *vmm.StateMachine
+
+	mu       sync.Mutex
+	launched bool
+	stopping bool
+}
+
+func newVirtualMachine(id, dir, binary string, qmpTimeout time.Duration, opts *vmm.NewVMOptions, cl *commandLine) *VirtualMachine {
+	return &VirtualMachine{
+		id:         id,
+		dir:        dir,
+		binary:     binary,
+		qmpTimeout: qmpTimeout,
+		opts:       opts,
+		cmdline:    cl,
+		exited:     make(chan struct{}),
+		states:     vmm.NewStateMachine(vmm.VirtualMachineStateTypeStopped),
+	}
+}
+
+// Args returns the arguments qemu is launched with, apart from those only used
+// to restore a snapshot.
+func (vm *VirtualMachine) Args() []string {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return slices.Clone(vm.cmdline.args)
+}
+
+// cid is the vsock context id of the guest, 0 without a vsock device. It changes
+// when the guest is launched with another cid.
+func (vm *VirtualMachine) cid() uint32 {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.cmdline.cid
+}
+
+// errGuestCIDInUse is returned by launchQEMU when another vm has the cid.
+var errGuestCIDInUse = errors.New("guest cid in use")
+
+// launch starts qemu, paused, with extra appended to its arguments and connects
+// to its qmp socket. The guest is moved to another cid while its cid is taken.
+func (vm *VirtualMachine) launch(ctx context.Context, extra ...string) error {
+	for attempt := 1; ; attempt++ {
+		err := vm.launchQEMU(ctx, extra...)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, errGuestCIDInUse) || attempt == guestCIDAttempts {
+			vm.gone(err)
+			return err
+		}
+
+		cid := randomGuestCID()
+		slog.WarnContext(ctx, "guest cid is taken, launching with another one", "id", vm.id, "cid", vm.cid(), "next_cid", cid)
+
+		vm.mu.Lock()
+		vm.cmdline.setCID(cid)
+		vm.mu.Unlock()
+	}
+}
+
+func (vm *VirtualMachine) launchQEMU(ctx context.Context, extra ...string) error {
+	if err := os.Remove(vm.cmdline.qmpSocket); err != nil && !os.IsNotExist(err) {
+		return errors.Errorf("removing stale qmp socket: %w", err)
+	}
+
+	logPath := filepath.Join(vm.dir, "qemu.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return errors.Errorf("creating qemu log: %w", err)
+	}
+	defer logFile.Close()
+
+	// the vm outlives the context it was started with
+	cmd := exec.Command(vm.binary, append(vm.Args(), extra...)...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.ExtraFiles = vm.cmdline.extraFiles
+	// own session, so qemu is not killed with the shim's process group
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	slog.DebugContext(ctx, "starting qemu", "id", vm.id, "binary", vm.binary, "args", cmd.Args[1:])
+
+	if err := cmd.Start(); err != nil {
+		return errors.Errorf("starting qemu: %w", err)
+	}
+
+	vm.process = cmd
+
+	// qemu is only gone for good once it served qmp, a launch can be retried
+	exited := make(chan struct{})
+	var waitErr error
+	go func() {
+		waitErr = cmd.Wait()
+		close(exited)
+	}()
+
+	qmp, err := vm.connectQMP(ctx, exited)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		<-exited
+		if log, _ := os.ReadFile(logPath); vm.cid() != 0 && guestCIDInUse(log) {
+			return errors.Errorf("launching qemu with cid %d: %w", vm.cid(), errGuestCIDInUse)
+		}
+		return err
+	}
+
+	go func() {
+		<-exited
+		slog.InfoContext(ctx, "qemu exited", "id", vm.id, "error", waitErr)
+		vm.gone(waitErr)
+	}()
+
+	vm.mu.Lock()
+	vm.qmp = qmp
+	vm.launched = true
+	vm.mu.Unlock()
+
+	if err := vm.writeLaunchState(); err != nil {
+		slog.WarnContext(ctx, "the vm cannot be reattached from another process", "id", vm.id, "error", err)
+	}
+
+	return nil
+}
+
+// connectQMP waits for qemu to serve qmp on its socket.
+func (vm *VirtualMachine) connectQMP(ctx context.Context, exited <-chan struct{}) (*qmpClient, error) {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.NewTimer(vm.qmpTimeout)
+	defer deadline.Stop()
+
+	for {
+		qmp, err := dialQMP(ctx, vm.cmdline.qmpSocket, vm.handleEvent)
+		if err == nil {
+			return qmp, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-exited:
+			return nil, errors.Errorf("qemu exited before serving qmp, see %s", filepath.Join(vm.dir, "qemu.log"))
+		case <-deadline.C:
+			return nil, errors.Errorf("waiting for qmp: timeout after %s: %w", vm.qmpTimeout, err)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// handleEvent follows the vm state from the events qemu sends.
+func (vm *VirtualMachine) handleEvent(event string, data json.RawMessage) {
+	var state vmm.VirtualMachineStateType
+	switch event {
+	case "STOP":
+		state = vmm.VirtualMachineStateTypePaused
+	case "RESUME":
+		state = vmm.VirtualMachineStateTypeRunning
+	case "SHUTDOWN":
+		// qemu exits once the guest is down
+		vm.mu.Lock()
+		vm.stopping = true
+		vm.mu.Unlock()
+		state = vmm.VirtualMachineStateTypeStopping
+	case "GUEST_PANICKED":
+		state = vmm.VirtualMachineStateTypeError
+	default:
+		return
+	}
+
+	if state == vm.CurrentState() {
+		return
+	}
+	vm.setState(state, map[string]string{"event": event, "data": string(data)})
+}
+
+// gone cleans up after qemu exited.
+func (vm *VirtualMachine) gone(err error) {
+	vm.exitOnce.Do(func() {
+		virtiofsd.Stop(vm.virtiofsd)
+		virtiofsd.Kill(vm.virtiofsdPids)
+
+		vm.mu.Lock()
+		stopping := vm.stopping
+		qmp := vm.qmp
+		vm.mu.Unlock()
+
+		if qmp != nil {
+			qmp.Close()
+		}
+
+		if err != nil && !stopping && vm.CurrentState() != vmm.VirtualMachineStateTypeStopped {
+			vm.setState(vmm.VirtualMachineStateTypeError, map[string]string{"error": err.Error()})
+		} else {
+			vm.setState(vmm.VirtualMachineStateTypeStopped, nil)
+		}
+
+		close(vm.exited)
+	})
+}
+
+func (vm *VirtualMachine) isLaunched() bool {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.launched
+}
+
+func (vm *VirtualMachine) Start(ctx context.Context) error {
+	if !vm.CanStart(ctx) {
+		return &vmm.OperationError{Operation: vmm.OperationStart, State: vm.CurrentState()}
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	vm.setState(vmm.VirtualMachineStateTypeStarting, nil)
+
+	if !vm.isLaunched() {
+		if err := vm.launch(ctx); err != nil {
+			vm.setState(vmm.VirtualMachineStateTypeError, map[string]string{"error": err.Error()})
+			return err
+		}
+	}
+
+	if err := vm.qmp.execute(ctx, "cont", nil, nil); err != nil {
+		vm.setState(vmm.VirtualMachineStateTypeError, map[string]string{"error": err.Error()})
+		return errors.Errorf("booting vm: %w", err)
+	}
+
+	vm.setState(vmm.VirtualMachineStateTypeRunning, nil)
+
+	return nil
+}
+
+// HardStop quits qemu along with the vm.
+func (vm *VirtualMachine) HardStop(ctx context.Context) error {
+	vm.mu.Lock()
+	vm.stopping = true
+	vm.mu.Unlock()
+
+	if !vm.isLaunched() {
+		vm.gone(nil)
+		return nil
+	}
+
+	// qemu may close the socket before its reply to quit is read
+	if err := vm.qmp.execute(ctx, "quit", nil, nil); err != nil {
+		select {
+		case <-vm.exited:
+		default:
+			if vm.process == nil {
+				return errors.Errorf("quitting qemu: %w", err)
+			}
+			slog.WarnContext(ctx, "qemu did not quit, killing it", "id", vm.id, "error", err)
+			_ = vm.process.Process.Kill()
+		}
+	}
+
+	select {
+	case <-vm.exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RequestStop presses the acpi power button of the vm.
+func (vm *VirtualMachine) RequestStop(ctx context.Context) (bool, error) {
+	if !vm.isLaunched() {
+		return false, errors.Errorf("vm %s is not running", vm.id)
+	}
+
+	if err := vm.states.Check(vmm.OperationRequestStop); err != nil {
+		return false, err
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	if err := vm.qmp.execute(ctx, "system_powerdown", nil, nil); err != nil {
+		return false, errors.Errorf("requesting vm stop: %w", err)
+	}
+	if vm.CurrentState() == vmm.VirtualMachineStateTypeRunning {
+		vm.setState(vmm.VirtualMachineStateTypeStopping, nil)
+	}
+	return true, nil
+}
+
+func (vm *VirtualMachine) Pause(ctx context.Context) error {
+	if !vm.isLaunched() {
+		return errors.Errorf("vm %s is not running", vm.id)
+	}
+
+	if err := vm.states.Check(vmm.OperationPause); err != nil {
+		return err
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	if err := vm.qmp.execute(ctx, "stop", nil, nil); err != nil {
+		return errors.Errorf("pausing vm: %w", err)
+	}
+	vm.setState(vmm.VirtualMachineStateTypePaused, nil)
+	return nil
+}
+
+func (vm *VirtualMachine) Resume(ctx context.Context) error {
+	if !vm.isLaunched() {
+		return errors.Errorf("vm %s is not running", vm.id)
+	}
+
+	if err := vm.states.Check(vmm.OperationResume); err != nil {
+		return err
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	if err := vm.qmp.execute(ctx, "cont", nil, nil); err != nil {
+		return errors.Errorf("resuming vm: %w", err)
+	}
+	vm.setState(vmm.VirtualMachineStateTypeRunning, nil)
+	return nil
+}
+
+func (vm *VirtualMachine) CanStart(_ context.Context) bool {
+	select {
+	case <-vm.exited:
+		return false
+	default:
+	}
+	return vm.states.Can(vmm.OperationStart)
+}
+
+func (vm *VirtualMachine) CanHardStop(_ context.Context) bool {
+	select {
+	case <-vm.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+func (vm *VirtualMachine) CanRequestStop(_ context.Context) bool {
+	return vm.states.Can(vmm.OperationRequestStop)
+}
+
+func (vm *VirtualMachine) CanPause(_ context.Context) bool {
+	return vm.states.Can(vmm.OperationPause)
+}
+
+func (vm *VirtualMachine) CanResume(_ context.Context) bool {
+	return vm.states.Can(vmm.OperationResume)
+}
+
+func (vm *VirtualMachine) CurrentState() vmm.VirtualMachineStateType {
+	return vm.states.Current()
+}
+
+// setState moves the vm to state, a change the state machine rejects is logged
+// and dropped.
+func (vm *VirtualMachine) setState(state vmm.VirtualMachineStateType, metadata map[string]string) {
+	if err := vm.states.Transition(state, metadata); err != nil {
+		slog.Warn("ignoring vm state change", "id", vm.id, "error", err)
+	}
+}
+
+// StateChangeNotify implements vmm.VirtualMachine.
+func (vm *VirtualMachine) StateChangeNotify(ctx context.Context) <-chan vmm.VirtualMachineStateChange {
+	return vm.states.Subscribe(ctx)
+}
+
+// StateHistory implements vmm.StateHistoryVM.
+func (vm *VirtualMachine) StateHistory() []vmm.StateTransition {
+	return vm.states.History()
+}
+
+// VSockConnect implements vmm.VirtualMachine over vhost-vsock.
+func (vm *VirtualMachine) VSockConnect(ctx context.Context, port uint32) (net.Conn, error) {
+	cid := vm.cid()
+	if cid == 0 {
+		return nil, errors.Errorf("vm %s has no vsock device", vm.id)
+	}
+	conn, err := vsock.Dial(cid, port, nil)
+	if err != nil {
+		return nil, errors.Errorf("dialing vsock port %d of cid %d: %w", port, cid, err)
+	}
+	return conn, nil
+}
+
+// SupportsFullSnapshot implements vmm.FullSnapshotCapable. The state of a
+// vhost-user-fs device lives in virtiofsd, so vms with directory shares cannot
+// be migrated to a file.
+func (vm *VirtualMachine) SupportsFullSnapshot(ctx context.Context) error {
+	if len(vm.cmdline.shares) > 0 {
+		return errors.Errorf("vm %s has virtiofs shares: %w", vm.id, vmm.ErrFullSnapshotNotSupported)
+	}
+	return nil
+}
+
+type migrateRequest struct {
+	URI string `json:"uri"`
+}
+
+type migrateInfo struct {
+	Status    string `json:"status"`
+	ErrorDesc string `json:"error-desc,omitempty"`
+}
+
+// waitForMigration polls the snapshot being written or read until it is done.
+func (vm *VirtualMachine) waitForMigration(ctx context.Context) error {
+	ticker := time.NewTicker(migratePollInterval)
+	defer ticker.Stop()
+
+	for {
+		info := &migrateInfo{}
+		if err := vm.qmp.execute(ctx, "query-migrate", nil, info); err != nil {
+			return err
+		}
+		switch info.Status {
+		case "completed":
+			return nil
+		case "failed", "cancelled":
+			return errors.Errorf("migration %s: %s", info.Status, info.ErrorDesc)
+		}
+		select {
+		case <-ticker.C:
+		case <-vm.exited:
+			return errors.Errorf("qemu exited during migration")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SaveFullSnapshot migrates the vm into the file path, which needs qemu 8.2 or
+// later. The vm must be paused.
+func (vm *VirtualMachine) SaveFullSnapshot(ctx context.Context, path string) error {
+	if err := vm.SupportsFullSnapshot(ctx); err != nil {
+		return err
+	}
+	if !vm.isLaunched() {
+		return errors.Errorf("vm %s is not running", vm.id)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Errorf("creating snapshot directory: %w", err)
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	if err := vm.qmp.execute(ctx, "migrate", &migrateRequest{URI: "file:" + path}, nil); err != nil {
+		return errors.Errorf("saving snapshot: %w", err)
+	}
+	if err := vm.waitForMigration(ctx); err != nil {
+		return errors.Errorf("saving snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// RestoreFromFullSnapshot launches qemu to receive the snapshot at path, the vm
+// must never have been started and is paused afterwards.
+func (vm *VirtualMachine) RestoreFromFullSnapshot(ctx context.Context, path string) error {
+	if err := vm.SupportsFullSnapshot(ctx); err != nil {
+		return err
+	}
+	if vm.isLaunched() {
+		return errors.New("cannot restore from snapshot into a vm that was already started")
+	}
+
+	vm.opMu.Lock()
+	defer vm.opMu.Unlock()
+
+	if err := vm.launch(ctx, "-incoming", "defer"); err != nil {
+		return err
+	}
+
+	if err := vm.qmp.execute(ctx, "migrate-incoming", &migrateRequest{URI: "file:" + path}, nil); err != nil {
+		return errors.Errorf("restoring from snapshot: %w", err)
+	}
+	if err := vm.waitForMigration(ctx); err != nil {
+		return errors.Errorf("restoring from snapshot: %w", err)
+	}
+
+	vm.setState(vmm.VirtualMachineStateTypePaused, nil)
+
+	return nil
+}
+
+type balloonRequest struct {
+	Value uint64 `json:"value"`
+}
+
+type balloonInfo struct {
+	Actual uint64 `json:"actual"`
+}
+
+// SetMemoryBalloonTargetSize inflates the balloon until the guest is left with
+// targetBytes.
+func (vm *VirtualMachine) SetMemoryBalloonTargetSize(ctx context.Context, targetBytes strongunits.B) error {
+	if !vm.cmdline.balloon {
+		return errors.New("no memory balloon devices found")
+	}
+	if !vm.isLaunched() {
+		return errors.Errorf("vm %s is not running", vm.id)
+	}
+
+	total := uint64(vm.opts.Memory.ToBytes())
+	if uint64(targetBytes) > total {
+		return errors.Errorf("target memory size %d exceeds vm memory %d", uint64(targetBytes), total)
+	}
+
+	if err := vm.qmp.execute(ctx, "balloon", &balloonRequest{Value: uint64(targetBytes)}, nil); err != nil {
+		return errors.Errorf("resizing memory balloon: %w", err)
+	}
+
+	return nil
+}
+
+func (vm *VirtualMachine) GetMemoryBalloonTargetSize(ctx context.Context) (strongunits.B, error) {
+	if !vm.cmdline.balloon {
+		return 0, errors.New("no memory balloon devices found")
+	}
+	if !vm.isLaunched() {
+		return vm.opts.Memory, nil
+	}
+
+	info := &balloonInfo{}
+	if err := vm.qmp.execute(ctx, "query-balloon", nil, info); err != nil {
+		return 0, errors.Errorf("reading memory balloon: %w", err)
+	}
+	return strongunits.B(info.Actual), nil
+}
+
+// HelperPids implements vmm.HelperProcessVM, the virtiofsd daemons of the vm.
+func (vm *VirtualMachine) HelperPids() []int {
+	pids := append([]int{}, vm.virtiofsdPids...)
+	for _, cmd := range vm.virtiofsd {
+		pids = append(pids, cmd.Process.Pid)
+	}
+	return pids
+}
+
+func (vm *VirtualMachine) ID() string {
+	return vm.id
+}
+
+// AppendsConsoleLog implements vmm.ConsoleLogAppender, the console chardev is
+// opened with append=on.
+func (vm *VirtualMachine) AppendsConsoleLog() bool {
+	return true
+}
+
+func (vm *VirtualMachine) Devices() []virtio.VirtioDevice {
+	return vm.opts.Devices
+}
+
+func (vm *VirtualMachine) Opts() *vmm.NewVMOptions {
+	return vm.opts
+}
+
+func (vm *VirtualMachine) ServeBackgroundTasks(ctx context.Context) error {
+	return nil
+}
+
+func (vm *VirtualMachine) StartGraphicApplication(width float64, height float64) error {
+	return errors.New("qemu vms have no display")
+}
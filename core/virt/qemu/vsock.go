@@ -0,0 +1,174 @@
+package qemu
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/mdlayher/vsock"
+	"gitlab.com/tozd/go/errors"
+)
+
+// listenVsock listens on a vsock port of the host.
+var listenVsock = func(port uint32) (net.Listener, error) {
+	return vsock.Listen(port, nil)
+}
+
+// hostListeners are the vsock listeners of this process by port. A vsock port is
+// global to the host and guests all reach it on cid 2, so the vms listening on the
+// same port share one listener that hands each connection to the vm of its cid.
+var hostListeners = struct {
+	mu    sync.Mutex
+	ports map[uint32]*sharedListener
+}{ports: map[uint32]*sharedListener{}}
+
+// sharedListener accepts the connections to a port for the vms listening on it.
+type sharedListener struct {
+	l      net.Listener
+	port   uint32
+	guests map[*guestListener]struct{}
+	// done is closed with err set once l stopped accepting
+	done chan struct{}
+	err  error
+}
+
+// VSockListen implements vmm.VirtualMachine. The listener only accepts the
+// connections of this guest, connections from other vms on the host go to their
+// own listener or are dropped. The port is taken for the whole host, while another
+// process listens on it this fails.
+func (vm *VirtualMachine) VSockListen(ctx context.Context, port uint32) (net.Listener, error) {
+	if vm.cid() == 0 {
+		return nil, errors.Errorf("vm %s has no vsock device", vm.id)
+	}
+
+	hostListeners.mu.Lock()
+	defer hostListeners.mu.Unlock()
+
+	sl, ok := hostListeners.ports[port]
+	if !ok {
+		l, err := listenVsock(port)
+		if err != nil {
+			return nil, errors.Errorf("listening on vsock port %d: %w", port, err)
+		}
+		sl = &sharedListener{
+			l:      l,
+			port:   port,
+			guests: map[*guestListener]struct{}{},
+			done:   make(chan struct{}),
+		}
+		hostListeners.ports[port] = sl
+		go sl.serve()
+	}
+
+	gl := &guestListener{
+		shared: sl,
+		vm:     vm,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	sl.guests[gl] = struct{}{}
+
+	return gl, nil
+}
+
+func (sl *sharedListener) serve() {
+	for {
+		conn, err := sl.l.Accept()
+		if err != nil {
+			hostListeners.mu.Lock()
+			if hostListeners.ports[sl.port] == sl {
+				delete(hostListeners.ports, sl.port)
+			}
+			hostListeners.mu.Unlock()
+
+			sl.err = err
+			close(sl.done)
+			return
+		}
+
+		gl := sl.guest(conn.RemoteAddr())
+		if gl == nil {
+			slog.Warn("dropping vsock connection from another vm", "port", sl.port, "remote", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		// a guest that is slow to accept does not hold up the others
+		go gl.deliver(conn)
+	}
+}
+
+// guest returns the listener of the vm at addr. The cid is read on every
+// connection, a guest may have been relaunched with another one since it listened.
+func (sl *sharedListener) guest(addr net.Addr) *guestListener {
+	va, ok := addr.(*vsock.Addr)
+	if !ok {
+		return nil
+	}
+
+	hostListeners.mu.Lock()
+	defer hostListeners.mu.Unlock()
+
+	for gl := range sl.guests {
+		if gl.vm.cid() == va.ContextID {
+			return gl
+		}
+	}
+	return nil
+}
+
+// guestListener only accepts the connections of the guest of vm.
+type guestListener struct {
+	shared    *sharedListener
+	vm        *VirtualMachine
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ net.Listener = &guestListener{}
+
+func (l *guestListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *guestListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.shared.done:
+		return nil, l.shared.err
+	}
+}
+
+// Close stops accepting for the guest, the port is released once no vm of this
+// process listens on it.
+func (l *guestListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+
+		hostListeners.mu.Lock()
+		defer hostListeners.mu.Unlock()
+
+		delete(l.shared.guests, l)
+		if len(l.shared.guests) == 0 {
+			if hostListeners.ports[l.shared.port] == l.shared {
+				delete(hostListeners.ports, l.shared.port)
+			}
+			err = l.shared.l.Close()
+		}
+	})
+	return err
+}
+
+func (l *guestListener) Addr() net.Addr {
+	return l.shared.l.Addr()
+}
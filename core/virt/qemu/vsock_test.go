@@ -0,0 +1,105 @@
+package qemu
+
+import (
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/mdlayher/vsock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+// fakeVsockListener hands out the connections pushed to conns, the host has no
+// vsock transport in tests.
+type fakeVsockListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *fakeVsockListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *fakeVsockListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *fakeVsockListener) Addr() net.Addr {
+	return &vsock.Addr{ContextID: vsock.Host}
+}
+
+// fakeVsockConn is a connection from the guest with cid.
+type fakeVsockConn struct {
+	net.Conn
+	cid uint32
+}
+
+func (c *fakeVsockConn) RemoteAddr() net.Addr {
+	return &vsock.Addr{ContextID: c.cid}
+}
+
+func TestVSockListenSharesPort(t *testing.T) {
+	fake := &fakeVsockListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+	listens := 0
+	prev := listenVsock
+	listenVsock = func(port uint32) (net.Listener, error) {
+		// the port is global to the host, it can only be bound once
+		listens++
+		if listens > 1 {
+			return nil, syscall.EADDRINUSE
+		}
+		return fake, nil
+	}
+	t.Cleanup(func() { listenVsock = prev })
+
+	ctx := t.Context()
+	vm1 := newVirtualMachine("vm-1", t.TempDir(), "", 0, &vmm.NewVMOptions{}, &commandLine{cid: 10})
+	vm2 := newVirtualMachine("vm-2", t.TempDir(), "", 0, &vmm.NewVMOptions{}, &commandLine{cid: 11})
+
+	l1, err := vm1.VSockListen(ctx, 1024)
+	require.NoError(t, err)
+	l2, err := vm2.VSockListen(ctx, 1024)
+	require.NoError(t, err)
+
+	dial := func(cid uint32) net.Conn {
+		client, server := net.Pipe()
+		fake.conns <- &fakeVsockConn{Conn: server, cid: cid}
+		return client
+	}
+
+	// no vm of this process has the cid
+	stranger := dial(99)
+	_, err = stranger.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	dial(11)
+	conn, err := l2.Accept()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(11), conn.RemoteAddr().(*vsock.Addr).ContextID)
+
+	require.NoError(t, l1.Close())
+	select {
+	case <-fake.closed:
+		t.Fatal("the port was released while vm-2 listens on it")
+	default:
+	}
+
+	require.NoError(t, l2.Close())
+	select {
+	case <-fake.closed:
+	default:
+		t.Fatal("the port was kept after the last vm stopped listening")
+	}
+}
@@ -0,0 +1,56 @@
+package vf
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+// TestConsoleLogRotate rotates the console log of a vm while it is held open for
+// appending, as the file serial port attachment of the vm holds it.
+func TestConsoleLogRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, vmm.ConsoleLogFile)
+
+	vm := &VirtualMachine{id: "vf", opts: &vmm.NewVMOptions{Devices: []virtio.VirtioDevice{
+		&virtio.VirtioSerialLogFile{Path: path, Append: true},
+	}}}
+	require.True(t, vmm.CanRotateConsoleLog(vm))
+
+	notAppended := &VirtualMachine{id: "vf", opts: &vmm.NewVMOptions{Devices: []virtio.VirtioDevice{
+		&virtio.VirtioSerialLogFile{Path: path},
+	}}}
+	assert.False(t, vmm.CanRotateConsoleLog(notAppended))
+
+	console, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	defer console.Close()
+
+	_, err = console.WriteString("booting\n1234")
+	require.NoError(t, err)
+
+	cl := vmm.NewConsoleLog(dir, vmm.ConsoleLogOptions{MaxSize: 9})
+	rotated, err := cl.Rotate(t.Context())
+	require.NoError(t, err)
+	require.True(t, rotated)
+
+	_, err = console.WriteString("running\n")
+	require.NoError(t, err)
+
+	// written from the start of the truncated log, not at the old offset
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "running\n", string(data))
+
+	var buf bytes.Buffer
+	_, err = cl.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "booting\n1234running\n", buf.String())
+}
@@ -37,6 +37,11 @@ func (hpv *Hypervisor) NewVirtualMachine(ctx context.Context, id string, opts *v
 		"memory_bytes", opts.Memory.ToBytes(),
 		"num_devices", len(opts.Devices))
 
+	if err := virtio.ValidateDevices(opts.Devices, bl, opts.GuestPlatform); err != nil {
+		slog.ErrorContext(ctx, "NewVirtualMachine: Invalid devices", "error", err)
+		return nil, err
+	}
+
 	cfg, vzbl, err := hpv.buildConfig(ctx, opts, bl)
 	if err != nil {
 		slog.ErrorContext(ctx, "NewVirtualMachine: Failed to build config", "error", err)
@@ -80,13 +85,7 @@ func (hpv *Hypervisor) NewVirtualMachine(ctx context.Context, id string, opts *v
 
 	slog.InfoContext(ctx, "NewVirtualMachine: vz.NewVirtualMachine completed successfully")
 
-	vm := &VirtualMachine{
-		id:            id,
-		bootLoader:    vzbl,
-		configuration: cfg,
-		vzvm:          vzVM,
-		opts:          opts,
-	}
+	vm := newVirtualMachine(id, vzVM, cfg, vzbl, opts)
 
 	hpv.mu.Lock()
 	hpv.vms[id] = vm
@@ -2,36 +2,38 @@ package vf
 
 import (
 	"context"
-	"crypto/sha256"
-	"fmt"
+	"os"
 	"path/filepath"
 
 	"github.com/Code-Hex/vz/v3"
 	"gitlab.com/tozd/go/errors"
 
-	"github.com/walteh/runm/core/virt/host"
+	"github.com/walteh/runm/core/virt/vmm"
 )
 
-const snapshotExtension = ".runm-vf-snapshot"
-
-func (v *VirtualMachine) SaveFullSnapshot(ctx context.Context, path string) error {
-
-	hash := sha256.Sum256([]byte(path))
+var _ vmm.FullSnapshotCapable = (*VirtualMachine)(nil)
 
+// SupportsFullSnapshot implements vmm.FullSnapshotCapable. Virtualization.framework
+// refuses to save machines with devices it cannot serialize.
+func (v *VirtualMachine) SupportsFullSnapshot(ctx context.Context) error {
 	if ok, err := v.configuration.ValidateSaveRestoreSupport(); err != nil {
 		return errors.Errorf("checking save/restore support: %w", err)
 	} else if !ok {
 		return errors.New("save/restore is not supported")
 	}
+	return nil
+}
 
-	cacheDir, err := host.EmphiricalVMCacheDir(ctx, v.ID())
-	if err != nil {
-		return errors.Errorf("getting cache directory: %w", err)
+func (v *VirtualMachine) SaveFullSnapshot(ctx context.Context, path string) error {
+	if err := v.SupportsFullSnapshot(ctx); err != nil {
+		return err
 	}
 
-	snapshotPath := filepath.Join(cacheDir, "snapshots", fmt.Sprintf("%x%s", hash, snapshotExtension))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Errorf("creating snapshot directory: %w", err)
+	}
 
-	if err := v.vzvm.SaveMachineStateToPath(snapshotPath); err != nil {
+	if err := v.vzvm.SaveMachineStateToPath(path); err != nil {
 		return errors.Errorf("saving snapshot: %w", err)
 	}
 
@@ -39,29 +41,20 @@ func (v *VirtualMachine) SaveFullSnapshot(ctx context.Context, path string) erro
 }
 
 func (v *VirtualMachine) RestoreFromFullSnapshot(ctx context.Context, path string) error {
-
-	if ok, err := v.configuration.ValidateSaveRestoreSupport(); err != nil {
-		return errors.Errorf("checking save/restore support: %w", err)
-	} else if !ok {
-		return errors.New("save/restore is not supported")
-	}
-
-	hash := sha256.Sum256([]byte(path))
-
-	cacheDir, err := host.EmphiricalVMCacheDir(ctx, v.ID())
-	if err != nil {
-		return errors.Errorf("getting cache directory: %w", err)
+	if err := v.SupportsFullSnapshot(ctx); err != nil {
+		return err
 	}
 
-	snapshotPath := filepath.Join(cacheDir, "snapshots", fmt.Sprintf("%x%s", hash, snapshotExtension))
-
 	if v.vzvm.State() != vz.VirtualMachineStateStopped {
 		return errors.New("cannot restore from snapshot while VM is running")
 	}
 
-	if err := v.vzvm.RestoreMachineStateFromURL(snapshotPath); err != nil {
+	if err := v.vzvm.RestoreMachineStateFromURL(path); err != nil {
 		return errors.Errorf("restoring from snapshot: %w", err)
 	}
 
+	// the machine comes back paused
+	v.syncState()
+
 	return nil
 }
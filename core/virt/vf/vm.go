@@ -20,7 +20,11 @@ import (
 type MemoryBalloonDevice struct {
 }
 
-var _ vmm.VirtualMachine = &VirtualMachine{}
+var (
+	_ vmm.VirtualMachine     = &VirtualMachine{}
+	_ vmm.StateHistoryVM     = &VirtualMachine{}
+	_ vmm.ConsoleLogAppender = &VirtualMachine{}
+)
 
 func vzStateToHypervisorState(state vz.VirtualMachineState) vmm.VirtualMachineStateType {
 	switch state {
@@ -47,6 +51,39 @@ type VirtualMachine struct {
 	configuration *vz.VirtualMachineConfiguration
 	bootLoader    vz.BootLoader
 	opts          *vmm.NewVMOptions
+
+	// states mirrors the state of vzvm, vz decides what a vm can do next and
+	// states only delivers its changes to every subscriber with a history.
+	states *vmm.StateMachine
+}
+
+func newVirtualMachine(id string, vzvm *vz.VirtualMachine, cfg *vz.VirtualMachineConfiguration, bl vz.BootLoader, opts *vmm.NewVMOptions) *VirtualMachine {
+	vm := &VirtualMachine{
+		id:            id,
+		bootLoader:    bl,
+		configuration: cfg,
+		vzvm:          vzvm,
+		opts:          opts,
+		states:        vmm.NewStateMachine(vzStateToHypervisorState(vzvm.State())),
+	}
+
+	// vz has a single notification channel, so it is read once here for everyone
+	go func() {
+		for range vzvm.StateChangedNotify() {
+			vm.syncState()
+		}
+	}()
+
+	return vm
+}
+
+// syncState moves states to the state of vzvm, which may have changed again since
+// the notification. A change the state machine rejects is logged and dropped.
+func (vm *VirtualMachine) syncState() {
+	state := vm.vzvm.State()
+	if err := vm.states.Transition(vzStateToHypervisorState(state), map[string]string{"raw_state": state.String()}); err != nil {
+		slog.Warn("ignoring vm state change", "id", vm.id, "error", err)
+	}
 }
 
 func (vm *VirtualMachine) Start(ctx context.Context) error {
@@ -69,6 +106,7 @@ func (vm *VirtualMachine) Start(ctx context.Context) error {
 	case <-timeout.C:
 		return errors.Errorf("timeout waiting for virtual machine to start")
 	case err := <-errchan:
+		vm.syncState()
 		return err
 	}
 }
@@ -150,7 +188,12 @@ func (vm *VirtualMachine) HardStop(ctx context.Context) error {
 
 // CurrentState implements vmm.VirtualMachine.
 func (vm *VirtualMachine) CurrentState() vmm.VirtualMachineStateType {
-	return vzStateToHypervisorState(vm.vzvm.State())
+	return vm.states.Current()
+}
+
+// StateHistory implements vmm.StateHistoryVM.
+func (vm *VirtualMachine) StateHistory() []vmm.StateTransition {
+	return vm.states.History()
 }
 
 // Devices implements vmm.VirtualMachine.
@@ -163,6 +206,12 @@ func (vm *VirtualMachine) ID() string {
 	return vm.id
 }
 
+// AppendsConsoleLog implements vmm.ConsoleLogAppender, the serial port attachment
+// of a VirtioSerialLogFile opens the log for appending when Append is set.
+func (vm *VirtualMachine) AppendsConsoleLog() bool {
+	return true
+}
+
 func (vm *VirtualMachine) GetVSockDevice() (*vz.VirtioSocketDevice, error) {
 	devices := vm.vzvm.SocketDevices()
 	if len(devices) == 0 {
@@ -187,26 +236,7 @@ func (vm *VirtualMachine) StartGraphicApplication(width float64, height float64)
 
 // StateChangeNotify implements vmm.VirtualMachine.
 func (vm *VirtualMachine) StateChangeNotify(ctx context.Context) <-chan vmm.VirtualMachineStateChange {
-	stateChangeNotify := make(chan vmm.VirtualMachineStateChange)
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				// slog.DebugContext(ctx, "state change notify context done")
-				return
-			case yep := <-vm.vzvm.StateChangedNotify():
-				// slog.DebugContext(ctx, "state change notify start", "state", yep)
-				stateChangeNotify <- vmm.VirtualMachineStateChange{
-					StateType: vzStateToHypervisorState(yep),
-					Metadata: map[string]string{
-						"raw_state": yep.String(),
-					},
-				}
-				// slog.DebugContext(ctx, "state change notify end", "state", yep)
-			}
-		}
-	}()
-	return stateChangeNotify
+	return vm.states.Subscribe(ctx)
 }
 
 type FormattedNSError struct {
@@ -269,19 +299,26 @@ func (vm *VirtualMachine) CanResume(_ context.Context) bool {
 	return vm.vzvm.CanResume()
 }
 
+// Pause, Resume, Stop and RequestStop sync the state as soon as vz returns, so a
+// caller does not see the state from before its own operation.
+
 func (vm *VirtualMachine) Pause(_ context.Context) error {
+	defer vm.syncState()
 	return vm.vzvm.Pause()
 }
 
 func (vm *VirtualMachine) Resume(_ context.Context) error {
+	defer vm.syncState()
 	return vm.vzvm.Resume()
 }
 
 func (vm *VirtualMachine) Stop(_ context.Context) error {
+	defer vm.syncState()
 	return vm.vzvm.Stop()
 }
 
 func (vm *VirtualMachine) RequestStop(_ context.Context) (bool, error) {
+	defer vm.syncState()
 	return vm.vzvm.RequestStop()
 }
 
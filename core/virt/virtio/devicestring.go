@@ -0,0 +1,593 @@
+package virtio
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// ErrInvalidDeviceString is returned for device strings ParseDevice cannot read,
+// and for devices DeviceString cannot write.
+var ErrInvalidDeviceString = errors.New("invalid device string")
+
+// option is one comma separated key[=value] element of a device string.
+type option struct {
+	key   string
+	value string
+}
+
+func (o option) String() string {
+	if o.value == "" {
+		return o.key
+	}
+	return o.key + "=" + o.value
+}
+
+func flagOption(key string, set bool) []option {
+	if !set {
+		return nil
+	}
+	return []option{{key: key}}
+}
+
+func valueOption(key, value string) []option {
+	if value == "" {
+		return nil
+	}
+	return []option{{key: key, value: value}}
+}
+
+func uintOption(key string, value uint64) option {
+	return option{key: key, value: strconv.FormatUint(value, 10)}
+}
+
+// ParseDevice reads a vfkit style device string, e.g.
+// "virtio-fs,sharedDir=/Users/me,mountTag=home" or "virtio-vsock,port=1024,socketURL=/tmp/vsock.sock,listen".
+// Serial ports are all "virtio-serial", the options pick the kind of console.
+func ParseDevice(s string) (VirtioDevice, error) {
+	parts := strings.Split(s, ",")
+	name := parts[0]
+
+	var options []option
+	for _, part := range parts[1:] {
+		if part == "" {
+			return nil, errors.Errorf("%q has an empty option: %w", s, ErrInvalidDeviceString)
+		}
+		key, value, _ := strings.Cut(part, "=")
+		options = append(options, option{key: key, value: value})
+	}
+
+	dev, err := deviceFromOptions(name, options)
+	if err != nil {
+		return nil, errors.Errorf("parsing %q: %w", s, err)
+	}
+	return dev, nil
+}
+
+// ParseDevices parses every string with ParseDevice.
+func ParseDevices(strs []string) ([]VirtioDevice, error) {
+	devices := make([]VirtioDevice, 0, len(strs))
+	for _, s := range strs {
+		dev, err := ParseDevice(s)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// DeviceString writes dev in the form ParseDevice reads. Open files are written
+// as their file descriptor, a VirtioSerialStdio as the stdio of the process.
+func DeviceString(dev VirtioDevice) (string, error) {
+	name, options, err := deviceOptions(dev)
+	if err != nil {
+		return "", err
+	}
+
+	parts := []string{name}
+	for _, o := range options {
+		if strings.Contains(o.key, ",") || strings.Contains(o.value, ",") {
+			return "", errors.Errorf("%s option %q contains a comma: %w", name, o, ErrInvalidDeviceString)
+		}
+		parts = append(parts, o.String())
+	}
+	return strings.Join(parts, ","), nil
+}
+
+func deviceOptions(dev VirtioDevice) (string, []option, error) {
+	switch dev := dev.(type) {
+	case *VirtioInput:
+		if err := dev.validate(); err != nil {
+			return "", nil, errors.Errorf("%s: %w", err, ErrInvalidDeviceString)
+		}
+		return "virtio-input", []option{{key: dev.InputType}}, nil
+	case *VirtioGPUResolution:
+		return "virtio-gpu-resolution", resolutionOptions(*dev), nil
+	case *VirtioGPU:
+		opts := resolutionOptions(dev.VirtioGPUResolution)
+		opts = append(opts, flagOption("gui", dev.UsesGUI)...)
+		opts = append(opts, flagOption("macos", dev.IsMacOS)...)
+		return "virtio-gpu", opts, nil
+	case *VirtioVsock:
+		opts := []option{uintOption("port", uint64(dev.Port))}
+		opts = append(opts, valueOption("socketURL", dev.SocketURL)...)
+		// listen and connect are from the host side
+		switch dev.Direction {
+		case VirtioVsockDirectionGuestConnectsAsClient:
+			opts = append(opts, option{key: "listen"})
+		case VirtioVsockDirectionGuestListensAsServer:
+			opts = append(opts, option{key: "connect"})
+		}
+		return "virtio-vsock", opts, nil
+	case *VirtioBlk:
+		opts := diskOptions(dev.DiskStorageConfig)
+		opts = append(opts, valueOption("deviceId", dev.DeviceIdentifier)...)
+		return "virtio-blk", opts, nil
+	case *DirectorySharingConfig:
+		return "directory-share", valueOption("mountTag", dev.MountTag), nil
+	case *VirtioFs:
+		opts := valueOption("sharedDir", dev.SharedDir)
+		opts = append(opts, valueOption("mountTag", dev.MountTag)...)
+		return "virtio-fs", opts, nil
+	case *RosettaShare:
+		opts := valueOption("mountTag", dev.MountTag)
+		opts = append(opts, flagOption("install", dev.InstallRosetta)...)
+		opts = append(opts, flagOption("ignore-if-missing", dev.IgnoreIfMissing)...)
+		return "rosetta", opts, nil
+	case *NVMExpressController:
+		return "nvme", diskOptions(dev.DiskStorageConfig), nil
+	case *USBMassStorage:
+		return "usb-mass-storage", diskOptions(dev.DiskStorageConfig), nil
+	case *VirtioRng:
+		return "virtio-rng", nil, nil
+	case *VirtioBalloon:
+		return "virtio-balloon", nil, nil
+	case *VirtioRootfs:
+		return "virtio-rootfs", valueOption("path", dev.ImagePath), nil
+	case *NetworkBlockDevice:
+		opts := valueOption("uri", dev.URI)
+		opts = append(opts, flagOption("readonly", dev.ReadOnly)...)
+		opts = append(opts, valueOption("deviceId", dev.DeviceIdentifier)...)
+		if dev.Timeout.Milliseconds() > 0 {
+			opts = append(opts, uintOption("timeout", uint64(dev.Timeout.Milliseconds())))
+		}
+		opts = append(opts, valueOption("sync", string(dev.SynchronizationMode))...)
+		return "nbd", opts, nil
+	case *VirtioNet:
+		opts := flagOption("nat", dev.Nat)
+		if dev.Socket != nil {
+			opts = append(opts, uintOption("fd", uint64(dev.Socket.Fd())))
+		}
+		if dev.MacAddress != nil {
+			opts = append(opts, option{key: "mac", value: dev.MacAddress.String()})
+		}
+		return "virtio-net", opts, nil
+	case *VirtioSerialLogFile:
+		opts := valueOption("logFilePath", dev.Path)
+		opts = append(opts, flagOption("append", dev.Append)...)
+		return "virtio-serial", opts, nil
+	case *VirtioSerialStdio:
+		return "virtio-serial", []option{{key: "stdio"}}, nil
+	case *VirtioSerialPty:
+		opts := []option{{key: "pty"}}
+		opts = append(opts, flagOption("systemConsole", dev.IsSystemConsole)...)
+		return "virtio-serial", opts, nil
+	case *VirtioSerialFifoFile:
+		return "virtio-serial", valueOption("fifo", dev.Path), nil
+	case *VirtioSerialFifo:
+		return "virtio-serial", []option{uintOption("fifoFd", uint64(dev.FD))}, nil
+	case *VirtioSerialStdioPipes:
+		opts := valueOption("stdin", dev.Stdin)
+		opts = append(opts, valueOption("stdout", dev.Stdout)...)
+		opts = append(opts, valueOption("stderr", dev.Stderr)...)
+		return "virtio-serial", opts, nil
+	case *VirtioSerialFDPipes:
+		return "virtio-serial", []option{
+			uintOption("stdinFd", uint64(dev.Stdin)),
+			uintOption("stdoutFd", uint64(dev.Stdout)),
+			uintOption("stderrFd", uint64(dev.Stderr)),
+		}, nil
+	default:
+		return "", nil, errors.Errorf("device %T: %w", dev, ErrUnknownKind)
+	}
+}
+
+func resolutionOptions(r VirtioGPUResolution) []option {
+	return []option{
+		uintOption(VirtioGPUResolutionWidth, uint64(r.Width)),
+		uintOption(VirtioGPUResolutionHeight, uint64(r.Height)),
+	}
+}
+
+func diskOptions(config DiskStorageConfig) []option {
+	opts := valueOption("path", config.ImagePath)
+	return append(opts, flagOption("readonly", config.ReadOnly)...)
+}
+
+func deviceFromOptions(name string, options []option) (VirtioDevice, error) {
+	switch name {
+	case "virtio-input":
+		dev := &VirtioInput{}
+		for _, option := range options {
+			switch option.key {
+			case VirtioInputPointingDevice, VirtioInputKeyboardDevice:
+				if err := noValue(name, option); err != nil {
+					return nil, err
+				}
+				dev.InputType = option.key
+			default:
+				return nil, unknownOption(name, option)
+			}
+		}
+		if err := dev.validate(); err != nil {
+			return nil, errors.Errorf("%s: %w", err, ErrInvalidDeviceString)
+		}
+		return dev, nil
+	case "virtio-gpu-resolution":
+		dev := &VirtioGPUResolution{}
+		for _, option := range options {
+			if ok, err := resolutionFromOption(name, dev, option); !ok {
+				return nil, unknownOption(name, option)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return dev, nil
+	case "virtio-gpu":
+		dev := &VirtioGPU{VirtioGPUResolution: VirtioGPUResolution{
+			Width:  defaultVirtioGPUResolutionWidth,
+			Height: defaultVirtioGPUResolutionHeight,
+		}}
+		for _, option := range options {
+			switch option.key {
+			case "gui":
+				dev.UsesGUI = true
+			case "macos":
+				dev.IsMacOS = true
+			default:
+				if ok, err := resolutionFromOption(name, &dev.VirtioGPUResolution, option); !ok {
+					return nil, unknownOption(name, option)
+				} else if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err := dev.validate(); err != nil {
+			return nil, errors.Errorf("%s: %w", err, ErrInvalidDeviceString)
+		}
+		return dev, nil
+	case "virtio-vsock":
+		dev := &VirtioVsock{}
+		for _, option := range options {
+			switch option.key {
+			case "port":
+				port, err := parseUint(name, option, 32)
+				if err != nil {
+					return nil, err
+				}
+				dev.Port = uint32(port) //#nosec G115 -- parseUint(_, _, 32) guarantees no overflow
+			case "socketURL":
+				dev.SocketURL = option.value
+			case "listen":
+				dev.Direction = VirtioVsockDirectionGuestConnectsAsClient
+			case "connect":
+				dev.Direction = VirtioVsockDirectionGuestListensAsServer
+			default:
+				return nil, unknownOption(name, option)
+			}
+		}
+		return dev, nil
+	case "virtio-blk":
+		dev := virtioBlkNewEmpty()
+		for _, option := range options {
+			switch option.key {
+			case "deviceId":
+				dev.DeviceIdentifier = option.value
+			default:
+				if ok, err := diskFromOption(name, &dev.DiskStorageConfig, option); !ok {
+					return nil, unknownOption(name, option)
+				} else if err != nil {
+					return nil, err
+				}
+			}
+		}
+		return dev, requireOption(name, "path", dev.ImagePath)
+	case "nvme", "usb-mass-storage":
+		var config *DiskStorageConfig
+		var dev VirtioDevice
+		if name == "nvme" {
+			nvme := nvmExpressControllerNewEmpty()
+			config, dev = &nvme.DiskStorageConfig, nvme
+		} else {
+			usb := usbMassStorageNewEmpty()
+			config, dev = &usb.DiskStorageConfig, usb
+		}
+		for _, option := range options {
+			if ok, err := diskFromOption(name, config, option); !ok {
+				return nil, unknownOption(name, option)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return dev, requireOption(name, "path", config.ImagePath)
+	case "directory-share":
+		dev := &DirectorySharingConfig{}
+		for _, option := range options {
+			switch option.key {
+			case "mountTag":
+				dev.MountTag = option.value
+			default:
+				return nil, unknownOption(name, option)
+			}
+		}
+		return dev, requireOption(name, "mountTag", dev.MountTag)
+	case "virtio-fs":
+		dev := &VirtioFs{}
+		for _, option := range options {
+			switch option.key {
+			case "sharedDir":
+				dev.SharedDir = option.value
+			case "mountTag":
+				dev.MountTag = option.value
+			default:
+				return nil, unknownOption(name, option)
+			}
+		}
+		return dev, requireOption(name, "sharedDir", dev.SharedDir)
+	case "rosetta":
+		dev := &RosettaShare{}
+		for _, option := range options {
+			switch option.key {
+			case "mountTag":
+				dev.MountTag = option.value
+			case "install":
+				dev.InstallRosetta = true
+			case "ignore-if-missing":
+				dev.IgnoreIfMissing = true
+			default:
+				return nil, unknownOption(name, option)
+			}
+		}
+		return dev, requireOption(name, "mountTag", dev.MountTag)
+	case "virtio-rng", "virtio-balloon":
+		if len(options) > 0 {
+			return nil, unknownOption(name, options[0])
+		}
+		if name == "virtio-rng" {
+			return &VirtioRng{}, nil
+		}
+		return &VirtioBalloon{}, nil
+	case "virtio-rootfs":
+		dev := &VirtioRootfs{}
+		for _, option := range options {
+			switch option.key {
+			case "path":
+				dev.ImagePath = option.value
+			default:
+				return nil, unknownOption(name, option)
+			}
+		}
+		return dev, requireOption(name, "path", dev.ImagePath)
+	case "nbd":
+		dev := networkBlockDeviceNewEmpty()
+		for _, option := range options {
+			switch option.key {
+			case "uri":
+				dev.URI = option.value
+			case "readonly":
+				if err := noValue(name, option); err != nil {
+					return nil, err
+				}
+				dev.ReadOnly = true
+			case "deviceId":
+				dev.DeviceIdentifier = option.value
+			case "timeout":
+				timeoutMS, err := parseUint(name, option, 32)
+				if err != nil {
+					return nil, err
+				}
+				dev.Timeout = time.Duration(timeoutMS) * time.Millisecond
+			case "sync":
+				switch NBDSynchronizationMode(option.value) {
+				case SynchronizationFullMode, SynchronizationNoneMode:
+					dev.SynchronizationMode = NBDSynchronizationMode(option.value)
+				default:
+					return nil, errors.Errorf("invalid nbd sync mode %q, must be 'full' or 'none': %w", option.value, ErrInvalidDeviceString)
+				}
+			default:
+				return nil, unknownOption(name, option)
+			}
+		}
+		return dev, requireOption(name, "uri", dev.URI)
+	case "virtio-net":
+		dev := &VirtioNet{}
+		fd := -1
+		for _, option := range options {
+			switch option.key {
+			case "nat":
+				dev.Nat = true
+			case "mac":
+				mac, err := net.ParseMAC(option.value)
+				if err != nil {
+					return nil, errors.Errorf("%s: %w", err, ErrInvalidDeviceString)
+				}
+				dev.MacAddress = mac
+			case "fd":
+				v, err := parseUint(name, option, 31)
+				if err != nil {
+					return nil, err
+				}
+				fd = int(v)
+			default:
+				return nil, unknownOption(name, option)
+			}
+		}
+		if dev.Nat && fd >= 0 {
+			return nil, errors.Errorf("virtio-net 'nat' and 'fd' cannot be set at the same time: %w", ErrInvalidDeviceString)
+		}
+		if fd >= 0 {
+			dev.Socket = os.NewFile(uintptr(fd), "virtio-net")
+		}
+		return dev, nil
+	case "virtio-serial":
+		return serialFromOptions(options)
+	default:
+		return nil, errors.Errorf("device %q: %w", name, ErrUnknownKind)
+	}
+}
+
+// serialFromOptions picks the serial device type from the first option.
+func serialFromOptions(options []option) (VirtioDevice, error) {
+	const name = "virtio-serial"
+	if len(options) == 0 {
+		return nil, errors.Errorf("virtio-serial needs one of 'logFilePath', 'stdio', 'pty', 'fifo', 'fifoFd', 'stdin' or 'stdinFd': %w", ErrInvalidDeviceString)
+	}
+
+	switch options[0].key {
+	case "logFilePath":
+		dev := &VirtioSerialLogFile{}
+		for _, option := range options {
+			switch option.key {
+			case "logFilePath":
+				dev.Path = option.value
+			case "append":
+				dev.Append = true
+			default:
+				return nil, unknownOption(name, option)
+			}
+		}
+		return dev, requireOption(name, "logFilePath", dev.Path)
+	case "stdio":
+		if len(options) > 1 {
+			return nil, unknownOption(name, options[1])
+		}
+		return &VirtioSerialStdio{Stdin: os.Stdin, Stdout: os.Stdout}, nil
+	case "pty":
+		dev := &VirtioSerialPty{}
+		for _, option := range options[1:] {
+			switch option.key {
+			case "systemConsole":
+				dev.IsSystemConsole = true
+			default:
+				return nil, unknownOption(name, option)
+			}
+		}
+		return dev, nil
+	case "fifo":
+		if len(options) > 1 {
+			return nil, unknownOption(name, options[1])
+		}
+		return &VirtioSerialFifoFile{Path: options[0].value}, requireOption(name, "fifo", options[0].value)
+	case "fifoFd":
+		if len(options) > 1 {
+			return nil, unknownOption(name, options[1])
+		}
+		fd, err := parseUint(name, options[0], 32)
+		if err != nil {
+			return nil, err
+		}
+		return &VirtioSerialFifo{FD: uintptr(fd)}, nil
+	case "stdin", "stdout", "stderr":
+		dev := &VirtioSerialStdioPipes{}
+		for _, option := range options {
+			switch option.key {
+			case "stdin":
+				dev.Stdin = option.value
+			case "stdout":
+				dev.Stdout = option.value
+			case "stderr":
+				dev.Stderr = option.value
+			default:
+				return nil, unknownOption(name, option)
+			}
+		}
+		return dev, nil
+	case "stdinFd", "stdoutFd", "stderrFd":
+		dev := &VirtioSerialFDPipes{}
+		for _, option := range options {
+			var fd *uintptr
+			switch option.key {
+			case "stdinFd":
+				fd = &dev.Stdin
+			case "stdoutFd":
+				fd = &dev.Stdout
+			case "stderrFd":
+				fd = &dev.Stderr
+			default:
+				return nil, unknownOption(name, option)
+			}
+			v, err := parseUint(name, option, 32)
+			if err != nil {
+				return nil, err
+			}
+			*fd = uintptr(v)
+		}
+		return dev, nil
+	default:
+		return nil, unknownOption(name, options[0])
+	}
+}
+
+func resolutionFromOption(name string, r *VirtioGPUResolution, option option) (bool, error) {
+	var dim *int
+	switch option.key {
+	case VirtioGPUResolutionWidth:
+		dim = &r.Width
+	case VirtioGPUResolutionHeight:
+		dim = &r.Height
+	default:
+		return false, nil
+	}
+	v, err := parseUint(name, option, 31)
+	if err != nil {
+		return true, err
+	}
+	*dim = int(v)
+	return true, nil
+}
+
+func diskFromOption(name string, config *DiskStorageConfig, option option) (bool, error) {
+	switch option.key {
+	case "path":
+		config.ImagePath = option.value
+	case "readonly":
+		if err := noValue(name, option); err != nil {
+			return true, err
+		}
+		config.ReadOnly = true
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func parseUint(name string, option option, bitSize int) (uint64, error) {
+	v, err := strconv.ParseUint(option.value, 10, bitSize)
+	if err != nil {
+		return 0, errors.Errorf("invalid value for %s '%s' option %q: %w", name, option.key, option.value, ErrInvalidDeviceString)
+	}
+	return v, nil
+}
+
+func noValue(name string, option option) error {
+	if option.value != "" {
+		return errors.Errorf("unexpected value for %s '%s' option: %s: %w", name, option.key, option.value, ErrInvalidDeviceString)
+	}
+	return nil
+}
+
+func requireOption(name, key, value string) error {
+	if value == "" {
+		return errors.Errorf("%s devices need a '%s' option: %w", name, key, ErrInvalidDeviceString)
+	}
+	return nil
+}
+
+func unknownOption(name string, option option) error {
+	return errors.Errorf("unknown option for %s devices: %s: %w", name, option.key, ErrInvalidDeviceString)
+}
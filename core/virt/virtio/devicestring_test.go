@@ -0,0 +1,130 @@
+package virtio_test
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/virt/virtio"
+)
+
+func TestDeviceStringRoundTrip(t *testing.T) {
+	mac, err := net.ParseMAC("52:54:00:12:34:56")
+	require.NoError(t, err)
+
+	// device unwraps the results of the virtio constructors
+	device := func(dev virtio.VirtioDevice, err error) virtio.VirtioDevice {
+		t.Helper()
+		require.NoError(t, err)
+		return dev
+	}
+
+	blk := device(virtio.VirtioBlkNew("/tmp/disk.img")).(*virtio.VirtioBlk)
+	blk.SetDeviceIdentifier("root")
+
+	usb := device(virtio.USBMassStorageNew("/tmp/usb.iso")).(*virtio.USBMassStorage)
+	usb.SetReadOnly(true)
+
+	gpu := device(virtio.VirtioGPUNew()).(*virtio.VirtioGPU)
+	gpu.UsesGUI = true
+
+	tests := []struct {
+		str string
+		dev virtio.VirtioDevice
+	}{
+		{"virtio-input,keyboard", device(virtio.VirtioInputNew(virtio.VirtioInputKeyboardDevice))},
+		{"virtio-gpu-resolution,width=1024,height=768", &virtio.VirtioGPUResolution{Width: 1024, Height: 768}},
+		{"virtio-gpu,width=800,height=600,gui", gpu},
+		{"virtio-vsock,port=1024,socketURL=/tmp/vsock.sock,listen", device(virtio.VirtioVsockNew(1024, "/tmp/vsock.sock", true))},
+		{"virtio-vsock,port=1025,socketURL=/tmp/vsock.sock,connect", device(virtio.VirtioVsockNew(1025, "/tmp/vsock.sock", false))},
+		{"virtio-vsock,port=0", &virtio.VirtioVsock{}},
+		{"virtio-blk,path=/tmp/disk.img,deviceId=root", blk},
+		{"directory-share,mountTag=share", &virtio.DirectorySharingConfig{MountTag: "share"}},
+		{"virtio-fs,sharedDir=/Users/me,mountTag=home", device(virtio.VirtioFsNew("/Users/me", "home"))},
+		{"rosetta,mountTag=rosetta,install,ignore-if-missing", &virtio.RosettaShare{
+			DirectorySharingConfig: virtio.DirectorySharingConfig{MountTag: "rosetta"},
+			InstallRosetta:         true,
+			IgnoreIfMissing:        true,
+		}},
+		{"nvme,path=/tmp/nvme.img", device(virtio.NVMExpressControllerNew("/tmp/nvme.img"))},
+		{"usb-mass-storage,path=/tmp/usb.iso,readonly", usb},
+		{"virtio-rng", device(virtio.VirtioRngNew())},
+		{"virtio-balloon", device(virtio.VirtioBalloonNew())},
+		{"virtio-rootfs,path=/tmp/rootfs.img", device(virtio.VirtioRootfsNew("/tmp/rootfs.img"))},
+		{"nbd,uri=nbd://localhost:10809/disk,timeout=5000,sync=none", device(virtio.NetworkBlockDeviceNew("nbd://localhost:10809/disk", 5000, virtio.SynchronizationNoneMode))},
+		{"virtio-net,nat,mac=52:54:00:12:34:56", &virtio.VirtioNet{Nat: true, MacAddress: mac}},
+		{"virtio-serial,logFilePath=/tmp/console.log,append", &virtio.VirtioSerialLogFile{Path: "/tmp/console.log", Append: true}},
+		{"virtio-serial,stdio", &virtio.VirtioSerialStdio{Stdin: os.Stdin, Stdout: os.Stdout}},
+		{"virtio-serial,pty,systemConsole", &virtio.VirtioSerialPty{IsSystemConsole: true}},
+		{"virtio-serial,fifo=/tmp/console.fifo", &virtio.VirtioSerialFifoFile{Path: "/tmp/console.fifo"}},
+		{"virtio-serial,fifoFd=3", &virtio.VirtioSerialFifo{FD: 3}},
+		{"virtio-serial,stdin=/tmp/in,stdout=/tmp/out,stderr=/tmp/err", &virtio.VirtioSerialStdioPipes{Stdin: "/tmp/in", Stdout: "/tmp/out", Stderr: "/tmp/err"}},
+		{"virtio-serial,stdinFd=3,stdoutFd=4,stderrFd=5", &virtio.VirtioSerialFDPipes{Stdin: 3, Stdout: 4, Stderr: 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.str, func(t *testing.T) {
+			dev, err := virtio.ParseDevice(tt.str)
+			require.NoError(t, err)
+			assert.Equal(t, tt.dev, dev)
+
+			str, err := virtio.DeviceString(tt.dev)
+			require.NoError(t, err)
+			assert.Equal(t, tt.str, str)
+		})
+	}
+}
+
+func TestParseDeviceDefaults(t *testing.T) {
+	dev, err := virtio.ParseDevice("nbd,uri=nbd://localhost/disk")
+	require.NoError(t, err)
+	nbd := dev.(*virtio.NetworkBlockDevice)
+	assert.Equal(t, 15*time.Second, nbd.Timeout)
+	assert.Equal(t, virtio.SynchronizationFullMode, nbd.SynchronizationMode)
+
+	gpu, err := virtio.VirtioGPUNew()
+	require.NoError(t, err)
+	dev, err = virtio.ParseDevice("virtio-gpu")
+	require.NoError(t, err)
+	assert.Equal(t, gpu, dev)
+}
+
+func TestParseDeviceErrors(t *testing.T) {
+	tests := []struct {
+		str  string
+		want error
+	}{
+		{"floppy,path=/tmp/a.img", virtio.ErrUnknownKind},
+		{"virtio-fs,mountTag=home", virtio.ErrInvalidDeviceString},
+		{"virtio-fs,sharedDir=/tmp,size=1", virtio.ErrInvalidDeviceString},
+		{"virtio-fs,,sharedDir=/tmp", virtio.ErrInvalidDeviceString},
+		{"virtio-vsock,port=-1", virtio.ErrInvalidDeviceString},
+		{"virtio-blk,readonly=yes,path=/tmp/a.img", virtio.ErrInvalidDeviceString},
+		{"virtio-input,joystick", virtio.ErrInvalidDeviceString},
+		{"virtio-gpu,width=0", virtio.ErrInvalidDeviceString},
+		{"nbd,uri=nbd://localhost/disk,sync=some", virtio.ErrInvalidDeviceString},
+		{"virtio-net,mac=zz", virtio.ErrInvalidDeviceString},
+		{"virtio-net,nat,fd=3", virtio.ErrInvalidDeviceString},
+		{"virtio-serial", virtio.ErrInvalidDeviceString},
+		{"virtio-serial,stdio,pty", virtio.ErrInvalidDeviceString},
+		{"virtio-rng,seed=1", virtio.ErrInvalidDeviceString},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.str, func(t *testing.T) {
+			_, err := virtio.ParseDevice(tt.str)
+			require.ErrorIs(t, err, tt.want)
+		})
+	}
+}
+
+func TestDeviceStringComma(t *testing.T) {
+	fs, err := virtio.VirtioFsNew("/tmp/a,b", "share")
+	require.NoError(t, err)
+	_, err = virtio.DeviceString(fs)
+	require.ErrorIs(t, err, virtio.ErrInvalidDeviceString)
+}
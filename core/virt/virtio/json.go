@@ -0,0 +1,211 @@
+package virtio
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// ErrUnknownKind is returned when a serialized device or bootloader names a kind
+// this package does not know.
+var ErrUnknownKind = errors.New("unknown kind")
+
+// devices and bootloaders are serialized as their own json object with an added
+// "kind" field naming the concrete type.
+const kindField = "kind"
+
+var deviceKinds = map[string]func() VirtioDevice{
+	"virtio-input":          func() VirtioDevice { return &VirtioInput{} },
+	"virtio-gpu-resolution": func() VirtioDevice { return &VirtioGPUResolution{} },
+	"virtio-gpu":            func() VirtioDevice { return &VirtioGPU{} },
+	"virtio-vsock":          func() VirtioDevice { return &VirtioVsock{} },
+	"virtio-blk":            func() VirtioDevice { return &VirtioBlk{} },
+	"directory-share":       func() VirtioDevice { return &DirectorySharingConfig{} },
+	"virtio-fs":             func() VirtioDevice { return &VirtioFs{} },
+	"rosetta":               func() VirtioDevice { return &RosettaShare{} },
+	"nvme":                  func() VirtioDevice { return &NVMExpressController{} },
+	"virtio-rng":            func() VirtioDevice { return &VirtioRng{} },
+	"serial-fifo":           func() VirtioDevice { return &VirtioSerialFifo{} },
+	"serial-fifo-file":      func() VirtioDevice { return &VirtioSerialFifoFile{} },
+	"serial-stdio":          func() VirtioDevice { return &VirtioSerialStdio{} },
+	"serial-stdio-pipes":    func() VirtioDevice { return &VirtioSerialStdioPipes{} },
+	"serial-fd-pipes":       func() VirtioDevice { return &VirtioSerialFDPipes{} },
+	"serial-pty":            func() VirtioDevice { return &VirtioSerialPty{} },
+	"serial-log-file":       func() VirtioDevice { return &VirtioSerialLogFile{} },
+	"nbd":                   func() VirtioDevice { return &NetworkBlockDevice{} },
+	"virtio-balloon":        func() VirtioDevice { return &VirtioBalloon{} },
+	"usb-mass-storage":      func() VirtioDevice { return &USBMassStorage{} },
+	"virtio-net":            func() VirtioDevice { return &VirtioNet{} },
+	"virtio-rootfs":         func() VirtioDevice { return &VirtioRootfs{} },
+}
+
+var bootloaderKinds = map[string]func() Bootloader{
+	"linux": func() Bootloader { return &LinuxBootloader{} },
+	"efi":   func() Bootloader { return &EFIBootloader{} },
+	"macos": func() Bootloader { return &MacOSBootloader{} },
+}
+
+var (
+	deviceKindsByType     = kindsByType(deviceKinds)
+	bootloaderKindsByType = kindsByType(bootloaderKinds)
+)
+
+func kindsByType[T any](kinds map[string]func() T) map[reflect.Type]string {
+	byType := make(map[reflect.Type]string, len(kinds))
+	for kind, newT := range kinds {
+		byType[reflect.TypeOf(newT())] = kind
+	}
+	return byType
+}
+
+// DeviceKind returns the name dev is serialized under.
+func DeviceKind(dev VirtioDevice) (string, error) {
+	kind, ok := deviceKindsByType[reflect.TypeOf(dev)]
+	if !ok {
+		return "", errors.Errorf("device %T: %w", dev, ErrUnknownKind)
+	}
+	return kind, nil
+}
+
+// MarshalDevice encodes dev as a json object with a "kind" field. Open files
+// held by a device, like the socket of a VirtioNet, are left out.
+func MarshalDevice(dev VirtioDevice) ([]byte, error) {
+	kind, err := DeviceKind(dev)
+	if err != nil {
+		return nil, err
+	}
+	return marshalKind(kind, dev)
+}
+
+// UnmarshalDevice decodes a device encoded by MarshalDevice.
+func UnmarshalDevice(data []byte) (VirtioDevice, error) {
+	kind, err := readKind(data)
+	if err != nil {
+		return nil, err
+	}
+	newDev, ok := deviceKinds[kind]
+	if !ok {
+		return nil, errors.Errorf("device %q: %w", kind, ErrUnknownKind)
+	}
+	dev := newDev()
+	if err := json.Unmarshal(data, dev); err != nil {
+		return nil, errors.Errorf("unmarshalling %s device: %w", kind, err)
+	}
+	return dev, nil
+}
+
+// MarshalBootloader encodes bl as a json object with a "kind" field.
+func MarshalBootloader(bl Bootloader) ([]byte, error) {
+	kind, ok := bootloaderKindsByType[reflect.TypeOf(bl)]
+	if !ok {
+		return nil, errors.Errorf("bootloader %T: %w", bl, ErrUnknownKind)
+	}
+	return marshalKind(kind, bl)
+}
+
+// UnmarshalBootloader decodes a bootloader encoded by MarshalBootloader.
+func UnmarshalBootloader(data []byte) (Bootloader, error) {
+	kind, err := readKind(data)
+	if err != nil {
+		return nil, err
+	}
+	newBl, ok := bootloaderKinds[kind]
+	if !ok {
+		return nil, errors.Errorf("bootloader %q: %w", kind, ErrUnknownKind)
+	}
+	bl := newBl()
+	if err := json.Unmarshal(data, bl); err != nil {
+		return nil, errors.Errorf("unmarshalling %s bootloader: %w", kind, err)
+	}
+	return bl, nil
+}
+
+func (v VirtioDevices) MarshalJSON() ([]byte, error) {
+	raw := make([]json.RawMessage, len(v))
+	for i, dev := range v {
+		data, err := MarshalDevice(dev)
+		if err != nil {
+			return nil, err
+		}
+		raw[i] = data
+	}
+	return json.Marshal(raw)
+}
+
+func (v *VirtioDevices) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return errors.Errorf("unmarshalling devices: %w", err)
+	}
+	devices := make(VirtioDevices, len(raw))
+	for i, r := range raw {
+		dev, err := UnmarshalDevice(r)
+		if err != nil {
+			return errors.Errorf("device %d: %w", i, err)
+		}
+		devices[i] = dev
+	}
+	*v = devices
+	return nil
+}
+
+type virtioNetJSON struct {
+	Nat        bool   `json:"nat"`
+	MacAddress string `json:"macAddress,omitempty"`
+}
+
+func (v *VirtioNet) MarshalJSON() ([]byte, error) {
+	j := virtioNetJSON{Nat: v.Nat}
+	if v.MacAddress != nil {
+		j.MacAddress = v.MacAddress.String()
+	}
+	return json.Marshal(j)
+}
+
+func (v *VirtioNet) UnmarshalJSON(data []byte) error {
+	j := virtioNetJSON{}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	v.Nat = j.Nat
+	v.MacAddress = nil
+	if j.MacAddress != "" {
+		mac, err := net.ParseMAC(j.MacAddress)
+		if err != nil {
+			return errors.Errorf("parsing mac address: %w", err)
+		}
+		v.MacAddress = mac
+	}
+	return nil
+}
+
+func marshalKind(kind string, v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Errorf("marshalling %s: %w", kind, err)
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, errors.Errorf("marshalling %s: %w", kind, err)
+	}
+	if _, ok := fields[kindField]; ok {
+		return nil, errors.Errorf("%s has its own %q field", kind, kindField)
+	}
+	fields[kindField], _ = json.Marshal(kind)
+	return json.Marshal(fields)
+}
+
+func readKind(data []byte) (string, error) {
+	var k struct {
+		Kind string `json:"kind"`
+	}
+	if err := json.Unmarshal(data, &k); err != nil {
+		return "", errors.Errorf("reading kind: %w", err)
+	}
+	if k.Kind == "" {
+		return "", errors.Errorf("missing %q field", kindField)
+	}
+	return k.Kind, nil
+}
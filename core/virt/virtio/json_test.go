@@ -0,0 +1,85 @@
+package virtio_test
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/virt/virtio"
+)
+
+func TestDevicesRoundTrip(t *testing.T) {
+	mac, err := net.ParseMAC("52:54:00:12:34:56")
+	require.NoError(t, err)
+
+	disk := virtio.DiskStorageConfig{StorageConfig: virtio.StorageConfig{DevName: "virtio-blk", ReadOnly: true}, ImagePath: "/tmp/disk.img"}
+
+	devices := virtio.VirtioDevices{
+		&virtio.VirtioInput{InputType: virtio.VirtioInputKeyboardDevice},
+		&virtio.VirtioGPUResolution{Width: 800, Height: 600},
+		&virtio.VirtioGPU{UsesGUI: true, VirtioGPUResolution: virtio.VirtioGPUResolution{Width: 1024, Height: 768}},
+		&virtio.VirtioVsock{Port: 1024, SocketURL: "/tmp/vsock.sock", Direction: virtio.VirtioVsockDirectionGuestConnectsAsClient},
+		&virtio.VirtioBlk{DiskStorageConfig: disk, DeviceIdentifier: "root"},
+		&virtio.DirectorySharingConfig{MountTag: "share"},
+		&virtio.VirtioFs{DirectorySharingConfig: virtio.DirectorySharingConfig{MountTag: "rootfs"}, SharedDir: "/tmp/rootfs"},
+		&virtio.RosettaShare{DirectorySharingConfig: virtio.DirectorySharingConfig{MountTag: "rosetta"}, InstallRosetta: true},
+		&virtio.NVMExpressController{DiskStorageConfig: disk},
+		&virtio.VirtioRng{},
+		&virtio.VirtioSerialFifo{FD: 3},
+		&virtio.VirtioSerialFifoFile{Path: "/tmp/fifo"},
+		&virtio.VirtioSerialStdio{},
+		&virtio.VirtioSerialStdioPipes{Stdin: "/tmp/in", Stdout: "/tmp/out", Stderr: "/tmp/err"},
+		&virtio.VirtioSerialFDPipes{Stdin: 3, Stdout: 4, Stderr: 5},
+		&virtio.VirtioSerialPty{IsSystemConsole: true},
+		&virtio.VirtioSerialLogFile{Path: "/tmp/console.log", Append: true},
+		&virtio.NetworkBlockDevice{
+			NetworkBlockStorageConfig: virtio.NetworkBlockStorageConfig{URI: "nbd://localhost:10809/disk"},
+			DeviceIdentifier:          "nbd0",
+			Timeout:                   5 * time.Second,
+			SynchronizationMode:       virtio.SynchronizationFullMode,
+		},
+		&virtio.VirtioBalloon{},
+		&virtio.USBMassStorage{DiskStorageConfig: disk},
+		&virtio.VirtioNet{Nat: true, MacAddress: mac},
+		&virtio.VirtioRootfs{ImagePath: "/tmp/rootfs.img"},
+	}
+
+	data, err := json.Marshal(devices)
+	require.NoError(t, err)
+
+	var decoded virtio.VirtioDevices
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, devices, decoded)
+
+	var raw []map[string]any
+	require.NoError(t, json.Unmarshal(data, &raw))
+	assert.Equal(t, "virtio-vsock", raw[3]["kind"])
+	assert.Equal(t, "52:54:00:12:34:56", raw[20]["macAddress"])
+}
+
+func TestUnmarshalDeviceUnknownKind(t *testing.T) {
+	_, err := virtio.UnmarshalDevice([]byte(`{"kind":"floppy"}`))
+	require.ErrorIs(t, err, virtio.ErrUnknownKind)
+
+	_, err = virtio.UnmarshalDevice([]byte(`{"path":"/tmp/console.log"}`))
+	require.Error(t, err)
+}
+
+func TestBootloaderRoundTrip(t *testing.T) {
+	for _, bl := range []virtio.Bootloader{
+		&virtio.LinuxBootloader{VmlinuzPath: "/boot/vmlinuz", InitrdPath: "/boot/initrd", KernelCmdLine: "console=hvc0"},
+		virtio.NewEFIBootloader("/tmp/efi", true),
+		&virtio.MacOSBootloader{AuxImagePath: "/tmp/aux"},
+	} {
+		data, err := virtio.MarshalBootloader(bl)
+		require.NoError(t, err)
+
+		decoded, err := virtio.UnmarshalBootloader(data)
+		require.NoError(t, err)
+		assert.Equal(t, bl, decoded)
+	}
+}
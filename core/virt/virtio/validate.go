@@ -0,0 +1,144 @@
+package virtio
+
+import (
+	"os"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/pkg/units"
+)
+
+var (
+	ErrDuplicateMountTag          = errors.New("duplicate mount tag")
+	ErrMultipleVsockDevices       = errors.New("more than one vsock device")
+	ErrConflictingConsoles        = errors.New("conflicting serial consoles")
+	ErrMissingSharedDirectory     = errors.New("missing shared directory")
+	ErrUnreadableDiskImage        = errors.New("unreadable disk image")
+	ErrBootloaderPlatformMismatch = errors.New("bootloader does not match the guest platform")
+)
+
+// DeviceSetError lists every problem ValidateDevices found, each wraps one of the
+// Err* values of this package.
+type DeviceSetError struct {
+	Problems []error
+}
+
+func (e *DeviceSetError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.Error()
+	}
+	return "invalid virtual machine devices: " + strings.Join(msgs, "; ")
+}
+
+func (e *DeviceSetError) Unwrap() []error {
+	return e.Problems
+}
+
+// ValidateDevices checks a device set before it is handed to a hypervisor, which
+// would otherwise fail on the first bad device or not at all. An empty platform
+// skips the bootloader check. All problems are returned at once as a
+// *DeviceSetError.
+func ValidateDevices(devices []VirtioDevice, bl Bootloader, platform units.Platform) error {
+	var problems []error
+
+	tags := map[string]bool{}
+	checkTag := func(tag string) {
+		if tags[tag] {
+			problems = append(problems, errors.Errorf("mount tag %q: %w", tag, ErrDuplicateMountTag))
+		}
+		tags[tag] = true
+	}
+
+	checkDisk := func(kind string, path string) {
+		if path == "" {
+			problems = append(problems, errors.Errorf("%s has no image path: %w", kind, ErrUnreadableDiskImage))
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			problems = append(problems, errors.Errorf("%s %s: %w", kind, path, errors.Join(ErrUnreadableDiskImage, err)))
+			return
+		}
+		f.Close()
+	}
+
+	var vsocks int
+	var consoles []string
+
+	for _, dev := range devices {
+		switch dev := dev.(type) {
+		case *VirtioFs:
+			checkTag(dev.MountTag)
+			if info, err := os.Stat(dev.SharedDir); err != nil {
+				problems = append(problems, errors.Errorf("shared directory of %q: %w", dev.MountTag, errors.Join(ErrMissingSharedDirectory, err)))
+			} else if !info.IsDir() {
+				problems = append(problems, errors.Errorf("shared directory of %q, %s is not a directory: %w", dev.MountTag, dev.SharedDir, ErrMissingSharedDirectory))
+			}
+		case *RosettaShare:
+			checkTag(dev.MountTag)
+		case *VirtioBlk:
+			checkDisk("disk", dev.ImagePath)
+		case *NVMExpressController:
+			checkDisk("nvme disk", dev.ImagePath)
+		case *USBMassStorage:
+			checkDisk("usb disk", dev.ImagePath)
+		case *VirtioVsock:
+			vsocks++
+		case *VirtioSerialLogFile:
+			consoles = append(consoles, "log file "+dev.Path)
+		case *VirtioSerialStdio:
+			consoles = append(consoles, "stdio")
+		case *VirtioSerialStdioPipes:
+			consoles = append(consoles, "stdio pipes")
+		case *VirtioSerialFDPipes:
+			consoles = append(consoles, "fd pipes")
+		case *VirtioSerialFifo:
+			consoles = append(consoles, "fifo")
+		case *VirtioSerialFifoFile:
+			consoles = append(consoles, "fifo "+dev.Path)
+		case *VirtioSerialPty:
+			if dev.IsSystemConsole {
+				consoles = append(consoles, "pty")
+			}
+		}
+	}
+
+	if vsocks > 1 {
+		problems = append(problems, errors.Errorf("%d vsock devices: %w", vsocks, ErrMultipleVsockDevices))
+	}
+
+	if len(consoles) > 1 {
+		problems = append(problems, errors.Errorf("%s: %w", strings.Join(consoles, ", "), ErrConflictingConsoles))
+	}
+
+	if err := validateBootloader(bl, platform); err != nil {
+		problems = append(problems, err)
+	}
+
+	if len(problems) > 0 {
+		return &DeviceSetError{Problems: problems}
+	}
+	return nil
+}
+
+func validateBootloader(bl Bootloader, platform units.Platform) error {
+	if platform == "" {
+		return nil
+	}
+	switch bl := bl.(type) {
+	case *LinuxBootloader:
+		if platform.OS() != "linux" {
+			return errors.Errorf("linux kernel for a %s guest: %w", platform, ErrBootloaderPlatformMismatch)
+		}
+		if bl.VmlinuzPath == "" {
+			return errors.Errorf("linux bootloader has no kernel: %w", ErrBootloaderPlatformMismatch)
+		}
+	case *MacOSBootloader:
+		if platform != units.PlatformDarwinARM64 {
+			return errors.Errorf("macos bootloader for a %s guest: %w", platform, ErrBootloaderPlatformMismatch)
+		}
+	}
+	return nil
+}
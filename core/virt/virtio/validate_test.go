@@ -0,0 +1,126 @@
+package virtio_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/pkg/units"
+)
+
+func TestValidateDevices(t *testing.T) {
+	dir := t.TempDir()
+	disk := filepath.Join(dir, "disk.img")
+	require.NoError(t, os.WriteFile(disk, []byte("disk"), 0600))
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0600))
+
+	linux := &virtio.LinuxBootloader{VmlinuzPath: "/boot/vmlinuz"}
+
+	share := func(tag, path string) *virtio.VirtioFs {
+		return &virtio.VirtioFs{
+			DirectorySharingConfig: virtio.DirectorySharingConfig{MountTag: tag},
+			SharedDir:              path,
+		}
+	}
+	blk := func(path string) *virtio.VirtioBlk {
+		return &virtio.VirtioBlk{DiskStorageConfig: virtio.DiskStorageConfig{ImagePath: path}}
+	}
+
+	tests := []struct {
+		name     string
+		devices  []virtio.VirtioDevice
+		bl       virtio.Bootloader
+		platform units.Platform
+		want     []error
+	}{
+		{
+			name: "valid",
+			devices: []virtio.VirtioDevice{
+				share("rootfs", dir),
+				blk(disk),
+				&virtio.VirtioVsock{},
+				&virtio.VirtioSerialLogFile{Path: filepath.Join(dir, "console.log")},
+				&virtio.VirtioSerialPty{},
+			},
+			bl:       linux,
+			platform: units.PlatformLinuxARM64,
+		},
+		{
+			name:    "duplicate mount tags",
+			devices: []virtio.VirtioDevice{share("rootfs", dir), &virtio.RosettaShare{DirectorySharingConfig: virtio.DirectorySharingConfig{MountTag: "rootfs"}}},
+			bl:      linux,
+			want:    []error{virtio.ErrDuplicateMountTag},
+		},
+		{
+			name:    "two vsock devices",
+			devices: []virtio.VirtioDevice{&virtio.VirtioVsock{}, &virtio.VirtioVsock{Port: 1024}},
+			bl:      linux,
+			want:    []error{virtio.ErrMultipleVsockDevices},
+		},
+		{
+			name:    "two consoles",
+			devices: []virtio.VirtioDevice{&virtio.VirtioSerialStdio{}, &virtio.VirtioSerialPty{IsSystemConsole: true}},
+			bl:      linux,
+			want:    []error{virtio.ErrConflictingConsoles},
+		},
+		{
+			name:    "shared directory is a file",
+			devices: []virtio.VirtioDevice{share("rootfs", file)},
+			bl:      linux,
+			want:    []error{virtio.ErrMissingSharedDirectory},
+		},
+		{
+			name:    "missing disk image",
+			devices: []virtio.VirtioDevice{blk(filepath.Join(dir, "missing.img"))},
+			bl:      linux,
+			want:    []error{virtio.ErrUnreadableDiskImage},
+		},
+		{
+			name:     "macos bootloader for a linux guest",
+			bl:       &virtio.MacOSBootloader{},
+			platform: units.PlatformLinuxARM64,
+			want:     []error{virtio.ErrBootloaderPlatformMismatch},
+		},
+		{
+			name: "all problems at once",
+			devices: []virtio.VirtioDevice{
+				share("rootfs", filepath.Join(dir, "missing")),
+				share("rootfs", dir),
+				blk(""),
+				&virtio.VirtioVsock{},
+				&virtio.VirtioVsock{},
+			},
+			bl:       linux,
+			platform: units.PlatformDarwinARM64,
+			want: []error{
+				virtio.ErrDuplicateMountTag,
+				virtio.ErrMissingSharedDirectory,
+				virtio.ErrUnreadableDiskImage,
+				virtio.ErrMultipleVsockDevices,
+				virtio.ErrBootloaderPlatformMismatch,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := virtio.ValidateDevices(tt.devices, tt.bl, tt.platform)
+			if len(tt.want) == 0 {
+				require.NoError(t, err)
+				return
+			}
+
+			var set *virtio.DeviceSetError
+			require.ErrorAs(t, err, &set)
+			assert.Len(t, set.Problems, len(tt.want))
+			for _, want := range tt.want {
+				assert.ErrorIs(t, err, want)
+			}
+		})
+	}
+}
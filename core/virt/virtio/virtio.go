@@ -166,28 +166,30 @@ var _ VirtioDevice = &VirtioSerialFifo{}
 func (v *VirtioSerialFifo) isVirtioDevice() {}
 
 type VirtioSerialFifo struct {
-	FD uintptr
+	FD uintptr `json:"fd"`
 }
 
 type VirtioSerialFifoFile struct {
-	Path string
+	Path string `json:"path"`
 }
 
+// VirtioSerialStdio connects the console to open files of the current process,
+// they are left out when the device is serialized.
 type VirtioSerialStdio struct {
-	Stdin  *os.File
-	Stdout *os.File
+	Stdin  *os.File `json:"-"`
+	Stdout *os.File `json:"-"`
 }
 
 type VirtioSerialStdioPipes struct {
-	Stdin  string
-	Stdout string
-	Stderr string
+	Stdin  string `json:"stdin"`
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
 }
 
 type VirtioSerialFDPipes struct {
-	Stdin  uintptr
-	Stdout uintptr
-	Stderr uintptr
+	Stdin  uintptr `json:"stdin"`
+	Stdout uintptr `json:"stdout"`
+	Stderr uintptr `json:"stderr"`
 }
 
 var _ VirtioDevice = &VirtioSerialFDPipes{}
@@ -196,13 +198,13 @@ func (v *VirtioSerialFDPipes) isVirtioDevice() {}
 
 type VirtioSerialPty struct {
 	// this will be reset by the hypervisor
-	InternalManagedName string
-	IsSystemConsole     bool
+	InternalManagedName string `json:"internalManagedName,omitempty"`
+	IsSystemConsole     bool   `json:"isSystemConsole"`
 }
 
 type VirtioSerialLogFile struct {
-	Path   string
-	Append bool
+	Path   string `json:"path"`
+	Append bool   `json:"append"`
 }
 
 var _ VirtioDevice = &VirtioSerialStdioPipes{}
@@ -238,9 +240,9 @@ func (v *NetworkBlockDevice) isVirtioDevice() {}
 
 type NetworkBlockDevice struct {
 	NetworkBlockStorageConfig
-	DeviceIdentifier    string
-	Timeout             time.Duration
-	SynchronizationMode NBDSynchronizationMode
+	DeviceIdentifier    string                 `json:"deviceIdentifier,omitempty"`
+	Timeout             time.Duration          `json:"timeout,omitempty"`
+	SynchronizationMode NBDSynchronizationMode `json:"synchronizationMode,omitempty"`
 }
 
 var _ VirtioDevice = &VirtioBalloon{}
@@ -321,29 +323,6 @@ func (dev *VirtioInput) validate() error {
 	return nil
 }
 
-// func (dev *VirtioInput) ToCmdLine() ([]string, error) {
-// 	if err := dev.validate(); err != nil {
-// 		return nil, err
-// 	}
-
-// 	return []string{"--device", fmt.Sprintf("virtio-input,%s", dev.InputType)}, nil
-// }
-
-// func (dev *VirtioInput) FromOptions(options []option) error {
-// 	for _, option := range options {
-// 		switch option.key {
-// 		case VirtioInputPointingDevice, VirtioInputKeyboardDevice:
-// 			if option.value != "" {
-// 				return fmt.Errorf("unexpected value for virtio-input %s option: %s", option.key, option.value)
-// 			}
-// 			dev.InputType = option.key
-// 		default:
-// 			return fmt.Errorf("unknown option for virtio-input devices: %s", option.key)
-// 		}
-// 	}
-// 	return dev.validate()
-// }
-
 // VirtioGPUNew creates a new gpu device for the virtual machine.
 // The usesGUI parameter determines whether a graphical application window will
 // be displayed
@@ -434,44 +413,6 @@ func VirtioVsockNew(port uint, socketURL string, shouldHostActAsServer bool) (Vi
 	}, nil
 }
 
-// func (dev *VirtioVsock) ToCmdLine() ([]string, error) {
-// 	if dev.Port == 0 || dev.SocketURL == "" {
-// 		return nil, fmt.Errorf("virtio-vsock needs both a port and a socket URL")
-// 	}
-// 	var listenStr string
-// 	if dev.Direction == VirtioVsockDirectionGuestConnectsAsClient {
-// 		// the listenStr is for the host, so it's the opposite of the direction
-// 		listenStr = "listen"
-// 	} else {
-// 		listenStr = "connect"
-// 	}
-// 	return []string{"--device", fmt.Sprintf("virtio-vsock,port=%d,socketURL=%s,%s", dev.Port, dev.SocketURL, listenStr)}, nil
-// }
-
-// func (dev *VirtioVsock) FromOptions(options []option) error {
-// 	// default to listen for backwards compatibliity
-// 	dev.Direction = VirtioVsockDirectionGuestListensAsServer
-// 	for _, option := range options {
-// 		switch option.key {
-// 		case "socketURL":
-// 			dev.SocketURL = option.value
-// 		case "port":
-// 			port, err := strconv.ParseUint(option.value, 10, 32)
-// 			if err != nil {
-// 				return err
-// 			}
-// 			dev.Port = uint32(port) //#nosec G115 -- ParseUint(_, _, 32) guarantees no overflow
-// 		case "listen":
-// 			dev.Direction = VirtioVsockDirectionGuestListensAsServer
-// 		case "connect":
-// 			dev.Direction = VirtioVsockDirectionGuestConnectsAsClient
-// 		default:
-// 			return fmt.Errorf("unknown option for virtio-vsock devices: %s", option.key)
-// 		}
-// 	}
-// 	return nil
-// }
-
 // VirtioFsNew creates a new virtio-fs device for file sharing. It will share
 // the directory at sharedDir with the virtual machine. This directory can be
 // mounted in the VM using `mount -t virtiofs mountTag /some/dir`
@@ -484,31 +425,6 @@ func VirtioFsNew(sharedDir string, mountTag string) (VirtioDevice, error) {
 	}, nil
 }
 
-// func (dev *VirtioFs) ToCmdLine() ([]string, error) {
-// 	if dev.SharedDir == "" {
-// 		return nil, fmt.Errorf("virtio-fs needs the path to the directory to share")
-// 	}
-// 	if dev.MountTag != "" {
-// 		return []string{"--device", fmt.Sprintf("virtio-fs,sharedDir=%s,mountTag=%s", dev.SharedDir, dev.MountTag)}, nil
-// 	}
-
-// 	return []string{"--device", fmt.Sprintf("virtio-fs,sharedDir=%s", dev.SharedDir)}, nil
-// }
-
-// func (dev *VirtioFs) FromOptions(options []option) error {
-// 	for _, option := range options {
-// 		switch option.key {
-// 		case "sharedDir":
-// 			dev.SharedDir = option.value
-// 		case "mountTag":
-// 			dev.MountTag = option.value
-// 		default:
-// 			return fmt.Errorf("unknown option for virtio-fs devices: %s", option.key)
-// 		}
-// 	}
-// 	return nil
-// }
-
 // RosettaShareNew RosettaShare creates a new rosetta share for running x86_64 binaries on M1 machines.
 // It will share a directory containing the linux rosetta binaries with the
 // virtual machine. This directory can be mounted in the VM using `mount -t
@@ -521,39 +437,6 @@ func RosettaShareNew(mountTag string) (VirtioDevice, error) {
 	}, nil
 }
 
-// func (dev *RosettaShare) ToCmdLine() ([]string, error) {
-// 	if dev.MountTag == "" {
-// 		return nil, fmt.Errorf("rosetta shares require a mount tag to be specified")
-// 	}
-// 	builder := strings.Builder{}
-// 	builder.WriteString("rosetta")
-// 	fmt.Fprintf(&builder, ",mountTag=%s", dev.MountTag)
-// 	if dev.InstallRosetta {
-// 		builder.WriteString(",install")
-// 	}
-// 	if dev.IgnoreIfMissing {
-// 		builder.WriteString(",ignore-if-missing")
-// 	}
-
-// 	return []string{"--device", builder.String()}, nil
-// }
-
-// func (dev *RosettaShare) FromOptions(options []option) error {
-// 	for _, option := range options {
-// 		switch option.key {
-// 		case "mountTag":
-// 			dev.MountTag = option.value
-// 		case "install":
-// 			dev.InstallRosetta = true
-// 		case "ignore-if-missing":
-// 			dev.IgnoreIfMissing = true
-// 		default:
-// 			return fmt.Errorf("unknown option for rosetta share: %s", option.key)
-// 		}
-// 	}
-// 	return nil
-// }
-
 func networkBlockDeviceNewEmpty() *NetworkBlockDevice {
 	return &NetworkBlockDevice{
 		NetworkBlockStorageConfig: NetworkBlockStorageConfig{
@@ -581,57 +464,6 @@ func NetworkBlockDeviceNew(uri string, timeout uint32, synchronization NBDSynchr
 	return nbd, nil
 }
 
-// func (nbd *NetworkBlockDevice) ToCmdLine() ([]string, error) {
-// 	cmdLine, err := nbd.NetworkBlockStorageConfig.ToCmdLine()
-// 	if err != nil {
-// 		return []string{}, err
-// 	}
-// 	if len(cmdLine) != 2 {
-// 		return []string{}, fmt.Errorf("unexpected storage config commandline")
-// 	}
-
-// 	if nbd.DeviceIdentifier != "" {
-// 		cmdLine[1] = fmt.Sprintf("%s,deviceId=%s", cmdLine[1], nbd.DeviceIdentifier)
-// 	}
-// 	if nbd.Timeout.Milliseconds() > 0 {
-// 		cmdLine[1] = fmt.Sprintf("%s,timeout=%d", cmdLine[1], nbd.Timeout.Milliseconds())
-// 	}
-// 	if nbd.SynchronizationMode == "none" || nbd.SynchronizationMode == "full" {
-// 		cmdLine[1] = fmt.Sprintf("%s,sync=%s", cmdLine[1], nbd.SynchronizationMode)
-// 	}
-
-// 	return cmdLine, nil
-// }
-
-// func (nbd *NetworkBlockDevice) FromOptions(options []option) error {
-// 	unhandledOpts := []option{}
-// 	for _, option := range options {
-// 		switch option.key {
-// 		case "deviceId":
-// 			nbd.DeviceIdentifier = option.value
-// 		case "timeout":
-// 			timeoutMS, err := strconv.ParseInt(option.value, 10, 32)
-// 			if err != nil {
-// 				return err
-// 			}
-// 			nbd.Timeout = time.Duration(timeoutMS) * time.Millisecond
-// 		case "sync":
-// 			switch option.value {
-// 			case string(SynchronizationFullMode):
-// 				nbd.SynchronizationMode = SynchronizationFullMode
-// 			case string(SynchronizationNoneMode):
-// 				nbd.SynchronizationMode = SynchronizationNoneMode
-// 			default:
-// 				return fmt.Errorf("invalid sync mode: %s, must be 'full' or 'none'", option.value)
-// 			}
-// 		default:
-// 			unhandledOpts = append(unhandledOpts, option)
-// 		}
-// 	}
-
-// 	return nbd.NetworkBlockStorageConfig.FromOptions(unhandledOpts)
-// }
-
 type USBMassStorage struct {
 	DiskStorageConfig
 }
@@ -674,63 +506,3 @@ type NetworkBlockStorageConfig struct {
 	StorageConfig
 	URI string `json:"uri,omitempty"`
 }
-
-// func (config *DiskStorageConfig) ToCmdLine() ([]string, error) {
-// 	if config.ImagePath == "" {
-// 		return nil, fmt.Errorf("%s devices need the path to a disk image", config.DevName)
-// 	}
-
-// 	value := fmt.Sprintf("%s,path=%s", config.DevName, config.ImagePath)
-
-// 	if config.ReadOnly {
-// 		value += ",readonly"
-// 	}
-// 	return []string{"--device", value}, nil
-// }
-
-// func (config *DiskStorageConfig) FromOptions(options []option) error {
-// 	for _, option := range options {
-// 		switch option.key {
-// 		case "path":
-// 			config.ImagePath = option.value
-// 		case "readonly":
-// 			if option.value != "" {
-// 				return fmt.Errorf("unexpected value for virtio-blk 'readonly' option: %s", option.value)
-// 			}
-// 			config.ReadOnly = true
-// 		default:
-// 			return fmt.Errorf("unknown option for %s devices: %s", config.DevName, option.key)
-// 		}
-// 	}
-// 	return nil
-// }
-
-// func (config *NetworkBlockStorageConfig) ToCmdLine() ([]string, error) {
-// 	if config.URI == "" {
-// 		return nil, fmt.Errorf("%s devices need the uri to a remote block device", config.DevName)
-// 	}
-
-// 	value := fmt.Sprintf("%s,uri=%s", config.DevName, config.URI)
-
-// 	if config.ReadOnly {
-// 		value += ",readonly"
-// 	}
-// 	return []string{"--device", value}, nil
-// }
-
-// func (config *NetworkBlockStorageConfig) FromOptions(options []option) error {
-// 	for _, option := range options {
-// 		switch option.key {
-// 		case "uri":
-// 			config.URI = option.value
-// 		case "readonly":
-// 			if option.value != "" {
-// 				return fmt.Errorf("unexpected value for virtio-blk 'readonly' option: %s", option.value)
-// 			}
-// 			config.ReadOnly = true
-// 		default:
-// 			return fmt.Errorf("unknown option for %s devices: %s", config.DevName, option.key)
-// 		}
-// 	}
-// 	return nil
-// }
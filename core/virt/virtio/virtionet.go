@@ -14,7 +14,8 @@ type VirtioNet struct {
 	MacAddress net.HardwareAddr `json:"-"` // custom marshaller in json.go
 	// file parameter is holding a connected datagram socket.
 	// see https://github.com/Code-Hex/vz/blob/7f648b6fb9205d6f11792263d79876e3042c33ec/network.go#L113-L155
-	Socket *os.File `json:"socket,omitempty"`
+	// It cannot be serialized and is left out of json.
+	Socket *os.File `json:"-"`
 
 	// UnixSocketPath string        `json:"unixSocketPath,omitempty"`
 	LocalAddr *net.UnixAddr `json:"-"`
@@ -101,56 +102,3 @@ func (v *VirtioNet) isVirtioDevice() {}
 
 // 	return nil
 // }
-
-// func (dev *VirtioNet) ToCmdLine() ([]string, error) {
-// 	if err := dev.validate(); err != nil {
-// 		return nil, err
-// 	}
-
-// 	builder := strings.Builder{}
-// 	builder.WriteString("virtio-net")
-// 	switch {
-// 	case dev.Nat:
-// 		builder.WriteString(",nat")
-// 	case dev.UnixSocketPath != "":
-// 		fmt.Fprintf(&builder, ",unixSocketPath=%s", dev.UnixSocketPath)
-// 	default:
-// 		fmt.Fprintf(&builder, ",fd=%d", dev.Socket.Fd())
-// 	}
-
-// 	if len(dev.MacAddress) != 0 {
-// 		builder.WriteString(fmt.Sprintf(",mac=%s", dev.MacAddress))
-// 	}
-
-// 	return []string{"--device", builder.String()}, nil
-// }
-
-// func (dev *VirtioNet) FromOptions(options []option) error {
-// 	for _, option := range options {
-// 		switch option.key {
-// 		case "nat":
-// 			if option.value != "" {
-// 				return fmt.Errorf("unexpected value for virtio-net 'nat' option: %s", option.value)
-// 			}
-// 			dev.Nat = true
-// 		case "mac":
-// 			macAddress, err := net.ParseMAC(option.value)
-// 			if err != nil {
-// 				return err
-// 			}
-// 			dev.MacAddress = macAddress
-// 		case "fd":
-// 			fd, err := strconv.Atoi(option.value)
-// 			if err != nil {
-// 				return err
-// 			}
-// 			dev.Socket = os.NewFile(uintptr(fd), "vfkit virtio-net socket")
-// 		case "unixSocketPath":
-// 			dev.UnixSocketPath = option.value
-// 		default:
-// 			return fmt.Errorf("unknown option for virtio-net devices: %s", option.key)
-// 		}
-// 	}
-
-// 	return dev.validate()
-// }
@@ -0,0 +1,107 @@
+// Package virtiofsd starts the vhost-user daemon that serves a virtiofs share to
+// hypervisors without a built in virtiofs device.
+package virtiofsd
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Share is a directory served under a mount tag on a vhost-user socket.
+type Share struct {
+	Tag    string
+	Dir    string
+	Socket string
+}
+
+// Start serves s with binary, logging to logPath, and waits up to timeout for its
+// socket to show up. The daemon is not tied to ctx.
+func Start(ctx context.Context, binary string, s Share, logPath string, timeout time.Duration) (*exec.Cmd, error) {
+	if err := os.Remove(s.Socket); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Errorf("removing stale virtiofsd socket: %w", err)
+	}
+
+	args := []string{
+		"--socket-path=" + s.Socket,
+		"--shared-dir=" + s.Dir,
+		"--cache=auto",
+	}
+	// the sandbox needs privileges an unprivileged shim does not have
+	if os.Geteuid() != 0 {
+		args = append(args, "--sandbox=none")
+	}
+
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return nil, errors.Errorf("creating virtiofsd log: %w", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(binary, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// keep serving the share if the shim that started us goes away
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	slog.DebugContext(ctx, "starting virtiofsd", "tag", s.Tag, "dir", s.Dir, "socket", s.Socket)
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Errorf("starting virtiofsd for %s: %w", s.Tag, err)
+	}
+
+	if err := waitForSocket(ctx, s.Socket, timeout); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, errors.Errorf("waiting for virtiofsd socket of %s: %w", s.Tag, err)
+	}
+
+	return cmd, nil
+}
+
+// Stop kills the daemons and waits for them to exit.
+func Stop(cmds []*exec.Cmd) {
+	for _, cmd := range cmds {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}
+}
+
+// Kill kills daemons started by another process, which cannot wait for them. A
+// daemon leads its own session, a pid that does not has been reused and is left
+// alone.
+func Kill(pids []int) {
+	for _, pid := range pids {
+		if sid, err := unix.Getsid(pid); err != nil || sid != pid {
+			continue
+		}
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+func waitForSocket(ctx context.Context, path string, timeout time.Duration) error {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		_, err := os.Stat(path)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return errors.Errorf("timeout after %s: %w", timeout, err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Package virtiofsdtest is a fake virtiofsd for the tests of the backends that start
+// one, the test binary runs as it in place of the daemon.
+package virtiofsdtest
+
+import (
+	"net"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Invoked reports whether args are the arguments virtiofsd.Start runs virtiofsd with.
+func Invoked(args []string) bool {
+	return slices.ContainsFunc(args, func(arg string) bool { return strings.HasPrefix(arg, "--socket-path=") })
+}
+
+// Run serves the shared directory in args on its socket like virtiofsd, every
+// connection is closed right away. It only returns on an error.
+func Run(args []string) error {
+	var socket, dir string
+	for _, arg := range args {
+		if v, ok := strings.CutPrefix(arg, "--socket-path="); ok {
+			socket = v
+		}
+		if v, ok := strings.CutPrefix(arg, "--shared-dir="); ok {
+			dir = v
+		}
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,453 @@
+package vmm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/host"
+	"github.com/walteh/runm/pkg/atomicfile"
+)
+
+const artifactVersion = 1
+
+// ErrArtifactCorrupt is returned when a stored artifact no longer matches its digest.
+var ErrArtifactCorrupt = errors.New("artifact does not match its digest")
+
+// LinkMethod is how ArtifactStore.Link placed an artifact, in the order it is tried.
+type LinkMethod string
+
+const (
+	LinkMethodHardlink LinkMethod = "hardlink"
+	LinkMethodReflink  LinkMethod = "reflink"
+	LinkMethodSymlink  LinkMethod = "symlink"
+	LinkMethodCopy     LinkMethod = "copy"
+)
+
+// Artifact is a read-only file in an ArtifactStore.
+type Artifact struct {
+	Version int    `json:"version"`
+	Digest  string `json:"digest"`
+	Size    int64  `json:"size"`
+	// ModTime is the time of the stored file when it was last verified, a file that
+	// was written to through a link has another one and is verified again.
+	ModTime time.Time `json:"mod_time"`
+}
+
+// artifactSource remembers the digest of a file outside the store, so that it is not
+// hashed again while its size and time stay the same.
+type artifactSource struct {
+	Version int       `json:"version"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Digest  string    `json:"digest"`
+}
+
+// artifactRef records a symlink to an artifact. Prune sees hardlinks in the link
+// count of the artifact, but nothing on the artifact tells of a symlink to it.
+type artifactRef struct {
+	Version int    `json:"version"`
+	Path    string `json:"path"`
+}
+
+// ArtifactStore keeps the guest kernel, initramfs and mbin images by digest, so the
+// working directories of all vms share one read-only copy of them instead of each
+// copying the build directory.
+type ArtifactStore struct {
+	root string
+}
+
+func NewArtifactStore(root string) *ArtifactStore {
+	return &ArtifactStore{root: root}
+}
+
+// DefaultArtifactStore returns the store in the host cache directory.
+func DefaultArtifactStore(ctx context.Context) (*ArtifactStore, error) {
+	root, err := host.ArtifactCacheDir(ctx)
+	if err != nil {
+		return nil, errors.Errorf("getting artifact cache dir: %w", err)
+	}
+	return NewArtifactStore(root), nil
+}
+
+func (s *ArtifactStore) Root() string {
+	return s.root
+}
+
+func (s *ArtifactStore) blobPath(digest string) (string, error) {
+	hexDigest, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(hexDigest) != sha256.Size*2 {
+		return "", errors.Errorf("invalid artifact digest %q", digest)
+	}
+	if _, err := hex.DecodeString(hexDigest); err != nil {
+		return "", errors.Errorf("invalid artifact digest %q", digest)
+	}
+	return filepath.Join(s.root, "blobs", "sha256", hexDigest), nil
+}
+
+func (s *ArtifactStore) refPath(blob, dst string) string {
+	sum := sha256.Sum256([]byte(dst))
+	return filepath.Join(s.refDir(blob), hex.EncodeToString(sum[:16])+".json")
+}
+
+func (s *ArtifactStore) refDir(blob string) string {
+	return filepath.Join(s.root, "refs", "sha256", filepath.Base(blob))
+}
+
+func (s *ArtifactStore) sourcePath(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(s.root, "sources", hex.EncodeToString(sum[:16])+".json")
+}
+
+// Add stores the file at path, unless the store already has its content, and
+// returns the stored artifact. A stored artifact that fails verification is
+// replaced.
+func (s *ArtifactStore) Add(ctx context.Context, path string) (*Artifact, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Errorf("reading artifact source: %w", err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, errors.Errorf("artifact source %s is not a regular file", path)
+	}
+
+	digest, err := s.sourceDigest(path, fi)
+	if err != nil {
+		return nil, err
+	}
+
+	art, err := s.Verify(ctx, digest)
+	switch {
+	case err == nil:
+		return art, nil
+	case errors.Is(err, ErrArtifactCorrupt):
+		slog.WarnContext(ctx, "replacing corrupt artifact", "digest", digest, "error", err)
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	return s.importFile(ctx, path, digest)
+}
+
+// sourceDigest returns the digest of path, hashing it only when it changed since the
+// last time it was added.
+func (s *ArtifactStore) sourceDigest(path string, fi fs.FileInfo) (string, error) {
+	src := &artifactSource{}
+	if data, err := os.ReadFile(s.sourcePath(path)); err == nil && json.Unmarshal(data, src) == nil &&
+		src.Version == artifactVersion && src.Path == path && src.Size == fi.Size() && src.ModTime.Equal(fi.ModTime()) {
+		return src.Digest, nil
+	}
+
+	digest, err := fileDigest(path)
+	if err != nil {
+		return "", errors.Errorf("hashing artifact source: %w", err)
+	}
+
+	src = &artifactSource{Version: artifactVersion, Path: path, Size: fi.Size(), ModTime: fi.ModTime(), Digest: digest}
+	if err := writeJSONFile(s.sourcePath(path), src); err != nil {
+		return "", errors.Errorf("recording artifact source: %w", err)
+	}
+
+	return digest, nil
+}
+
+func (s *ArtifactStore) importFile(ctx context.Context, path, digest string) (*Artifact, error) {
+	blob, err := s.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		return nil, errors.Errorf("creating artifact directory: %w", err)
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Errorf("opening artifact source: %w", err)
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(blob), ".tmp-*")
+	if err != nil {
+		return nil, errors.Errorf("creating artifact: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), in); err != nil {
+		tmp.Close()
+		return nil, errors.Errorf("copying artifact: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, errors.Errorf("closing artifact: %w", err)
+	}
+
+	// the source may have changed since it was hashed
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != digest {
+		os.Remove(s.sourcePath(path))
+		return nil, errors.Errorf("artifact source %s changed while it was added", path)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return nil, errors.Errorf("making artifact read-only: %w", err)
+	}
+
+	// a corrupt artifact may still be linked from a working directory, so it is
+	// unlinked rather than written over
+	if err := os.Remove(blob); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Errorf("removing previous artifact: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), blob); err != nil {
+		return nil, errors.Errorf("renaming artifact: %w", err)
+	}
+
+	fi, err := os.Stat(blob)
+	if err != nil {
+		return nil, errors.Errorf("reading artifact: %w", err)
+	}
+
+	art := &Artifact{Version: artifactVersion, Digest: digest, Size: fi.Size(), ModTime: fi.ModTime()}
+	if err := writeJSONFile(blob+".json", art); err != nil {
+		return nil, errors.Errorf("recording artifact: %w", err)
+	}
+
+	slog.InfoContext(ctx, "added artifact", "digest", digest, "source", path, "size", art.Size)
+
+	return art, nil
+}
+
+// Verify returns the stored artifact with digest. It is hashed again when its size or
+// time changed since it was last verified, and ErrArtifactCorrupt is returned when its
+// content no longer matches digest. A missing artifact gives fs.ErrNotExist.
+func (s *ArtifactStore) Verify(ctx context.Context, digest string) (*Artifact, error) {
+	blob, err := s.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(blob)
+	if err != nil {
+		return nil, errors.Errorf("reading artifact %s: %w", digest, err)
+	}
+
+	art := &Artifact{}
+	if data, err := os.ReadFile(blob + ".json"); err == nil && json.Unmarshal(data, art) == nil &&
+		art.Version == artifactVersion && art.Digest == digest && art.Size == fi.Size() && art.ModTime.Equal(fi.ModTime()) {
+		return art, nil
+	}
+
+	got, err := fileDigest(blob)
+	if err != nil {
+		return nil, errors.Errorf("hashing artifact %s: %w", digest, err)
+	}
+	if got != digest {
+		return nil, errors.Errorf("artifact %s hashes to %s: %w", digest, got, ErrArtifactCorrupt)
+	}
+
+	art = &Artifact{Version: artifactVersion, Digest: digest, Size: fi.Size(), ModTime: fi.ModTime()}
+	if err := writeJSONFile(blob+".json", art); err != nil {
+		return nil, errors.Errorf("recording artifact: %w", err)
+	}
+
+	slog.DebugContext(ctx, "verified artifact", "digest", digest)
+
+	return art, nil
+}
+
+// Link places the artifact with digest at dst, replacing what is there. It hardlinks
+// or reflinks the stored file where the file system allows it, symlinks it across
+// file systems and copies it as a last resort.
+func (s *ArtifactStore) Link(ctx context.Context, digest, dst string) (LinkMethod, error) {
+	blob, err := s.blobPath(digest)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return "", errors.Errorf("removing %s: %w", dst, err)
+	}
+
+	if err := os.Link(blob, dst); err == nil {
+		return LinkMethodHardlink, nil
+	}
+
+	if err := reflink(blob, dst); err == nil {
+		return LinkMethodReflink, nil
+	}
+
+	if err := os.Symlink(blob, dst); err == nil {
+		if err := s.recordSymlink(blob, dst); err != nil {
+			os.Remove(dst)
+			return "", errors.Errorf("recording link to artifact %s: %w", digest, err)
+		}
+		return LinkMethodSymlink, nil
+	}
+
+	if err := copyFile(dst, blob); err != nil {
+		return "", errors.Errorf("copying artifact %s to %s: %w", digest, dst, err)
+	}
+	return LinkMethodCopy, nil
+}
+
+func (s *ArtifactStore) recordSymlink(blob, dst string) error {
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(s.refPath(blob, dst), &artifactRef{Version: artifactVersion, Path: dst})
+}
+
+// symlinked reports whether a recorded symlink still points at blob. The records of
+// symlinks that are gone or point elsewhere are removed, unless dryRun is set.
+func (s *ArtifactStore) symlinked(blob string, dryRun bool) bool {
+	refs, err := os.ReadDir(s.refDir(blob))
+	if err != nil {
+		return false
+	}
+
+	for _, e := range refs {
+		path := filepath.Join(s.refDir(blob), e.Name())
+		ref := &artifactRef{}
+		if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, ref) == nil {
+			if target, err := os.Readlink(ref.Path); err == nil && target == blob {
+				return true
+			}
+		}
+		if !dryRun {
+			os.Remove(path)
+		}
+	}
+
+	return false
+}
+
+// LinkTree mirrors the regular files under src into dst through the store, like
+// os.CopyFS does with copies.
+func (s *ArtifactStore) LinkTree(ctx context.Context, dst, src string) error {
+	methods := map[LinkMethod]int{}
+
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case d.Type().IsRegular():
+			art, err := s.Add(ctx, path)
+			if err != nil {
+				return err
+			}
+			method, err := s.Link(ctx, art.Digest, target)
+			if err != nil {
+				return err
+			}
+			methods[method]++
+			return nil
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		return errors.Errorf("linking %s from the artifact store: %w", src, err)
+	}
+
+	slog.DebugContext(ctx, "linked artifacts", "src", src, "dst", dst, "methods", methods)
+
+	return nil
+}
+
+// Prune removes the artifacts that no working directory links to and that are not
+// the current content of a file added before, and returns their digests.
+func (s *ArtifactStore) Prune(ctx context.Context, dryRun bool) ([]string, error) {
+	current := map[string]bool{}
+	sources, err := os.ReadDir(filepath.Join(s.root, "sources"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Errorf("reading artifact sources: %w", err)
+	}
+	for _, e := range sources {
+		path := filepath.Join(s.root, "sources", e.Name())
+		src := &artifactSource{}
+		data, err := os.ReadFile(path)
+		if err != nil || json.Unmarshal(data, src) != nil {
+			continue
+		}
+		fi, err := os.Stat(src.Path)
+		if err != nil || fi.Size() != src.Size || !fi.ModTime().Equal(src.ModTime) {
+			// the source changed or is gone, it is hashed again when it is added
+			if !dryRun {
+				os.Remove(path)
+			}
+			continue
+		}
+		current[src.Digest] = true
+	}
+
+	blobs, err := os.ReadDir(filepath.Join(s.root, "blobs", "sha256"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Errorf("reading artifacts: %w", err)
+	}
+
+	var removed []string
+	for _, e := range blobs {
+		if strings.HasPrefix(e.Name(), ".") || strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		digest := "sha256:" + e.Name()
+		blob := filepath.Join(s.root, "blobs", "sha256", e.Name())
+		info, err := e.Info()
+		if err != nil || current[digest] || sharedFile(info) || s.symlinked(blob, dryRun) {
+			continue
+		}
+
+		removed = append(removed, digest)
+		if dryRun {
+			continue
+		}
+
+		if err := os.Remove(blob); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Errorf("removing artifact %s: %w", digest, err)
+		}
+		os.Remove(blob + ".json")
+		os.RemoveAll(s.refDir(blob))
+		slog.InfoContext(ctx, "pruned artifact", "digest", digest, "size", info.Size())
+	}
+
+	return removed, nil
+}
+
+func writeJSONFile(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(path, data)
+}
@@ -0,0 +1,163 @@
+package vmm_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+func TestArtifactStoreLinkTree(t *testing.T) {
+	ctx := t.Context()
+	store := vmm.NewArtifactStore(t.TempDir())
+
+	build := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(build, "kernel"), []byte("kernel"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(build, "build"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(build, "build", "mbin.squashfs"), []byte("mbin"), 0644))
+
+	vm1, vm2 := t.TempDir(), t.TempDir()
+	require.NoError(t, store.LinkTree(ctx, vm1, build))
+	require.NoError(t, store.LinkTree(ctx, vm2, build))
+
+	for _, name := range []string{"kernel", filepath.Join("build", "mbin.squashfs")} {
+		a, err := os.Stat(filepath.Join(vm1, name))
+		require.NoError(t, err)
+		b, err := os.Stat(filepath.Join(vm2, name))
+		require.NoError(t, err)
+		assert.True(t, os.SameFile(a, b), "%s is shared", name)
+		assert.Equal(t, os.FileMode(0444), a.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(filepath.Join(vm2, "kernel"))
+	require.NoError(t, err)
+	assert.Equal(t, "kernel", string(data))
+}
+
+func TestArtifactStoreVerify(t *testing.T) {
+	ctx := t.Context()
+	store := vmm.NewArtifactStore(t.TempDir())
+
+	src := filepath.Join(t.TempDir(), "initramfs.cpio.gz")
+	require.NoError(t, os.WriteFile(src, []byte("initramfs"), 0644))
+
+	art, err := store.Add(ctx, src)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("initramfs")), art.Size)
+
+	linked := filepath.Join(t.TempDir(), "initramfs.cpio.gz")
+	_, err = store.Link(ctx, art.Digest, linked)
+	require.NoError(t, err)
+
+	// something writes to the shared file through its link
+	require.NoError(t, os.Chmod(linked, 0644))
+	require.NoError(t, os.WriteFile(linked, []byte("tampered"), 0644))
+
+	_, err = store.Verify(ctx, art.Digest)
+	require.ErrorIs(t, err, vmm.ErrArtifactCorrupt)
+
+	// adding the source again replaces the corrupt artifact
+	again, err := store.Add(ctx, src)
+	require.NoError(t, err)
+	assert.Equal(t, art.Digest, again.Digest)
+
+	relinked := filepath.Join(t.TempDir(), "initramfs.cpio.gz")
+	_, err = store.Link(ctx, art.Digest, relinked)
+	require.NoError(t, err)
+	data, err := os.ReadFile(relinked)
+	require.NoError(t, err)
+	assert.Equal(t, "initramfs", string(data))
+
+	_, err = store.Verify(ctx, "sha256:nope")
+	require.Error(t, err)
+}
+
+func TestArtifactStorePrune(t *testing.T) {
+	ctx := t.Context()
+	store := vmm.NewArtifactStore(t.TempDir())
+
+	src := filepath.Join(t.TempDir(), "kernel")
+	require.NoError(t, os.WriteFile(src, []byte("kernel v1"), 0644))
+	old, err := store.Add(ctx, src)
+	require.NoError(t, err)
+
+	linked := filepath.Join(t.TempDir(), "kernel")
+	_, err = store.Link(ctx, old.Digest, linked)
+	require.NoError(t, err)
+
+	// a new build replaces the kernel
+	require.NoError(t, os.WriteFile(src, []byte("kernel v2"), 0644))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(src, later, later))
+	current, err := store.Add(ctx, src)
+	require.NoError(t, err)
+	require.NotEqual(t, old.Digest, current.Digest)
+
+	// a working directory still links the old kernel
+	pruned, err := store.Prune(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+
+	require.NoError(t, os.Remove(linked))
+
+	pruned, err = store.Prune(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{old.Digest}, pruned)
+	_, err = store.Verify(ctx, old.Digest)
+	require.NoError(t, err, "dry run keeps the artifact")
+
+	pruned, err = store.Prune(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{old.Digest}, pruned)
+	_, err = store.Verify(ctx, old.Digest)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = store.Verify(ctx, current.Digest)
+	require.NoError(t, err)
+}
+
+func TestArtifactStorePruneSymlinked(t *testing.T) {
+	ctx := t.Context()
+	store := vmm.NewArtifactStore(t.TempDir())
+
+	src := filepath.Join(t.TempDir(), "kernel")
+	require.NoError(t, os.WriteFile(src, []byte("kernel v1"), 0644))
+	old, err := store.Add(ctx, src)
+	require.NoError(t, err)
+
+	// a working directory on another filesystem can only get a symlink
+	dir, err := os.MkdirTemp("/dev/shm", "runm-artifact-")
+	if err != nil {
+		t.Skipf("no other filesystem: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	linked := filepath.Join(dir, "kernel")
+	method, err := store.Link(ctx, old.Digest, linked)
+	require.NoError(t, err)
+	if method != vmm.LinkMethodSymlink {
+		t.Skipf("artifact was linked with %s", method)
+	}
+
+	require.NoError(t, os.WriteFile(src, []byte("kernel v2"), 0644))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(src, later, later))
+	_, err = store.Add(ctx, src)
+	require.NoError(t, err)
+
+	pruned, err := store.Prune(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+	_, err = store.Verify(ctx, old.Digest)
+	require.NoError(t, err)
+
+	require.NoError(t, os.Remove(linked))
+
+	pruned, err = store.Prune(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{old.Digest}, pruned)
+}
@@ -0,0 +1,176 @@
+package vmm
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/containerd/typeurl/v2"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/pkg/atomicfile"
+)
+
+// BootTimingFile is written to the vm working directory as the phases of a
+// container start complete.
+const BootTimingFile = "runm-boot-timing.json"
+
+// TaskBootTimingEventTopic is published right after the containerd TaskStart event
+// and carries the phases the container create and start went through.
+const TaskBootTimingEventTopic = "/runm/tasks/boot-timing"
+
+const bootTimingVersion = 1
+
+func init() {
+	typeurl.Register(&BootTiming{}, "github.com/walteh/runm/core/virt/vmm", "BootTiming")
+}
+
+// BootPhase is one step of starting a container in a vm.
+type BootPhase string
+
+const (
+	BootPhaseBuildDirCopy     BootPhase = "build-dir-copy"
+	BootPhaseMountPreparation BootPhase = "mount-preparation"
+	BootPhaseNetworkStartup   BootPhase = "network-startup"
+	BootPhaseHypervisorCreate BootPhase = "hypervisor-create"
+	BootPhaseKernelBoot       BootPhase = "kernel-boot"
+	BootPhaseGuestAgent       BootPhase = "guest-agent"
+	BootPhaseRuncCreate       BootPhase = "runc-create"
+	BootPhaseRuncStart        BootPhase = "runc-start"
+)
+
+// BootSpan is the time spent in one phase. Spans can overlap, e.g. the mount
+// preparation keeps running in the background while the network starts.
+type BootSpan struct {
+	Phase    BootPhase     `json:"phase"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+}
+
+// BootTiming is the summary of a container start.
+type BootTiming struct {
+	Version     int       `json:"version"`
+	ContainerID string    `json:"container_id"`
+	VMID        string    `json:"vm_id"`
+	StartedAt   time.Time `json:"started_at"`
+	// Total runs from StartedAt to the end of the last span.
+	Total time.Duration `json:"total"`
+	Spans []BootSpan    `json:"spans"`
+}
+
+// Span returns the span recorded for phase.
+func (b *BootTiming) Span(phase BootPhase) (BootSpan, bool) {
+	for _, span := range b.Spans {
+		if span.Phase == phase {
+			return span, true
+		}
+	}
+	return BootSpan{}, false
+}
+
+// BootTimeline records the phases of a container start as they happen. A nil
+// timeline records nothing.
+type BootTimeline struct {
+	mu          sync.Mutex
+	containerID string
+	vmID        string
+	start       time.Time
+	spans       []BootSpan
+}
+
+func NewBootTimeline(containerID, vmID string, start time.Time) *BootTimeline {
+	return &BootTimeline{
+		containerID: containerID,
+		vmID:        vmID,
+		start:       start,
+	}
+}
+
+// Record adds a span for phase that started at start and ends now. Recording a
+// phase again replaces the earlier span.
+func (t *BootTimeline) Record(phase BootPhase, start time.Time) {
+	if t == nil {
+		return
+	}
+
+	span := BootSpan{Phase: phase, Start: start, Duration: time.Since(start)}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.spans = slices.DeleteFunc(t.spans, func(s BootSpan) bool { return s.Phase == phase })
+	t.spans = append(t.spans, span)
+}
+
+// Summary returns the spans recorded so far, in the order they started.
+func (t *BootTimeline) Summary() *BootTiming {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	spans := slices.Clone(t.spans)
+	slices.SortStableFunc(spans, func(a, b BootSpan) int { return a.Start.Compare(b.Start) })
+
+	var end time.Time
+	for _, span := range spans {
+		if e := span.Start.Add(span.Duration); e.After(end) {
+			end = e
+		}
+	}
+
+	summary := &BootTiming{
+		Version:     bootTimingVersion,
+		ContainerID: t.containerID,
+		VMID:        t.vmID,
+		StartedAt:   t.start,
+		Spans:       spans,
+	}
+	if !end.IsZero() {
+		summary.Total = end.Sub(t.start)
+	}
+	return summary
+}
+
+// BootTimingProvider is implemented by runtimes that record how their container
+// was started.
+type BootTimingProvider interface {
+	BootTiming() *BootTiming
+}
+
+// WriteBootTiming atomically writes b to dir/BootTimingFile.
+func WriteBootTiming(dir string, b *BootTiming) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return errors.Errorf("marshalling boot timing: %w", err)
+	}
+
+	if err := atomicfile.WriteFile(filepath.Join(dir, BootTimingFile), data); err != nil {
+		return errors.Errorf("writing boot timing file: %w", err)
+	}
+
+	return nil
+}
+
+func ReadBootTiming(dir string) (*BootTiming, error) {
+	data, err := os.ReadFile(filepath.Join(dir, BootTimingFile))
+	if err != nil {
+		return nil, errors.Errorf("reading boot timing file: %w", err)
+	}
+
+	b := &BootTiming{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, errors.Errorf("unmarshalling boot timing file: %w", err)
+	}
+
+	if b.Version != bootTimingVersion {
+		return nil, errors.Errorf("unsupported boot timing version %d", b.Version)
+	}
+
+	return b, nil
+}
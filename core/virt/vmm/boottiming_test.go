@@ -0,0 +1,69 @@
+package vmm_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+func TestBootTimelineSummary(t *testing.T) {
+	start := time.Now().Add(-time.Second)
+	tl := vmm.NewBootTimeline("ctr-1", "vm-oci-ctr-1", start)
+
+	tl.Record(vmm.BootPhaseNetworkStartup, start.Add(200*time.Millisecond))
+	tl.Record(vmm.BootPhaseBuildDirCopy, start)
+	tl.Record(vmm.BootPhaseKernelBoot, start.Add(300*time.Millisecond))
+	// recording a phase again replaces it
+	tl.Record(vmm.BootPhaseKernelBoot, start.Add(400*time.Millisecond))
+
+	summary := tl.Summary()
+	assert.Equal(t, "ctr-1", summary.ContainerID)
+	assert.Equal(t, "vm-oci-ctr-1", summary.VMID)
+	assert.Equal(t, start, summary.StartedAt)
+
+	var phases []vmm.BootPhase
+	for _, span := range summary.Spans {
+		phases = append(phases, span.Phase)
+	}
+	assert.Equal(t, []vmm.BootPhase{vmm.BootPhaseBuildDirCopy, vmm.BootPhaseNetworkStartup, vmm.BootPhaseKernelBoot}, phases)
+
+	kernel, ok := summary.Span(vmm.BootPhaseKernelBoot)
+	require.True(t, ok)
+	assert.Equal(t, start.Add(400*time.Millisecond), kernel.Start)
+	assert.Equal(t, kernel.Start.Add(kernel.Duration).Sub(start), summary.Total)
+
+	_, ok = summary.Span(vmm.BootPhaseRuncStart)
+	assert.False(t, ok)
+}
+
+func TestBootTimelineNil(t *testing.T) {
+	var tl *vmm.BootTimeline
+	tl.Record(vmm.BootPhaseRuncCreate, time.Now())
+	assert.Nil(t, tl.Summary())
+}
+
+func TestBootTimingRoundTrip(t *testing.T) {
+	start := time.Now()
+	tl := vmm.NewBootTimeline("ctr-1", "vm-oci-ctr-1", start)
+	tl.Record(vmm.BootPhaseHypervisorCreate, start)
+	tl.Record(vmm.BootPhaseRuncCreate, time.Now())
+
+	dir := t.TempDir()
+	require.NoError(t, vmm.WriteBootTiming(dir, tl.Summary()))
+
+	got, err := vmm.ReadBootTiming(dir)
+	require.NoError(t, err)
+	want := tl.Summary()
+	assert.Equal(t, want.ContainerID, got.ContainerID)
+	assert.Equal(t, want.Total, got.Total)
+	require.Len(t, got.Spans, 2)
+	for i := range want.Spans {
+		assert.Equal(t, want.Spans[i].Phase, got.Spans[i].Phase)
+		assert.Equal(t, want.Spans[i].Duration, got.Spans[i].Duration)
+		assert.True(t, want.Spans[i].Start.Equal(got.Spans[i].Start))
+	}
+}
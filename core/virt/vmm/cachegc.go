@@ -0,0 +1,394 @@
+package vmm
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/errdefs/pkg/errgrpc"
+	"github.com/containerd/ttrpc"
+	"gitlab.com/tozd/go/errors"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/walteh/runm/core/virt/host"
+)
+
+// WorkingDirLockFile is kept locked in the working directory of a vm by the process
+// that owns the vm, see LockWorkingDir.
+const WorkingDirLockFile = "runm-vm.lock"
+
+// DefaultCacheGCMinAge keeps fresh working directories, whose vm may still be in the
+// middle of being created.
+const DefaultCacheGCMinAge = 10 * time.Minute
+
+// LockWorkingDir marks dir as the working directory of a vm owned by the calling
+// process. The lock is held until the returned file is closed or the process exits,
+// so the working directory of a crashed shim is collected by the next VMCacheGC.
+func LockWorkingDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, WorkingDirLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Errorf("opening working directory lock: %w", err)
+	}
+
+	// blocks only while a VMCacheGC probes the lock
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, errors.Errorf("locking working directory: %w", err)
+	}
+
+	return f, nil
+}
+
+// workingDirLocked reports whether a process holds the lock of dir.
+func workingDirLocked(dir string) bool {
+	f, err := os.Open(filepath.Join(dir, WorkingDirLockFile))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		return errors.Is(err, unix.EWOULDBLOCK)
+	}
+	_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	return false
+}
+
+// The kind of a CacheGCEntry.
+const (
+	CacheEntryWorkingDir = "working-dir"
+	CacheEntryLog        = "log"
+	CacheEntrySnapshot   = "snapshot"
+)
+
+// The reason a CacheGCEntry is removed.
+const (
+	// CacheGCReasonOrphaned working directories belong to vms that no longer exist.
+	CacheGCReasonOrphaned = "orphaned"
+	// CacheGCReasonBudget logs and snapshots are evicted, least recently used first,
+	// to bring the cache under CacheGCOptions.Budget.
+	CacheGCReasonBudget = "budget"
+)
+
+type CacheGCOptions struct {
+	// Budget caps the bytes the vm working directories and the snapshot store may
+	// take on disk, zero evicts nothing.
+	Budget int64
+	// MinAge keeps unlocked working directories modified within MinAge, zero means
+	// DefaultCacheGCMinAge.
+	MinAge time.Duration
+	// DryRun lists what would be removed without removing it.
+	DryRun bool
+}
+
+// CacheGCEntry is something VMCacheGC removed, or would remove in a dry run.
+type CacheGCEntry struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+	// VMID is the vm a working directory or log belongs to, empty for snapshots.
+	VMID     string    `json:"vm_id,omitempty"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+	Reason   string    `json:"reason"`
+}
+
+// CacheGCResult lists what a collection removed and the disk usage it left behind.
+type CacheGCResult struct {
+	Removed []CacheGCEntry `json:"removed"`
+	// Size is the disk usage of the cache after the collection, or after it would
+	// have run in a dry run.
+	Size int64 `json:"size"`
+}
+
+// Freed is the number of bytes the removed entries took.
+func (r *CacheGCResult) Freed() int64 {
+	var n int64
+	for _, e := range r.Removed {
+		n += e.Size
+	}
+	return n
+}
+
+// CacheGCRunner is implemented by runtime creators that run a VMCacheGC, so that a
+// collection can be asked of the shim, see CacheGCTTRPCService.
+type CacheGCRunner interface {
+	CollectVMCache(ctx context.Context, dryRun bool) (*CacheGCResult, error)
+}
+
+// CacheGCTTRPCService is served by the shim next to the task service. Its
+// CacheGCCollectMethod takes a BoolValue, whether the collection is a dry run, runs
+// CacheGCRunner.CollectVMCache and answers with the CacheGCResult as json in a
+// BytesValue. See CollectVMCache.
+const (
+	CacheGCTTRPCService  = "runm.v1.CacheGC"
+	CacheGCCollectMethod = "Collect"
+)
+
+// CollectVMCache asks the shim behind client to collect the vm cache, or with dryRun
+// to list what it would remove.
+func CollectVMCache(ctx context.Context, client *ttrpc.Client, dryRun bool) (*CacheGCResult, error) {
+	var resp wrapperspb.BytesValue
+	if err := client.Call(ctx, CacheGCTTRPCService, CacheGCCollectMethod, wrapperspb.Bool(dryRun), &resp); err != nil {
+		return nil, errors.Errorf("collecting vm cache: %w", errgrpc.ToNative(err))
+	}
+
+	res := &CacheGCResult{}
+	if err := json.Unmarshal(resp.GetValue(), res); err != nil {
+		return nil, errors.Errorf("decoding cache gc result: %w", err)
+	}
+	return res, nil
+}
+
+// VMCacheGC removes the working directories of vms that no longer exist and keeps
+// the cache within a disk budget.
+//
+// A working directory is in use while its lock is held (see LockWorkingDir), while
+// the hybrid vsock endpoint of its persisted vm accepts connections, i.e. the vm
+// outlived its shim, or while it is younger than CacheGCOptions.MinAge.
+type VMCacheGC struct {
+	root      string
+	snapshots *SnapshotStore
+}
+
+// NewVMCacheGC collects the working directories in root and, when snapshots is not
+// nil, counts and evicts its snapshots against the budget.
+func NewVMCacheGC(root string, snapshots *SnapshotStore) *VMCacheGC {
+	return &VMCacheGC{root: root, snapshots: snapshots}
+}
+
+// DefaultVMCacheGC returns the collector of the host cache directory.
+func DefaultVMCacheGC(ctx context.Context) (*VMCacheGC, error) {
+	root, err := host.VMCacheDir(ctx)
+	if err != nil {
+		return nil, errors.Errorf("getting vm cache dir: %w", err)
+	}
+
+	snapshots, err := DefaultSnapshotStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewVMCacheGC(root, snapshots), nil
+}
+
+// Collect runs one collection.
+func (g *VMCacheGC) Collect(ctx context.Context, opts CacheGCOptions) (*CacheGCResult, error) {
+	if opts.MinAge == 0 {
+		opts.MinAge = DefaultCacheGCMinAge
+	}
+
+	entries, err := os.ReadDir(g.root)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Errorf("reading vm cache dir: %w", err)
+	}
+
+	res := &CacheGCResult{}
+	// logs and snapshots that may be evicted to meet the budget
+	var evictable []CacheGCEntry
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(g.root, e.Name())
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		size := diskUsage(dir)
+
+		if !workingDirInUse(ctx, dir, info.ModTime(), opts.MinAge) {
+			res.Removed = append(res.Removed, CacheGCEntry{
+				Kind:     CacheEntryWorkingDir,
+				Path:     dir,
+				VMID:     e.Name(),
+				Size:     size,
+				LastUsed: info.ModTime(),
+				Reason:   CacheGCReasonOrphaned,
+			})
+			continue
+		}
+
+		res.Size += size
+		evictable = append(evictable, rotatedLogs(dir, e.Name())...)
+	}
+
+	if g.snapshots != nil {
+		snapshots, err := g.snapshotEntries(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range snapshots {
+			res.Size += s.Size
+		}
+		evictable = append(evictable, snapshots...)
+	}
+
+	if opts.Budget > 0 && res.Size > opts.Budget {
+		slices.SortFunc(evictable, func(a, b CacheGCEntry) int {
+			return a.LastUsed.Compare(b.LastUsed)
+		})
+		for _, e := range evictable {
+			if res.Size <= opts.Budget {
+				break
+			}
+			e.Reason = CacheGCReasonBudget
+			res.Removed = append(res.Removed, e)
+			res.Size -= e.Size
+		}
+	}
+
+	if opts.DryRun {
+		return res, nil
+	}
+
+	for _, e := range res.Removed {
+		if err := g.remove(ctx, e); err != nil {
+			return nil, err
+		}
+		slog.InfoContext(ctx, "removed vm cache entry", "kind", e.Kind, "path", e.Path, "size", e.Size, "reason", e.Reason)
+	}
+
+	return res, nil
+}
+
+func (g *VMCacheGC) remove(ctx context.Context, e CacheGCEntry) error {
+	switch e.Kind {
+	case CacheEntrySnapshot:
+		if err := g.snapshots.Delete(ctx, filepath.Base(e.Path)); err != nil && !errors.Is(err, ErrSnapshotNotFound) {
+			return err
+		}
+	case CacheEntryWorkingDir:
+		// a vm may have claimed the directory since it was inspected
+		if workingDirLocked(e.Path) {
+			slog.InfoContext(ctx, "keeping working directory locked during collection", "path", e.Path)
+			return nil
+		}
+		if err := os.RemoveAll(e.Path); err != nil {
+			return errors.Errorf("removing working directory %s: %w", e.Path, err)
+		}
+	default:
+		if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+			return errors.Errorf("removing %s: %w", e.Path, err)
+		}
+	}
+	return nil
+}
+
+func (g *VMCacheGC) snapshotEntries(ctx context.Context) ([]CacheGCEntry, error) {
+	infos, err := g.snapshots.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]CacheGCEntry, 0, len(infos))
+	for _, info := range infos {
+		dir := filepath.Join(g.snapshots.Root(), info.Name)
+
+		// SnapshotStore.Restore touches the directory
+		lastUsed := info.CreatedAt
+		if fi, err := os.Stat(dir); err == nil && fi.ModTime().After(lastUsed) {
+			lastUsed = fi.ModTime()
+		}
+
+		entries = append(entries, CacheGCEntry{
+			Kind:     CacheEntrySnapshot,
+			Path:     dir,
+			Size:     diskUsage(dir),
+			LastUsed: lastUsed,
+		})
+	}
+
+	return entries, nil
+}
+
+func workingDirInUse(ctx context.Context, dir string, modTime time.Time, minAge time.Duration) bool {
+	if time.Since(modTime) < minAge || workingDirLocked(dir) {
+		return true
+	}
+
+	st, err := ReadPersistedVM(dir)
+	if err != nil || st.VsockEndpoint == "" {
+		return false
+	}
+
+	conn, err := net.DialTimeout("unix", st.VsockEndpoint, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	slog.DebugContext(ctx, "vm outlived its shim, keeping its working directory", "id", st.ID)
+	return true
+}
+
+// rotatedLogs are the logs in a working directory that are no longer written to,
+// e.g. console.log.1. The logs a running vm writes are never evicted.
+func rotatedLogs(dir, vmID string) []CacheGCEntry {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var logs []CacheGCEntry
+	for _, f := range files {
+		if f.IsDir() || !strings.Contains(f.Name(), ".log.") {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		logs = append(logs, CacheGCEntry{
+			Kind:     CacheEntryLog,
+			Path:     path,
+			VMID:     vmID,
+			Size:     fileDiskUsage(info),
+			LastUsed: info.ModTime(),
+		})
+	}
+	return logs
+}
+
+// diskUsage is the space the files under path take on disk. The block devices in a
+// working directory are sparse, so their apparent size would overstate it, and
+// hardlinked guest images belong to the ArtifactStore.
+func diskUsage(path string) int64 {
+	var n int64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil && !sharedFile(info) {
+				n += fileDiskUsage(info)
+			}
+		}
+		return nil
+	})
+	return n
+}
+
+func sharedFile(info fs.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink > 1
+}
+
+func fileDiskUsage(info fs.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+	return info.Size()
+}
@@ -0,0 +1,140 @@
+package vmm_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+func writeAged(t *testing.T, path string, size int, age time.Duration) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, make([]byte, size), 0644))
+	at := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(path, at, at))
+}
+
+func ageDir(t *testing.T, dir string, age time.Duration) {
+	t.Helper()
+	at := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(dir, at, at))
+}
+
+func TestVMCacheGC(t *testing.T) {
+	ctx := t.Context()
+	root := t.TempDir()
+
+	// a vm whose shim is gone
+	writeAged(t, filepath.Join(root, "gone", "console.log"), 4096, 2*time.Hour)
+	ageDir(t, filepath.Join(root, "gone"), 2*time.Hour)
+
+	// a vm owned by this process, with two rotated console logs
+	running := filepath.Join(root, "running")
+	require.NoError(t, os.MkdirAll(running, 0755))
+	lock, err := vmm.LockWorkingDir(running)
+	require.NoError(t, err)
+	defer lock.Close()
+	writeAged(t, filepath.Join(running, "console.log"), 4096, 0)
+	writeAged(t, filepath.Join(running, "console.log.2"), 64*1024, 3*time.Hour)
+	writeAged(t, filepath.Join(running, "console.log.1"), 64*1024, time.Hour)
+	ageDir(t, running, 2*time.Hour)
+
+	// a vm that is still being created
+	writeAged(t, filepath.Join(root, "creating", "build", "kernel"), 4096, 0)
+
+	gc := vmm.NewVMCacheGC(root, nil)
+
+	dry, err := gc.Collect(ctx, vmm.CacheGCOptions{Budget: 100 * 1024, DryRun: true})
+	require.NoError(t, err)
+	require.Len(t, dry.Removed, 2)
+	assert.Equal(t, vmm.CacheEntryWorkingDir, dry.Removed[0].Kind)
+	assert.Equal(t, "gone", dry.Removed[0].VMID)
+	assert.Equal(t, vmm.CacheGCReasonOrphaned, dry.Removed[0].Reason)
+	// the least recently used rotated log goes first
+	assert.Equal(t, filepath.Join(running, "console.log.2"), dry.Removed[1].Path)
+	assert.Equal(t, vmm.CacheGCReasonBudget, dry.Removed[1].Reason)
+	assert.LessOrEqual(t, dry.Size, int64(100*1024))
+	assert.DirExists(t, filepath.Join(root, "gone"))
+	assert.FileExists(t, filepath.Join(running, "console.log.2"))
+
+	res, err := gc.Collect(ctx, vmm.CacheGCOptions{Budget: 100 * 1024})
+	require.NoError(t, err)
+	assert.Equal(t, dry.Removed, res.Removed)
+	assert.NoDirExists(t, filepath.Join(root, "gone"))
+	assert.NoFileExists(t, filepath.Join(running, "console.log.2"))
+	assert.FileExists(t, filepath.Join(running, "console.log.1"))
+	assert.FileExists(t, filepath.Join(running, "console.log"))
+	assert.DirExists(t, filepath.Join(root, "creating"))
+
+	// once released, the working directory of the running vm is collected too
+	require.NoError(t, lock.Close())
+	ageDir(t, running, 2*time.Hour)
+	res, err = gc.Collect(ctx, vmm.CacheGCOptions{})
+	require.NoError(t, err)
+	require.Len(t, res.Removed, 1)
+	assert.Equal(t, "running", res.Removed[0].VMID)
+	assert.NoDirExists(t, running)
+}
+
+func TestCollectVMCacheTTRPC(t *testing.T) {
+	root := t.TempDir()
+	writeAged(t, filepath.Join(root, "gone", "console.log"), 4096, 2*time.Hour)
+	ageDir(t, filepath.Join(root, "gone"), 2*time.Hour)
+
+	gc := vmm.NewVMCacheGC(root, nil)
+
+	server, err := ttrpc.NewServer()
+	require.NoError(t, err)
+	server.RegisterService(vmm.CacheGCTTRPCService, &ttrpc.ServiceDesc{
+		Methods: map[string]ttrpc.Method{
+			vmm.CacheGCCollectMethod: func(ctx context.Context, unmarshal func(interface{}) error) (interface{}, error) {
+				var req wrapperspb.BoolValue
+				if err := unmarshal(&req); err != nil {
+					return nil, err
+				}
+				res, err := gc.Collect(ctx, vmm.CacheGCOptions{DryRun: req.GetValue()})
+				if err != nil {
+					return nil, err
+				}
+				data, err := json.Marshal(res)
+				if err != nil {
+					return nil, err
+				}
+				return wrapperspb.Bytes(data), nil
+			},
+		},
+	})
+
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "shim.sock"))
+	require.NoError(t, err)
+	go server.Serve(t.Context(), l)
+	defer server.Close()
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	require.NoError(t, err)
+	client := ttrpc.NewClient(conn)
+	defer client.Close()
+
+	dry, err := vmm.CollectVMCache(t.Context(), client, true)
+	require.NoError(t, err)
+	require.Len(t, dry.Removed, 1)
+	assert.Equal(t, "gone", dry.Removed[0].VMID)
+	assert.Equal(t, vmm.CacheGCReasonOrphaned, dry.Removed[0].Reason)
+	assert.DirExists(t, filepath.Join(root, "gone"))
+
+	res, err := vmm.CollectVMCache(t.Context(), client, false)
+	require.NoError(t, err)
+	assert.Equal(t, dry.Removed, res.Removed)
+	assert.NoDirExists(t, filepath.Join(root, "gone"))
+}
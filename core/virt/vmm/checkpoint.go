@@ -0,0 +1,293 @@
+package vmm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/pkg/atomicfile"
+	"github.com/walteh/runm/pkg/units"
+)
+
+// VMCheckpointFile marks a checkpoint image directory as holding a full vm snapshot.
+const VMCheckpointFile = "runm-vm-checkpoint.json"
+
+const (
+	vmCheckpointVersion    = 1
+	vmCheckpointSnapshot   = "vm.snapshot"
+	vmCheckpointWorkingDir = "workdir"
+)
+
+// ErrFullSnapshotNotSupported is returned when the hypervisor, or the configuration
+// of a vm, does not allow saving and restoring the full vm state.
+var ErrFullSnapshotNotSupported = errors.New("full vm snapshots are not supported")
+
+// FullSnapshotCapable is implemented by virtual machines that can tell, before
+// anything is paused, whether SaveFullSnapshot and RestoreFromFullSnapshot will work
+// with their configuration. Virtual machines that do not implement it are assumed
+// not to support full snapshots.
+type FullSnapshotCapable interface {
+	SupportsFullSnapshot(ctx context.Context) error
+}
+
+// VMCheckpoint describes a full vm snapshot written into a checkpoint image.
+type VMCheckpoint struct {
+	Version       int            `json:"version"`
+	ContainerID   string         `json:"container_id"`
+	VMID          string         `json:"vm_id"`
+	GuestPlatform units.Platform `json:"guest_platform"`
+	VCPUs         uint64         `json:"vcpus"`
+	Memory        strongunits.B  `json:"memory"`
+	// InitPid is the pid of the container init process, it is unchanged once the
+	// vm is restored.
+	InitPid int `json:"init_pid"`
+
+	Devices         []SnapshotDevice `json:"devices"`
+	KernelDigest    string           `json:"kernel_digest,omitempty"`
+	InitramfsDigest string           `json:"initramfs_digest,omitempty"`
+	CreatedAt       time.Time        `json:"created_at"`
+}
+
+// CheckFullSnapshotSupport returns an error wrapping ErrFullSnapshotNotSupported if
+// vm cannot be checkpointed.
+func CheckFullSnapshotSupport(ctx context.Context, vm VirtualMachine) error {
+	fsc, ok := any(vm).(FullSnapshotCapable)
+	if !ok {
+		return errors.Errorf("virtual machine %T: %w", vm, ErrFullSnapshotNotSupported)
+	}
+	if err := fsc.SupportsFullSnapshot(ctx); err != nil {
+		return errors.Errorf("virtual machine %s: %w: %s", vm.ID(), ErrFullSnapshotNotSupported, err)
+	}
+	return nil
+}
+
+// IsVMCheckpoint reports whether dir is a checkpoint image written by Checkpoint.
+func IsVMCheckpoint(dir string) bool {
+	if dir == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(dir, VMCheckpointFile))
+	return err == nil
+}
+
+func ReadVMCheckpoint(dir string) (*VMCheckpoint, error) {
+	data, err := os.ReadFile(filepath.Join(dir, VMCheckpointFile))
+	if err != nil {
+		return nil, errors.Errorf("reading vm checkpoint: %w", err)
+	}
+
+	cp := &VMCheckpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, errors.Errorf("unmarshalling vm checkpoint: %w", err)
+	}
+
+	if cp.Version != vmCheckpointVersion {
+		return nil, errors.Errorf("unsupported vm checkpoint version %d", cp.Version)
+	}
+
+	return cp, nil
+}
+
+// VMCheckpointWorkingDir is the copy of the vm working directory inside a checkpoint
+// image. It has to be laid over the working directory of the restored vm before the
+// vm is created, so its disks match the saved device state.
+func VMCheckpointWorkingDir(dir string) string {
+	return filepath.Join(dir, vmCheckpointWorkingDir)
+}
+
+// Checkpoint pauses the vm and saves its full state and working directory into dir.
+// The vm is resumed afterwards unless exit is set, in which case it is stopped.
+func (r *RunningVM[VM]) Checkpoint(ctx context.Context, dir string, cp *VMCheckpoint, exit bool) error {
+	if err := CheckFullSnapshotSupport(ctx, r.vm); err != nil {
+		return err
+	}
+
+	if !r.vm.CanPause(ctx) {
+		return errors.Errorf("virtual machine %s cannot be paused in state %s", r.vm.ID(), r.vm.CurrentState())
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Errorf("creating checkpoint directory: %w", err)
+	}
+
+	if err := r.vm.Pause(ctx); err != nil {
+		return errors.Errorf("pausing virtual machine: %w", err)
+	}
+
+	if err := WaitForVMState(ctx, r.vm, VirtualMachineStateTypePaused, time.After(10*time.Second)); err != nil {
+		return errors.Errorf("waiting for virtual machine to pause: %w", err)
+	}
+
+	saveErr := r.checkpointPaused(ctx, dir, cp)
+
+	if exit && saveErr == nil {
+		if err := r.HardStop(ctx); err != nil {
+			return errors.Errorf("stopping checkpointed virtual machine: %w", err)
+		}
+		return nil
+	}
+
+	if err := r.vm.Resume(ctx); err != nil {
+		if saveErr != nil {
+			return errors.Errorf("resuming virtual machine after failed checkpoint (%s): %w", saveErr, err)
+		}
+		return errors.Errorf("resuming virtual machine: %w", err)
+	}
+
+	return saveErr
+}
+
+func (r *RunningVM[VM]) checkpointPaused(ctx context.Context, dir string, cp *VMCheckpoint) error {
+	start := time.Now()
+
+	if err := r.vm.SaveFullSnapshot(ctx, filepath.Join(dir, vmCheckpointSnapshot)); err != nil {
+		return errors.Errorf("saving full snapshot: %w", err)
+	}
+
+	if err := copyTree(filepath.Join(dir, vmCheckpointWorkingDir), r.workingDir); err != nil {
+		return errors.Errorf("copying working directory: %w", err)
+	}
+
+	cp.Version = vmCheckpointVersion
+	cp.VMID = r.vm.ID()
+	cp.Devices = DescribeDevices(r.vm.Devices())
+	cp.CreatedAt = time.Now()
+
+	var err error
+	if cp.KernelDigest, cp.InitramfsDigest, err = bootDigests(r.bootloader); err != nil {
+		return err
+	}
+	if opts := r.vm.Opts(); opts != nil {
+		cp.VCPUs = opts.Vcpus
+		cp.Memory = opts.Memory
+		cp.GuestPlatform = opts.GuestPlatform
+	}
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return errors.Errorf("marshalling vm checkpoint: %w", err)
+	}
+
+	// written last, a checkpoint without it is incomplete and is not restored from
+	if err := atomicfile.WriteFile(filepath.Join(dir, VMCheckpointFile), data); err != nil {
+		return errors.Errorf("writing vm checkpoint: %w", err)
+	}
+
+	slog.InfoContext(ctx, "checkpointed vm", "id", r.vm.ID(), "dir", dir, "duration", time.Since(start))
+
+	return nil
+}
+
+// Restore brings up the vm from the full snapshot in the checkpoint image dir
+// instead of booting it. It is the counterpart of Start for a vm created with the
+// working directory of the checkpoint laid over its own, and is refused if the vm
+// devices or boot files differ from the checkpointed vm. The devices of the restored
+// vm use the files in its own working directory, not the ones of the checkpointed
+// vm the snapshot names, each backend's RestoreFromFullSnapshot takes care of that.
+func (r *RunningVM[VM]) Restore(ctx context.Context, dir string) error {
+	if err := CheckFullSnapshotSupport(ctx, r.vm); err != nil {
+		return err
+	}
+
+	cp, err := ReadVMCheckpoint(dir)
+	if err != nil {
+		return err
+	}
+
+	saved := &SnapshotInfo{
+		Devices:         cp.Devices,
+		KernelDigest:    cp.KernelDigest,
+		InitramfsDigest: cp.InitramfsDigest,
+	}
+	if err := saved.Matches(r.vm.Devices(), r.bootloader); err != nil {
+		return errors.Errorf("restoring checkpoint %s: %w", dir, err)
+	}
+
+	return r.bootWith(ctx, func(ctx context.Context) error {
+		return restoreVM(ctx, r.vm, filepath.Join(dir, vmCheckpointSnapshot))
+	})
+}
+
+func restoreVM[VM VirtualMachine](ctx context.Context, vm VM, snapshotPath string) error {
+	slog.InfoContext(ctx, "restoring virtual machine", "snapshot", snapshotPath)
+
+	if err := vm.RestoreFromFullSnapshot(ctx, snapshotPath); err != nil {
+		return errors.Errorf("restoring virtual machine from snapshot: %w", err)
+	}
+
+	if err := vm.Resume(ctx); err != nil {
+		return errors.Errorf("resuming restored virtual machine: %w", err)
+	}
+
+	if err := WaitForVMState(ctx, vm, VirtualMachineStateTypeRunning, time.After(defaultBootTimeout)); err != nil {
+		return errors.Errorf("waiting for restored virtual machine to run: %w", err)
+	}
+
+	slog.InfoContext(ctx, "virtual machine is running from snapshot")
+
+	return nil
+}
+
+// copyTree copies the regular files and directories under src into dst, replacing
+// files that already exist. Sockets and other special files are skipped.
+func copyTree(dst, src string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case d.Type().IsRegular(), d.Type()&fs.ModeSymlink != 0:
+			// symlinked artifacts are copied, the store may not outlive the copy
+			return copyFile(target, path)
+		default:
+			return nil
+		}
+	})
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	// dst may be linked to a shared artifact, see ArtifactStore.Link
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
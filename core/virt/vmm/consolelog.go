@@ -0,0 +1,322 @@
+package vmm
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/errdefs/pkg/errgrpc"
+	"github.com/containerd/ttrpc"
+	"github.com/nxadm/tail"
+	"gitlab.com/tozd/go/errors"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/walteh/runm/core/virt/virtio"
+)
+
+// ConsoleLogFile is where a vm writes its hvc0 console, in its working directory.
+// Rotated logs sit next to it as console.log.1, console.log.2 and so on, newest first.
+const ConsoleLogFile = "console.log"
+
+const (
+	DefaultConsoleLogMaxSize  = 10 << 20
+	DefaultConsoleLogMaxFiles = 5
+
+	consoleLogRotateInterval = 5 * time.Second
+)
+
+type ConsoleLogOptions struct {
+	// MaxSize is the size at which the console log is rotated, zero means
+	// DefaultConsoleLogMaxSize.
+	MaxSize int64
+	// MaxFiles is the number of rotated logs kept, zero means
+	// DefaultConsoleLogMaxFiles.
+	MaxFiles int
+	// MaxAge removes rotated logs older than MaxAge, zero keeps them.
+	MaxAge time.Duration
+}
+
+// ConsoleLog is the console output of a vm, across rotations.
+//
+// The hypervisor keeps the log open, so it is rotated by copying it and truncating
+// it in place. What the guest writes between the two is lost. Only the logs of vms
+// that are a ConsoleLogAppender are rotated, any other hypervisor would keep
+// writing at its old offset and leave a sparse log behind.
+type ConsoleLog struct {
+	dir  string
+	opts ConsoleLogOptions
+}
+
+// ConsoleLogAppender is implemented by virtual machines that write their console
+// through a descriptor opened with O_APPEND when VirtioSerialLogFile.Append is set,
+// so that a truncated log is written from its start again.
+type ConsoleLogAppender interface {
+	AppendsConsoleLog() bool
+}
+
+// CanRotateConsoleLog reports whether the console log of vm can be rotated, i.e.
+// whether the vm appends to it.
+func CanRotateConsoleLog(vm VirtualMachine) bool {
+	if a, ok := vm.(ConsoleLogAppender); !ok || !a.AppendsConsoleLog() {
+		return false
+	}
+	for _, dev := range vm.Devices() {
+		if log, ok := dev.(*virtio.VirtioSerialLogFile); ok && log.Append {
+			return true
+		}
+	}
+	return false
+}
+
+// ConsoleLogProvider is implemented by runtimes whose container runs in a vm.
+type ConsoleLogProvider interface {
+	ConsoleLog() *ConsoleLog
+}
+
+// ConsoleLogTTRPCService is served by the shim next to the task service. Its methods
+// take the container id as a StringValue and stream the console log of the
+// container's vm as BytesValue chunks: ConsoleLogReadMethod what is kept, like
+// ConsoleLog.WriteTo, and ConsoleLogFollowMethod that and then what the vm prints
+// until the call is cancelled, like ConsoleLog.Follow. See CopyConsoleLog.
+const (
+	ConsoleLogTTRPCService = "runm.v1.ConsoleLog"
+	ConsoleLogReadMethod   = "Read"
+	ConsoleLogFollowMethod = "Follow"
+)
+
+// CopyConsoleLog copies the console log of container id from the shim behind client
+// to w. With follow it keeps copying until ctx is done.
+func CopyConsoleLog(ctx context.Context, client *ttrpc.Client, id string, follow bool, w io.Writer) error {
+	method := ConsoleLogReadMethod
+	if follow {
+		method = ConsoleLogFollowMethod
+	}
+
+	stream, err := client.NewStream(ctx, &ttrpc.StreamDesc{StreamingServer: true}, ConsoleLogTTRPCService, method, wrapperspb.String(id))
+	if err != nil {
+		return errors.Errorf("reading console log: %w", errgrpc.ToNative(err))
+	}
+
+	for {
+		var chunk wrapperspb.BytesValue
+		if err := stream.RecvMsg(&chunk); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Errorf("reading console log: %w", errgrpc.ToNative(err))
+		}
+		if _, err := w.Write(chunk.GetValue()); err != nil {
+			return err
+		}
+		flush(w)
+	}
+}
+
+func NewConsoleLog(dir string, opts ConsoleLogOptions) *ConsoleLog {
+	if opts.MaxSize == 0 {
+		opts.MaxSize = DefaultConsoleLogMaxSize
+	}
+	if opts.MaxFiles == 0 {
+		opts.MaxFiles = DefaultConsoleLogMaxFiles
+	}
+	return &ConsoleLog{dir: dir, opts: opts}
+}
+
+// Path is the log the vm writes to.
+func (l *ConsoleLog) Path() string {
+	return filepath.Join(l.dir, ConsoleLogFile)
+}
+
+func (l *ConsoleLog) rotatedPath(n int) string {
+	return l.Path() + "." + strconv.Itoa(n)
+}
+
+// Rotate rotates the log when it reached MaxSize and applies the retention of the
+// rotated logs. It reports whether the log was rotated.
+func (l *ConsoleLog) Rotate(ctx context.Context) (bool, error) {
+	fi, err := os.Stat(l.Path())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.Errorf("reading console log: %w", err)
+	}
+
+	rotated := false
+	if fi.Size() >= l.opts.MaxSize {
+		if err := os.Remove(l.rotatedPath(l.opts.MaxFiles)); err != nil && !os.IsNotExist(err) {
+			return false, errors.Errorf("removing oldest console log: %w", err)
+		}
+		for n := l.opts.MaxFiles - 1; n >= 1; n-- {
+			if err := os.Rename(l.rotatedPath(n), l.rotatedPath(n+1)); err != nil && !os.IsNotExist(err) {
+				return false, errors.Errorf("rotating console log: %w", err)
+			}
+		}
+
+		if err := copyFile(l.rotatedPath(1), l.Path()); err != nil {
+			return false, errors.Errorf("copying console log: %w", err)
+		}
+		if err := os.Truncate(l.Path(), 0); err != nil {
+			return false, errors.Errorf("truncating console log: %w", err)
+		}
+		rotated = true
+
+		slog.DebugContext(ctx, "rotated console log", "path", l.Path(), "size", fi.Size())
+	}
+
+	if err := l.applyRetention(); err != nil {
+		return rotated, err
+	}
+
+	return rotated, nil
+}
+
+func (l *ConsoleLog) applyRetention() error {
+	for i, path := range l.rotated() {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if i >= l.opts.MaxFiles || (l.opts.MaxAge > 0 && time.Since(fi.ModTime()) > l.opts.MaxAge) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return errors.Errorf("removing rotated console log: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// rotated returns the rotated logs, newest first.
+func (l *ConsoleLog) rotated() []string {
+	matches, _ := filepath.Glob(l.Path() + ".*")
+
+	type rotatedLog struct {
+		path string
+		n    int
+	}
+	logs := make([]rotatedLog, 0, len(matches))
+	for _, path := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(path, l.Path()+"."))
+		if err != nil || n < 1 {
+			continue
+		}
+		logs = append(logs, rotatedLog{path: path, n: n})
+	}
+	slices.SortFunc(logs, func(a, b rotatedLog) int { return a.n - b.n })
+
+	paths := make([]string, len(logs))
+	for i, log := range logs {
+		paths[i] = log.path
+	}
+	return paths
+}
+
+// RunRotation rotates the log until ctx is done.
+func (l *ConsoleLog) RunRotation(ctx context.Context) {
+	ticker := time.NewTicker(consoleLogRotateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := l.Rotate(ctx); err != nil {
+				slog.WarnContext(ctx, "rotating console log", "path", l.Path(), "error", err)
+			}
+		}
+	}
+}
+
+// WriteTo writes everything the vm printed that is still kept, oldest first, and
+// returns the size of the current log it read up to.
+func (l *ConsoleLog) WriteTo(w io.Writer) (int64, error) {
+	rotated := l.rotated()
+	for i := len(rotated) - 1; i >= 0; i-- {
+		if err := copyFileTo(w, rotated[i]); err != nil && !os.IsNotExist(err) {
+			return 0, errors.Errorf("reading rotated console log: %w", err)
+		}
+	}
+
+	f, err := os.Open(l.Path())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Errorf("opening console log: %w", err)
+	}
+	defer f.Close()
+
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return n, errors.Errorf("reading console log: %w", err)
+	}
+	return n, nil
+}
+
+// Follow writes the kept log like WriteTo, then what the vm prints until ctx is done.
+func (l *ConsoleLog) Follow(ctx context.Context, w io.Writer) error {
+	offset, err := l.WriteTo(w)
+	if err != nil {
+		return err
+	}
+	flush(w)
+
+	// tail reopens the log when a rotation truncates it
+	t, err := tail.TailFile(l.Path(), tail.Config{
+		Follow:    true,
+		MustExist: false,
+		Logger:    tail.DiscardingLogger,
+		Location:  &tail.SeekInfo{Offset: offset, Whence: io.SeekStart},
+	})
+	if err != nil {
+		return errors.Errorf("following console log: %w", err)
+	}
+	defer t.Cleanup()
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case line, ok := <-t.Lines:
+			if !ok {
+				return t.Err()
+			}
+			if line.Err != nil {
+				return errors.Errorf("following console log: %w", line.Err)
+			}
+			if _, err := io.WriteString(w, line.Text+"\n"); err != nil {
+				return err
+			}
+			flush(w)
+		}
+	}
+}
+
+// flush sends what was written so far when w buffers, e.g. an http response.
+func flush(w io.Writer) {
+	if f, ok := w.(interface{ Flush() }); ok {
+		f.Flush()
+	}
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,175 @@
+package vmm_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/ttrpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+func appendConsole(t *testing.T, path, s string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(s)
+	require.NoError(t, err)
+}
+
+func TestConsoleLogRotate(t *testing.T) {
+	ctx := t.Context()
+	dir := t.TempDir()
+	cl := vmm.NewConsoleLog(dir, vmm.ConsoleLogOptions{MaxSize: 9, MaxFiles: 2})
+	path := filepath.Join(dir, vmm.ConsoleLogFile)
+	assert.Equal(t, path, cl.Path())
+
+	rotated, err := cl.Rotate(ctx)
+	require.NoError(t, err)
+	assert.False(t, rotated, "nothing to rotate before the vm writes")
+
+	for _, s := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		appendConsole(t, path, s+"1234")
+		rotated, err := cl.Rotate(ctx)
+		require.NoError(t, err)
+		assert.True(t, rotated)
+	}
+	appendConsole(t, path, "current\n")
+
+	rotated, err = cl.Rotate(ctx)
+	require.NoError(t, err)
+	assert.False(t, rotated)
+
+	// the oldest rotations are dropped beyond MaxFiles
+	assert.NoFileExists(t, path+".3")
+	assert.FileExists(t, path+".2")
+
+	var buf bytes.Buffer
+	n, err := cl.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("current\n")), n)
+	assert.Equal(t, "third\n1234fourth\n1234current\n", buf.String())
+}
+
+func TestConsoleLogMaxAge(t *testing.T) {
+	ctx := t.Context()
+	dir := t.TempDir()
+	cl := vmm.NewConsoleLog(dir, vmm.ConsoleLogOptions{MaxAge: time.Hour})
+	path := cl.Path()
+
+	appendConsole(t, path, "current\n")
+	appendConsole(t, path+".1", "recent\n")
+	appendConsole(t, path+".2", "stale\n")
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(path+".2", old, old))
+
+	_, err := cl.Rotate(ctx)
+	require.NoError(t, err)
+
+	assert.FileExists(t, path+".1")
+	assert.NoFileExists(t, path+".2")
+
+	var buf bytes.Buffer
+	_, err = cl.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "recent\ncurrent\n", buf.String())
+}
+
+// syncBuffer is written by CopyConsoleLog while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestCopyConsoleLog(t *testing.T) {
+	dir := t.TempDir()
+	cl := vmm.NewConsoleLog(dir, vmm.ConsoleLogOptions{})
+	appendConsole(t, cl.Path()+".1", "rotated\n")
+	appendConsole(t, cl.Path(), "current\n")
+
+	stream := func(follow bool) ttrpc.Stream {
+		return ttrpc.Stream{
+			StreamingServer: true,
+			Handler: func(ctx context.Context, ss ttrpc.StreamServer) (interface{}, error) {
+				var req wrapperspb.StringValue
+				if err := ss.RecvMsg(&req); err != nil {
+					return nil, err
+				}
+				assert.Equal(t, "abc123", req.GetValue())
+				w := writerFunc(func(p []byte) (int, error) {
+					return len(p), ss.SendMsg(wrapperspb.Bytes(p))
+				})
+				if follow {
+					return nil, cl.Follow(ctx, w)
+				}
+				_, err := cl.WriteTo(w)
+				return nil, err
+			},
+		}
+	}
+
+	server, err := ttrpc.NewServer()
+	require.NoError(t, err)
+	server.RegisterService(vmm.ConsoleLogTTRPCService, &ttrpc.ServiceDesc{
+		Streams: map[string]ttrpc.Stream{
+			vmm.ConsoleLogReadMethod:   stream(false),
+			vmm.ConsoleLogFollowMethod: stream(true),
+		},
+	})
+
+	l, err := net.Listen("unix", filepath.Join(dir, "shim.sock"))
+	require.NoError(t, err)
+	go server.Serve(t.Context(), l)
+	defer server.Close()
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	require.NoError(t, err)
+	client := ttrpc.NewClient(conn)
+	defer client.Close()
+
+	var buf bytes.Buffer
+	require.NoError(t, vmm.CopyConsoleLog(t.Context(), client, "abc123", false, &buf))
+	assert.Equal(t, "rotated\ncurrent\n", buf.String())
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	followed := &syncBuffer{}
+	done := make(chan error, 1)
+	go func() { done <- vmm.CopyConsoleLog(ctx, client, "abc123", true, followed) }()
+
+	require.Eventually(t, func() bool { return followed.String() == "rotated\ncurrent\n" }, 5*time.Second, 10*time.Millisecond)
+	appendConsole(t, cl.Path(), "printed later\n")
+	require.Eventually(t, func() bool { return followed.String() == "rotated\ncurrent\nprinted later\n" }, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,128 @@
+package vmm
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/common/pkg/strongunits"
+	"gitlab.com/tozd/go/errors"
+	"sigs.k8s.io/yaml"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/pkg/atomicfile"
+	"github.com/walteh/runm/pkg/units"
+)
+
+// VMDefinitionFile is written to the vm working directory when the vm is created,
+// it records what the vm was booted with.
+const VMDefinitionFile = "runm-vm-definition.yaml"
+
+const vmDefinitionVersion = 1
+
+// VMDefinition is the serializable form of a vm: its NewVMOptions, bootloader and
+// devices. It reads and writes as json or yaml, devices and the bootloader carry
+// a "kind" field naming their type.
+type VMDefinition struct {
+	Version       int            `json:"version"`
+	ID            string         `json:"id"`
+	Vcpus         uint64         `json:"vcpus"`
+	Memory        strongunits.B  `json:"memory"`
+	GuestPlatform units.Platform `json:"guest_platform,omitempty"`
+	// Bootloader is encoded by MarshalJSON, it is an interface.
+	Bootloader virtio.Bootloader    `json:"-"`
+	Devices    virtio.VirtioDevices `json:"devices"`
+}
+
+func NewVMDefinition(id string, opts *NewVMOptions, bl virtio.Bootloader) *VMDefinition {
+	return &VMDefinition{
+		Version:       vmDefinitionVersion,
+		ID:            id,
+		Vcpus:         opts.Vcpus,
+		Memory:        opts.Memory,
+		GuestPlatform: opts.GuestPlatform,
+		Bootloader:    bl,
+		Devices:       opts.Devices,
+	}
+}
+
+// Options returns the NewVMOptions the definition describes.
+func (d *VMDefinition) Options() *NewVMOptions {
+	return &NewVMOptions{
+		Vcpus:         d.Vcpus,
+		Memory:        d.Memory,
+		Devices:       d.Devices,
+		GuestPlatform: d.GuestPlatform,
+	}
+}
+
+// vmDefinitionJSON adds the encoded bootloader to the fields of a VMDefinition.
+type vmDefinitionJSON struct {
+	*vmDefinitionFields
+	Bootloader json.RawMessage `json:"bootloader,omitempty"`
+}
+
+type vmDefinitionFields VMDefinition
+
+func (d *VMDefinition) MarshalJSON() ([]byte, error) {
+	j := vmDefinitionJSON{vmDefinitionFields: (*vmDefinitionFields)(d)}
+	if d.Bootloader != nil {
+		raw, err := virtio.MarshalBootloader(d.Bootloader)
+		if err != nil {
+			return nil, err
+		}
+		j.Bootloader = raw
+	}
+	return json.Marshal(j)
+}
+
+func (d *VMDefinition) UnmarshalJSON(data []byte) error {
+	fields := &vmDefinitionFields{}
+	j := vmDefinitionJSON{vmDefinitionFields: fields}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if fields.Version != vmDefinitionVersion {
+		return errors.Errorf("unsupported vm definition version %d", fields.Version)
+	}
+	if len(j.Bootloader) > 0 {
+		bl, err := virtio.UnmarshalBootloader(j.Bootloader)
+		if err != nil {
+			return err
+		}
+		fields.Bootloader = bl
+	}
+	*d = VMDefinition(*fields)
+	return nil
+}
+
+// ParseVMDefinition decodes a definition written as json or yaml.
+func ParseVMDefinition(data []byte) (*VMDefinition, error) {
+	d := &VMDefinition{}
+	if err := yaml.Unmarshal(data, d); err != nil {
+		return nil, errors.Errorf("unmarshalling vm definition: %w", err)
+	}
+	return d, nil
+}
+
+// WriteVMDefinition atomically writes d to dir/VMDefinitionFile.
+func WriteVMDefinition(dir string, d *VMDefinition) error {
+	data, err := yaml.Marshal(d)
+	if err != nil {
+		return errors.Errorf("marshalling vm definition: %w", err)
+	}
+
+	if err := atomicfile.WriteFile(filepath.Join(dir, VMDefinitionFile), data); err != nil {
+		return errors.Errorf("writing vm definition file: %w", err)
+	}
+
+	return nil
+}
+
+func ReadVMDefinition(dir string) (*VMDefinition, error) {
+	data, err := os.ReadFile(filepath.Join(dir, VMDefinitionFile))
+	if err != nil {
+		return nil, errors.Errorf("reading vm definition file: %w", err)
+	}
+	return ParseVMDefinition(data)
+}
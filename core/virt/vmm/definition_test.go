@@ -0,0 +1,58 @@
+package vmm_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/pkg/units"
+)
+
+func TestVMDefinitionRoundTrip(t *testing.T) {
+	opts := &vmm.NewVMOptions{
+		Vcpus:         2,
+		Memory:        strongunits.GiB(1).ToBytes(),
+		GuestPlatform: units.PlatformLinuxARM64,
+		Devices: []virtio.VirtioDevice{
+			&virtio.VirtioFs{DirectorySharingConfig: virtio.DirectorySharingConfig{MountTag: "rootfs"}, SharedDir: "/tmp/rootfs"},
+			&virtio.VirtioSerialLogFile{Path: "/tmp/console.log"},
+			&virtio.VirtioVsock{},
+			&virtio.VirtioBalloon{},
+		},
+	}
+	bl := &virtio.LinuxBootloader{VmlinuzPath: "/boot/vmlinuz", InitrdPath: "/boot/initramfs.cpio.gz", KernelCmdLine: "console=hvc0"}
+
+	dir := t.TempDir()
+	require.NoError(t, vmm.WriteVMDefinition(dir, vmm.NewVMDefinition("vm-1", opts, bl)))
+
+	d, err := vmm.ReadVMDefinition(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "vm-1", d.ID)
+	assert.Equal(t, bl, d.Bootloader)
+	assert.Equal(t, opts.Vcpus, d.Options().Vcpus)
+	assert.Equal(t, opts.Memory, d.Options().Memory)
+	assert.Equal(t, opts.GuestPlatform, d.Options().GuestPlatform)
+	assert.Equal(t, opts.Devices, d.Options().Devices)
+
+	// the stored yaml and plain json decode the same
+	data, err := json.Marshal(d)
+	require.NoError(t, err)
+	fromJSON, err := vmm.ParseVMDefinition(data)
+	require.NoError(t, err)
+	assert.Equal(t, d, fromJSON)
+}
+
+func TestVMDefinitionVersion(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, vmm.VMDefinitionFile), []byte("version: 2\nid: vm-1\n"), 0600))
+
+	_, err := vmm.ReadVMDefinition(dir)
+	require.ErrorContains(t, err, "unsupported vm definition version 2")
+}
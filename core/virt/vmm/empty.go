@@ -15,6 +15,7 @@ import (
 
 	"github.com/walteh/runm/core/virt/host"
 	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/pkg/cmdline"
 	"github.com/walteh/runm/pkg/units"
 )
 
@@ -48,6 +49,11 @@ func NewKernelCommandVM[VM VirtualMachine](
 		return nil, errors.Errorf("creating working directory: %w", err)
 	}
 
+	workingDirLock, err := LockWorkingDir(workingDir)
+	if err != nil {
+		return nil, err
+	}
+
 	ec1Dev, _, err := NewEc1BlockDevice(ctx, workingDir)
 	if err != nil {
 		return nil, errors.Errorf("creating ec1 block device: %w", err)
@@ -58,25 +64,24 @@ func NewKernelCommandVM[VM VirtualMachine](
 		return nil, errors.New("LINUX_RUNTIME_BUILD_DIR is not set")
 	}
 
-	var bootloader virtio.Bootloader
-
 	devices := []virtio.VirtioDevice{
 		ec1Dev,
 	}
 
-	switch ctrconfig.Platform {
-	case units.PlatformLinuxARM64:
-		bootloader = &virtio.LinuxBootloader{
-			InitrdPath:    filepath.Join(linuxRuntimeBuildDir, "initramfs.cpio.gz"),
-			VmlinuzPath:   filepath.Join(linuxRuntimeBuildDir, "kernel"),
-			KernelCmdLine: "console=hvc0 -- runm-mode=empty",
-		}
-	default:
-		return nil, errors.Errorf("unsupported OS: %s", ctrconfig.Platform.OS())
+	params := cmdline.DefaultRunmParams()
+	params.Mode = cmdline.ModeEmpty
+
+	bootloader, err := NewLinuxBootloader(ctrconfig.Platform,
+		filepath.Join(linuxRuntimeBuildDir, "kernel"),
+		filepath.Join(linuxRuntimeBuildDir, "initramfs.cpio.gz"),
+		params,
+	)
+	if err != nil {
+		return nil, err
 	}
 	// setup a log
 	devices = append(devices, &virtio.VirtioSerialLogFile{
-		Path:   filepath.Join(workingDir, "console.log"),
+		Path:   filepath.Join(workingDir, ConsoleLogFile),
 		Append: false,
 	})
 
@@ -111,6 +116,10 @@ func NewKernelCommandVM[VM VirtualMachine](
 		return nil, errors.Errorf("creating virtual machine: %w", err)
 	}
 
+	if err := WriteVMDefinition(workingDir, NewVMDefinition(id, &opts, bootloader)); err != nil {
+		slog.WarnContext(ctx, "failed to write vm definition", "error", err)
+	}
+
 	runner := &RunningVM[VM]{
 		bootloader:   bootloader,
 		start:        startTime,
@@ -120,6 +129,8 @@ func NewKernelCommandVM[VM VirtualMachine](
 		runtime:      nil,
 		workingDir:   workingDir,
 		netdev:       netdev,
+
+		workingDirLock: workingDirLock,
 	}
 
 	return runner, nil
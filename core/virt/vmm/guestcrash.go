@@ -0,0 +1,278 @@
+package vmm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/typeurl/v2"
+	"gitlab.com/tozd/go/errors"
+)
+
+// TaskGuestCrashEventTopic is published when the guest of a task crashes, right
+// before the exits of the processes that went down with it.
+const TaskGuestCrashEventTopic = "/runm/tasks/guest-crash"
+
+// GuestCrashExitStatus is the exit status of the processes of a crashed guest, as
+// if they had been killed.
+const GuestCrashExitStatus = 128 + 9
+
+var ErrGuestCrashed = errors.New("guest crashed")
+
+func init() {
+	typeurl.Register(&GuestCrash{}, "github.com/walteh/runm/core/virt/vmm", "GuestCrash")
+}
+
+type GuestCrashKind string
+
+const (
+	GuestCrashKernelPanic GuestCrashKind = "kernel-panic"
+	// GuestCrashGoPanic is a panic of runm-linux-init, runm-linux-mounter or any
+	// other go program writing to the console.
+	GuestCrashGoPanic GuestCrashKind = "go-panic"
+	// GuestCrashUnexpectedStop is a vm that stopped without being asked to and
+	// without anything on its console to say why.
+	GuestCrashUnexpectedStop GuestCrashKind = "unexpected-stop"
+)
+
+const (
+	// guestCrashExcerptBefore and guestCrashExcerptAfter are the console lines kept
+	// around the line that gave a crash away.
+	guestCrashExcerptBefore = 20
+	guestCrashExcerptAfter  = 60
+	// guestCrashWarnings is the number of warnings kept, the latest ones, as a soft
+	// lockup is reported again and again for as long as it lasts.
+	guestCrashWarnings = 10
+	// guestCrashSettle is how long a detector waits for the rest of a crash to reach
+	// the console before reporting it.
+	guestCrashSettle = 500 * time.Millisecond
+)
+
+// GuestCrash is a crash of the guest, seen on its console or in the vm state. It
+// matches ErrGuestCrashed.
+type GuestCrash struct {
+	ContainerID string         `json:"container_id,omitempty"`
+	VMID        string         `json:"vm_id"`
+	Kind        GuestCrashKind `json:"kind"`
+	// Summary is the console line that gave the crash away, or the state the vm
+	// stopped in.
+	Summary string `json:"summary"`
+	// Excerpt is the console around the crash.
+	Excerpt string `json:"excerpt,omitempty"`
+	// Warnings are the oopses and BUG reports the kernel printed before the crash.
+	// The kernel carries on after those, so they are no crash by themselves.
+	Warnings   []string  `json:"warnings,omitempty"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+func (e *GuestCrash) Error() string {
+	return fmt.Sprintf("guest of vm %s crashed with a %s: %s", e.VMID, e.Kind, e.Summary)
+}
+
+func (e *GuestCrash) Is(target error) bool {
+	return target == ErrGuestCrashed
+}
+
+// GuestCrashWatcher is implemented by runtimes whose container runs in a vm.
+type GuestCrashWatcher interface {
+	// WaitGuestCrash blocks until the guest crashes, returning the crash once the vm
+	// is stopped, or until the vm is stopped on purpose or ctx is done.
+	WaitGuestCrash(ctx context.Context) (*GuestCrash, error)
+}
+
+var guestCrashSignatures = []struct {
+	kind GuestCrashKind
+	re   *regexp.Regexp
+}{
+	{GuestCrashKernelPanic, regexp.MustCompile(`Kernel panic - not syncing`)},
+	// go writes the panic at the start of the line, after the kernel timestamp
+	// when it comes through printk
+	{GuestCrashGoPanic, regexp.MustCompile(`^(\[[^\]]*\]\s*)?(panic: |fatal error: )`)},
+}
+
+// guestWarningSignature matches the kernel reporting a problem it carries on after,
+// e.g. an oops in a driver or a soft lockup. It only takes the guest down when
+// panic_on_oops turns it into a kernel panic.
+var guestWarningSignature = regexp.MustCompile(`Oops: |BUG: |general protection fault|Unable to handle kernel`)
+
+// GuestCrashDetector watches the console of a vm, line by line, for kernel panics
+// and go panics. The first crash seen is the one reported, with the oopses seen
+// before it as warnings.
+type GuestCrashDetector struct {
+	mu       sync.Mutex
+	vmID     string
+	recent   []string
+	warnings []string
+	crash    *GuestCrash
+	excerpt  []string
+	after    int
+	crashed  chan struct{}
+	settle   *time.Timer
+}
+
+func NewGuestCrashDetector(vmID string) *GuestCrashDetector {
+	return &GuestCrashDetector{vmID: vmID, crashed: make(chan struct{})}
+}
+
+// ObserveLine feeds the next console line to the detector. It returns the line,
+// trimmed, when it is a warning and an empty string otherwise.
+func (d *GuestCrashDetector) ObserveLine(line string) (warning string) {
+	line = strings.TrimRight(line, "\r\n")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.crash != nil {
+		if d.after > 0 {
+			d.excerpt = append(d.excerpt, line)
+			d.after--
+			if d.after == 0 {
+				d.report()
+			}
+		}
+		return ""
+	}
+
+	for _, sig := range guestCrashSignatures {
+		if !sig.re.MatchString(line) {
+			continue
+		}
+		d.crash = &GuestCrash{
+			VMID:       d.vmID,
+			Kind:       sig.kind,
+			Summary:    strings.TrimSpace(line),
+			DetectedAt: time.Now(),
+		}
+		d.excerpt = append(append(d.excerpt, d.recent...), line)
+		d.recent = nil
+		d.after = guestCrashExcerptAfter
+		d.settle = time.AfterFunc(guestCrashSettle, func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.report()
+		})
+		return ""
+	}
+
+	if guestWarningSignature.MatchString(line) {
+		warning = strings.TrimSpace(line)
+		d.warnings = append(d.warnings, warning)
+		if len(d.warnings) > guestCrashWarnings {
+			d.warnings = d.warnings[1:]
+		}
+	}
+
+	d.recent = append(d.recent, line)
+	if len(d.recent) > guestCrashExcerptBefore {
+		d.recent = d.recent[1:]
+	}
+	return warning
+}
+
+// ObserveStop reports the vm as crashed when it stopped in state without its
+// console showing a crash first.
+func (d *GuestCrashDetector) ObserveStop(state VirtualMachineStateType) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.crash != nil {
+		d.report()
+		return
+	}
+
+	d.crash = &GuestCrash{
+		VMID:       d.vmID,
+		Kind:       GuestCrashUnexpectedStop,
+		Summary:    fmt.Sprintf("vm entered state %s without being stopped", state),
+		DetectedAt: time.Now(),
+	}
+	d.excerpt = d.recent
+	d.recent = nil
+	d.report()
+}
+
+// report must be called with mu held.
+func (d *GuestCrashDetector) report() {
+	select {
+	case <-d.crashed:
+		return
+	default:
+	}
+	if d.settle != nil {
+		d.settle.Stop()
+	}
+	d.after = 0
+	d.crash.Excerpt = strings.Join(d.excerpt, "\n")
+	d.crash.Warnings = d.warnings
+	close(d.crashed)
+}
+
+// Crashed is closed once a crash is seen and its excerpt is complete.
+func (d *GuestCrashDetector) Crashed() <-chan struct{} {
+	return d.crashed
+}
+
+// Crash returns the crash that closed Crashed, or nil.
+func (d *GuestCrashDetector) Crash() *GuestCrash {
+	select {
+	case <-d.crashed:
+	default:
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := *d.crash
+	return &c
+}
+
+// finish reports a crash seen so far without waiting for it to settle, and returns
+// it or nil.
+func (d *GuestCrashDetector) finish() *GuestCrash {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.crash == nil {
+		return nil
+	}
+	d.report()
+	c := *d.crash
+	return &c
+}
+
+// DetectGuestCrash scans a console log for a crash. It returns nil when the log
+// shows none.
+func DetectGuestCrash(vmID, consoleLog string) (*GuestCrash, error) {
+	d := NewGuestCrashDetector(vmID)
+	if err := d.scan(consoleLog); err != nil {
+		return nil, err
+	}
+	return d.finish(), nil
+}
+
+func (d *GuestCrashDetector) scan(consoleLog string) error {
+	f, err := os.Open(consoleLog)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Errorf("opening console log: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		d.ObserveLine(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Errorf("reading console log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package vmm_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+func TestDetectGuestCrash(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		console  string
+		kind     vmm.GuestCrashKind
+		summary  string
+		warnings []string
+	}{
+		{
+			name: "kernel panic",
+			console: `[    0.412345] Run /init as init process
+[    0.512345] Kernel panic - not syncing: VFS: Unable to mount root fs on unknown-block(0,0)
+[    0.512346] CPU: 0 PID: 1 Comm: swapper/0 Not tainted 6.12.0 #1`,
+			kind:    vmm.GuestCrashKernelPanic,
+			summary: "[    0.512345] Kernel panic - not syncing: VFS: Unable to mount root fs on unknown-block(0,0)",
+		},
+		{
+			name: "kernel oops with panic_on_oops",
+			console: `[    3.100000] BUG: kernel NULL pointer dereference, address: 0000000000000008
+[    3.100001] Oops: 0000 [#1] PREEMPT SMP NOPTI
+[    3.100002] Kernel panic - not syncing: Fatal exception`,
+			kind:    vmm.GuestCrashKernelPanic,
+			summary: "[    3.100002] Kernel panic - not syncing: Fatal exception",
+			warnings: []string{
+				"[    3.100000] BUG: kernel NULL pointer dereference, address: 0000000000000008",
+				"[    3.100001] Oops: 0000 [#1] PREEMPT SMP NOPTI",
+			},
+		},
+		{
+			name: "go panic",
+			console: `time=2025-01-01T00:00:00Z level=INFO msg="mounting rootfs"
+panic: runtime error: invalid memory address or nil pointer dereference
+[signal SIGSEGV: segmentation violation code=0x1 addr=0x0 pc=0x4a2b1c]
+
+goroutine 1 [running]:
+main.main()
+	/src/cmd/runm-linux-init/main.go:42 +0x1c
+[    1.200000] Kernel panic - not syncing: Attempted to kill init! exitcode=0x00000200`,
+			kind:    vmm.GuestCrashGoPanic,
+			summary: "panic: runtime error: invalid memory address or nil pointer dereference",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), vmm.ConsoleLogFile)
+			require.NoError(t, os.WriteFile(path, []byte(tc.console+"\n"), 0644))
+
+			crash, err := vmm.DetectGuestCrash("vm-1", path)
+			require.NoError(t, err)
+			require.NotNil(t, crash)
+			assert.Equal(t, tc.kind, crash.Kind)
+			assert.Equal(t, tc.summary, crash.Summary)
+			assert.Equal(t, tc.warnings, crash.Warnings)
+			assert.Equal(t, "vm-1", crash.VMID)
+			// the whole console is short enough to end up in the excerpt
+			assert.Equal(t, tc.console, crash.Excerpt)
+
+			wrapped := errors.Errorf("booting virtual machine: %w", crash)
+			assert.ErrorIs(t, wrapped, vmm.ErrGuestCrashed)
+		})
+	}
+}
+
+func TestDetectGuestCrashHealthy(t *testing.T) {
+	dir := t.TempDir()
+
+	crash, err := vmm.DetectGuestCrash("vm-1", filepath.Join(dir, vmm.ConsoleLogFile))
+	require.NoError(t, err)
+	assert.Nil(t, crash, "no console log yet")
+
+	path := filepath.Join(dir, vmm.ConsoleLogFile)
+	require.NoError(t, os.WriteFile(path, []byte(`[    0.412345] Run /init as init process
+time=2025-01-01T00:00:00Z level=WARN msg="recovered from panic: retrying"
+[   48.123456] watchdog: BUG: soft lockup - CPU#0 stuck for 22s! [runm-linux-init:1]
+[   49.000000] Oops: 0000 [#1] PREEMPT SMP NOPTI
+`), 0644))
+
+	crash, err = vmm.DetectGuestCrash("vm-1", path)
+	require.NoError(t, err)
+	assert.Nil(t, crash)
+}
+
+func TestGuestCrashDetector(t *testing.T) {
+	d := vmm.NewGuestCrashDetector("vm-1")
+
+	for i := range 30 {
+		d.ObserveLine("boot line " + strings.Repeat("x", i))
+	}
+	assert.Nil(t, d.Crash())
+
+	assert.Equal(t, "watchdog: BUG: soft lockup - CPU#0 stuck for 22s!", d.ObserveLine("watchdog: BUG: soft lockup - CPU#0 stuck for 22s!"))
+	assert.Nil(t, d.Crash(), "the kernel carries on after an oops")
+
+	assert.Empty(t, d.ObserveLine("fatal error: concurrent map writes"))
+	select {
+	case <-d.Crashed():
+		t.Fatal("reported before the rest of the trace reached the console")
+	default:
+	}
+
+	// the trace keeps coming until the excerpt is full
+	for range 100 {
+		d.ObserveLine("goroutine 7 [running]:")
+	}
+	<-d.Crashed()
+
+	crash := d.Crash()
+	require.NotNil(t, crash)
+	assert.Equal(t, vmm.GuestCrashGoPanic, crash.Kind)
+	lines := strings.Split(crash.Excerpt, "\n")
+	assert.Len(t, lines, 20+1+60)
+	assert.Equal(t, "fatal error: concurrent map writes", lines[20])
+	assert.Equal(t, []string{"watchdog: BUG: soft lockup - CPU#0 stuck for 22s!"}, crash.Warnings)
+
+	// a stop after the crash does not replace it
+	d.ObserveStop(vmm.VirtualMachineStateTypeStopped)
+	assert.Equal(t, vmm.GuestCrashGoPanic, d.Crash().Kind)
+}
+
+func TestGuestCrashDetectorUnexpectedStop(t *testing.T) {
+	d := vmm.NewGuestCrashDetector("vm-1")
+	d.ObserveLine("last words")
+	d.ObserveStop(vmm.VirtualMachineStateTypeError)
+
+	<-d.Crashed()
+	crash := d.Crash()
+	require.NotNil(t, crash)
+	assert.Equal(t, vmm.GuestCrashUnexpectedStop, crash.Kind)
+	assert.Equal(t, "last words", crash.Excerpt)
+	assert.ErrorIs(t, crash, vmm.ErrGuestCrashed)
+}
@@ -0,0 +1,69 @@
+package vmm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// HybridVsockVM is implemented by virtual machines whose vsock device is exposed on
+// the host as a unix socket using the "hybrid vsock" convention shared by Firecracker
+// and Cloud Hypervisor. Unlike an in-process vsock device, that socket stays usable
+// by any process on the host for as long as the VM runs.
+type HybridVsockVM interface {
+	HybridVsockSocketPath() string
+}
+
+// DialHybridVsock connects to a guest vsock port through a hybrid vsock unix socket:
+// the host writes "CONNECT <port>\n" and the VMM answers "OK <host-port>\n" before
+// handing the stream over to the guest.
+func DialHybridVsock(ctx context.Context, socketPath string, port uint32) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return nil, errors.Errorf("dialing hybrid vsock socket %s: %w", socketPath, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		conn.Close()
+		return nil, errors.Errorf("writing hybrid vsock connect: %w", err)
+	}
+
+	// read byte by byte so nothing after the ack is buffered away from the caller
+	line, err := readLine(conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Errorf("reading hybrid vsock ack: %w", err)
+	}
+
+	if !strings.HasPrefix(line, "OK ") {
+		conn.Close()
+		return nil, errors.Errorf("hybrid vsock connect to port %d refused: %q", port, line)
+	}
+
+	return conn, nil
+}
+
+func readLine(conn net.Conn) (string, error) {
+	var sb strings.Builder
+	buf := make([]byte, 1)
+	for sb.Len() < 512 {
+		if _, err := conn.Read(buf); err != nil {
+			return "", err
+		}
+		if buf[0] == '\n' {
+			return sb.String(), nil
+		}
+		sb.WriteByte(buf[0])
+	}
+	return "", errors.Errorf("hybrid vsock ack too long")
+}
@@ -71,6 +71,8 @@ func NewMbinBlockDevice(ctx context.Context, wrkdir string) (virtio.VirtioDevice
 	if err != nil {
 		return nil, outMount, errors.Errorf("creating mbin virtio device: %w", err)
 	}
+	// the image is shared with other vms through the artifact store
+	mbinDev.ReadOnly = true
 
 	return mbinDev, outMount, nil
 }
@@ -100,3 +102,26 @@ func connectToVsockWithRetry(ctx context.Context, vm VirtualMachine, port uint32
 		}
 	}
 }
+
+// WaitFor retries check until it succeeds or timeout passes, e.g. while a
+// hypervisor process starts serving its api.
+func WaitFor(ctx context.Context, timeout time.Duration, check func(context.Context) error) error {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		err := check(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return errors.Errorf("timeout after %s: %w", timeout, err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
@@ -21,10 +22,12 @@ import (
 
 	slogctx "github.com/veqryn/slog-context"
 
+	"github.com/walteh/runm/core/gvnet"
 	"github.com/walteh/runm/core/runc/process"
 	"github.com/walteh/runm/core/virt/host"
 	"github.com/walteh/runm/core/virt/virtio"
 	"github.com/walteh/runm/linux/constants"
+	"github.com/walteh/runm/pkg/cmdline"
 	"github.com/walteh/runm/pkg/units"
 )
 
@@ -38,6 +41,27 @@ type OCIVMConfig struct {
 	StartingMemory strongunits.B
 	VCPUs          uint64
 	Platform       units.Platform
+	// RestoreWorkingDir, when set, is laid over the working directory once the
+	// devices are prepared, see VMCheckpointWorkingDir.
+	RestoreWorkingDir string
+	// BuildDir is copied into the working directory, it holds the guest images.
+	BuildDir string
+	// KernelPath and InitramfsPath are booted by the vm, they default to the
+	// kernel and initramfs in BuildDir.
+	KernelPath    string
+	InitramfsPath string
+	// DisableNetwork boots the vm without a network device.
+	DisableNetwork bool
+	// GuestLogLevel, GuestDebug and the OTLP collector are passed to runm-linux-init.
+	GuestLogLevel     slog.Level
+	GuestDebug        bool
+	GuestOTLPEndpoint string
+	GuestOTLPProtocol string
+	// BootTimeout and GuestConnectTimeout override the defaults when set.
+	BootTimeout         time.Duration
+	GuestConnectTimeout time.Duration
+	// ExtraDevices are added after the devices runm needs.
+	ExtraDevices []virtio.VirtioDevice
 }
 
 func appendContext(ctx context.Context, id string) context.Context {
@@ -82,10 +106,32 @@ func NewOCIVirtualMachine[VM VirtualMachine](
 	ctx = appendContext(ctx, id)
 
 	startTime := time.Now()
+	timeline := NewBootTimeline(ctrconfig.ID, id, startTime)
 
-	linuxRuntimeBuildDir := os.Getenv("LINUX_RUNTIME_BUILD_DIR")
+	linuxRuntimeBuildDir := ctrconfig.BuildDir
 	if linuxRuntimeBuildDir == "" {
-		return nil, errors.New("LINUX_RUNTIME_BUILD_DIR is not set")
+		return nil, errors.New("no build directory configured, set build_dir in the runm runtime options")
+	}
+
+	kernelPath := ctrconfig.KernelPath
+	if kernelPath == "" {
+		kernelPath = filepath.Join(linuxRuntimeBuildDir, "kernel")
+	}
+	initramfsPath := ctrconfig.InitramfsPath
+	if initramfsPath == "" {
+		initramfsPath = filepath.Join(linuxRuntimeBuildDir, "initramfs.cpio.gz")
+	}
+
+	bootloader, err := NewLinuxBootloader(ctrconfig.Platform, kernelPath, initramfsPath, cmdline.RunmParams{
+		Mode:         cmdline.ModeOCI,
+		LogLevel:     ctrconfig.GuestLogLevel,
+		VsockPort:    constants.RunmVsockPort,
+		Debug:        ctrconfig.GuestDebug,
+		OTLPEndpoint: ctrconfig.GuestOTLPEndpoint,
+		OTLPProtocol: ctrconfig.GuestOTLPProtocol,
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	workingDir, err := host.EmphiricalVMCacheDir(ctx, id)
@@ -93,16 +139,38 @@ func NewOCIVirtualMachine[VM VirtualMachine](
 		return nil, err
 	}
 
-	// copy the build dir to the working dir
+	// link the build dir into the working dir, sharing its images with other vms
+	copyStart := time.Now()
 	err = os.MkdirAll(filepath.Join(workingDir, "build"), 0755)
 	if err != nil {
 		return nil, errors.Errorf("creating build directory: %w", err)
 	}
 
-	if err = os.CopyFS(workingDir, os.DirFS(linuxRuntimeBuildDir)); err != nil {
-		return nil, errors.Errorf("copying build directory: %w", err)
+	workingDirLock, err := LockWorkingDir(workingDir)
+	if err != nil {
+		return nil, err
+	}
+	// handed to the running vm, released when the vm is not created
+	defer func() {
+		if workingDirLock != nil {
+			workingDirLock.Close()
+		}
+	}()
+
+	artifacts, err := DefaultArtifactStore(ctx)
+	if err != nil {
+		return nil, err
 	}
 
+	if err = artifacts.LinkTree(ctx, workingDir, linuxRuntimeBuildDir); err != nil {
+		return nil, errors.Errorf("linking build directory: %w", err)
+	}
+	timeline.Record(BootPhaseBuildDirCopy, copyStart)
+
+	// the rootfs devices are finished in the background, so this phase overlaps the
+	// network startup and ends once creationErrGroup is done
+	mountStart := time.Now()
+
 	bindMounts, mountDevices, err := PrepareContainerMounts(ctx, ctrconfig.Spec, ctrconfig.ID)
 	if err != nil {
 		return nil, errors.Errorf("preparing container mounts: %w", err)
@@ -134,39 +202,33 @@ func NewOCIVirtualMachine[VM VirtualMachine](
 	}
 	devices = append(devices, ec1Devices...)
 
-	var bootloader virtio.Bootloader
-
-	switch ctrconfig.Platform {
-	case units.PlatformLinuxARM64:
-		bootloader = &virtio.LinuxBootloader{
-			InitrdPath:    filepath.Join(linuxRuntimeBuildDir, "initramfs.cpio.gz"),
-			VmlinuzPath:   filepath.Join(linuxRuntimeBuildDir, "kernel"),
-			KernelCmdLine: "console=hvc0 -- runm-mode=oci",
-		}
-	default:
-		return nil, errors.Errorf("unsupported OS: %s", ctrconfig.Platform.OS())
-	}
-
 	if ctrconfig.Spec.Process.Terminal {
 		return nil, errors.New("terminal support is not implemented yet")
 	} else {
-		// setup a log
+		// setup a log, appended to so that ConsoleLog can rotate it in place
 		devices = append(devices, &virtio.VirtioSerialLogFile{
-			Path:   filepath.Join(workingDir, "console.log"),
-			Append: false,
+			Path:   filepath.Join(workingDir, ConsoleLogFile),
+			Append: true,
 		})
 
 	}
 
 	// add vsock and memory devices
 
-	netdev, hostIPPort, err := PrepareVirtualNetwork(ctx)
-	if err != nil {
-		return nil, errors.Errorf("creating net device: %w", err)
+	var netdev gvnet.Proxy
+	var hostIPPort uint16
+	if !ctrconfig.DisableNetwork {
+		netStart := time.Now()
+		netdev, hostIPPort, err = PrepareVirtualNetwork(ctx)
+		if err != nil {
+			return nil, errors.Errorf("creating net device: %w", err)
+		}
+		devices = append(devices, netdev.VirtioNetDevice())
+		timeline.Record(BootPhaseNetworkStartup, netStart)
 	}
-	devices = append(devices, netdev.VirtioNetDevice())
 	devices = append(devices, &virtio.VirtioVsock{})
 	devices = append(devices, &virtio.VirtioBalloon{})
+	devices = append(devices, ctrconfig.ExtraDevices...)
 
 	opts := NewVMOptions{
 		Vcpus:         ctrconfig.VCPUs,
@@ -182,12 +244,26 @@ func NewOCIVirtualMachine[VM VirtualMachine](
 		return nil, errors.Errorf("error waiting for errgroup: %w", err)
 	}
 
-	slog.InfoContext(ctx, "ready to create vm", "async_wait_duration", time.Since(waitStart))
+	timeline.Record(BootPhaseMountPreparation, mountStart)
+
+	slog.InfoContext(ctx, "ready to create vm", "async_wait_duration", time.Since(waitStart), "devices", deviceStrings(devices))
 
+	if ctrconfig.RestoreWorkingDir != "" {
+		if err := copyTree(workingDir, ctrconfig.RestoreWorkingDir); err != nil {
+			return nil, errors.Errorf("restoring working directory from checkpoint: %w", err)
+		}
+	}
+
+	createStart := time.Now()
 	vm, err := hpv.NewVirtualMachine(ctx, id, &opts, bootloader)
 	if err != nil {
 		return nil, errors.Errorf("creating virtual machine: %w", err)
 	}
+	timeline.Record(BootPhaseHypervisorCreate, createStart)
+
+	if err := WriteVMDefinition(workingDir, NewVMDefinition(id, &opts, bootloader)); err != nil {
+		slog.WarnContext(ctx, "failed to write vm definition", "error", err)
+	}
 
 	runner := &RunningVM[VM]{
 		bootloader:   bootloader,
@@ -198,7 +274,14 @@ func NewOCIVirtualMachine[VM VirtualMachine](
 		runtime:      nil,
 		workingDir:   workingDir,
 		netdev:       netdev,
+		timeline:     timeline,
+
+		workingDirLock: workingDirLock,
+
+		bootTimeout:         ctrconfig.BootTimeout,
+		guestConnectTimeout: ctrconfig.GuestConnectTimeout,
 	}
+	workingDirLock = nil
 
 	slog.InfoContext(ctx, "created oci vm", "id", ctrconfig.ID)
 
@@ -382,11 +465,15 @@ func PrepareContainerVirtioDevicesFromRootfs(ctx context.Context, wrkdir string,
 	// create a temporary timesync file
 	go func() {
 
+		defer timeout.Stop()
+
 		for {
 			select {
+			case <-ctx.Done():
+				return
 			case <-timeout.C:
 				err := os.WriteFile(timesyncFile, []byte("done"), 0644)
-				if err != nil {
+				if err != nil && !os.IsNotExist(err) {
 					slog.ErrorContext(ctx, "error writing timesync file", "error", err)
 				}
 				return
@@ -395,6 +482,10 @@ func PrepareContainerVirtioDevicesFromRootfs(ctx context.Context, wrkdir string,
 				timez += ":" + strconv.Itoa(zoneoffset)
 				// slog.InfoContext(ctx, "writing timesync file", "time", timez)
 				err := os.WriteFile(timesyncFile, []byte(timez), 0644)
+				if os.IsNotExist(err) {
+					// the vm is gone along with its working dir
+					return
+				}
 				if err != nil {
 					slog.ErrorContext(ctx, "error writing timesync file", "error", err)
 				}
@@ -411,3 +502,17 @@ func PrepareContainerVirtioDevicesFromRootfs(ctx context.Context, wrkdir string,
 
 	return devices, nil
 }
+
+// deviceStrings describes devices for the logs, by the device strings the runm
+// devices option takes where they have one.
+func deviceStrings(devices []virtio.VirtioDevice) []string {
+	strs := make([]string, 0, len(devices))
+	for _, dev := range devices {
+		str, err := virtio.DeviceString(dev)
+		if err != nil {
+			str = fmt.Sprintf("%T", dev)
+		}
+		strs = append(strs, str)
+	}
+	return strs
+}
@@ -0,0 +1,191 @@
+package vmm
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+
+	grpcruntime "github.com/walteh/runm/core/runc/runtime/grpc"
+	"github.com/walteh/runm/linux/constants"
+	"github.com/walteh/runm/pkg/atomicfile"
+	"github.com/walteh/runm/pkg/units"
+)
+
+// PersistedVMFile is written to the vm working directory once the vm is running.
+const PersistedVMFile = "runm-vm.json"
+
+const persistedVMVersion = 1
+
+// ErrNotReattachable is returned when a vm cannot be reached from a process other
+// than the one that started it, e.g. because its vsock device lives in that process.
+var ErrNotReattachable = errors.New("vm cannot be reattached from another process")
+
+// PersistedVM is everything a new shim process needs to find and reconnect to a vm
+// started by a previous one.
+type PersistedVM struct {
+	Version       int            `json:"version"`
+	ID            string         `json:"id"`
+	WorkingDir    string         `json:"working_dir"`
+	GuestPlatform units.Platform `json:"guest_platform"`
+	// VsockEndpoint is the hybrid vsock unix socket of the vm, empty when the vsock
+	// device is only reachable through the VirtualMachine, e.g. the one a
+	// ReattachableHypervisor rebuilds.
+	VsockEndpoint string `json:"vsock_endpoint,omitempty"`
+	VsockPort     uint32 `json:"vsock_port"`
+	// GvnetPort is the host port forwarded to the guest by gvnet. It is only
+	// served while the shim that started the vm is alive, see ReattachRunningVM.
+	GvnetPort uint16    `json:"gvnet_port"`
+	StartedAt time.Time `json:"started_at"`
+	// HelperPids are the host processes the vm needs next to its hypervisor, see
+	// HelperProcessVM.
+	HelperPids []int `json:"helper_pids,omitempty"`
+}
+
+// HelperProcessVM is implemented by vms that run host processes next to their
+// hypervisor, e.g. the virtiofsd serving a share. A shim that reattaches to the vm
+// stops them along with it.
+type HelperProcessVM interface {
+	HelperPids() []int
+}
+
+// Persist writes the reattach information for the vm into its working directory.
+func (r *RunningVM[VM]) Persist(ctx context.Context, guestPlatform units.Platform) (*PersistedVM, error) {
+	st := &PersistedVM{
+		Version:       persistedVMVersion,
+		ID:            r.vm.ID(),
+		WorkingDir:    r.workingDir,
+		GuestPlatform: guestPlatform,
+		VsockPort:     uint32(constants.RunmVsockPort),
+		GvnetPort:     r.portOnHostIP,
+		StartedAt:     r.start,
+	}
+
+	if hv, ok := any(r.vm).(HybridVsockVM); ok {
+		st.VsockEndpoint = hv.HybridVsockSocketPath()
+	}
+
+	if hp, ok := any(r.vm).(HelperProcessVM); ok {
+		st.HelperPids = hp.HelperPids()
+	}
+
+	if err := WritePersistedVM(r.workingDir, st); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+func (r *RunningVM[VM]) WorkingDir() string {
+	return r.workingDir
+}
+
+// ReleaseWorkingDir lets VMCacheGC collect the working directory once the vm is
+// gone.
+func (r *RunningVM[VM]) ReleaseWorkingDir() {
+	if r.workingDirLock != nil {
+		r.workingDirLock.Close()
+		r.workingDirLock = nil
+	}
+}
+
+// WritePersistedVM atomically writes st to dir/PersistedVMFile.
+func WritePersistedVM(dir string, st *PersistedVM) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return errors.Errorf("marshalling persisted vm: %w", err)
+	}
+
+	if err := atomicfile.WriteFile(filepath.Join(dir, PersistedVMFile), data); err != nil {
+		return errors.Errorf("writing persisted vm file: %w", err)
+	}
+
+	return nil
+}
+
+func ReadPersistedVM(dir string) (*PersistedVM, error) {
+	data, err := os.ReadFile(filepath.Join(dir, PersistedVMFile))
+	if err != nil {
+		return nil, errors.Errorf("reading persisted vm file: %w", err)
+	}
+
+	st := &PersistedVM{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, errors.Errorf("unmarshalling persisted vm file: %w", err)
+	}
+
+	if st.Version != persistedVMVersion {
+		return nil, errors.Errorf("unsupported persisted vm version %d", st.Version)
+	}
+
+	return st, nil
+}
+
+// ReattachGuestService connects to the guest agent of a vm started by another process.
+func ReattachGuestService(ctx context.Context, st *PersistedVM) (*grpcruntime.GRPCClientRuntime, error) {
+	if st.VsockEndpoint == "" {
+		return nil, errors.Errorf("vm %s has no host side vsock endpoint: %w", st.ID, ErrNotReattachable)
+	}
+
+	if _, err := os.Stat(st.VsockEndpoint); err != nil {
+		return nil, errors.Errorf("vm %s vsock endpoint is gone, the vm is probably not running: %w", st.ID, err)
+	}
+
+	return connectGuestService(ctx, st.ID, defaultGuestConnectTimeout, func(ctx context.Context) (net.Conn, error) {
+		return DialHybridVsock(ctx, st.VsockEndpoint, st.VsockPort)
+	})
+}
+
+// ReattachableHypervisor is implemented by hypervisors that can rebuild a
+// VirtualMachine handle for a vm started by another process.
+type ReattachableHypervisor[VM VirtualMachine] interface {
+	ReattachVirtualMachine(ctx context.Context, st *PersistedVM) (VM, error)
+}
+
+// ReattachRunningVM rebuilds a RunningVM for a vm described by st.
+//
+// The gvnet proxy is not restored: its network stack ran inside the previous
+// process and the guest's virtio-net device was connected to it, so a reattached
+// vm has no network and PortOnHostIP returns 0.
+func ReattachRunningVM[VM VirtualMachine](ctx context.Context, hpv Hypervisor[VM], st *PersistedVM) (*RunningVM[VM], error) {
+	rh, ok := any(hpv).(ReattachableHypervisor[VM])
+	if !ok {
+		return nil, errors.Errorf("hypervisor %T does not support reattaching: %w", hpv, ErrNotReattachable)
+	}
+
+	vm, err := rh.ReattachVirtualMachine(ctx, st)
+	if err != nil {
+		return nil, errors.Errorf("reattaching virtual machine %s: %w", st.ID, err)
+	}
+
+	var rt *grpcruntime.GRPCClientRuntime
+	if st.VsockEndpoint != "" {
+		rt, err = ReattachGuestService(ctx, st)
+	} else {
+		// the vsock device of the reattached vm is reachable through vm itself
+		rt, err = connectGuestService(ctx, st.ID, defaultGuestConnectTimeout, func(ctx context.Context) (net.Conn, error) {
+			return vm.VSockConnect(ctx, st.VsockPort)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	workingDirLock, err := LockWorkingDir(st.WorkingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RunningVM[VM]{
+		runtime:        rt,
+		start:          st.StartedAt,
+		vm:             vm,
+		wait:           make(chan error, 1),
+		workingDir:     st.WorkingDir,
+		workingDirLock: workingDirLock,
+	}, nil
+}
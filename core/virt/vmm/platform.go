@@ -0,0 +1,43 @@
+package vmm
+
+import (
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/pkg/cmdline"
+	"github.com/walteh/runm/pkg/units"
+)
+
+// linuxKernelParams are the kernel parameters every linux guest of a platform boots
+// with, the guest console is always the first virtio console.
+var linuxKernelParams = map[units.Platform][]cmdline.Param{
+	units.PlatformLinuxARM64: cmdline.MustParse("console=hvc0").Kernel,
+	// there is no legacy pc hardware to probe or calibrate against
+	units.PlatformLinuxAMD64: cmdline.MustParse("console=hvc0 reboot=k tsc=reliable no_timer_check i8042.noaux i8042.nomux i8042.nopnp i8042.dumbkbd").Kernel,
+}
+
+// IsSupportedGuestPlatform reports whether linux guests of platform can be booted.
+func IsSupportedGuestPlatform(platform units.Platform) bool {
+	_, ok := linuxKernelParams[platform]
+	return ok
+}
+
+// NewLinuxBootloader boots kernel and initramfs as a guest of platform, passing
+// runm to runm-linux-init.
+func NewLinuxBootloader(platform units.Platform, kernel, initramfs string, runm cmdline.RunmParams) (*virtio.LinuxBootloader, error) {
+	params, ok := linuxKernelParams[platform]
+	if !ok {
+		return nil, errors.Errorf("unsupported guest platform: %s", platform)
+	}
+
+	cl := &cmdline.Cmdline{
+		Kernel: params,
+		Init:   runm.Params(),
+	}
+
+	return &virtio.LinuxBootloader{
+		VmlinuzPath:   kernel,
+		InitrdPath:    initramfs,
+		KernelCmdLine: cl.String(),
+	}, nil
+}
@@ -0,0 +1,12 @@
+//go:build darwin
+
+package vmm
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// reflink makes dst a copy-on-write clone of src, on apfs.
+func reflink(src, dst string) error {
+	return unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+}
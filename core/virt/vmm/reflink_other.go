@@ -0,0 +1,11 @@
+//go:build !darwin && !linux
+
+package vmm
+
+import (
+	"gitlab.com/tozd/go/errors"
+)
+
+func reflink(src, dst string) error {
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/nxadm/tail"
@@ -18,6 +19,8 @@ import (
 	"github.com/walteh/runm/core/virt/virtio"
 	"github.com/walteh/runm/linux/constants"
 	"github.com/walteh/runm/pkg/logging"
+	"github.com/walteh/runm/pkg/metrics"
+	"github.com/walteh/runm/pkg/tracing"
 	runmv1 "github.com/walteh/runm/proto/v1"
 	"gitlab.com/tozd/go/errors"
 	"golang.org/x/sync/errgroup"
@@ -41,17 +44,59 @@ type RunningVM[VM VirtualMachine] struct {
 	stdout       io.Writer
 	stderr       io.Writer
 	// connStatus      <-chan VSockManagerState
-	start time.Time
+	start        time.Time
+	bootDuration time.Duration
+	// timeline is nil for vms that do not run a container
+	timeline *BootTimeline
+	// active is set while the vm is counted in metrics.ActiveVMs
+	active atomic.Bool
+	// workingDirLock keeps VMCacheGC away from workingDir, see LockWorkingDir
+	workingDirLock *os.File
+	// stopping is set once the vm is stopped on purpose, so it is not taken for a
+	// crash
+	stopping atomic.Bool
+
+	// zero means defaultBootTimeout and defaultGuestConnectTimeout
+	bootTimeout         time.Duration
+	guestConnectTimeout time.Duration
 }
 
+const (
+	defaultBootTimeout         = 30 * time.Second
+	defaultGuestConnectTimeout = 3 * time.Second
+)
+
 func (r *RunningVM[VM]) GuestService(ctx context.Context) (*grpcruntime.GRPCClientRuntime, error) {
 	slog.InfoContext(ctx, "getting guest service", "id", r.vm.ID())
 	if r.runtime != nil {
 		return r.runtime, nil
 	}
 
+	timeout := r.guestConnectTimeout
+	if timeout == 0 {
+		timeout = defaultGuestConnectTimeout
+	}
+
+	rt, err := connectGuestService(ctx, r.vm.ID(), timeout, func(ctx context.Context) (net.Conn, error) {
+		return r.vm.VSockConnect(ctx, uint32(constants.RunmVsockPort))
+	})
+	if err != nil {
+		// the guest agent never answers a crashed guest, say why
+		if crash := r.GuestCrash(ctx); crash != nil {
+			return nil, errors.Errorf("connecting to guest service: %w", crash)
+		}
+		return nil, err
+	}
+
+	r.runtime = rt
+	return r.runtime, nil
+}
+
+// connectGuestService retries dial until the guest agent accepts a connection and
+// returns a grpc client over it, giving up after wait.
+func connectGuestService(ctx context.Context, id string, wait time.Duration, dial func(ctx context.Context) (net.Conn, error)) (*grpcruntime.GRPCClientRuntime, error) {
 	ticker := time.NewTicker(100 * time.Millisecond)
-	timeout := time.NewTimer(3 * time.Second)
+	timeout := time.NewTimer(wait)
 	defer ticker.Stop()
 	defer timeout.Stop()
 
@@ -60,17 +105,24 @@ func (r *RunningVM[VM]) GuestService(ctx context.Context) (*grpcruntime.GRPCClie
 	for {
 		select {
 		case <-ticker.C:
-			slog.InfoContext(ctx, "connecting to vsock", "port", constants.RunmVsockPort)
-			conn, err := r.vm.VSockConnect(ctx, uint32(constants.RunmVsockPort))
+			slog.InfoContext(ctx, "connecting to vsock", "id", id, "port", constants.RunmVsockPort)
+			conn, err := dial(ctx)
 			if err != nil {
 				lastError = err
 				continue
 			}
 			grpcConn, err := grpc.NewClient("passthrough:target",
 				grpc.WithTransportCredentials(insecure.NewCredentials()),
+				tracing.GRPCClientOption(),
+				metrics.GRPCClientOption(),
 				grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
 					slog.InfoContext(ctx, "dialing vsock", "port", constants.RunmVsockPort, "ignored_addr", addr)
-					return conn, nil
+					// hand out the first connection, then redial so grpc can reconnect
+					if c := conn; c != nil {
+						conn = nil
+						return c, nil
+					}
+					return dial(ctx)
 				}),
 			)
 			if err != nil {
@@ -81,12 +133,12 @@ func (r *RunningVM[VM]) GuestService(ctx context.Context) (*grpcruntime.GRPCClie
 			// test the connection
 			grpcConn.Connect()
 
-			r.runtime, err = grpcruntime.NewGRPCClientRuntimeFromConn(grpcConn)
+			rt, err := grpcruntime.NewGRPCClientRuntimeFromConn(grpcConn)
 			if err != nil {
 				lastError = err
 				continue
 			}
-			return r.runtime, nil
+			return rt, nil
 		case <-timeout.C:
 			slog.ErrorContext(ctx, "timeout waiting for guest service connection", "error", lastError)
 			return nil, errors.Errorf("timeout waiting for guest service connection: %w", lastError)
@@ -130,10 +182,11 @@ func (r *RunningVM[VM]) RunCommandSimple(ctx context.Context, command string) ([
 	// req, err := harpoonv1.NewValidatedRunRequest(func(b *harpoonv1.RunRequest_builder) {
 	// 	// b.Stdin = stdinData
 	// })
+	// env_vars is required, an empty map fails validation
 	req, err := runmv1.NewGuestRunCommandRequestE(&runmv1.GuestRunCommandRequest_builder{
 		Argc:    argc,
 		Argv:    argv,
-		EnvVars: map[string]string{},
+		EnvVars: map[string]string{"PATH": constants.DefaultGuestPath},
 		Stdin:   []byte{},
 	})
 	if err != nil {
@@ -149,25 +202,45 @@ func (r *RunningVM[VM]) RunCommandSimple(ctx context.Context, command string) ([
 }
 
 func (rvm *RunningVM[VM]) Start(ctx context.Context) error {
+	return rvm.bootWith(ctx, func(ctx context.Context) error {
+		timeout := rvm.bootTimeout
+		if timeout == 0 {
+			timeout = defaultBootTimeout
+		}
+		return bootVM(ctx, rvm.VM(), timeout)
+	})
+}
+
+// bootWith brings the vm up with boot and then waits for the guest service, the same
+// way whether the vm is booted fresh or restored from a snapshot.
+func (rvm *RunningVM[VM]) bootWith(ctx context.Context, boot func(ctx context.Context) error) error {
 
 	errgrp, _ := errgroup.WithContext(ctx)
 
-	errgrp.Go(func() error {
-		err := rvm.netdev.Wait(ctx)
-		if err != nil {
-			slog.ErrorContext(ctx, "error waiting for netdev", "error", err)
-			return errors.Errorf("waiting for netdev: %w", err)
-		}
-		return nil
-	})
+	// netdev is nil when the vm has no network
+	if rvm.netdev != nil {
+		errgrp.Go(func() error {
+			err := rvm.netdev.Wait(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "error waiting for netdev", "error", err)
+				return errors.Errorf("waiting for netdev: %w", err)
+			}
+			return nil
+		})
+	}
 
-	err := bootVM(ctx, rvm.VM())
+	bootStart := time.Now()
+	err := boot(ctx)
 	if err != nil {
 		if err := TryAppendingConsoleLog(ctx, rvm.workingDir); err != nil {
 			slog.ErrorContext(ctx, "error appending console log", "error", err)
 		}
+		if crash := rvm.GuestCrash(ctx); crash != nil {
+			return errors.Errorf("booting virtual machine: %w", crash)
+		}
 		return errors.Errorf("booting virtual machine: %w", err)
 	}
+	rvm.timeline.Record(BootPhaseKernelBoot, bootStart)
 
 	errgrp.Go(func() error {
 		err = rvm.VM().ServeBackgroundTasks(ctx)
@@ -216,7 +289,15 @@ func (rvm *RunningVM[VM]) Start(ctx context.Context) error {
 		stateNotify := rvm.VM().StateChangeNotify(ctx)
 		for {
 			select {
-			case state := <-stateNotify:
+			case state, ok := <-stateNotify:
+				if !ok {
+					return
+				}
+				if state.StateType == VirtualMachineStateTypeError || state.StateType == VirtualMachineStateTypeStopped {
+					if rvm.active.CompareAndSwap(true, false) {
+						metrics.ActiveVMs.Dec()
+					}
+				}
 				if state.StateType == VirtualMachineStateTypeError {
 					rvm.wait <- errors.Errorf("VM entered error state")
 					return
@@ -235,6 +316,7 @@ func (rvm *RunningVM[VM]) Start(ctx context.Context) error {
 
 	slog.InfoContext(ctx, "waiting for guest service")
 
+	agentStart := time.Now()
 	connection, err := rvm.GuestService(ctx)
 	if err != nil {
 		return errors.Errorf("failed to get guest service: %w", err)
@@ -252,10 +334,159 @@ func (rvm *RunningVM[VM]) Start(ctx context.Context) error {
 
 	slog.InfoContext(ctx, "time sync", "response", response)
 
+	rvm.timeline.Record(BootPhaseGuestAgent, agentStart)
+	rvm.bootDuration = time.Since(rvm.start)
+
+	metrics.VMBootDuration.Observe(rvm.bootDuration.Seconds())
+	if rvm.active.CompareAndSwap(false, true) {
+		metrics.ActiveVMs.Inc()
+	}
+
+	rvm.writeBootTiming(ctx)
+
+	return nil
+}
+
+// RecordBootPhase adds a span that started at start and ends now to the boot timing
+// of the container, for the phases that run after the vm is up.
+func (rvm *RunningVM[VM]) RecordBootPhase(ctx context.Context, phase BootPhase, start time.Time) {
+	rvm.timeline.Record(phase, start)
+	rvm.writeBootTiming(ctx)
+}
+
+// BootTiming returns the phases the container start went through. A reattached vm
+// reads what the shim that started it wrote, nil means nothing was recorded.
+func (rvm *RunningVM[VM]) BootTiming() *BootTiming {
+	if rvm.timeline != nil {
+		return rvm.timeline.Summary()
+	}
+	b, err := ReadBootTiming(rvm.workingDir)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// HardStop stops the vm. Unlike a stop of the vm underneath, it is not reported as
+// a crash of the guest.
+func (rvm *RunningVM[VM]) HardStop(ctx context.Context) error {
+	rvm.stopping.Store(true)
+	return rvm.vm.HardStop(ctx)
+}
+
+// GuestCrash returns the crash that brought the guest down, going by its console
+// log and the vm state, or nil while the guest looks fine.
+func (rvm *RunningVM[VM]) GuestCrash(ctx context.Context) *GuestCrash {
+	d := NewGuestCrashDetector(rvm.vm.ID())
+	if err := d.scan(filepath.Join(rvm.workingDir, ConsoleLogFile)); err != nil {
+		slog.WarnContext(ctx, "failed to scan console log for a guest crash", "id", rvm.vm.ID(), "error", err)
+	}
+	if crash := d.finish(); crash != nil {
+		return crash
+	}
+
+	switch state := rvm.vm.CurrentState(); state {
+	case VirtualMachineStateTypeStopped, VirtualMachineStateTypeError:
+		if !rvm.stopping.Load() {
+			d.ObserveStop(state)
+			return d.Crash()
+		}
+	}
 	return nil
 }
 
-func bootVM[VM VirtualMachine](ctx context.Context, vm VM) error {
+// WaitGuestCrash watches the console and the state of the vm until the guest
+// crashes, or until the vm is stopped on purpose or ctx is done. A crashed vm is
+// stopped before its crash is returned, so nothing still runs in a guest whose
+// processes are reported as gone. Oopses are only logged.
+func (rvm *RunningVM[VM]) WaitGuestCrash(ctx context.Context) (*GuestCrash, error) {
+	crash, err := rvm.waitGuestCrash(ctx)
+	if crash == nil {
+		return nil, err
+	}
+
+	// the vm keeps running after a go panic, and after a kernel panic unless the
+	// guest reboots on it
+	if rvm.vm.CurrentState() != VirtualMachineStateTypeStopped {
+		if err := rvm.HardStop(context.WithoutCancel(ctx)); err != nil {
+			slog.WarnContext(ctx, "stopping crashed virtual machine", "id", rvm.vm.ID(), "error", err)
+		}
+	}
+	return crash, nil
+}
+
+func (rvm *RunningVM[VM]) waitGuestCrash(ctx context.Context) (*GuestCrash, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	d := NewGuestCrashDetector(rvm.vm.ID())
+
+	// from the start of the log, for crashes printed before the watch began
+	t, err := tail.TailFile(filepath.Join(rvm.workingDir, ConsoleLogFile), tail.Config{
+		Follow:    true,
+		ReOpen:    true,
+		MustExist: false,
+		Logger:    tail.DiscardingLogger,
+	})
+	if err != nil {
+		return nil, errors.Errorf("tailing console log: %w", err)
+	}
+	defer t.Cleanup()
+	defer t.Stop()
+
+	go func() {
+		for line := range t.Lines {
+			if line.Err != nil {
+				continue
+			}
+			if warning := d.ObserveLine(line.Text); warning != "" {
+				slog.WarnContext(ctx, "guest kernel reported a problem", "id", rvm.vm.ID(), "line", warning)
+			}
+		}
+	}()
+
+	states := rvm.vm.StateChangeNotify(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-d.Crashed():
+			return d.Crash(), nil
+		case state, ok := <-states:
+			if !ok {
+				states = nil
+				continue
+			}
+			if state.StateType != VirtualMachineStateTypeStopped && state.StateType != VirtualMachineStateTypeError {
+				continue
+			}
+			if rvm.stopping.Load() {
+				return nil, nil
+			}
+
+			// give the console a moment to catch up with the last words of the guest
+			select {
+			case <-d.Crashed():
+			case <-time.After(guestCrashSettle):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			d.ObserveStop(state.StateType)
+			return d.Crash(), nil
+		}
+	}
+}
+
+func (rvm *RunningVM[VM]) writeBootTiming(ctx context.Context) {
+	if rvm.timeline == nil {
+		return
+	}
+	if err := WriteBootTiming(rvm.workingDir, rvm.timeline.Summary()); err != nil {
+		slog.WarnContext(ctx, "failed to write boot timing", "id", rvm.vm.ID(), "error", err)
+	}
+}
+
+func bootVM[VM VirtualMachine](ctx context.Context, vm VM, timeout time.Duration) error {
 	bootCtx, bootCancel := context.WithCancel(ctx)
 	errGroup, ctx := errgroup.WithContext(bootCtx)
 	defer func() {
@@ -272,13 +503,8 @@ func bootVM[VM VirtualMachine](ctx context.Context, vm VM) error {
 	}()
 
 	go func() {
-		for {
-			select {
-			case <-bootCtx.Done():
-				return
-			case <-vm.StateChangeNotify(bootCtx):
-				slog.InfoContext(bootCtx, "virtual machine state changed", "state", vm.CurrentState())
-			}
+		for state := range vm.StateChangeNotify(bootCtx) {
+			slog.InfoContext(bootCtx, "virtual machine state changed", "state", state.StateType)
 		}
 	}()
 
@@ -288,7 +514,7 @@ func bootVM[VM VirtualMachine](ctx context.Context, vm VM) error {
 		return errors.Errorf("starting virtual machine: %w", err)
 	}
 
-	if err := WaitForVMState(ctx, vm, VirtualMachineStateTypeRunning, time.After(30*time.Second)); err != nil {
+	if err := WaitForVMState(ctx, vm, VirtualMachineStateTypeRunning, time.After(timeout)); err != nil {
 		return errors.Errorf("waiting for virtual machine to start: %w", err)
 	}
 
@@ -305,7 +531,7 @@ func ptr[T any](v T) *T { return &v }
 
 func TryAppendingConsoleLog(ctx context.Context, workingDir string) error {
 	// log file
-	file, err := os.ReadFile(filepath.Join(workingDir, "console.log"))
+	file, err := os.ReadFile(filepath.Join(workingDir, ConsoleLogFile))
 	if err != nil {
 		return errors.Errorf("opening console log file: %w", err)
 	}
@@ -314,7 +540,7 @@ func TryAppendingConsoleLog(ctx context.Context, workingDir string) error {
 
 	buf := bytes.NewBuffer(nil)
 	buf.Write([]byte("\n\n--------------------------------\n\n"))
-	buf.Write([]byte(filepath.Join(workingDir, "console.log")))
+	buf.Write([]byte(filepath.Join(workingDir, ConsoleLogFile)))
 	buf.Write([]byte("\n\n"))
 	buf.Write(file)
 	buf.Write([]byte("\n--------------------------------\n\n"))
@@ -329,7 +555,7 @@ func TryAppendingConsoleLog(ctx context.Context, workingDir string) error {
 }
 
 func TailConsoleLog(ctx context.Context, workingDir string) error {
-	dat, err := os.ReadFile(filepath.Join(workingDir, "console.log"))
+	dat, err := os.ReadFile(filepath.Join(workingDir, ConsoleLogFile))
 	if err != nil {
 		slog.ErrorContext(ctx, "error reading console log file", "error", err)
 		return errors.Errorf("reading console log file: %w", err)
@@ -342,7 +568,7 @@ func TailConsoleLog(ctx context.Context, workingDir string) error {
 	}
 
 	go func() {
-		t, err := tail.TailFile(filepath.Join(workingDir, "console.log"), tail.Config{Follow: true, Location: &tail.SeekInfo{Offset: int64(len(dat)), Whence: io.SeekStart}})
+		t, err := tail.TailFile(filepath.Join(workingDir, ConsoleLogFile), tail.Config{Follow: true, Location: &tail.SeekInfo{Offset: int64(len(dat)), Whence: io.SeekStart}})
 		if err != nil {
 			slog.ErrorContext(ctx, "error tailing log file", "error", err)
 			return
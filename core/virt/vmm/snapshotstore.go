@@ -0,0 +1,482 @@
+package vmm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/core/virt/host"
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/pkg/atomicfile"
+)
+
+const (
+	snapshotInfoFile  = "snapshot.json"
+	snapshotStateFile = "vm.snapshot"
+	snapshotVersion   = 1
+)
+
+var (
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	ErrSnapshotExists   = errors.New("snapshot already exists")
+	// ErrSnapshotMismatch is returned when restoring a snapshot into a vm whose devices
+	// or boot files differ from the vm the snapshot was taken from.
+	ErrSnapshotMismatch = errors.New("snapshot does not match the virtual machine")
+)
+
+var snapshotNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,127}$`)
+
+// SnapshotDevice is the hypervisor independent identity of a device, enough to tell
+// whether a restored vm is wired the same way as the one that was saved.
+type SnapshotDevice struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id,omitempty"`
+}
+
+func (d SnapshotDevice) String() string {
+	if d.ID == "" {
+		return d.Kind
+	}
+	return d.Kind + "(" + d.ID + ")"
+}
+
+// SnapshotInfo is the metadata recorded next to every snapshot in a SnapshotStore.
+type SnapshotInfo struct {
+	Version         int              `json:"version"`
+	Name            string           `json:"name"`
+	VMID            string           `json:"vm_id"`
+	Devices         []SnapshotDevice `json:"devices"`
+	KernelDigest    string           `json:"kernel_digest,omitempty"`
+	InitramfsDigest string           `json:"initramfs_digest,omitempty"`
+	CreatedAt       time.Time        `json:"created_at"`
+	// Size is the size in bytes of the saved vm state.
+	Size int64 `json:"size"`
+}
+
+// SnapshotStore keeps named full vm snapshots with their metadata, one directory
+// per snapshot, independently of the hypervisor that wrote them.
+type SnapshotStore struct {
+	root string
+}
+
+func NewSnapshotStore(root string) *SnapshotStore {
+	return &SnapshotStore{root: root}
+}
+
+// DefaultSnapshotStore returns the store in the host cache directory.
+func DefaultSnapshotStore(ctx context.Context) (*SnapshotStore, error) {
+	root, err := host.SnapshotCacheDir(ctx)
+	if err != nil {
+		return nil, errors.Errorf("getting snapshot cache directory: %w", err)
+	}
+	return NewSnapshotStore(root), nil
+}
+
+func (s *SnapshotStore) Root() string {
+	return s.root
+}
+
+func (s *SnapshotStore) dir(name string) (string, error) {
+	if !snapshotNameRegexp.MatchString(name) {
+		return "", errors.Errorf("invalid snapshot name %q", name)
+	}
+	return filepath.Join(s.root, name), nil
+}
+
+// Save writes the full state of vm, which the caller has paused, as the named
+// snapshot. bootloader is the one vm was booted with, its kernel and initramfs
+// digests are recorded so a restore into a vm with other boot files is refused.
+func (s *SnapshotStore) Save(ctx context.Context, name string, vm VirtualMachine, bootloader virtio.Bootloader) (*SnapshotInfo, error) {
+	dir, err := s.dir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := CheckFullSnapshotSupport(ctx, vm); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(dir); err == nil {
+		return nil, errors.Errorf("snapshot %s: %w", name, ErrSnapshotExists)
+	}
+
+	if err := os.MkdirAll(s.root, 0700); err != nil {
+		return nil, errors.Errorf("creating snapshot store: %w", err)
+	}
+
+	// the snapshot is written next to its directory and renamed into place once it is
+	// complete. the temporary directory is locked meanwhile, so Prune leaves it alone
+	tmp, err := os.MkdirTemp(s.root, "."+name+".tmp-")
+	if err != nil {
+		return nil, errors.Errorf("creating snapshot directory: %w", err)
+	}
+
+	lock, err := LockWorkingDir(tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	defer lock.Close()
+
+	info, err := s.save(ctx, tmp, name, vm, bootloader)
+	if err == nil {
+		err = commitSnapshot(tmp, dir)
+	}
+	if err != nil {
+		if rerr := os.RemoveAll(tmp); rerr != nil {
+			slog.WarnContext(ctx, "failed to remove incomplete snapshot", "name", name, "error", rerr)
+		}
+		if errors.Is(err, os.ErrExist) || errors.Is(err, syscall.ENOTEMPTY) {
+			return nil, errors.Errorf("snapshot %s: %w", name, ErrSnapshotExists)
+		}
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "saved vm snapshot", "name", name, "vm_id", info.VMID, "size", info.Size)
+
+	return info, nil
+}
+
+func (s *SnapshotStore) save(ctx context.Context, dir, name string, vm VirtualMachine, bootloader virtio.Bootloader) (*SnapshotInfo, error) {
+	info := &SnapshotInfo{
+		Version:   snapshotVersion,
+		Name:      name,
+		VMID:      vm.ID(),
+		Devices:   DescribeDevices(vm.Devices()),
+		CreatedAt: time.Now(),
+	}
+
+	var err error
+	if info.KernelDigest, info.InitramfsDigest, err = bootDigests(bootloader); err != nil {
+		return nil, err
+	}
+
+	statePath := filepath.Join(dir, snapshotStateFile)
+	if err := vm.SaveFullSnapshot(ctx, statePath); err != nil {
+		return nil, errors.Errorf("saving full snapshot: %w", err)
+	}
+
+	fi, err := os.Stat(statePath)
+	if err != nil {
+		return nil, errors.Errorf("checking saved snapshot: %w", err)
+	}
+	info.Size = fi.Size()
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, errors.Errorf("marshalling snapshot info: %w", err)
+	}
+
+	// written last, a directory without it is an incomplete snapshot
+	if err := atomicfile.WriteFile(filepath.Join(dir, snapshotInfoFile), data); err != nil {
+		return nil, errors.Errorf("writing snapshot info: %w", err)
+	}
+
+	return info, nil
+}
+
+// commitSnapshot moves the complete snapshot in tmp to dir. The lock file of tmp is
+// removed first, its lock is released by Save once the snapshot is in place.
+func commitSnapshot(tmp, dir string) error {
+	if err := os.Remove(filepath.Join(tmp, WorkingDirLockFile)); err != nil {
+		return errors.Errorf("removing snapshot lock: %w", err)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return errors.Errorf("moving snapshot into place: %w", err)
+	}
+	return nil
+}
+
+// Inspect returns the metadata of the named snapshot.
+func (s *SnapshotStore) Inspect(ctx context.Context, name string) (*SnapshotInfo, error) {
+	dir, err := s.dir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, snapshotInfoFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("snapshot %s: %w", name, ErrSnapshotNotFound)
+		}
+		return nil, errors.Errorf("reading snapshot info: %w", err)
+	}
+
+	info := &SnapshotInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, errors.Errorf("unmarshalling snapshot info of %s: %w", name, err)
+	}
+
+	if info.Version != snapshotVersion {
+		return nil, errors.Errorf("snapshot %s has unsupported version %d", name, info.Version)
+	}
+
+	return info, nil
+}
+
+// List returns the complete snapshots in the store, oldest first.
+func (s *SnapshotStore) List(ctx context.Context) ([]*SnapshotInfo, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Errorf("reading snapshot store: %w", err)
+	}
+
+	infos := make([]*SnapshotInfo, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		info, err := s.Inspect(ctx, e.Name())
+		if err != nil {
+			slog.DebugContext(ctx, "skipping snapshot", "name", e.Name(), "error", err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	slices.SortFunc(infos, func(a, b *SnapshotInfo) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	return infos, nil
+}
+
+// Delete removes the named snapshot.
+func (s *SnapshotStore) Delete(ctx context.Context, name string) error {
+	dir, err := s.dir(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return errors.Errorf("snapshot %s: %w", name, ErrSnapshotNotFound)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Errorf("removing snapshot %s: %w", name, err)
+	}
+
+	return nil
+}
+
+type PruneOptions struct {
+	// OlderThan removes snapshots created before now minus OlderThan, zero keeps all.
+	OlderThan time.Duration
+	// KeepLatest keeps the newest snapshots of every vm, zero keeps all.
+	KeepLatest int
+	// DryRun reports what would be removed without removing it.
+	DryRun bool
+}
+
+// Prune removes the snapshots selected by opts, and any incomplete snapshot left
+// behind by an interrupted Save, and returns the names it removed.
+func (s *SnapshotStore) Prune(ctx context.Context, opts PruneOptions) ([]string, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Errorf("reading snapshot store: %w", err)
+	}
+
+	var remove []string
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(s.root, e.Name())
+		// a snapshot Save is still writing is locked
+		if _, err := os.Stat(filepath.Join(dir, snapshotInfoFile)); os.IsNotExist(err) && !workingDirLocked(dir) {
+			remove = append(remove, e.Name())
+		}
+	}
+
+	infos, err := s.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// newest first, so the first KeepLatest of every vm are kept
+	slices.Reverse(infos)
+	seen := map[string]int{}
+	for _, info := range infos {
+		seen[info.VMID]++
+		switch {
+		case opts.KeepLatest > 0 && seen[info.VMID] > opts.KeepLatest:
+			remove = append(remove, info.Name)
+		case opts.OlderThan > 0 && time.Since(info.CreatedAt) > opts.OlderThan:
+			remove = append(remove, info.Name)
+		}
+	}
+
+	if opts.DryRun {
+		return remove, nil
+	}
+
+	for _, name := range remove {
+		if err := os.RemoveAll(filepath.Join(s.root, name)); err != nil {
+			return nil, errors.Errorf("removing snapshot %s: %w", name, err)
+		}
+		slog.InfoContext(ctx, "pruned vm snapshot", "name", name)
+	}
+
+	return remove, nil
+}
+
+// Restore loads the named snapshot into vm, which must be created but not started.
+// It refuses snapshots whose devices or boot files differ from those of vm.
+func (s *SnapshotStore) Restore(ctx context.Context, name string, vm VirtualMachine, bootloader virtio.Bootloader) error {
+	info, err := s.Inspect(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if err := info.Matches(vm.Devices(), bootloader); err != nil {
+		return errors.Errorf("restoring snapshot %s: %w", name, err)
+	}
+
+	dir, err := s.dir(name)
+	if err != nil {
+		return err
+	}
+
+	// the directory time is when the snapshot was last used, see VMCacheGC
+	now := time.Now()
+	if err := os.Chtimes(dir, now, now); err != nil {
+		slog.DebugContext(ctx, "marking snapshot as used", "name", name, "error", err)
+	}
+
+	return restoreVM(ctx, vm, filepath.Join(dir, snapshotStateFile))
+}
+
+// Matches returns an error wrapping ErrSnapshotMismatch if a vm with devices, booted
+// with bootloader, cannot be restored from the snapshot.
+func (info *SnapshotInfo) Matches(devices []virtio.VirtioDevice, bootloader virtio.Bootloader) error {
+	if err := MatchDevices(info.Devices, DescribeDevices(devices)); err != nil {
+		return err
+	}
+
+	kernel, initramfs, err := bootDigests(bootloader)
+	if err != nil {
+		return err
+	}
+	if info.KernelDigest != "" && kernel != info.KernelDigest {
+		return errors.Errorf("%w: kernel digest is %s, snapshot has %s", ErrSnapshotMismatch, kernel, info.KernelDigest)
+	}
+	if info.InitramfsDigest != "" && initramfs != info.InitramfsDigest {
+		return errors.Errorf("%w: initramfs digest is %s, snapshot has %s", ErrSnapshotMismatch, initramfs, info.InitramfsDigest)
+	}
+
+	return nil
+}
+
+// MatchDevices returns an error wrapping ErrSnapshotMismatch listing the differences
+// between the devices a snapshot was saved with and the ones of a vm.
+func MatchDevices(saved, current []SnapshotDevice) error {
+	if slices.Equal(saved, current) {
+		return nil
+	}
+
+	var diffs []string
+	for i := range max(len(saved), len(current)) {
+		switch {
+		case i >= len(saved):
+			diffs = append(diffs, fmt.Sprintf("device %d: %s was added", i, current[i]))
+		case i >= len(current):
+			diffs = append(diffs, fmt.Sprintf("device %d: %s was removed", i, saved[i]))
+		case saved[i] != current[i]:
+			diffs = append(diffs, fmt.Sprintf("device %d: %s is now %s", i, saved[i], current[i]))
+		}
+	}
+
+	return errors.Errorf("%w: %s", ErrSnapshotMismatch, strings.Join(diffs, "; "))
+}
+
+// DescribeDevices returns the snapshot identity of devices, in order.
+func DescribeDevices(devices []virtio.VirtioDevice) []SnapshotDevice {
+	out := make([]SnapshotDevice, 0, len(devices))
+	for _, dev := range devices {
+		out = append(out, DescribeDevice(dev))
+	}
+	return out
+}
+
+// DescribeDevice returns the kind of dev and, for devices the guest tells apart, the
+// identifier the guest sees. Host side paths are left out since they change every
+// time a vm is created.
+func DescribeDevice(dev virtio.VirtioDevice) SnapshotDevice {
+	d := SnapshotDevice{Kind: strings.TrimPrefix(fmt.Sprintf("%T", dev), "*virtio.")}
+
+	switch dev := dev.(type) {
+	case *virtio.VirtioBlk:
+		d.ID = dev.DeviceIdentifier
+	case *virtio.NetworkBlockDevice:
+		d.ID = dev.DeviceIdentifier
+	case *virtio.VirtioFs:
+		d.ID = dev.MountTag
+	case *virtio.RosettaShare:
+		d.ID = dev.MountTag
+	case *virtio.VirtioVsock:
+		if dev.Port != 0 {
+			d.ID = fmt.Sprintf("%d", dev.Port)
+		}
+	case *virtio.VirtioNet:
+		d.ID = dev.MacAddress.String()
+	case *virtio.VirtioInput:
+		d.ID = dev.InputType
+	}
+
+	return d
+}
+
+func bootDigests(bootloader virtio.Bootloader) (kernel, initramfs string, err error) {
+	lb, ok := bootloader.(*virtio.LinuxBootloader)
+	if !ok || lb == nil {
+		return "", "", nil
+	}
+
+	if lb.VmlinuzPath != "" {
+		if kernel, err = fileDigest(lb.VmlinuzPath); err != nil {
+			return "", "", errors.Errorf("hashing kernel: %w", err)
+		}
+	}
+	if lb.InitrdPath != "" {
+		if initramfs, err = fileDigest(lb.InitrdPath); err != nil {
+			return "", "", errors.Errorf("hashing initramfs: %w", err)
+		}
+	}
+
+	return kernel, initramfs, nil
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,231 @@
+package vmm_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/vmm"
+
+	mockvmm "github.com/walteh/runm/gen/mocks/core/virt/vmm"
+)
+
+// snapshotVM adds vmm.FullSnapshotCapable to the generated mock.
+type snapshotVM struct {
+	*mockvmm.MockVirtualMachine
+}
+
+func (v *snapshotVM) SupportsFullSnapshot(ctx context.Context) error {
+	return nil
+}
+
+func newSnapshotVM(id string, devices ...virtio.VirtioDevice) *snapshotVM {
+	return &snapshotVM{&mockvmm.MockVirtualMachine{
+		IDFunc: func() string { return id },
+		DevicesFunc: func() []virtio.VirtioDevice {
+			return devices
+		},
+		SaveFullSnapshotFunc: func(ctx context.Context, path string) error {
+			return os.WriteFile(path, []byte("state of "+id), 0600)
+		},
+		RestoreFromFullSnapshotFunc: func(ctx context.Context, path string) error {
+			return nil
+		},
+		ResumeFunc: func(ctx context.Context) error {
+			return nil
+		},
+		CurrentStateFunc: func() vmm.VirtualMachineStateType {
+			return vmm.VirtualMachineStateTypeRunning
+		},
+		StateChangeNotifyFunc: func(ctx context.Context) <-chan vmm.VirtualMachineStateChange {
+			return nil
+		},
+	}}
+}
+
+func bootloader(t *testing.T, kernel string) *virtio.LinuxBootloader {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "kernel"), []byte(kernel), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "initramfs.cpio.gz"), []byte("initramfs"), 0600))
+	return &virtio.LinuxBootloader{
+		VmlinuzPath: filepath.Join(dir, "kernel"),
+		InitrdPath:  filepath.Join(dir, "initramfs.cpio.gz"),
+	}
+}
+
+func TestSnapshotStoreSaveListInspectDelete(t *testing.T) {
+	ctx := t.Context()
+	store := vmm.NewSnapshotStore(t.TempDir())
+	bl := bootloader(t, "kernel")
+
+	vm := newSnapshotVM("vm-1",
+		&virtio.VirtioBlk{DeviceIdentifier: "mbin"},
+		&virtio.VirtioFs{DirectorySharingConfig: virtio.DirectorySharingConfig{MountTag: "rootfs"}, SharedDir: "/tmp/a"},
+		&virtio.VirtioVsock{},
+	)
+
+	info, err := store.Save(ctx, "first", vm, bl)
+	require.NoError(t, err)
+	assert.Equal(t, "vm-1", info.VMID)
+	assert.Equal(t, int64(len("state of vm-1")), info.Size)
+	assert.NotEmpty(t, info.KernelDigest)
+	assert.NotEmpty(t, info.InitramfsDigest)
+	assert.Equal(t, []vmm.SnapshotDevice{
+		{Kind: "VirtioBlk", ID: "mbin"},
+		{Kind: "VirtioFs", ID: "rootfs"},
+		{Kind: "VirtioVsock"},
+	}, info.Devices)
+
+	_, err = store.Save(ctx, "first", vm, bl)
+	require.ErrorIs(t, err, vmm.ErrSnapshotExists)
+
+	_, err = store.Save(ctx, "../escape", vm, bl)
+	require.Error(t, err)
+
+	_, err = store.Save(ctx, "second", vm, bl)
+	require.NoError(t, err)
+
+	infos, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	assert.Equal(t, "first", infos[0].Name)
+	assert.Equal(t, "second", infos[1].Name)
+
+	got, err := store.Inspect(ctx, "first")
+	require.NoError(t, err)
+	assert.Equal(t, info.Devices, got.Devices)
+	assert.Equal(t, info.KernelDigest, got.KernelDigest)
+
+	require.NoError(t, store.Delete(ctx, "first"))
+	_, err = store.Inspect(ctx, "first")
+	require.ErrorIs(t, err, vmm.ErrSnapshotNotFound)
+	require.ErrorIs(t, store.Delete(ctx, "first"), vmm.ErrSnapshotNotFound)
+}
+
+func TestSnapshotStoreRestoreRefusesMismatch(t *testing.T) {
+	ctx := t.Context()
+	store := vmm.NewSnapshotStore(t.TempDir())
+	bl := bootloader(t, "kernel")
+
+	saved := newSnapshotVM("vm-1", &virtio.VirtioBlk{DeviceIdentifier: "mbin"}, &virtio.VirtioBalloon{})
+	_, err := store.Save(ctx, "snap", saved, bl)
+	require.NoError(t, err)
+
+	t.Run("same devices on other host paths", func(t *testing.T) {
+		vm := newSnapshotVM("vm-2", &virtio.VirtioBlk{DeviceIdentifier: "mbin", DiskStorageConfig: virtio.DiskStorageConfig{ImagePath: "/elsewhere"}}, &virtio.VirtioBalloon{})
+		require.NoError(t, store.Restore(ctx, "snap", vm, bl))
+		require.Len(t, vm.RestoreFromFullSnapshotCalls(), 1)
+		assert.Equal(t, filepath.Join(store.Root(), "snap", "vm.snapshot"), vm.RestoreFromFullSnapshotCalls()[0].Path)
+		assert.Len(t, vm.ResumeCalls(), 1)
+	})
+
+	t.Run("device removed", func(t *testing.T) {
+		vm := newSnapshotVM("vm-2", &virtio.VirtioBlk{DeviceIdentifier: "mbin"})
+		err := store.Restore(ctx, "snap", vm, bl)
+		require.ErrorIs(t, err, vmm.ErrSnapshotMismatch)
+		assert.Contains(t, err.Error(), "VirtioBalloon was removed")
+		assert.Empty(t, vm.RestoreFromFullSnapshotCalls())
+	})
+
+	t.Run("device changed", func(t *testing.T) {
+		vm := newSnapshotVM("vm-2", &virtio.VirtioBlk{DeviceIdentifier: "ec1"}, &virtio.VirtioBalloon{})
+		err := store.Restore(ctx, "snap", vm, bl)
+		require.ErrorIs(t, err, vmm.ErrSnapshotMismatch)
+		assert.Contains(t, err.Error(), "VirtioBlk(mbin) is now VirtioBlk(ec1)")
+	})
+
+	t.Run("kernel changed", func(t *testing.T) {
+		vm := newSnapshotVM("vm-2", &virtio.VirtioBlk{DeviceIdentifier: "mbin"}, &virtio.VirtioBalloon{})
+		err := store.Restore(ctx, "snap", vm, bootloader(t, "other kernel"))
+		require.ErrorIs(t, err, vmm.ErrSnapshotMismatch)
+		assert.Contains(t, err.Error(), "kernel digest")
+	})
+}
+
+func TestSnapshotStorePrune(t *testing.T) {
+	ctx := t.Context()
+	store := vmm.NewSnapshotStore(t.TempDir())
+	bl := bootloader(t, "kernel")
+
+	for _, name := range []string{"a1", "a2", "a3"} {
+		_, err := store.Save(ctx, name, newSnapshotVM("vm-a"), bl)
+		require.NoError(t, err)
+	}
+	_, err := store.Save(ctx, "b1", newSnapshotVM("vm-b"), bl)
+	require.NoError(t, err)
+
+	// left behind by an interrupted save
+	require.NoError(t, os.MkdirAll(filepath.Join(store.Root(), "partial"), 0700))
+
+	removed, err := store.Prune(ctx, vmm.PruneOptions{KeepLatest: 1, DryRun: true})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"partial", "a1", "a2"}, removed)
+
+	infos, err := store.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, infos, 4)
+
+	removed, err = store.Prune(ctx, vmm.PruneOptions{KeepLatest: 1})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"partial", "a1", "a2"}, removed)
+
+	infos, err = store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	assert.Equal(t, "a3", infos[0].Name)
+	assert.Equal(t, "b1", infos[1].Name)
+	assert.NoDirExists(t, filepath.Join(store.Root(), "partial"))
+}
+
+func TestSnapshotStorePruneSkipsSaveInProgress(t *testing.T) {
+	ctx := t.Context()
+	store := vmm.NewSnapshotStore(t.TempDir())
+	bl := bootloader(t, "kernel")
+
+	saving := make(chan struct{})
+	pruned := make(chan struct{})
+	vm := newSnapshotVM("vm-a")
+	save := vm.SaveFullSnapshotFunc
+	vm.SaveFullSnapshotFunc = func(ctx context.Context, path string) error {
+		close(saving)
+		<-pruned
+		return save(ctx, path)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := store.Save(ctx, "snap", vm, bl)
+		done <- err
+	}()
+
+	<-saving
+	removed, err := store.Prune(ctx, vmm.PruneOptions{})
+	close(pruned)
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+
+	require.NoError(t, <-done)
+	_, err = store.Inspect(ctx, "snap")
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(store.Root())
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "the temporary directory is renamed into place")
+	assert.NoFileExists(t, filepath.Join(store.Root(), "snap", vmm.WorkingDirLockFile))
+}
+
+func TestSnapshotStoreRequiresSnapshotSupport(t *testing.T) {
+	store := vmm.NewSnapshotStore(t.TempDir())
+
+	vm := &mockvmm.MockVirtualMachine{
+		IDFunc: func() string { return "vm-1" },
+	}
+
+	_, err := store.Save(t.Context(), "snap", vm, nil)
+	require.ErrorIs(t, err, vmm.ErrFullSnapshotNotSupported)
+}
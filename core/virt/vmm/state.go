@@ -55,7 +55,10 @@ func WaitForVMState(ctx context.Context, vm VirtualMachine, state VirtualMachine
 		select {
 		case s := <-signalCh:
 			slog.DebugContext(ctx, "ignoring signal", "signal", s)
-		case newState := <-notifier:
+		case newState, ok := <-notifier:
+			if !ok {
+				return errors.Errorf("waiting for VM state %s: %w", state, ctx.Err())
+			}
 
 			slog.DebugContext(ctx, "VM state changed", "state", newState.StateType, "metadata", newState.Metadata)
 
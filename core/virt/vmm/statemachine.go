@@ -0,0 +1,247 @@
+package vmm
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// Operation is a state change a caller asks a VirtualMachine for.
+type Operation string
+
+const (
+	OperationStart       Operation = "start"
+	OperationPause       Operation = "pause"
+	OperationResume      Operation = "resume"
+	OperationHardStop    Operation = "hard-stop"
+	OperationRequestStop Operation = "request-stop"
+)
+
+var (
+	ErrInvalidTransition   = errors.New("invalid vm state transition")
+	ErrOperationNotAllowed = errors.New("operation not allowed in the current vm state")
+)
+
+// TransitionError is returned when a vm is moved between states that do not
+// follow each other. It matches ErrInvalidTransition.
+type TransitionError struct {
+	From VirtualMachineStateType
+	To   VirtualMachineStateType
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("invalid vm state transition from %s to %s", e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrInvalidTransition
+}
+
+// OperationError is returned when an operation is asked for in a state that does
+// not allow it. It matches ErrOperationNotAllowed.
+type OperationError struct {
+	Operation Operation
+	State     VirtualMachineStateType
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("cannot %s vm in state %s", e.Operation, e.State)
+}
+
+func (e *OperationError) Is(target error) bool {
+	return target == ErrOperationNotAllowed
+}
+
+// validTransitions lists the states each state can move to. Any state can move to
+// error, and a vm whose process went away is stopped whatever it was doing.
+var validTransitions = map[VirtualMachineStateType][]VirtualMachineStateType{
+	VirtualMachineStateTypeUnknown: {
+		VirtualMachineStateTypeStarting, VirtualMachineStateTypeRunning, VirtualMachineStateTypePaused,
+		VirtualMachineStateTypeStopping, VirtualMachineStateTypeStopped,
+	},
+	// a restored vm comes back paused or running without starting
+	VirtualMachineStateTypeStopped: {
+		VirtualMachineStateTypeStarting, VirtualMachineStateTypeRunning, VirtualMachineStateTypePaused,
+	},
+	VirtualMachineStateTypeStarting: {
+		VirtualMachineStateTypeRunning, VirtualMachineStateTypePaused, VirtualMachineStateTypeStopping,
+		VirtualMachineStateTypeStopped,
+	},
+	VirtualMachineStateTypeRunning: {
+		VirtualMachineStateTypePaused, VirtualMachineStateTypeStopping, VirtualMachineStateTypeStopped,
+	},
+	VirtualMachineStateTypePaused: {
+		VirtualMachineStateTypeRunning, VirtualMachineStateTypeStopping, VirtualMachineStateTypeStopped,
+	},
+	VirtualMachineStateTypeStopping: {
+		VirtualMachineStateTypeStopped,
+	},
+	// a failed vm can be cleaned up or started again
+	VirtualMachineStateTypeError: {
+		VirtualMachineStateTypeStarting, VirtualMachineStateTypeStopped,
+	},
+}
+
+// allowedOperations lists the states each operation can be asked for in.
+var allowedOperations = map[Operation][]VirtualMachineStateType{
+	OperationStart:  {VirtualMachineStateTypeStopped, VirtualMachineStateTypeError},
+	OperationPause:  {VirtualMachineStateTypeRunning},
+	OperationResume: {VirtualMachineStateTypePaused},
+	OperationHardStop: {
+		VirtualMachineStateTypeStarting, VirtualMachineStateTypeRunning, VirtualMachineStateTypePaused,
+		VirtualMachineStateTypeStopping, VirtualMachineStateTypeError,
+	},
+	OperationRequestStop: {VirtualMachineStateTypeRunning},
+}
+
+// StateTransition is one entry of the history of a StateMachine.
+type StateTransition struct {
+	From     VirtualMachineStateType
+	To       VirtualMachineStateType
+	At       time.Time
+	Metadata map[string]string
+}
+
+// StateHistoryVM is implemented by vms that keep their state in a StateMachine.
+type StateHistoryVM interface {
+	StateHistory() []StateTransition
+}
+
+// StateMachine tracks the state of a vm for a backend. It rejects transitions
+// and operations that do not fit the current state, keeps the history of every
+// transition and delivers each one to every subscriber in order, however slowly
+// they read.
+type StateMachine struct {
+	mu          sync.Mutex
+	state       VirtualMachineStateType
+	history     []StateTransition
+	subscribers map[*stateSubscriber]struct{}
+}
+
+func NewStateMachine(initial VirtualMachineStateType) *StateMachine {
+	return &StateMachine{
+		state:       initial,
+		subscribers: map[*stateSubscriber]struct{}{},
+	}
+}
+
+func (m *StateMachine) Current() VirtualMachineStateType {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Check returns an *OperationError when op is not allowed in the current state.
+func (m *StateMachine) Check(op Operation) error {
+	state := m.Current()
+	if !slices.Contains(allowedOperations[op], state) {
+		return &OperationError{Operation: op, State: state}
+	}
+	return nil
+}
+
+// Can reports whether op is allowed in the current state.
+func (m *StateMachine) Can(op Operation) bool {
+	return m.Check(op) == nil
+}
+
+// Transition moves the machine to state and notifies the subscribers. Moving to
+// the current state does nothing, moving to a state that cannot follow it returns
+// a *TransitionError and leaves the state as it was.
+func (m *StateMachine) Transition(state VirtualMachineStateType, metadata map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if state == m.state {
+		return nil
+	}
+	if state != VirtualMachineStateTypeError && !slices.Contains(validTransitions[m.state], state) {
+		return &TransitionError{From: m.state, To: state}
+	}
+
+	m.history = append(m.history, StateTransition{
+		From:     m.state,
+		To:       state,
+		At:       time.Now(),
+		Metadata: maps.Clone(metadata),
+	})
+	m.state = state
+
+	change := VirtualMachineStateChange{StateType: state, Metadata: metadata}
+	for sub := range m.subscribers {
+		sub.queue = append(sub.queue, change)
+		select {
+		case sub.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// History returns every transition so far, oldest first.
+func (m *StateMachine) History() []StateTransition {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.history)
+}
+
+// stateSubscriber buffers the changes a subscriber has not read yet, the queue is
+// guarded by the StateMachine mutex.
+type stateSubscriber struct {
+	queue []VirtualMachineStateChange
+	wake  chan struct{}
+}
+
+// Subscribe returns a channel that gets every transition made after the call
+// until ctx is done, then it is closed. Transitions are queued for a subscriber
+// that does not keep up rather than dropped.
+func (m *StateMachine) Subscribe(ctx context.Context) <-chan VirtualMachineStateChange {
+	ch := make(chan VirtualMachineStateChange)
+	sub := &stateSubscriber{wake: make(chan struct{}, 1)}
+
+	m.mu.Lock()
+	m.subscribers[sub] = struct{}{}
+	m.mu.Unlock()
+
+	go func() {
+		defer close(ch)
+		defer func() {
+			m.mu.Lock()
+			delete(m.subscribers, sub)
+			m.mu.Unlock()
+		}()
+
+		for {
+			select {
+			case <-sub.wake:
+			case <-ctx.Done():
+				return
+			}
+
+			for {
+				m.mu.Lock()
+				if len(sub.queue) == 0 {
+					m.mu.Unlock()
+					break
+				}
+				change := sub.queue[0]
+				sub.queue = sub.queue[1:]
+				m.mu.Unlock()
+
+				select {
+				case ch <- change:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch
+}
@@ -0,0 +1,119 @@
+package vmm_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+func TestStateMachineTransitions(t *testing.T) {
+	m := vmm.NewStateMachine(vmm.VirtualMachineStateTypeStopped)
+
+	require.NoError(t, m.Check(vmm.OperationStart))
+	assert.False(t, m.Can(vmm.OperationPause))
+
+	err := m.Check(vmm.OperationResume)
+	require.ErrorIs(t, err, vmm.ErrOperationNotAllowed)
+	var opErr *vmm.OperationError
+	require.ErrorAs(t, err, &opErr)
+	assert.Equal(t, vmm.OperationResume, opErr.Operation)
+	assert.Equal(t, vmm.VirtualMachineStateTypeStopped, opErr.State)
+
+	require.NoError(t, m.Transition(vmm.VirtualMachineStateTypeStarting, nil))
+	require.NoError(t, m.Transition(vmm.VirtualMachineStateTypeRunning, map[string]string{"pid": "1"}))
+	// a repeated state is not a transition
+	require.NoError(t, m.Transition(vmm.VirtualMachineStateTypeRunning, nil))
+	require.NoError(t, m.Transition(vmm.VirtualMachineStateTypePaused, nil))
+
+	err = m.Transition(vmm.VirtualMachineStateTypeStarting, nil)
+	require.ErrorIs(t, err, vmm.ErrInvalidTransition)
+	var trErr *vmm.TransitionError
+	require.ErrorAs(t, err, &trErr)
+	assert.Equal(t, vmm.VirtualMachineStateTypePaused, trErr.From)
+	assert.Equal(t, vmm.VirtualMachineStateTypeStarting, trErr.To)
+	assert.Equal(t, vmm.VirtualMachineStateTypePaused, m.Current())
+
+	require.NoError(t, m.Transition(vmm.VirtualMachineStateTypeError, map[string]string{"error": "boom"}))
+	require.NoError(t, m.Transition(vmm.VirtualMachineStateTypeStopped, nil))
+
+	history := m.History()
+	require.Len(t, history, 5)
+	assert.Equal(t, vmm.VirtualMachineStateTypeStopped, history[0].From)
+	assert.Equal(t, vmm.VirtualMachineStateTypeStarting, history[0].To)
+	assert.Equal(t, map[string]string{"pid": "1"}, history[1].Metadata)
+	assert.Equal(t, vmm.VirtualMachineStateTypeError, history[3].To)
+	for i := 1; i < len(history); i++ {
+		assert.False(t, history[i].At.Before(history[i-1].At))
+	}
+}
+
+func TestStateMachineSubscribersGetEveryChange(t *testing.T) {
+	m := vmm.NewStateMachine(vmm.VirtualMachineStateTypeStopped)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	fast := m.Subscribe(ctx)
+	slow := m.Subscribe(ctx)
+
+	want := []vmm.VirtualMachineStateType{vmm.VirtualMachineStateTypeStarting}
+	for range 50 {
+		want = append(want, vmm.VirtualMachineStateTypeRunning, vmm.VirtualMachineStateTypePaused)
+	}
+
+	var wg sync.WaitGroup
+	read := func(ch <-chan vmm.VirtualMachineStateChange, delay time.Duration) []vmm.VirtualMachineStateType {
+		var got []vmm.VirtualMachineStateType
+		for len(got) < len(want) {
+			select {
+			case change := <-ch:
+				got = append(got, change.StateType)
+				time.Sleep(delay)
+			case <-time.After(5 * time.Second):
+				return got
+			}
+		}
+		return got
+	}
+
+	var gotFast, gotSlow []vmm.VirtualMachineStateType
+	wg.Add(2)
+	go func() { defer wg.Done(); gotFast = read(fast, 0) }()
+	go func() { defer wg.Done(); gotSlow = read(slow, time.Millisecond) }()
+
+	// the transitions do not wait for the subscribers
+	for _, state := range want {
+		require.NoError(t, m.Transition(state, nil))
+	}
+
+	wg.Wait()
+	assert.Equal(t, want, gotFast)
+	assert.Equal(t, want, gotSlow)
+}
+
+func TestStateMachineSubscriptionClosesWithContext(t *testing.T) {
+	m := vmm.NewStateMachine(vmm.VirtualMachineStateTypeStopped)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	ch := m.Subscribe(ctx)
+
+	require.NoError(t, m.Transition(vmm.VirtualMachineStateTypeStarting, nil))
+	assert.Equal(t, vmm.VirtualMachineStateTypeStarting, (<-ch).StateType)
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok, "no change was made after the subscription ended")
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription was not closed")
+	}
+
+	// later transitions are not queued for the ended subscription
+	require.NoError(t, m.Transition(vmm.VirtualMachineStateTypeRunning, nil))
+}
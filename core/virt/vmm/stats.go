@@ -0,0 +1,107 @@
+package vmm
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/containerd/typeurl/v2"
+	"gitlab.com/tozd/go/errors"
+
+	ptypes "github.com/containerd/containerd/v2/pkg/protobuf/types"
+)
+
+func init() {
+	typeurl.Register(&VMStats{}, "github.com/walteh/runm/core/virt/vmm", "VMStats")
+	typeurl.Register(&TaskMetrics{}, "github.com/walteh/runm/core/virt/vmm", "TaskMetrics")
+}
+
+// VMStats is the hypervisor side view of a vm, i.e. the overhead a container pays
+// for running in its own vm.
+type VMStats struct {
+	ID string `json:"id"`
+
+	VCPUs uint64 `json:"vcpus"`
+	// MemoryConfiguredBytes is the memory the vm was booted with.
+	MemoryConfiguredBytes uint64 `json:"memory_configured_bytes"`
+	// MemoryBalloonTargetBytes is the memory the balloon device asks the guest to
+	// keep, zero when there is no balloon device.
+	MemoryBalloonTargetBytes uint64 `json:"memory_balloon_target_bytes"`
+
+	// NetRxBytes and NetTxBytes are counted on the host side of the virtual network:
+	// received from and sent to the guest.
+	NetRxBytes uint64 `json:"net_rx_bytes"`
+	NetTxBytes uint64 `json:"net_tx_bytes"`
+
+	StartedAt    time.Time     `json:"started_at"`
+	BootDuration time.Duration `json:"boot_duration"`
+	Uptime       time.Duration `json:"uptime"`
+	// Boot breaks the container start down by phase, nil when it was not recorded.
+	Boot *BootTiming `json:"boot,omitempty"`
+}
+
+// TaskMetrics is returned by the shim's Stats call for vm backed containers. Cgroup
+// holds the guest cgroup metrics exactly as a runc shim would return them, VM the
+// overhead of the vm around them. See SplitTaskMetrics.
+type TaskMetrics struct {
+	Cgroup *ptypes.Any `json:"cgroup"`
+	VM     *VMStats    `json:"vm"`
+}
+
+// SplitTaskMetrics takes the stats of a task Stats response apart into the cgroup
+// metrics and the vm stats. Responses of containers that do not run in a vm are
+// returned as they are, with nil vm stats.
+func SplitTaskMetrics(stats typeurl.Any) (typeurl.Any, *VMStats, error) {
+	if !typeurl.Is(stats, &TaskMetrics{}) {
+		return stats, nil, nil
+	}
+
+	v, err := typeurl.UnmarshalAny(stats)
+	if err != nil {
+		return nil, nil, errors.Errorf("decoding task metrics: %w", err)
+	}
+	tm, ok := v.(*TaskMetrics)
+	if !ok {
+		return nil, nil, errors.Errorf("unexpected task metrics type %T", v)
+	}
+	return tm.Cgroup, tm.VM, nil
+}
+
+// NetworkStatsProvider is implemented by network devices that count the bytes they
+// move between the host and the guest.
+type NetworkStatsProvider interface {
+	NetworkStats() (rxBytes, txBytes uint64)
+}
+
+// VMStatsProvider is implemented by runtimes backed by a vm.
+type VMStatsProvider interface {
+	VMStats(ctx context.Context) (*VMStats, error)
+}
+
+func (r *RunningVM[VM]) Stats(ctx context.Context) (*VMStats, error) {
+	stats := &VMStats{
+		ID:           r.vm.ID(),
+		StartedAt:    r.start,
+		BootDuration: r.bootDuration,
+		Uptime:       time.Since(r.start),
+		Boot:         r.BootTiming(),
+	}
+
+	if opts := r.vm.Opts(); opts != nil {
+		stats.VCPUs = opts.Vcpus
+		stats.MemoryConfiguredBytes = uint64(opts.Memory)
+	}
+
+	target, err := r.vm.GetMemoryBalloonTargetSize(ctx)
+	if err != nil {
+		slog.DebugContext(ctx, "no memory balloon target size", "id", r.vm.ID(), "error", err)
+	} else {
+		stats.MemoryBalloonTargetBytes = uint64(target)
+	}
+
+	if nsp, ok := r.netdev.(NetworkStatsProvider); ok {
+		stats.NetRxBytes, stats.NetTxBytes = nsp.NetworkStats()
+	}
+
+	return stats, nil
+}
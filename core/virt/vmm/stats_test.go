@@ -0,0 +1,62 @@
+package vmm_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/containerd/typeurl/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	cgroupstats "github.com/containerd/cgroups/v3/cgroup2/stats"
+	taskAPI "github.com/containerd/containerd/api/runtime/task/v3"
+
+	"github.com/walteh/runm/core/virt/vmm"
+)
+
+func TestSplitTaskMetrics(t *testing.T) {
+	vmStats := &vmm.VMStats{
+		ID:                    "vm-1",
+		VCPUs:                 2,
+		MemoryConfiguredBytes: 512 << 20,
+		NetRxBytes:            10,
+		NetTxBytes:            20,
+		StartedAt:             time.Unix(1700000000, 0).UTC(),
+		BootDuration:          time.Second,
+	}
+	metrics := &cgroupstats.Metrics{Pids: &cgroupstats.PidsStat{Current: 3}}
+
+	cgroup, err := typeurl.MarshalAny(metrics)
+	require.NoError(t, err)
+	wrapped, err := typeurl.MarshalAny(&vmm.TaskMetrics{
+		Cgroup: typeurl.MarshalProto(cgroup),
+		VM:     vmStats,
+	})
+	require.NoError(t, err)
+
+	// the metrics go over the wire in a task stats response
+	raw, err := proto.Marshal(&taskAPI.StatsResponse{Stats: typeurl.MarshalProto(wrapped)})
+	require.NoError(t, err)
+	var res taskAPI.StatsResponse
+	require.NoError(t, proto.Unmarshal(raw, &res))
+
+	gotCgroup, gotVM, err := vmm.SplitTaskMetrics(res.GetStats())
+	require.NoError(t, err)
+	assert.Equal(t, vmStats, gotVM)
+
+	v, err := typeurl.UnmarshalAny(gotCgroup)
+	require.NoError(t, err)
+	require.IsType(t, &cgroupstats.Metrics{}, v)
+	assert.Equal(t, uint64(3), v.(*cgroupstats.Metrics).GetPids().GetCurrent())
+}
+
+func TestSplitTaskMetricsWithoutVM(t *testing.T) {
+	cgroup, err := typeurl.MarshalAny(&cgroupstats.Metrics{})
+	require.NoError(t, err)
+
+	gotCgroup, gotVM, err := vmm.SplitTaskMetrics(cgroup)
+	require.NoError(t, err)
+	assert.Nil(t, gotVM)
+	assert.Equal(t, cgroup, gotCgroup)
+}
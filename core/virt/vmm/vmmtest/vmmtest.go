@@ -0,0 +1,237 @@
+// Package vmmtest holds what the tests of the hypervisor backends share. The test
+// binary runs as a fake of the hypervisor, and the same cases run against each
+// backend, which only adds the cases of its own.
+package vmmtest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/common/pkg/strongunits"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/core/virt/virtio"
+	"github.com/walteh/runm/core/virt/virtiofsd/virtiofsdtest"
+	"github.com/walteh/runm/core/virt/vmm"
+	"github.com/walteh/runm/pkg/cmdline"
+	"github.com/walteh/runm/pkg/units"
+)
+
+// fakeEnv makes the test binary run as the fake hypervisor or virtiofsd.
+const fakeEnv = "RUNM_VMM_TEST_FAKE"
+
+// Main runs the tests, or when the test binary was started as the Binary of a
+// backend, runs fake with the arguments, or the fake virtiofsd when they are its own.
+func Main(m *testing.M, fake func(args []string) error) {
+	if os.Getenv(fakeEnv) == "" {
+		os.Exit(m.Run())
+	}
+
+	run := fake
+	if virtiofsdtest.Invoked(os.Args[1:]) {
+		run = virtiofsdtest.Run
+	}
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "fake:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Binary is the binary a backend starts as its hypervisor and virtiofsd, the test
+// binary running as their fakes.
+func Binary(t *testing.T) string {
+	t.Setenv(fakeEnv, "1")
+	return os.Args[0]
+}
+
+// Root is a directory for the sockets of a hypervisor, removed when the test ends.
+func Root(t *testing.T, prefix string) string {
+	// unix socket paths are too long for t.TempDir on some systems
+	root, err := os.MkdirTemp("", prefix)
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(root) })
+	return root
+}
+
+// Bootloader boots a linux guest from images the fakes never read.
+func Bootloader(t *testing.T) virtio.Bootloader {
+	bl, err := vmm.NewLinuxBootloader(units.PlatformLinuxAMD64, "/images/kernel", "/images/initramfs.cpio.gz", cmdline.DefaultRunmParams())
+	require.NoError(t, err)
+	return bl
+}
+
+// ServeHybridVsock serves a hybrid vsock socket at path for a fake hypervisor, every
+// guest port echoes.
+func ServeHybridVsock(path string) error {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(io.LimitReader(conn, 64)).ReadString('\n')
+				if err != nil || !strings.HasPrefix(line, "CONNECT ") {
+					return
+				}
+				fmt.Fprintf(conn, "OK 1073741824\n")
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// Echo checks that a port of the guest served by ServeHybridVsock echoes.
+func Echo(t *testing.T, vm vmm.VirtualMachine) {
+	t.Helper()
+	conn, err := vm.VSockConnect(t.Context(), vmm.ExecVSockPort)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+// RunVirtualMachine creates a vm with opts, which need a memory balloon, and takes
+// it through its states until the guest stops it. running checks the backend
+// specifics of the vm once it started.
+func RunVirtualMachine[VM vmm.VirtualMachine](t *testing.T, hpv vmm.Hypervisor[VM], opts *vmm.NewVMOptions, running func(t *testing.T, vm VM)) {
+	ctx := t.Context()
+
+	vm, err := hpv.NewVirtualMachine(ctx, "vm-test", opts, Bootloader(t))
+	require.NoError(t, err)
+	defer vm.HardStop(context.Background())
+	assert.Equal(t, vm, <-hpv.OnCreate())
+
+	require.NoError(t, vm.Start(ctx))
+	assert.Equal(t, vmm.VirtualMachineStateTypeRunning, vm.CurrentState())
+	assert.False(t, vm.CanStart(ctx))
+
+	if running != nil {
+		running(t, vm)
+	}
+
+	require.NoError(t, vm.Pause(ctx))
+	assert.Equal(t, vmm.VirtualMachineStateTypePaused, vm.CurrentState())
+	require.NoError(t, vm.Resume(ctx))
+	assert.Equal(t, vmm.VirtualMachineStateTypeRunning, vm.CurrentState())
+
+	require.NoError(t, vm.SetMemoryBalloonTargetSize(ctx, opts.Memory/2))
+	target, err := vm.GetMemoryBalloonTargetSize(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, opts.Memory/2, target)
+	require.Error(t, vm.SetMemoryBalloonTargetSize(ctx, opts.Memory*2))
+
+	// the guest shutting down ends the vm
+	ok, err := vm.RequestStop(ctx)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, vmm.WaitForVMState(ctx, vm, vmm.VirtualMachineStateTypeStopped, time.After(5*time.Second)))
+
+	require.NoError(t, vm.HardStop(ctx))
+	assert.Equal(t, vmm.VirtualMachineStateTypeStopped, vm.CurrentState())
+	assert.False(t, vm.CanStart(ctx))
+}
+
+// RunSnapshotRestore saves a paused vm and restores it into a new one, both created
+// with opts. A hybrid vsock device comes back on the socket of the new vm.
+func RunSnapshotRestore[VM vmm.VirtualMachine](t *testing.T, hpv vmm.Hypervisor[VM], opts func() *vmm.NewVMOptions) {
+	ctx := t.Context()
+
+	vm, err := hpv.NewVirtualMachine(ctx, "vm-saved", opts(), Bootloader(t))
+	require.NoError(t, err)
+	defer vm.HardStop(context.Background())
+
+	require.NoError(t, vm.Start(ctx))
+	require.NoError(t, vmm.CheckFullSnapshotSupport(ctx, vm))
+	require.NoError(t, vm.Pause(ctx))
+
+	snapshot := filepath.Join(t.TempDir(), "snapshot", "vm.state")
+	require.NoError(t, vm.SaveFullSnapshot(ctx, snapshot))
+	var savedSocket string
+	if hv, ok := any(vm).(vmm.HybridVsockVM); ok {
+		savedSocket = hv.HybridVsockSocketPath()
+	}
+	require.NoError(t, vm.HardStop(ctx))
+
+	restored, err := hpv.NewVirtualMachine(ctx, "vm-restored", opts(), Bootloader(t))
+	require.NoError(t, err)
+	defer restored.HardStop(context.Background())
+
+	require.NoError(t, restored.RestoreFromFullSnapshot(ctx, snapshot))
+	assert.Equal(t, vmm.VirtualMachineStateTypePaused, restored.CurrentState())
+	assert.False(t, restored.CanStart(ctx))
+	require.NoError(t, restored.Resume(ctx))
+	assert.Equal(t, vmm.VirtualMachineStateTypeRunning, restored.CurrentState())
+
+	if hv, ok := any(restored).(vmm.HybridVsockVM); ok && savedSocket != "" {
+		assert.NotEqual(t, savedSocket, hv.HybridVsockSocketPath())
+		Echo(t, restored)
+	}
+
+	// a snapshot is only restored into a fresh vm
+	require.Error(t, restored.RestoreFromFullSnapshot(ctx, snapshot))
+}
+
+// BadConfig is a vm a backend refuses to create.
+type BadConfig struct {
+	Name     string
+	Platform units.Platform
+	Devices  []virtio.VirtioDevice
+	// Bootloader is a linux Bootloader when nil
+	Bootloader virtio.Bootloader
+	// Is is the error the backend refuses with, any error when nil
+	Is error
+}
+
+// RunUnsupportedConfig checks that hpv refuses the vms no backend supports and the
+// configs of its own. unsupported is the error it refuses unknown devices with, nil
+// when it has none.
+func RunUnsupportedConfig[VM vmm.VirtualMachine](t *testing.T, hpv vmm.Hypervisor[VM], unsupported error, configs ...BadConfig) {
+	configs = append([]BadConfig{
+		{Name: "gpu", Devices: []virtio.VirtioDevice{&virtio.VirtioGPU{}}, Is: unsupported},
+		{Name: "efi", Bootloader: &virtio.EFIBootloader{}},
+	}, configs...)
+
+	for _, c := range configs {
+		t.Run(c.Name, func(t *testing.T) {
+			platform := c.Platform
+			if platform == "" {
+				platform = units.PlatformLinuxAMD64
+			}
+			bl := c.Bootloader
+			if bl == nil {
+				bl = Bootloader(t)
+			}
+			_, err := hpv.NewVirtualMachine(t.Context(), "vm-bad", &vmm.NewVMOptions{
+				Vcpus:         1,
+				Memory:        strongunits.MiB(256).ToBytes(),
+				GuestPlatform: platform,
+				Devices:       c.Devices,
+			}, bl)
+			require.Error(t, err)
+			if c.Is != nil {
+				require.ErrorIs(t, err, c.Is)
+			}
+		})
+	}
+}
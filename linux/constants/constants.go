@@ -22,4 +22,9 @@ const (
 	VsockStdinPort        = 2020
 	VsockStdoutPort       = 2021
 	VsockStderrPort       = 2022
+	RunmMetricsVsockPort  = 2023
 )
+
+// DefaultGuestPath is the PATH commands run with in the guest when the caller does
+// not set one.
+const DefaultGuestPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
@@ -0,0 +1,39 @@
+// Package atomicfile writes the state files runm reads back after a crash or a
+// restart of the shim.
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// WriteFile replaces path with data through a temporary file next to it, so a
+// reader sees the previous content or data and never a part of it, even when the
+// host goes down halfway. The file is only readable by its owner.
+func WriteFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return errors.Errorf("creating temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Errorf("writing temporary file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Errorf("syncing temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Errorf("closing temporary file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Errorf("renaming temporary file: %w", err)
+	}
+
+	return nil
+}
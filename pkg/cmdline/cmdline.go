@@ -0,0 +1,169 @@
+// Package cmdline builds and parses linux kernel command lines.
+//
+// A command line is a list of kernel parameters, optionally followed by "--" and
+// the parameters the kernel hands to init:
+//
+//	console=hvc0 reboot=k -- runm-mode=oci runm-vsock-port=2019
+package cmdline
+
+import (
+	"os"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// Separator splits the kernel parameters from the init parameters.
+const Separator = "--"
+
+// Param is a single "key" or "key=value" parameter.
+type Param struct {
+	Key   string
+	Value string
+	// HasValue tells "key=" apart from "key".
+	HasValue bool
+}
+
+// Flag returns a parameter without a value.
+func Flag(key string) Param {
+	return Param{Key: key}
+}
+
+// KV returns a "key=value" parameter.
+func KV(key, value string) Param {
+	return Param{Key: key, Value: value, HasValue: true}
+}
+
+func (p Param) String() string {
+	if !p.HasValue {
+		return p.Key
+	}
+	if strings.ContainsAny(p.Value, " \t\n") {
+		return p.Key + `="` + p.Value + `"`
+	}
+	return p.Key + "=" + p.Value
+}
+
+// Cmdline is a parsed kernel command line.
+type Cmdline struct {
+	Kernel []Param
+	Init   []Param
+}
+
+func (c *Cmdline) String() string {
+	parts := make([]string, 0, len(c.Kernel)+len(c.Init)+1)
+	for _, p := range c.Kernel {
+		parts = append(parts, p.String())
+	}
+	if len(c.Init) > 0 {
+		parts = append(parts, Separator)
+		for _, p := range c.Init {
+			parts = append(parts, p.String())
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Get returns the value of the last init parameter named key, the kernel
+// parameters are only searched when no init parameter matches.
+func (c *Cmdline) Get(key string) (Param, bool) {
+	if p, ok := lookup(c.Init, key); ok {
+		return p, true
+	}
+	return lookup(c.Kernel, key)
+}
+
+func lookup(params []Param, key string) (Param, bool) {
+	for i := len(params) - 1; i >= 0; i-- {
+		if params[i].Key == key {
+			return params[i], true
+		}
+	}
+	return Param{}, false
+}
+
+// Parse parses a command line as the kernel does: parameters are separated by
+// whitespace, values may be double quoted to contain whitespace, and everything
+// after the first "--" is for init.
+func Parse(s string) (*Cmdline, error) {
+	c := &Cmdline{}
+	afterSeparator := false
+
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeft(s, " \t\n") {
+		word, rest, err := nextWord(s)
+		if err != nil {
+			return nil, err
+		}
+		s = rest
+
+		if word == Separator && !afterSeparator {
+			afterSeparator = true
+			continue
+		}
+
+		p := parseParam(word)
+		if afterSeparator {
+			c.Init = append(c.Init, p)
+		} else {
+			c.Kernel = append(c.Kernel, p)
+		}
+	}
+
+	return c, nil
+}
+
+// MustParse is Parse for command lines known to be valid.
+func MustParse(s string) *Cmdline {
+	c, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// FromInitArgs returns the command line init sees in its arguments, the kernel
+// passes init everything after "--" with the quotes already removed.
+func FromInitArgs(args []string) *Cmdline {
+	c := &Cmdline{}
+	for _, arg := range args {
+		key, value, hasValue := strings.Cut(arg, "=")
+		c.Init = append(c.Init, Param{Key: key, Value: value, HasValue: hasValue})
+	}
+	return c
+}
+
+// ReadProc parses the command line the running kernel was booted with.
+func ReadProc() (*Cmdline, error) {
+	data, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return nil, errors.Errorf("reading kernel command line: %w", err)
+	}
+	return Parse(string(data))
+}
+
+// nextWord splits the first parameter off s, leaving quotes in place.
+func nextWord(s string) (string, string, error) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ' ', '\t', '\n':
+			if !quoted {
+				return s[:i], s[i:], nil
+			}
+		}
+	}
+	if quoted {
+		return "", "", errors.Errorf("unterminated quote in %q", s)
+	}
+	return s, "", nil
+}
+
+func parseParam(word string) Param {
+	key, value, hasValue := strings.Cut(word, "=")
+	if !hasValue {
+		return Param{Key: strings.ReplaceAll(key, `"`, "")}
+	}
+	return Param{Key: key, Value: strings.ReplaceAll(value, `"`, ""), HasValue: true}
+}
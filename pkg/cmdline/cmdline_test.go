@@ -0,0 +1,145 @@
+package cmdline_test
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/pkg/cmdline"
+)
+
+func TestParseRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want *cmdline.Cmdline
+	}{
+		{
+			name: "kernel only",
+			in:   "console=hvc0 quiet",
+			want: &cmdline.Cmdline{Kernel: []cmdline.Param{cmdline.KV("console", "hvc0"), cmdline.Flag("quiet")}},
+		},
+		{
+			name: "kernel and init",
+			in:   "console=hvc0 -- runm-mode=oci runm-debug",
+			want: &cmdline.Cmdline{
+				Kernel: []cmdline.Param{cmdline.KV("console", "hvc0")},
+				Init:   []cmdline.Param{cmdline.KV("runm-mode", "oci"), cmdline.Flag("runm-debug")},
+			},
+		},
+		{
+			name: "empty value",
+			in:   "root= ro",
+			want: &cmdline.Cmdline{Kernel: []cmdline.Param{cmdline.KV("root", ""), cmdline.Flag("ro")}},
+		},
+		{
+			name: "quoted value",
+			in:   `dyndbg="file a.c +p" -- name="two words"`,
+			want: &cmdline.Cmdline{
+				Kernel: []cmdline.Param{cmdline.KV("dyndbg", "file a.c +p")},
+				Init:   []cmdline.Param{cmdline.KV("name", "two words")},
+			},
+		},
+		{
+			name: "second separator belongs to init",
+			in:   "a -- b -- c",
+			want: &cmdline.Cmdline{
+				Kernel: []cmdline.Param{cmdline.Flag("a")},
+				Init:   []cmdline.Param{cmdline.Flag("b"), cmdline.Flag("--"), cmdline.Flag("c")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cmdline.Parse(tt.in)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+
+			again, err := cmdline.Parse(got.String())
+			require.NoError(t, err)
+			assert.Equal(t, got, again)
+		})
+	}
+}
+
+func TestParseWhitespace(t *testing.T) {
+	got, err := cmdline.Parse("  console=hvc0\t reboot=k \n")
+	require.NoError(t, err)
+	assert.Equal(t, "console=hvc0 reboot=k", got.String())
+
+	_, err = cmdline.Parse(`name="unterminated`)
+	require.Error(t, err)
+}
+
+func TestRunmParamsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		params cmdline.RunmParams
+		want   string
+	}{
+		{
+			name:   "defaults stay off the command line",
+			params: cmdline.DefaultRunmParams(),
+			want:   "console=hvc0 -- runm-mode=oci",
+		},
+		{
+			name:   "everything",
+			params: cmdline.RunmParams{Mode: cmdline.ModeEmpty, LogLevel: slog.LevelWarn, VsockPort: 3000, Debug: true, OTLPEndpoint: "http://192.168.127.254:4317", OTLPProtocol: "grpc"},
+			want:   "console=hvc0 -- runm-mode=empty runm-log-level=warn runm-vsock-port=3000 runm-debug runm-otlp-endpoint=http://192.168.127.254:4317 runm-otlp-protocol=grpc",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := &cmdline.Cmdline{Kernel: []cmdline.Param{cmdline.KV("console", "hvc0")}, Init: tt.params.Params()}
+			assert.Equal(t, tt.want, cl.String())
+
+			parsed, err := cmdline.Parse(cl.String())
+			require.NoError(t, err)
+			got, err := parsed.RunmParams()
+			require.NoError(t, err)
+			assert.Equal(t, tt.params, got)
+
+			// runm-linux-mounter reads the same parameters from its arguments
+			var args []string
+			for _, p := range tt.params.Params() {
+				args = append(args, p.String())
+			}
+			fromArgs, err := cmdline.FromInitArgs(args).RunmParams()
+			require.NoError(t, err)
+			assert.Equal(t, tt.params, fromArgs)
+		})
+	}
+}
+
+func TestRunmParamsErrors(t *testing.T) {
+	for _, in := range []string{
+		"-- runm-mode=vm",
+		"-- runm-log-level=loud",
+		"-- runm-vsock-port=0",
+		"-- runm-vsock-port=-1",
+		"-- runm-debug=maybe",
+	} {
+		t.Run(in, func(t *testing.T) {
+			cl, err := cmdline.Parse(in)
+			require.NoError(t, err)
+			_, err = cl.RunmParams()
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestGetPrefersInitParams(t *testing.T) {
+	cl, err := cmdline.Parse("runm-mode=empty -- runm-mode=oci")
+	require.NoError(t, err)
+
+	p, ok := cl.Get(cmdline.ParamMode)
+	require.True(t, ok)
+	assert.Equal(t, "oci", p.Value)
+
+	_, ok = cl.Get("missing")
+	assert.False(t, ok)
+}
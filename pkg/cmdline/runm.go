@@ -0,0 +1,132 @@
+package cmdline
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+
+	"github.com/walteh/runm/linux/constants"
+)
+
+// The init parameters the host passes runm-linux-init.
+const (
+	ParamMode      = "runm-mode"
+	ParamLogLevel  = "runm-log-level"
+	ParamVsockPort = "runm-vsock-port"
+	ParamDebug     = "runm-debug"
+
+	ParamOTLPEndpoint = "runm-otlp-endpoint"
+	ParamOTLPProtocol = "runm-otlp-protocol"
+)
+
+type Mode string
+
+const (
+	// ModeOCI runs a single oci container.
+	ModeOCI Mode = "oci"
+	// ModeEmpty boots a vm without a container, for running commands in.
+	ModeEmpty Mode = "empty"
+)
+
+// RunmParams are the runm init parameters, zero fields are left off the command
+// line and take the defaults in the guest.
+type RunmParams struct {
+	Mode     Mode
+	LogLevel slog.Level
+	// VsockPort is where the guest agent listens, constants.RunmVsockPort by default.
+	VsockPort uint32
+	// Debug keeps extra diagnostics running in the guest.
+	Debug bool
+	// OTLPEndpoint is the collector the guest agent exports its spans to, it
+	// exports nothing when this is empty. OTLPProtocol is as in tracing.Config.
+	OTLPEndpoint string
+	OTLPProtocol string
+}
+
+// DefaultRunmParams are used for anything the command line does not set.
+func DefaultRunmParams() RunmParams {
+	return RunmParams{
+		Mode:      ModeOCI,
+		// what runm-linux-init logged at before the level could be set
+		LogLevel:  slog.LevelDebug,
+		VsockPort: constants.RunmVsockPort,
+	}
+}
+
+// Params returns the init parameters for p.
+func (p RunmParams) Params() []Param {
+	defaults := DefaultRunmParams()
+
+	var params []Param
+	if p.Mode != "" {
+		params = append(params, KV(ParamMode, string(p.Mode)))
+	}
+	if p.LogLevel != defaults.LogLevel {
+		params = append(params, KV(ParamLogLevel, strings.ToLower(p.LogLevel.String())))
+	}
+	if p.VsockPort != 0 && p.VsockPort != defaults.VsockPort {
+		params = append(params, KV(ParamVsockPort, strconv.FormatUint(uint64(p.VsockPort), 10)))
+	}
+	if p.Debug {
+		params = append(params, Flag(ParamDebug))
+	}
+	if p.OTLPEndpoint != "" {
+		params = append(params, KV(ParamOTLPEndpoint, p.OTLPEndpoint))
+	}
+	if p.OTLPProtocol != "" {
+		params = append(params, KV(ParamOTLPProtocol, p.OTLPProtocol))
+	}
+	return params
+}
+
+// RunmParams reads the runm init parameters from c.
+func (c *Cmdline) RunmParams() (RunmParams, error) {
+	p := DefaultRunmParams()
+
+	if v, ok := c.Get(ParamMode); ok {
+		switch m := Mode(v.Value); m {
+		case ModeOCI, ModeEmpty:
+			p.Mode = m
+		default:
+			return RunmParams{}, errors.Errorf("invalid %s %q", ParamMode, v.Value)
+		}
+	}
+
+	if v, ok := c.Get(ParamLogLevel); ok {
+		if err := p.LogLevel.UnmarshalText([]byte(v.Value)); err != nil {
+			return RunmParams{}, errors.Errorf("invalid %s %q: %w", ParamLogLevel, v.Value, err)
+		}
+	}
+
+	if v, ok := c.Get(ParamVsockPort); ok {
+		port, err := strconv.ParseUint(v.Value, 10, 32)
+		if err != nil || port == 0 {
+			return RunmParams{}, errors.Errorf("invalid %s %q", ParamVsockPort, v.Value)
+		}
+		p.VsockPort = uint32(port)
+	}
+
+	if v, ok := c.Get(ParamDebug); ok {
+		// "runm-debug" alone turns it on
+		debug, err := strconv.ParseBool(v.Value)
+		if !v.HasValue {
+			debug, err = true, nil
+		}
+		if err != nil {
+			return RunmParams{}, errors.Errorf("invalid %s %q", ParamDebug, v.Value)
+		}
+		p.Debug = debug
+	}
+
+	if v, ok := c.Get(ParamOTLPEndpoint); ok {
+		p.OTLPEndpoint = v.Value
+	}
+
+	if v, ok := c.Get(ParamOTLPProtocol); ok {
+		p.OTLPProtocol = v.Value
+	}
+
+	return p, nil
+}
@@ -31,8 +31,11 @@ type LoggerOpts struct {
 	delayedHandlerCreatorOpts []OptLoggerOptsSetter `opts:"-"`
 }
 
+// NewDefaultDevLogger logs at debug to a terminal handler on writer and makes itself
+// the default logger. opts are applied after the defaults, so they override them,
+// e.g. runm-linux-init sets the level it is booted with.
 func NewDefaultDevLogger(name string, writer io.Writer, opts ...OptLoggerOptsSetter) *slog.Logger {
-	opts = append(opts,
+	opts = append([]OptLoggerOptsSetter{
 		WithDevTermHanlder(writer),
 		WithProcessName(name),
 		WithGlobalRedactor(),
@@ -45,12 +48,13 @@ func NewDefaultDevLogger(name string, writer io.Writer, opts ...OptLoggerOptsSet
 			Level:     slog.LevelDebug,
 			AddSource: true,
 		}),
-	)
+	}, opts...)
 	return NewLogger(opts...)
 }
 
+// NewDefaultJSONLogger is NewDefaultDevLogger with a json handler.
 func NewDefaultJSONLogger(name string, writer io.Writer, opts ...OptLoggerOptsSetter) *slog.Logger {
-	opts = append(opts,
+	opts = append([]OptLoggerOptsSetter{
 		WithProcessName(name),
 		WithGlobalRedactor(),
 		WithErrorStackTracer(),
@@ -63,7 +67,7 @@ func NewDefaultJSONLogger(name string, writer io.Writer, opts ...OptLoggerOptsSe
 			Level:     slog.LevelDebug,
 			AddSource: true,
 		}),
-	)
+	}, opts...)
 	return NewLogger(opts...)
 }
 
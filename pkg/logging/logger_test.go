@@ -0,0 +1,47 @@
+package logging_test
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/walteh/runm/pkg/logging"
+)
+
+// quiet keeps the logger under test from replacing the process wide loggers.
+var quiet = []logging.OptLoggerOptsSetter{
+	logging.WithMakeDefaultLogger(false),
+	logging.WithInterceptLogrus(false),
+	logging.WithInterceptHclog(false),
+	logging.WithGlobalLogWriter(nil),
+}
+
+func TestDefaultJSONLoggerLogsDebug(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logging.NewDefaultJSONLogger("test", &buf, quiet...)
+
+	logger.Debug("debug message")
+	assert.Contains(t, buf.String(), "debug message")
+}
+
+func TestDefaultLoggerOptsOverrideDefaults(t *testing.T) {
+	level := logging.WithHandlerOptions(&slog.HandlerOptions{Level: slog.LevelWarn})
+
+	var buf bytes.Buffer
+	logger := logging.NewDefaultJSONLogger("test", &buf, append(quiet, level)...)
+
+	logger.Info("info message")
+	logger.Warn("warn message")
+	assert.NotContains(t, buf.String(), "info message")
+	assert.Contains(t, buf.String(), "warn message")
+
+	buf.Reset()
+	logger = logging.NewDefaultDevLogger("test", &buf, append(quiet, level)...)
+
+	logger.Info("info message")
+	logger.Warn("warn message")
+	assert.NotContains(t, buf.String(), "info message")
+	assert.Contains(t, buf.String(), "warn message")
+}
@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// GRPCClientOption records the duration of the unary calls of a grpc client to
+// the guest agent.
+func GRPCClientOption() grpc.DialOption {
+	return grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		ObserveRPC(SideGuestClient, method, start, err)
+		return err
+	})
+}
+
+// GRPCServerOption records the duration of the unary calls the guest agent serves.
+func GRPCServerOption() grpc.ServerOption {
+	return grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		ObserveRPC(SideGuestServer, info.FullMethod, start, err)
+		return resp, err
+	})
+}
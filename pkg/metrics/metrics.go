@@ -0,0 +1,217 @@
+// Package metrics holds the prometheus metrics of the shim and the guest agent.
+//
+// The shim serves its metrics, and those it scrapes from the guest agent over vsock,
+// on the listener set by metrics_address in the runm runtime options. Guest metric
+// names get a runm_guest_ prefix and the vmid and container_id labels of their vm.
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gitlab.com/tozd/go/errors"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const namespace = "runm"
+
+// Registry holds the metrics of the current process, see RegisterHostMetrics and
+// RegisterGuestMetrics.
+var Registry = prometheus.NewRegistry()
+
+var (
+	RPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Duration of the ttrpc and grpc calls runm serves and makes.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+	}, []string{"side", "method", "status"})
+
+	VMBootDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "vm_boot_duration_seconds",
+		Help:      "Time from creating a vm until its guest agent answers.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+
+	ActiveVMs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_vms",
+		Help:      "Number of vms that are booted and not stopped.",
+	})
+
+	OOMKills = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "oom_kills_total",
+		Help:      "Number of oom kills seen in container cgroups.",
+	}, []string{"container_id"})
+
+	GuestCrashes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "guest_crashes_total",
+		Help:      "Number of guest crashes seen, by kind of crash.",
+	}, []string{"kind"})
+)
+
+// The side label of RPCDuration.
+const (
+	SideTask        = "task"
+	SideGuestClient = "guest-client"
+	SideGuestServer = "guest-server"
+)
+
+var registerHost = sync.OnceFunc(func() {
+	Registry.MustRegister(RPCDuration, VMBootDuration, ActiveVMs, OOMKills, GuestCrashes)
+})
+
+var registerGuest = sync.OnceFunc(func() {
+	Registry.MustRegister(
+		RPCDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+})
+
+// RegisterHostMetrics adds the shim metrics to Registry.
+func RegisterHostMetrics() {
+	registerHost()
+}
+
+// RegisterGuestMetrics adds the guest agent metrics to Registry.
+func RegisterGuestMetrics() {
+	registerGuest()
+}
+
+// ObserveRPC records a call to method that started at start.
+func ObserveRPC(side, method string, start time.Time, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	RPCDuration.WithLabelValues(side, method, status).Observe(time.Since(start).Seconds())
+}
+
+var (
+	gatherersMu sync.Mutex
+	gatherers   = map[*prometheus.Gatherer]struct{}{}
+)
+
+// AddGatherer serves the metrics of g next to Registry until the returned func is
+// called.
+func AddGatherer(g prometheus.Gatherer) func() {
+	key := &g
+
+	gatherersMu.Lock()
+	gatherers[key] = struct{}{}
+	gatherersMu.Unlock()
+
+	return func() {
+		gatherersMu.Lock()
+		delete(gatherers, key)
+		gatherersMu.Unlock()
+	}
+}
+
+// Gatherer returns Registry together with every added gatherer.
+func Gatherer() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		gatherersMu.Lock()
+		gs := prometheus.Gatherers{Registry}
+		for g := range gatherers {
+			gs = append(gs, *g)
+		}
+		gatherersMu.Unlock()
+
+		return gs.Gather()
+	})
+}
+
+// Handler serves Gatherer in the prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Gatherer(), promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError})
+}
+
+// Listen listens on address, either "unix://<path>" or a tcp "host:port".
+func Listen(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix://"); ok {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, errors.Errorf("creating metrics socket directory: %w", err)
+		}
+		// a previous shim may have left its socket behind
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Errorf("removing stale metrics socket: %w", err)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, errors.Errorf("listening on metrics socket: %w", err)
+		}
+		return l, nil
+	}
+
+	l, err := net.Listen("tcp", strings.TrimPrefix(address, "tcp://"))
+	if err != nil {
+		return nil, errors.Errorf("listening on metrics address: %w", err)
+	}
+	return l, nil
+}
+
+// Serve serves Handler on l until ctx is done.
+func Serve(ctx context.Context, l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return errors.Errorf("serving metrics: %w", err)
+	}
+	return nil
+}
+
+// OpenResources is implemented by the shim and guest state that keeps io, sockets
+// and consoles open for containers, keyed by kind.
+type OpenResources interface {
+	OpenResources() map[string]int
+}
+
+type openResourcesCollector struct {
+	desc *prometheus.Desc
+	src  OpenResources
+}
+
+// NewOpenResourcesCollector reports what src holds open as runm_open_resources.
+func NewOpenResourcesCollector(src OpenResources, constLabels prometheus.Labels) prometheus.Collector {
+	return &openResourcesCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "open_resources"),
+			"Number of io, sockets and consoles held open for containers.",
+			[]string{"kind"}, constLabels,
+		),
+		src: src,
+	}
+}
+
+func (c *openResourcesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *openResourcesCollector) Collect(ch chan<- prometheus.Metric) {
+	for kind, n := range c.src.OpenResources() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), kind)
+	}
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"gitlab.com/tozd/go/errors"
+	"google.golang.org/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// GuestPrefix replaces the runm_ prefix of the metric names scraped from a guest.
+const GuestPrefix = namespace + "_guest_"
+
+const remoteScrapeTimeout = 5 * time.Second
+
+type remoteGatherer struct {
+	client *http.Client
+	labels map[string]string
+}
+
+// NewRemoteGatherer scrapes the /metrics endpoint served on the connections dial
+// opens, renames the metrics with GuestPrefix and adds labels to every one of them.
+func NewRemoteGatherer(dial func(ctx context.Context) (net.Conn, error), labels map[string]string) prometheus.Gatherer {
+	return &remoteGatherer{
+		client: &http.Client{
+			Timeout: remoteScrapeTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dial(ctx)
+				},
+				// a vsock connection is cheap and the guest may go away between scrapes
+				DisableKeepAlives: true,
+			},
+		},
+		labels: labels,
+	}
+}
+
+func (g *remoteGatherer) Gather() ([]*dto.MetricFamily, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteScrapeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://guest/metrics", nil)
+	if err != nil {
+		return nil, errors.Errorf("creating guest metrics request: %w", err)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("scraping guest metrics: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("scraping guest metrics: unexpected status %s", resp.Status)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("parsing guest metrics: %w", err)
+	}
+
+	out := make([]*dto.MetricFamily, 0, len(families))
+	for name, mf := range families {
+		mf.Name = proto.String(GuestPrefix + strings.TrimPrefix(name, namespace+"_"))
+		for _, m := range mf.Metric {
+			m.Label = withLabels(m.Label, g.labels)
+		}
+		out = append(out, mf)
+	}
+
+	return out, nil
+}
+
+// withLabels sets labels on pairs, replacing pairs of the same name, and keeps them
+// sorted by name.
+func withLabels(pairs []*dto.LabelPair, labels map[string]string) []*dto.LabelPair {
+	pairs = slices.DeleteFunc(pairs, func(p *dto.LabelPair) bool {
+		_, ok := labels[p.GetName()]
+		return ok
+	})
+	for name, value := range labels {
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	slices.SortFunc(pairs, func(a, b *dto.LabelPair) int { return strings.Compare(a.GetName(), b.GetName()) })
+	return pairs
+}
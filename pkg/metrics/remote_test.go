@@ -0,0 +1,68 @@
+package metrics_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/walteh/runm/pkg/metrics"
+)
+
+type fakeResources map[string]int
+
+func (f fakeResources) OpenResources() map[string]int { return f }
+
+func TestRemoteGatherer(t *testing.T) {
+	// what the guest agent serves on its metrics vsock port
+	guest := prometheus.NewRegistry()
+	guest.MustRegister(metrics.NewOpenResourcesCollector(fakeResources{"io": 2, "socket": 1}, nil))
+
+	sock := filepath.Join(t.TempDir(), "guest.sock")
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(guest, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux}
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	g := metrics.NewRemoteGatherer(func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", sock)
+	}, map[string]string{"vmid": "vm-1", "container_id": "abc"})
+
+	families, err := g.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 1)
+
+	mf := families[0]
+	assert.Equal(t, metrics.GuestPrefix+"open_resources", mf.GetName())
+
+	got := map[string]float64{}
+	for _, m := range mf.GetMetric() {
+		labels := map[string]string{}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		assert.Equal(t, "vm-1", labels["vmid"])
+		assert.Equal(t, "abc", labels["container_id"])
+		got[labels["kind"]] = m.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"io": 2, "socket": 1}, got)
+}
+
+func TestRemoteGathererUnreachable(t *testing.T) {
+	g := metrics.NewRemoteGatherer(func(ctx context.Context) (net.Conn, error) {
+		return nil, net.ErrClosed
+	}, nil)
+
+	_, err := g.Gather()
+	require.ErrorContains(t, err, "scraping guest metrics")
+}
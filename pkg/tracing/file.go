@@ -0,0 +1,110 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+var _ sdktrace.SpanExporter = (*FileExporter)(nil)
+
+// FileSpan is a line of the file written by a FileExporter.
+type FileSpan struct {
+	Name         string            `json:"name"`
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Kind         string            `json:"kind"`
+	Service      string            `json:"service,omitempty"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Status       string            `json:"status,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// FileExporter appends spans to a file as json lines.
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Errorf("opening trace file: %w", err)
+	}
+	return &FileExporter{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// ExportSpans implements sdktrace.SpanExporter.
+func (e *FileExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.file == nil {
+		return errors.New("trace file exporter is shut down")
+	}
+
+	for _, span := range spans {
+		if err := e.enc.Encode(fileSpan(span)); err != nil {
+			return errors.Errorf("writing span: %w", err)
+		}
+	}
+	return nil
+}
+
+// Shutdown implements sdktrace.SpanExporter.
+func (e *FileExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.file == nil {
+		return nil
+	}
+	err := e.file.Close()
+	e.file = nil
+	if err != nil {
+		return errors.Errorf("closing trace file: %w", err)
+	}
+	return nil
+}
+
+func fileSpan(span sdktrace.ReadOnlySpan) FileSpan {
+	fs := FileSpan{
+		Name:    span.Name(),
+		TraceID: span.SpanContext().TraceID().String(),
+		SpanID:  span.SpanContext().SpanID().String(),
+		Kind:    span.SpanKind().String(),
+		Start:   span.StartTime(),
+		End:     span.EndTime(),
+		Status:  span.Status().Code.String(),
+		Error:   span.Status().Description,
+	}
+
+	if span.Parent().HasSpanID() {
+		fs.ParentSpanID = span.Parent().SpanID().String()
+	}
+
+	if res := span.Resource(); res != nil {
+		if v, ok := res.Set().Value("service.name"); ok {
+			fs.Service = v.Emit()
+		}
+	}
+
+	if attrs := span.Attributes(); len(attrs) > 0 {
+		fs.Attributes = make(map[string]string, len(attrs))
+		for _, kv := range attrs {
+			fs.Attributes[string(kv.Key)] = kv.Value.Emit()
+		}
+	}
+
+	return fs
+}
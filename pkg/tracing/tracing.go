@@ -0,0 +1,134 @@
+// Package tracing sets up OpenTelemetry tracing for the shim and the guest agent.
+//
+// Trace context travels in grpc metadata over vsock, so with both sides exporting a
+// single trace runs from containerd through the shim and the guest agent to runc.
+package tracing
+
+import (
+	"context"
+
+	"gitlab.com/tozd/go/errors"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// TracerName is the instrumentation scope of the spans runm starts itself.
+const TracerName = "github.com/walteh/runm"
+
+type Protocol string
+
+const (
+	ProtocolGRPC Protocol = "grpc"
+	ProtocolHTTP Protocol = "http/protobuf"
+)
+
+// Config selects where spans are exported. With neither Endpoint nor FilePath set
+// nothing is exported, but trace context is still passed on.
+type Config struct {
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName string
+	// Endpoint is the url of an OTLP collector, e.g. "http://localhost:4317". An
+	// http url is used without TLS.
+	Endpoint string
+	// Protocol is how Endpoint is spoken to, ProtocolGRPC by default.
+	Protocol Protocol
+	// FilePath gets every span as a line of json, for use without a collector.
+	FilePath string
+}
+
+func (c Config) Enabled() bool {
+	return c.Endpoint != "" || c.FilePath != ""
+}
+
+// Setup installs the trace context propagator and, when cfg exports anywhere, a
+// tracer provider. The returned func flushes and stops the exporters.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if !cfg.Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName)))
+	if err != nil {
+		return nil, errors.Errorf("creating trace resource: %w", err)
+	}
+
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+
+	if cfg.Endpoint != "" {
+		exp, err := newOTLPExporter(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+
+	if cfg.FilePath != "" {
+		exp, err := NewFileExporter(cfg.FilePath)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+func newOTLPExporter(ctx context.Context, cfg Config) (sdktrace.SpanExporter, error) {
+	switch cfg.Protocol {
+	case "", ProtocolGRPC:
+		exp, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(cfg.Endpoint))
+		if err != nil {
+			return nil, errors.Errorf("creating otlp grpc exporter: %w", err)
+		}
+		return exp, nil
+	case ProtocolHTTP:
+		exp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		if err != nil {
+			return nil, errors.Errorf("creating otlp http exporter: %w", err)
+		}
+		return exp, nil
+	default:
+		return nil, errors.Errorf("unknown otlp protocol %q", cfg.Protocol)
+	}
+}
+
+// Start starts a span named name with the runm tracer.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// GRPCClientOption traces the calls of a grpc client and passes the trace context
+// on to the server.
+func GRPCClientOption() grpc.DialOption {
+	return grpc.WithStatsHandler(otelgrpc.NewClientHandler())
+}
+
+// GRPCServerOption traces the calls a grpc server handles, continuing the trace
+// of the client.
+func GRPCServerOption() grpc.ServerOption {
+	return grpc.StatsHandler(otelgrpc.NewServerHandler())
+}
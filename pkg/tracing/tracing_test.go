@@ -0,0 +1,68 @@
+package tracing_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/walteh/runm/pkg/tracing"
+)
+
+func TestFileExportAcrossPropagation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+
+	shutdown, err := tracing.Setup(t.Context(), tracing.Config{ServiceName: "runm-test", FilePath: path})
+	require.NoError(t, err)
+
+	ctx, parent := tracing.Start(t.Context(), "shim.Create")
+
+	// what the grpc handlers do on either side of the vsock connection
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	guestCtx := otel.GetTextMapPropagator().Extract(t.Context(), carrier)
+
+	_, child := tracing.Start(guestCtx, "runc.create")
+	tracing.End(child, errors.New("runc failed"))
+	tracing.End(parent, nil)
+
+	require.NoError(t, shutdown(t.Context()))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	spans := map[string]tracing.FileSpan{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var span tracing.FileSpan
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &span))
+		spans[span.Name] = span
+	}
+	require.NoError(t, scanner.Err())
+	require.Len(t, spans, 2)
+
+	p, c := spans["shim.Create"], spans["runc.create"]
+	assert.Equal(t, p.TraceID, c.TraceID)
+	assert.Equal(t, p.SpanID, c.ParentSpanID)
+	assert.Empty(t, p.ParentSpanID)
+	assert.Equal(t, "runm-test", p.Service)
+	assert.Equal(t, "Error", c.Status)
+	assert.Equal(t, "runc failed", c.Error)
+}
+
+func TestSetupWithoutExport(t *testing.T) {
+	shutdown, err := tracing.Setup(t.Context(), tracing.Config{})
+	require.NoError(t, err)
+	require.NoError(t, shutdown(t.Context()))
+
+	_, err = tracing.Setup(t.Context(), tracing.Config{Endpoint: "http://localhost:4317", Protocol: "zipkin"})
+	require.ErrorContains(t, err, "unknown otlp protocol")
+}
@@ -27,9 +27,10 @@ const (
 )
 
 type GetCgroupStatsRequest struct {
-	state         protoimpl.MessageState `protogen:"opaque.v1"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state                 protoimpl.MessageState `protogen:"opaque.v1"`
+	xxx_hidden_CgroupPath string                 `protobuf:"bytes,1,opt,name=cgroup_path,json=cgroupPath"`
+	unknownFields         protoimpl.UnknownFields
+	sizeCache             protoimpl.SizeCache
 }
 
 func (x *GetCgroupStatsRequest) Reset() {
@@ -57,15 +58,28 @@ func (x *GetCgroupStatsRequest) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
+func (x *GetCgroupStatsRequest) GetCgroupPath() string {
+	if x != nil {
+		return x.xxx_hidden_CgroupPath
+	}
+	return ""
+}
+
+func (x *GetCgroupStatsRequest) SetCgroupPath(v string) {
+	x.xxx_hidden_CgroupPath = v
+}
+
 type GetCgroupStatsRequest_builder struct {
 	_ [0]func() // Prevents comparability and use of unkeyed literals for the builder.
 
+	CgroupPath string
 }
 
 func (b0 GetCgroupStatsRequest_builder) Build() *GetCgroupStatsRequest {
 	m0 := &GetCgroupStatsRequest{}
 	b, x := &b0, m0
 	_, _ = b, x
+	x.xxx_hidden_CgroupPath = b.CgroupPath
 	return m0
 }
 
@@ -451,8 +465,10 @@ var File_v1_cgroup_proto protoreflect.FileDescriptor
 
 const file_v1_cgroup_proto_rawDesc = "" +
 	"\n" +
-	"\x0fv1/cgroup.proto\x12\arunm.v1\x1a\x1bbuf/validate/validate.proto\x1a\x19google/protobuf/any.proto\x1a\x1bgoogle/protobuf/empty.proto\x1a!google/protobuf/go_features.proto\x1a\x1cgoogle/protobuf/struct.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\x17\n" +
-	"\x15GetCgroupStatsRequest\"D\n" +
+	"\x0fv1/cgroup.proto\x12\arunm.v1\x1a\x1bbuf/validate/validate.proto\x1a\x19google/protobuf/any.proto\x1a\x1bgoogle/protobuf/empty.proto\x1a!google/protobuf/go_features.proto\x1a\x1cgoogle/protobuf/struct.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"8\n" +
+	"\x15GetCgroupStatsRequest\x12\x1f\n" +
+	"\vcgroup_path\x18\x01 \x01(\tR\n" +
+	"cgroupPath\"D\n" +
 	"\x16GetCgroupStatsResponse\x12*\n" +
 	"\x05stats\x18\x01 \x01(\v2\x14.google.protobuf.AnyR\x05stats\"\x1b\n" +
 	"\x19StreamCgroupEventsRequest\"r\n" +
@@ -12,7 +12,8 @@ func (x *GetCgroupStatsRequest) LogValue() slog.Value {
 	if x == nil {
 		return slog.AnyValue(nil)
 	}
-	attrs := make([]slog.Attr, 0, 0)
+	attrs := make([]slog.Attr, 0, 1)
+	attrs = append(attrs, slog.String("cgroup_path", x.GetCgroupPath()))
 	return slog.GroupValue(attrs...)
 }
 
@@ -26,6 +26,7 @@ import (
 	"github.com/walteh/runm/cmd/containerd-shim-runm-v2/manager"
 	taskplugin "github.com/walteh/runm/cmd/containerd-shim-runm-v2/task/plugin"
 	vfruntimeplugin "github.com/walteh/runm/core/runc/runtime/virt/plugins/vf"
+	"github.com/walteh/runm/core/runc/runtime/virt/vmoptions"
 	"github.com/walteh/runm/pkg/logging"
 	"github.com/walteh/runm/pkg/logging/sloglogrus"
 )
@@ -159,7 +160,7 @@ func RunShim(ctx context.Context) error {
 		return errors.New("failed to get caller")
 	}
 
-	os.Setenv("LINUX_RUNTIME_BUILD_DIR", filepath.Join(filepath.Dir(filename), "..", "..", "..", "gen", "build", "linux_vf_arm64"))
+	os.Setenv(vmoptions.BuildDirEnv, filepath.Join(filepath.Dir(filename), "..", "..", "..", "gen", "build", "linux_vf_"+runtime.GOARCH))
 
 	shim.Run(ctx, manager.NewDebugManager(manager.NewShimManager("io.containerd.runc.v2")), func(c *shim.Config) {
 		c.NoReaper = true